@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"osc2hue/internal/api"
+	"osc2hue/internal/command"
+	"osc2hue/internal/config"
+	"osc2hue/internal/web"
+)
+
+// apiBackend performs API requests on the service's current controller
+type apiBackend struct {
+	svc *service
+}
+
+// startHTTPAPI starts the HTTP control API and web control panel if configured, returns nil otherwise.
+// The service feeds OSC messages to the returned server's message log.
+func startHTTPAPI(cfg *config.Config, svc *service) *api.Server {
+	if cfg.HTTP == nil {
+		return nil
+	}
+
+	_, ctrl := svc.current()
+	server := api.NewServer(fmt.Sprintf("%s:%d", cfg.HTTP.Host, cfg.HTTP.Port), &apiBackend{svc: svc}, ctrl.state)
+	server.Handle("GET /", web.Handler())
+	server.Handle("GET /metrics", metricsHandler(svc))
+	server.Start()
+	httpLog.Info("Web control panel", "url", fmt.Sprintf("http://%s:%d/", cfg.HTTP.Host, cfg.HTTP.Port))
+	return server
+}
+
+// Status reports the bridge connection
+func (b *apiBackend) Status() api.Status {
+	cfg, ctrl := b.svc.current()
+	status := api.Status{
+		Lights:     len(ctrl.lights),
+		Bridges:    make([]api.BridgeStatus, 0, len(ctrl.bridges)),
+		OSCAddress: fmt.Sprintf("%s:%d", cfg.OSC.Host, cfg.OSC.Port),
+	}
+	for i, br := range ctrl.bridges {
+		connected := br.up.Load()
+		if i == 0 {
+			status.BridgeIP = br.ip
+		}
+		status.BridgeConnected = status.BridgeConnected || connected
+		bs := api.BridgeStatus{Name: br.name, IP: br.ip, Connected: connected, Lights: len(br.lights)}
+		if b := cfg.Bridge(br.name); b != nil {
+			bs.ID = b.BridgeID
+		}
+		status.Bridges = append(status.Bridges, bs)
+	}
+	return status
+}
+
+// Lights lists the discovered lights with their cached state
+func (b *apiBackend) Lights() []api.Light {
+	_, ctrl := b.svc.current()
+	lights := make([]api.Light, 0, len(ctrl.lights))
+	for _, light := range ctrl.lights {
+		name := *light.Id
+		if light.Metadata != nil && light.Metadata.Name != nil {
+			name = *light.Metadata.Name
+		}
+		st, _ := ctrl.state.Get(*light.Id)
+		lights = append(lights, api.Light{ID: *light.Id, Number: ctrl.number(*light.Id), Bridge: ctrl.lightBridge[*light.Id].name, Name: name, State: st})
+	}
+	return lights
+}
+
+// SetLight applies a command to a light (UUID, numeric ID or "all")
+func (b *apiBackend) SetLight(id string, cmd command.Light) error {
+	_, ctrl := b.svc.current()
+	return withStatus(applyCommand(ctrl, id, cmd))
+}
+
+// SetGroup applies a command to every light of a room (UUID or numeric ID)
+func (b *apiBackend) SetGroup(id string, cmd command.Light) error {
+	_, ctrl := b.svc.current()
+	group, ok := ctrl.resolveGroup(id)
+	if !ok {
+		return fmt.Errorf("group %s: %w", id, api.ErrNotFound)
+	}
+	put, err := cmd.LightPut()
+	if err != nil {
+		return err
+	}
+	return withStatus(ctrl.updateLights(group.LightIDs, put))
+}
+
+// RecallScene recalls a bridge scene
+func (b *apiBackend) RecallScene(id string, durationMs int) error {
+	_, ctrl := b.svc.current()
+	if !ctrl.hasScene(id) {
+		return fmt.Errorf("scene %s: %w", id, api.ErrNotFound)
+	}
+	return withStatus(ctrl.recallScene(id, durationMs))
+}
+
+// statusError is an error of the controller that also wraps the API error
+// choosing the status of the response
+type statusError struct {
+	err    error
+	status error
+}
+
+func (e statusError) Error() string   { return e.err.Error() }
+func (e statusError) Unwrap() []error { return []error{e.err, e.status} }
+
+// withStatus wraps an error of a light command or scene recall with the API
+// error for it: not found for an unknown light, unavailable if a bridge is
+// not connected, conflict if the blackout or the flash limiter refused it,
+// and a bridge error otherwise. Invalid commands are bad requests.
+func withStatus(err error) error {
+	switch {
+	case err == nil, errors.Is(err, errInvalidCommand):
+		return err
+	case errors.Is(err, errUnknownLight):
+		return statusError{err, api.ErrNotFound}
+	case errors.Is(err, errNotConnected):
+		return statusError{err, api.ErrUnavailable}
+	case errors.Is(err, errBlackout), errors.Is(err, errFlashLimited):
+		return statusError{err, api.ErrConflict}
+	default:
+		return statusError{err, api.ErrBridge}
+	}
+}
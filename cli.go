@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"osc2hue/internal/config"
+	"osc2hue/internal/hue"
+	"osc2hue/internal/logging"
+	"osc2hue/internal/monitor"
+	"osc2hue/internal/osc"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+	"github.com/openhue/openhue-go"
+)
+
+// cliCommand is an osc2hue subcommand
+type cliCommand struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+// cliCommands lists the subcommands in the order they are shown in the usage
+var cliCommands = []cliCommand{
+	{"serve", "serve [-monitor] [-filter pattern]... [-record file]", "run the OSC to Hue bridge (default)", runServe},
+	{"discover", "discover [-timeout 5s]", "list Hue bridges on the network", runDiscover},
+	{"pair", "pair [-ip address] [-timeout 30s] [-save=true]", "press the link button and obtain an API key", runPair},
+	{"lights", "lights", "list lights with their IDs, capabilities and gamut", runLights},
+	{"send", "send [-host address] [-port n] /address [args...]", "send an OSC message", runSend},
+	{"monitor", "monitor [-host address] [-port n] [-filter pattern]... [-record file]", "print incoming OSC packets without controlling lights", runMonitor},
+	{"replay", "replay [-speed 1] [-loop] [-seek 0s] [-to host:port] file", "play back a recording made with -record", runReplay},
+}
+
+// errUsage is returned when the command line is invalid and the usage has been printed
+var errUsage = errors.New("invalid usage")
+
+// runCLI dispatches to the subcommand named by args[0], defaulting to serve
+func runCLI(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			printUsage()
+			return nil
+		}
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runServe(args)
+	}
+
+	name := args[0]
+
+	for _, cmd := range cliCommands {
+		if cmd.name == name {
+			return cmd.run(args[1:])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	printUsage()
+	return errUsage
+}
+
+// printUsage prints the list of subcommands
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: osc2hue <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.usage, cmd.summary)
+	}
+	w.Flush()
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands that read the configuration accept -config file.")
+}
+
+// newFlagSet creates a flag set for a subcommand that returns parse errors instead of exiting
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("osc2hue "+name, flag.ContinueOnError)
+}
+
+// configFlag adds the -config flag to a subcommand, resolve it with config.Path
+func configFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", "", "config file (default: $"+config.PathEnv+", $XDG_CONFIG_HOME/osc2hue/config.json, then ./config.json)")
+}
+
+// logFlags adds the -log-level, -log-format and -log-burst flags to a subcommand, apply them with logging.Setup
+func logFlags(fs *flag.FlagSet) *logging.Options {
+	opts := &logging.Options{}
+	fs.StringVar(&opts.Level, "log-level", "info", "debug, info, warn or error, optionally per subsystem such as info,osc=debug")
+	fs.StringVar(&opts.Format, "log-format", "text", "log output format: text or json")
+	fs.IntVar(&opts.Burst, "log-burst", logging.DefaultBurst, "repetitions of a log message allowed per second, -1 for all")
+	return opts
+}
+
+// oscEndpoint returns the OSC host and port from the config file, or defaultHost:8080 if it cannot be read
+func oscEndpoint(configPath, defaultHost string) (string, int) {
+	host, port := defaultHost, 8080
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		cfg = config.Default()
+	}
+	if err := config.ApplyEnv(cfg); err != nil {
+		return host, port
+	}
+	if cfg.OSC.Host != "" && cfg.OSC.Host != "0.0.0.0" {
+		host = cfg.OSC.Host
+	}
+	if cfg.OSC.Port != 0 {
+		port = cfg.OSC.Port
+	}
+	return host, port
+}
+
+// stringList is a flag that can be repeated, collecting every value
+type stringList []string
+
+// String returns the values joined by commas
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+// Set appends a value
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// runDiscover lists every bridge found on the network
+func runDiscover(args []string) error {
+	fs := newFlagSet("discover")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for mDNS answers")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	fmt.Fprintln(os.Stderr, "Discovering Hue bridges...")
+	bridges, err := hue.DiscoverBridges(*timeout)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tIP\tNAME")
+	for _, bridge := range bridges {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", orDash(bridge.ID), bridge.IPAddress, orDash(bridge.Name))
+	}
+	return w.Flush()
+}
+
+// runPair waits for the link button and stores the resulting API key in the config
+func runPair(args []string) error {
+	fs := newFlagSet("pair")
+	bridgeName := fs.String("bridge", "", "name of the bridge to pair (default: the first configured, a new name adds a bridge)")
+	bridgeIP := fs.String("ip", "", "bridge IP address (default: from config, else discovered)")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for the link button (0 waits until interrupted)")
+	save := fs.Bool("save", true, "save the bridge IP and API key to the config file")
+	configFile := configFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	configPath := config.Path(*configFile)
+	cfg, err := loadOrCreateConfig(configPath)
+	if err != nil {
+		return err
+	}
+	name := *bridgeName
+	if name == "" {
+		name = cfg.Hue[0].Name
+	}
+	existing := cfg.Bridge(name)
+	if existing == nil {
+		// Check the name before asking for the link button
+		added := *cfg
+		added.Hue = append(append([]config.HueConfig(nil), cfg.Hue...), config.HueConfig{Name: name})
+		if err := added.Validate(); err != nil {
+			return err
+		}
+	}
+	if *bridgeIP == "" && existing != nil {
+		*bridgeIP = existing.BridgeIP
+	}
+	if *bridgeIP == "" {
+		fmt.Fprintln(os.Stderr, "Discovering Hue bridges...")
+		bridges, err := hue.DiscoverBridges(5 * time.Second)
+		if err != nil {
+			return err
+		}
+		bridges = unconfiguredBridges(bridges, cfg)
+		if len(bridges) == 0 {
+			return fmt.Errorf("every bridge found is already configured, choose one with -ip")
+		}
+		if len(bridges) > 1 {
+			return fmt.Errorf("found %d bridges, choose one with -ip (see osc2hue discover)", len(bridges))
+		}
+		*bridgeIP = bridges[0].IPAddress
+	}
+
+	// Trust the certificate the bridge presents now, and pin it for later connections
+	identity, err := hue.Identify(*bridgeIP, identifyTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to reach the bridge at %s: %v", *bridgeIP, err)
+	}
+	fmt.Fprintf(os.Stderr, "Bridge ID %s, certificate %s", identity.ID, identity.Fingerprint)
+	if identity.Signed {
+		fmt.Fprint(os.Stderr, " (signed by the Hue root CA)")
+	}
+	fmt.Fprintln(os.Stderr)
+	if existing != nil && existing.BridgeID != "" && existing.BridgeID != identity.ID {
+		fmt.Fprintf(os.Stderr, "Warning: bridge %s was %s, replacing it\n", name, existing.BridgeID)
+	}
+
+	fmt.Fprintf(os.Stderr, "Press the link button on the Hue bridge at %s...\n", *bridgeIP)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	tlsConfig := hue.TLSConfig(identity.ID, identity.Fingerprint)
+	apiKey, err := hue.AuthenticateWithBridge(ctx, *bridgeIP, tlsConfig, func(elapsed time.Duration) {
+		if *timeout > 0 {
+			remaining := (*timeout - elapsed).Round(time.Second)
+			fmt.Fprintf(os.Stderr, "\rWaiting for link button... %3ds remaining", int(remaining.Seconds()))
+		} else {
+			fmt.Fprintf(os.Stderr, "\rWaiting for link button... %3ds, Ctrl-C to cancel", int(elapsed.Seconds()))
+		}
+	})
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Authentication successful!")
+	fmt.Println(apiKey)
+
+	if !*save {
+		return nil
+	}
+	paired := config.HueConfig{
+		Name:            name,
+		BridgeIP:        *bridgeIP,
+		BridgeID:        identity.ID,
+		APIKey:          apiKey,
+		CertFingerprint: identity.Fingerprint,
+	}
+	err = config.UpdateConfig(configPath, func(c *config.Config) {
+		if b := c.Bridge(name); b != nil {
+			*b = paired
+			return
+		}
+		c.Hue = append(c.Hue, paired)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save config: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Saved bridge %s IP, ID, certificate fingerprint and API key to %s\n", name, configPath)
+	return nil
+}
+
+// unconfiguredBridges returns the bridges whose IP is not in the config yet
+func unconfiguredBridges(bridges []hue.Bridge, cfg *config.Config) []hue.Bridge {
+	var unconfigured []hue.Bridge
+	for _, candidate := range bridges {
+		configured := false
+		for _, b := range cfg.Hue {
+			configured = configured || b.BridgeIP == candidate.IPAddress
+		}
+		if !configured {
+			unconfigured = append(unconfigured, candidate)
+		}
+	}
+	return unconfigured
+}
+
+// runLights prints a table of the lights known to the configured bridges
+func runLights(args []string) error {
+	fs := newFlagSet("lights")
+	configFile := configFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	cfg, err := config.LoadConfig(config.Path(*configFile))
+	if err != nil {
+		return err
+	}
+	if err := config.ApplyEnv(cfg); err != nil {
+		return fmt.Errorf("invalid environment override: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tBRIDGE\tID\tNAME\tTYPE\tCAPABILITIES\tGAMUT")
+	number, paired := 0, 0
+	for _, b := range cfg.Hue {
+		if b.BridgeIP == "" || !hue.IsValidAPIKey(b.APIKey) {
+			fmt.Fprintf(os.Stderr, "Bridge %s not paired, run osc2hue pair -bridge %s\n", b.Name, b.Name)
+			continue
+		}
+		paired++
+
+		_, lights, err := connectHue(context.Background(), b)
+		if err != nil {
+			return fmt.Errorf("failed to get lights from %s: %v", b.Name, err)
+		}
+		for i, light := range lights {
+			number++
+			archetype := "-"
+			if light.Metadata != nil && light.Metadata.Archetype != nil {
+				archetype = string(*light.Metadata.Archetype)
+			}
+			fmt.Fprintf(w, "%d\t%s/%d\t%s\t%s\t%s\t%s\t%s\n", number, b.Name, i+1, *light.Id, orDash(lightName(light)), archetype,
+				strings.Join(lightCapabilities(light), ","), lightGamut(light))
+		}
+	}
+	if paired == 0 {
+		return fmt.Errorf("bridge not paired, run osc2hue pair first")
+	}
+	return w.Flush()
+}
+
+// lightCapabilities lists the features a light supports
+func lightCapabilities(light openhue.LightGet) []string {
+	capabilities := []string{"on"}
+	if light.Dimming != nil {
+		capabilities = append(capabilities, "dim")
+	}
+	if light.Color != nil {
+		capabilities = append(capabilities, "color")
+	}
+	if light.ColorTemperature != nil {
+		capabilities = append(capabilities, "ct")
+	}
+	return capabilities
+}
+
+// lightGamut returns the color gamut type of a light, or "-" if it has none
+func lightGamut(light openhue.LightGet) string {
+	if light.Color == nil || light.Color.GamutType == nil {
+		return "-"
+	}
+	return string(*light.Color.GamutType)
+}
+
+// runSend sends one OSC message, by default to the locally configured OSC server
+func runSend(args []string) error {
+	fs := newFlagSet("send")
+	host := fs.String("host", "", "OSC server host (default: from config, else 127.0.0.1)")
+	port := fs.Int("port", 0, "OSC server port (default: from config, else 8080)")
+	configFile := configFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	cfgHost, cfgPort := oscEndpoint(config.Path(*configFile), "127.0.0.1")
+	if *host == "" {
+		*host = cfgHost
+	}
+	if *port == 0 {
+		*port = cfgPort
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: osc2hue send [-host address] [-port n] /address [args...]")
+		return errUsage
+	}
+
+	address := fs.Arg(0)
+	var oscArgs []interface{}
+	for _, arg := range fs.Args()[1:] {
+		oscArgs = append(oscArgs, osc.ParseArgument(arg))
+	}
+
+	if err := osc.Send(*host, *port, address, oscArgs...); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Sent %s %v to %s:%d\n", address, oscArgs, *host, *port)
+	return nil
+}
+
+// orDash returns s, or "-" if s is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// runMonitor prints every OSC packet arriving on the configured port without dispatching to the bridge
+func runMonitor(args []string) error {
+	var filters stringList
+	fs := newFlagSet("monitor")
+	host := fs.String("host", "", "address to listen on (default: from config, else 0.0.0.0)")
+	port := fs.Int("port", 0, "port to listen on (default: from config, else 8080)")
+	fs.Var(&filters, "filter", "only show addresses matching this OSC pattern (repeatable)")
+	recordPath := fs.String("record", "", "record incoming OSC packets to this file")
+	configFile := configFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	cfgHost, cfgPort := oscEndpoint(config.Path(*configFile), "0.0.0.0")
+	if *host == "" {
+		*host = cfgHost
+	}
+	if *port == 0 {
+		*port = cfgPort
+	}
+
+	oscServer := osc.NewServer(*host, *port)
+	oscServer.AddObserver(sniffer{monitor.New(os.Stdout, filters)})
+	if *recordPath != "" {
+		f, err := startRecording(*recordPath, oscServer)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		oscServer.Stop()
+	}()
+
+	return oscServer.Start()
+}
+
+// sniffer is a monitor that only shows packets, since no handlers are registered
+type sniffer struct {
+	*monitor.Monitor
+}
+
+// MessageDispatched does nothing, every message would be reported as unhandled
+func (sniffer) MessageDispatched(*gosc.Message, []string) {}
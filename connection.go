@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"osc2hue/internal/config"
+	"osc2hue/internal/hue"
+	"osc2hue/internal/osc"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+	"github.com/openhue/openhue-go"
+)
+
+// Reconnection attempts start after reconnectMinDelay and back off to reconnectMaxDelay
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = time.Minute
+)
+
+// connectionCheckInterval is how often the connection manager looks at the bridges
+const connectionCheckInterval = time.Second
+
+// lightPollInterval is how often connected bridges are asked for their lights,
+// to pick up lights that were added or removed
+const lightPollInterval = 10 * time.Second
+
+// connectionRetry is the backoff state of a bridge that is down
+type connectionRetry struct {
+	delay time.Duration
+	next  time.Time
+}
+
+// manageConnections reconnects to bridges that are down until stop is closed,
+// reports connection changes in the log and over OSC, picks up lights added
+// to or removed from connected bridges and keeps lights within their policies
+func (s *service) manageConnections(stop <-chan struct{}) {
+	retries := make(map[string]*connectionRetry)
+	polled := make(map[string]time.Time)
+	var enforced time.Time
+	ticker := time.NewTicker(connectionCheckInterval)
+	defer ticker.Stop()
+	for {
+		s.checkConnections(retries)
+		s.pollLights(polled)
+		if time.Since(enforced) >= policyCheckInterval {
+			enforced = time.Now()
+			_, ctrl := s.current()
+			ctrl.enforcePolicies(enforced)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkConnections reports the state of every bridge and tries to connect
+// those that are paired but down, once their backoff delay has passed
+func (s *service) checkConnections(retries map[string]*connectionRetry) {
+	cfg, ctrl := s.current()
+	for _, b := range ctrl.bridges {
+		up := b.up.Load()
+		s.reportConnection(b.name, up)
+
+		hc := cfg.Bridge(b.name)
+		if up || hc == nil || hc.BridgeIP == "" || !hue.IsValidAPIKey(hc.APIKey) {
+			// Connected, or waiting for pairing
+			delete(retries, b.name)
+			continue
+		}
+
+		retry := retries[b.name]
+		if retry == nil {
+			retry = &connectionRetry{}
+			retries[b.name] = retry
+		}
+		if time.Now().Before(retry.next) {
+			continue
+		}
+
+		home, lights, err := connectHue(ctrl.requests.ctx, *hc)
+		s.setConnectionError(b.name, err)
+		if err != nil {
+			retry.delay = min(max(2*retry.delay, reconnectMinDelay), reconnectMaxDelay)
+			retry.next = time.Now().Add(retry.delay)
+			hueLog.Warn("Bridge unreachable", "bridge", b.name, "error", err, "retry_in", retry.delay)
+			continue
+		}
+		delete(retries, b.name)
+		s.bridgeConnected(*hc, home, lights)
+	}
+}
+
+// setConnectionError records the outcome of the last attempt to connect to a bridge, nil if it succeeded
+func (s *service) setConnectionError(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.connErrors, name)
+	} else {
+		s.connErrors[name] = err
+	}
+}
+
+// bridgeConnected swaps in the live client and lights of a bridge that came back
+func (s *service) bridgeConnected(hc config.HueConfig, home *hue.Client, lights []openhue.LightGet) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if !s.replaceBridge(hc, home, lights) {
+		return
+	}
+	hueLog.Info("Bridge connected", "bridge", hc.Name, "lights", len(lights))
+	s.reportConnection(hc.Name, true)
+}
+
+// pollLights fetches the lights of each connected bridge every
+// lightPollInterval, and swaps in handlers for the current lights if some
+// were added or removed
+func (s *service) pollLights(polled map[string]time.Time) {
+	_, ctrl := s.current()
+	for _, b := range ctrl.bridges {
+		if !b.up.Load() || b.home == nil {
+			continue
+		}
+		if last, ok := polled[b.name]; !ok || time.Since(last) < lightPollInterval {
+			if !ok {
+				polled[b.name] = time.Now() // the lights were just fetched
+			}
+			continue
+		}
+		polled[b.name] = time.Now()
+
+		lights, err := fetchLights(ctrl.requests.ctx, b.home)
+		if err != nil {
+			ctrl.checkReachable(b, err)
+			continue
+		}
+		b.polled.Store(time.Now().UnixNano())
+		if slices.Equal(lightIDs(lights), lightIDs(b.lights)) {
+			continue
+		}
+
+		cfg, _ := s.current()
+		if hc := cfg.Bridge(b.name); hc != nil {
+			s.reloadMu.Lock()
+			s.replaceBridge(*hc, b.home, lights)
+			s.reloadMu.Unlock()
+		}
+	}
+}
+
+// replaceBridge swaps in a controller with the client and lights of one
+// bridge replaced, registering handlers for its lights, rooms and scenes and
+// logging the lights that were added or removed. Lights keep their numeric
+// aliases. It does nothing and returns false if the bridge configuration
+// changed meanwhile. The caller holds reloadMu.
+func (s *service) replaceBridge(hc config.HueConfig, home *hue.Client, lights []openhue.LightGet) bool {
+	cfg, oldCtrl := s.current()
+	if current := cfg.Bridge(hc.Name); current == nil || *current != hc {
+		return false // reloaded meanwhile
+	}
+
+	var oldBridge *bridge
+	bridges := make([]*bridge, 0, len(oldCtrl.bridges))
+	for _, b := range oldCtrl.bridges {
+		if b.name == hc.Name {
+			oldBridge = b
+			b = newBridge(hc.Name, hc.BridgeIP, home, lights, true)
+		}
+		bridges = append(bridges, b)
+	}
+	ctrl := replaceController(cfg, bridges, oldCtrl)
+	s.install(cfg, cfg, ctrl, oldCtrl)
+
+	if oldBridge != nil && oldBridge.home != nil {
+		logLightChanges(ctrl, hc.Name, oldBridge.lights, lights)
+	}
+	return true
+}
+
+// logLightChanges logs the lights of a bridge that were added or removed, with
+// the numeric alias of the added ones
+func logLightChanges(ctrl *controller, bridgeName string, old, lights []openhue.LightGet) {
+	known := make(map[string]bool, len(old))
+	for _, light := range old {
+		known[*light.Id] = true
+	}
+	for _, light := range lights {
+		if !known[*light.Id] {
+			hueLog.Info("Light added", "bridge", bridgeName, "number", ctrl.number(*light.Id), "name", lightName(light), "id", *light.Id)
+		}
+		delete(known, *light.Id)
+	}
+	for _, light := range old {
+		if known[*light.Id] {
+			hueLog.Info("Light removed", "bridge", bridgeName, "name", lightName(light), "id", *light.Id)
+		}
+	}
+}
+
+// reportConnection logs and sends /hue/{bridge}/connected to the OSC feedback
+// address when the connection state of a bridge changes
+func (s *service) reportConnection(name string, up bool) {
+	s.mu.Lock()
+	reported, known := s.reported[name]
+	s.reported[name] = up
+	s.mu.Unlock()
+	if known && reported == up {
+		return
+	}
+	if known && !up {
+		hueLog.Warn("Bridge disconnected", "bridge", name)
+	}
+	s.sendFeedback(fmt.Sprintf("/hue/%s/connected", name), boolArg(up))
+}
+
+// addStatusHandler adds /hue/status, which sends /hue/{bridge}/connected for
+// every bridge to the OSC feedback address
+func (s *service) addStatusHandler(oscServer osc.HandlerAdder) {
+	oscServer.AddHandler("/hue/status", func(msg *gosc.Message) {
+		_, ctrl := s.current()
+		for _, b := range ctrl.bridges {
+			s.sendFeedback(fmt.Sprintf("/hue/%s/connected", b.name), boolArg(b.up.Load()))
+		}
+	})
+}
+
+// sendFeedback sends a message to the OSC feedback address, if configured
+func (s *service) sendFeedback(address string, args ...interface{}) {
+	cfg, _ := s.current()
+	if cfg.OSC.Feedback == "" {
+		return
+	}
+	host, portStr, err := net.SplitHostPort(cfg.OSC.Feedback)
+	if err != nil {
+		return
+	}
+	port, _ := strconv.Atoi(portStr)
+	if err := osc.Send(host, port, address, args...); err != nil {
+		oscLog.Warn("Failed to send feedback", "address", address, "to", cfg.OSC.Feedback, "error", err)
+	}
+}
+
+// boolArg converts a flag to the 0 or 1 OSC argument used for on/off values
+func boolArg(v bool) int32 {
+	if v {
+		return 1
+	}
+	return 0
+}
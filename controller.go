@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"osc2hue/internal/color"
+	"osc2hue/internal/config"
+	"osc2hue/internal/hue"
+	"osc2hue/internal/policy"
+	"osc2hue/internal/safety"
+	"osc2hue/internal/state"
+
+	"github.com/openhue/openhue-go"
+)
+
+// lightGroup is a named set of lights controlled together
+type lightGroup struct {
+	ID       string
+	Name     string
+	LightIDs []string
+}
+
+// scene is a scene stored on a bridge
+type scene struct {
+	ID      string
+	Name    string
+	bridge  *bridge
+	actions map[string]openhue.LightPut // light UUID -> change applied on recall
+}
+
+// Errors of light commands, updates and scene recalls
+var (
+	errUnknownLight   = errors.New("unknown light")
+	errInvalidCommand = errors.New("invalid command")
+	errNotConnected   = errors.New("hue bridge not connected")
+	errBlackout       = errors.New("blackout is on")
+	errFlashLimited   = errors.New("refused by the flash limiter, the scene would flash too fast")
+)
+
+// bridge is a Hue bridge with the lights discovered on it
+type bridge struct {
+	name   string
+	ip     string
+	home   *hue.Client // nil if the bridge is not paired
+	lights []openhue.LightGet
+
+	// numbers holds the light UUID of each numeric alias on this bridge, from
+	// 1, with "" for lights that were removed
+	numbers []string
+
+	// up is set once the lights were fetched, and cleared when a request cannot reach the bridge
+	up atomic.Bool
+
+	// polled is when the lights were last fetched, in Unix nanoseconds
+	polled atomic.Int64
+}
+
+// newBridge creates a bridge, up if its lights were fetched
+func newBridge(name, ip string, home *hue.Client, lights []openhue.LightGet, up bool) *bridge {
+	b := &bridge{name: name, ip: ip, home: home, lights: lights}
+	b.up.Store(up)
+	if up {
+		b.polled.Store(time.Now().UnixNano())
+	}
+	return b
+}
+
+// requests carries the context of the requests sent to the bridges and counts
+// those in flight, so shutdown can wait for them and cancel what is left.
+// Controllers replacing each other share it.
+type requests struct {
+	ctx      context.Context
+	inflight atomic.Int64
+}
+
+// begin counts a request in flight and returns its context and the function ending it
+func (r *requests) begin() (context.Context, func()) {
+	r.inflight.Add(1)
+	return r.ctx, func() { r.inflight.Add(-1) }
+}
+
+// controller holds the bridge connections, the discovered lights and their cached state
+type controller struct {
+	bridges     []*bridge
+	lights      []openhue.LightGet // lights of every bridge in bridge order
+	numbers     []string           // light UUID of each numeric alias across bridges, "" once removed
+	lightBridge map[string]*bridge // light UUID -> bridge
+	groups      []lightGroup       // rooms discovered on the bridges, then groups from the config
+	scenes      []scene
+	state       *state.Store
+	safety      *safety.Limiter          // nil unless the flash limiter is enabled
+	policies    map[string]policy.Policy // light UUID -> limits from the config
+	master      *masterState             // master fader and blackout
+	panicLook   state.LightState         // set on every light by /hue/panic
+	requests    *requests                // requests to the bridges, shared with replaced controllers
+
+	// onRequest, if set, is called after every request sent to a bridge
+	onRequest func(resource, id string, body interface{}, took time.Duration, err error)
+	// onUnreachable, if set, is called with the bridge name when a request cannot reach it
+	onUnreachable func(name string)
+}
+
+// newController creates a controller and seeds the state cache from the discovered lights
+func newController(bridges []*bridge) *controller {
+	return newControllerWithStore(bridges, state.NewStore())
+}
+
+// newControllerWithStore creates a controller sharing an existing state cache,
+// so components holding the cache keep working when the controller is replaced
+func newControllerWithStore(bridges []*bridge, store *state.Store) *controller {
+	ctrl := &controller{
+		bridges:     bridges,
+		lightBridge: make(map[string]*bridge),
+		state:       store,
+		master:      newMasterState(),
+		requests:    &requests{ctx: context.Background()},
+	}
+
+	for _, b := range bridges {
+		if b.numbers == nil {
+			b.numbers = lightIDs(b.lights)
+		}
+		for _, light := range b.lights {
+			ctrl.lights = append(ctrl.lights, light)
+			ctrl.numbers = append(ctrl.numbers, *light.Id)
+			ctrl.lightBridge[*light.Id] = b
+			ctrl.state.Set(*light.Id, lightStateFromBridge(light))
+		}
+	}
+
+	return ctrl
+}
+
+// keepNumbers gives the lights that oldCtrl knew the same numeric aliases, on
+// their bridge and across bridges. Lights that appeared get the next free
+// numbers, the numbers of lights that disappeared are not reused.
+func (c *controller) keepNumbers(oldCtrl *controller) {
+	for _, b := range c.bridges {
+		if old := oldCtrl.bridge(b.name); old != nil && old != b {
+			b.numbers = renumber(old.numbers, b.lights)
+		}
+	}
+	c.numbers = renumber(oldCtrl.numbers, c.lights)
+}
+
+// renumber returns the numeric aliases for lights given the previous ones:
+// lights keep their number, removed lights leave a gap and new lights are
+// numbered after the highest number in the order given
+func renumber(numbers []string, lights []openhue.LightGet) []string {
+	present := make(map[string]bool, len(lights))
+	for _, light := range lights {
+		present[*light.Id] = true
+	}
+	renumbered := make([]string, 0, len(numbers)+len(lights))
+	numbered := make(map[string]bool, len(numbers))
+	for _, id := range numbers {
+		if !present[id] {
+			id = ""
+		}
+		renumbered = append(renumbered, id)
+		numbered[id] = true
+	}
+	for _, light := range lights {
+		if !numbered[*light.Id] {
+			renumbered = append(renumbered, *light.Id)
+		}
+	}
+	return renumbered
+}
+
+// number returns the numeric alias of a light across bridges, or 0
+func (c *controller) number(lightID string) int {
+	for i, id := range c.numbers {
+		if id == lightID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// lightIDs returns the UUIDs of lights in order
+func lightIDs(lights []openhue.LightGet) []string {
+	ids := make([]string, 0, len(lights))
+	for _, light := range lights {
+		ids = append(ids, *light.Id)
+	}
+	return ids
+}
+
+// connected reports whether at least one bridge can be reached
+func (c *controller) connected() bool {
+	for _, b := range c.bridges {
+		if b.home != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// bridge returns the bridge with the given name, or nil
+func (c *controller) bridge(name string) *bridge {
+	for _, b := range c.bridges {
+		if b.name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// discoverGroupsAndScenes loads the rooms and scenes from every bridge
+func (c *controller) discoverGroupsAndScenes() {
+	for _, b := range c.bridges {
+		if b.home == nil {
+			continue
+		}
+		groups, scenes := b.discoverGroupsAndScenes(c.requests.ctx)
+		c.groups = append(c.groups, groups...)
+		c.scenes = append(c.scenes, scenes...)
+	}
+
+	hueLog.Info("Found rooms and scenes", "rooms", len(c.groups), "scenes", len(c.scenes))
+	for i, group := range c.groups {
+		hueLog.Info("Group", "number", i+1, "id", group.ID, "name", group.Name, "lights", len(group.LightIDs))
+	}
+}
+
+// discoverGroupsAndScenes loads the rooms and scenes of a bridge, sorted by name
+func (b *bridge) discoverGroupsAndScenes(ctx context.Context) ([]lightGroup, []scene) {
+	// Rooms group devices, lights belong to a device through their owner
+	lightsByDevice := make(map[string][]string)
+	for _, light := range b.lights {
+		if light.Owner != nil && light.Owner.Rid != nil {
+			lightsByDevice[*light.Owner.Rid] = append(lightsByDevice[*light.Owner.Rid], *light.Id)
+		}
+	}
+
+	var groups []lightGroup
+	rooms, err := b.home.GetRooms(ctx)
+	if err != nil {
+		hueLog.Warn("Failed to get rooms", "bridge", b.name, "error", err)
+	}
+	for id, room := range rooms {
+		group := lightGroup{ID: id, Name: id}
+		if room.Metadata != nil && room.Metadata.Name != nil {
+			group.Name = *room.Metadata.Name
+		}
+		if room.Children != nil {
+			for _, child := range *room.Children {
+				if child.Rid != nil {
+					group.LightIDs = append(group.LightIDs, lightsByDevice[*child.Rid]...)
+				}
+			}
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	var scenes []scene
+	bridgeScenes, err := b.home.GetScenes(ctx)
+	if err != nil {
+		hueLog.Warn("Failed to get scenes", "bridge", b.name, "error", err)
+	}
+	for id, sc := range bridgeScenes {
+		name := id
+		if sc.Metadata != nil && sc.Metadata.Name != nil {
+			name = *sc.Metadata.Name
+		}
+		scenes = append(scenes, scene{ID: id, Name: name, bridge: b, actions: sceneActions(sc)})
+	}
+	sort.Slice(scenes, func(i, j int) bool { return scenes[i].Name < scenes[j].Name })
+	return groups, scenes
+}
+
+// addConfigGroups adds the groups defined in the config after the rooms,
+// skipping lights that are not known
+func (c *controller) addConfigGroups(groups []config.GroupConfig) {
+	for _, g := range groups {
+		group := lightGroup{ID: g.Name, Name: g.Name}
+		for _, ref := range g.Lights {
+			lightID, ok := c.resolveLight(ref)
+			if !ok {
+				configLog.Warn("Skipping unknown light of group", "group", g.Name, "light", ref)
+				continue
+			}
+			group.LightIDs = append(group.LightIDs, lightID)
+		}
+		c.groups = append(c.groups, group)
+		configLog.Info("Group", "number", len(c.groups), "name", g.Name, "lights", len(group.LightIDs))
+	}
+}
+
+// allLights returns every discovered light as a group
+func (c *controller) allLights() lightGroup {
+	group := lightGroup{ID: "all", Name: "All lights"}
+	for _, light := range c.lights {
+		group.LightIDs = append(group.LightIDs, *light.Id)
+	}
+	return group
+}
+
+// allLights returns every light of a bridge as a group
+func (b *bridge) allLights() lightGroup {
+	group := lightGroup{ID: b.name + "/all", Name: "All lights on " + b.name}
+	for _, light := range b.lights {
+		group.LightIDs = append(group.LightIDs, *light.Id)
+	}
+	return group
+}
+
+// resolveGroup returns the group for a numeric ID, room ID or config group name
+func (c *controller) resolveGroup(ref string) (lightGroup, bool) {
+	if n, err := strconv.Atoi(ref); err == nil {
+		if n >= 1 && n <= len(c.groups) {
+			return c.groups[n-1], true
+		}
+		return lightGroup{}, false
+	}
+
+	for _, group := range c.groups {
+		if group.ID == ref {
+			return group, true
+		}
+	}
+	return lightGroup{}, false
+}
+
+// groupByName returns the first room or group with the given name
+func (c *controller) groupByName(name string) (lightGroup, bool) {
+	for _, group := range c.groups {
+		if group.Name == name {
+			return group, true
+		}
+	}
+	return lightGroup{}, false
+}
+
+// hasScene reports whether a scene ID is known
+func (c *controller) hasScene(sceneID string) bool {
+	_, ok := c.findScene(sceneID)
+	return ok
+}
+
+// findScene returns the scene with the given ID
+func (c *controller) findScene(sceneID string) (scene, bool) {
+	for _, sc := range c.scenes {
+		if sc.ID == sceneID {
+			return sc, true
+		}
+	}
+	return scene{}, false
+}
+
+// sceneActions returns the change a scene applies to each of its lights.
+// Color temperatures are converted to XY, as the state cache holds colors.
+func sceneActions(sc openhue.SceneGet) map[string]openhue.LightPut {
+	actions := make(map[string]openhue.LightPut)
+	if sc.Actions == nil {
+		return actions
+	}
+	for _, a := range *sc.Actions {
+		if a.Action == nil || a.Target == nil || a.Target.Rid == nil ||
+			a.Target.Rtype == nil || *a.Target.Rtype != openhue.ResourceIdentifierRtypeLight {
+			continue
+		}
+		put := openhue.LightPut{On: a.Action.On, Dimming: a.Action.Dimming, Color: a.Action.Color}
+		if put.Color == nil && a.Action.ColorTemperature != nil && a.Action.ColorTemperature.Mirek != nil && *a.Action.ColorTemperature.Mirek > 0 {
+			x, y := color.KelvinToXY(1e6 / float64(*a.Action.ColorTemperature.Mirek))
+			fx, fy := float32(x), float32(y)
+			put.Color = &openhue.Color{Xy: &openhue.GamutPosition{X: &fx, Y: &fy}}
+		}
+		actions[*a.Target.Rid] = put
+	}
+	return actions
+}
+
+// sceneLevels returns what the flash limiter sees of each light of a scene once it is recalled
+func (c *controller) sceneLevels(sc scene) map[string]safety.Level {
+	levels := make(map[string]safety.Level, len(sc.actions))
+	for lightID, put := range sc.actions {
+		st, _ := c.state.Get(lightID)
+		applyLightPut(&st, put)
+		levels[lightID] = lightLevel(st)
+	}
+	return levels
+}
+
+// recallScene activates a scene on its bridge, a negative duration uses the
+// scene default. The flash limiter refuses recalls that would make one of the
+// scene's lights or rooms flash too fast.
+func (c *controller) recallScene(sceneID string, durationMs int) error {
+	sc, ok := c.findScene(sceneID)
+	if !ok || sc.bridge.home == nil {
+		return errNotConnected
+	}
+	if _, blackout := c.master.get(); blackout {
+		return errBlackout
+	}
+	if c.safety != nil && !c.safety.SubmitAll(c.sceneLevels(sc)) {
+		return errFlashLimited
+	}
+
+	action := openhue.SceneRecallActionActive
+	recall := &openhue.SceneRecall{Action: &action}
+	if durationMs >= 0 {
+		recall.Duration = &durationMs
+	}
+	put := openhue.ScenePut{Recall: recall}
+	ctx, done := c.requests.begin()
+	defer done()
+	start := time.Now()
+	err := sc.bridge.home.UpdateScene(ctx, sceneID, put)
+	c.reportRequest("scene", sceneID, put, start, err)
+	c.checkReachable(sc.bridge, err)
+	return err
+}
+
+// resolveLight returns the light UUID for a UUID or numeric ID across all
+// bridges, or for "bridge/id" with a UUID or numeric ID on one bridge
+func (c *controller) resolveLight(ref string) (string, bool) {
+	if name, id, ok := strings.Cut(ref, "/"); ok {
+		b := c.bridge(name)
+		if b == nil {
+			return "", false
+		}
+		return resolveLightIn(b.numbers, id)
+	}
+	return resolveLightIn(c.numbers, ref)
+}
+
+// resolveLightIn returns the light UUID for a UUID or a numeric alias in numbers
+func resolveLightIn(numbers []string, ref string) (string, bool) {
+	if n, err := strconv.Atoi(ref); err == nil {
+		if n >= 1 && n <= len(numbers) && numbers[n-1] != "" {
+			return numbers[n-1], true
+		}
+		return "", false
+	}
+
+	for _, id := range numbers {
+		if id != "" && id == ref {
+			return ref, true
+		}
+	}
+	return "", false
+}
+
+// updateLight records a light update in the state cache and sends it to the
+// light's bridge, within the policy of the light. Every input protocol gets
+// here with a command converted by command.Light.LightPut.
+func (c *controller) updateLight(lightID string, put openhue.LightPut) error {
+	if p, ok := c.policies[lightID]; ok {
+		put = c.limitLight(lightID, p, put, time.Now())
+	}
+	st := c.state.Update(lightID, func(st *state.LightState) {
+		applyLightPut(st, put)
+	})
+
+	b := c.lightBridge[lightID]
+	if b == nil || b.home == nil {
+		return errNotConnected
+	}
+	master := c.masterOf(lightID)
+	if _, blackout := master.get(); blackout {
+		return nil // recorded, sent when the blackout is released
+	}
+	if c.safety != nil && !c.safety.Submit(lightID, lightLevel(master.output(st)), func() { c.sendState(b, lightID) }) {
+		return nil // held back by the flash limiter, sent later
+	}
+	return c.sendLight(b, lightID, master.scale(put, st))
+}
+
+// updateLights applies a light update to several lights at once, like a
+// group command, and returns the errors of every light that failed
+func (c *controller) updateLights(lightIDs []string, put openhue.LightPut) error {
+	errs := make([]error, len(lightIDs))
+	var wg sync.WaitGroup
+	for i, lightID := range lightIDs {
+		wg.Add(1)
+		go func(i int, lightID string) {
+			defer wg.Done()
+			if err := c.updateLight(lightID, put); err != nil {
+				errs[i] = fmt.Errorf("light %s: %w", lightID, err)
+			}
+		}(i, lightID)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// sendLight sends a light update to its bridge
+func (c *controller) sendLight(b *bridge, lightID string, put openhue.LightPut) error {
+	lightQueueDepth.Add(1, lightID)
+	defer lightQueueDepth.Add(-1, lightID)
+	ctx, done := c.requests.begin()
+	defer done()
+	start := time.Now()
+	err := b.home.UpdateLight(ctx, lightID, put)
+	c.reportRequest("light", lightID, put, start, err)
+	c.checkReachable(b, err)
+	return err
+}
+
+// sendState sends the cached state of a light to its bridge, once the flash
+// limiter releases a change it held back
+func (c *controller) sendState(b *bridge, lightID string) {
+	st, _ := c.state.Get(lightID)
+	if err := c.sendLight(b, lightID, c.masterOf(lightID).scale(statePut(st, 0), st)); err != nil {
+		hueLog.Error("Failed to update light", "light", lightID, "error", err)
+	}
+}
+
+// checkReachable marks a bridge whose request failed on the network as down
+// and passes it to onUnreachable, if set
+func (c *controller) checkReachable(b *bridge, err error) {
+	if err == nil || !isNetworkError(err) {
+		return
+	}
+	b.up.Store(false)
+	if c.onUnreachable != nil {
+		c.onUnreachable(b.name)
+	}
+}
+
+// reportRequest records a finished bridge request in the metrics and passes it to onRequest, if set
+func (c *controller) reportRequest(resource, id string, body interface{}, start time.Time, err error) {
+	took := time.Since(start)
+	observeRequest(resource, took, err)
+	if c.onRequest != nil {
+		c.onRequest(resource, id, body, took, err)
+	}
+}
+
+// applyLightPut merges the fields set in a light update into a cached state
+func applyLightPut(st *state.LightState, put openhue.LightPut) {
+	if put.On != nil && put.On.On != nil {
+		st.On = *put.On.On
+	}
+	if put.Dimming != nil && put.Dimming.Brightness != nil {
+		st.Brightness = float64(*put.Dimming.Brightness) / 100
+	}
+	if put.Color != nil && put.Color.Xy != nil && put.Color.Xy.X != nil && put.Color.Xy.Y != nil {
+		st.X = float64(*put.Color.Xy.X)
+		st.Y = float64(*put.Color.Xy.Y)
+	}
+}
+
+// lightStateFromBridge converts the state reported by the bridge into a cached state
+func lightStateFromBridge(light openhue.LightGet) state.LightState {
+	st := state.DefaultLightState()
+	if light.On != nil && light.On.On != nil {
+		st.On = *light.On.On
+	}
+	if light.Dimming != nil && light.Dimming.Brightness != nil {
+		st.Brightness = float64(*light.Dimming.Brightness) / 100
+	}
+	if light.Color != nil && light.Color.Xy != nil && light.Color.Xy.X != nil && light.Color.Xy.Y != nil {
+		st.X = float64(*light.Color.Xy.X)
+		st.Y = float64(*light.Color.Xy.Y)
+	}
+	return st
+}
+
+// sortLights orders lights by name, then ID, so numeric aliases are stable across runs
+func sortLights(lights []openhue.LightGet) {
+	sort.SliceStable(lights, func(i, j int) bool {
+		ni, nj := lightName(lights[i]), lightName(lights[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return *lights[i].Id < *lights[j].Id
+	})
+}
+
+// lightName returns a light's display name, or "" if it has none
+func lightName(light openhue.LightGet) string {
+	if light.Metadata == nil || light.Metadata.Name == nil {
+		return ""
+	}
+	return *light.Metadata.Name
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+
+	"osc2hue/internal/config"
+	"osc2hue/internal/dmx"
+	"osc2hue/internal/osc"
+	"osc2hue/internal/state"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+)
+
+// startDMXOutput starts the Art-Net / sACN output if configured, returns nil otherwise
+func startDMXOutput(cfg *config.Config, ctrl *controller) *dmx.Output {
+	if cfg.DMXOutput == nil {
+		return nil
+	}
+
+	fixtures, err := buildDMXFixtures(cfg.DMXOutput, ctrl)
+	if err != nil {
+		dmxLog.Error("DMX output disabled", "error", err)
+		return nil
+	}
+
+	var sender dmx.Sender
+	switch cfg.DMXOutput.Protocol {
+	case "artnet":
+		sender, err = dmx.NewArtNetSender(cfg.DMXOutput.Target)
+	case "sacn":
+		sender, err = dmx.NewSACNSender(cfg.DMXOutput.Target, "osc2hue")
+	default:
+		err = fmt.Errorf("unknown protocol %q (expected artnet or sacn)", cfg.DMXOutput.Protocol)
+	}
+	if err != nil {
+		dmxLog.Error("DMX output disabled", "error", err)
+		return nil
+	}
+
+	output := dmx.NewOutput(sender, fixtures, dmxSource{ctrl}, cfg.DMXOutput.RefreshHz)
+	output.Start()
+	dmxLog.Info("DMX output", "protocol", cfg.DMXOutput.Protocol, "fixtures", len(fixtures))
+	return output
+}
+
+// dmxSource renders lights to DMX as they are sent to the bridges, with the
+// master fader and blackout applied
+type dmxSource struct {
+	ctrl *controller
+}
+
+// Get returns the cached state of a light as seen through its master
+func (s dmxSource) Get(lightID string) (state.LightState, bool) {
+	st, ok := s.ctrl.state.Get(lightID)
+	if !ok {
+		return st, false
+	}
+	return s.ctrl.masterOf(lightID).output(st), true
+}
+
+// buildDMXFixtures resolves the configured fixtures against the discovered lights
+func buildDMXFixtures(cfg *config.DMXOutputConfig, ctrl *controller) ([]dmx.Fixture, error) {
+	var fixtures []dmx.Fixture
+	for _, f := range cfg.Fixtures {
+		channels, err := dmx.ResolveProfile(f.Profile, cfg.Profiles)
+		if err != nil {
+			return nil, err
+		}
+
+		lightID, ok := ctrl.resolveLight(f.Light)
+		if !ok {
+			dmxLog.Warn("Skipping DMX fixture for unknown light", "light", f.Light)
+			continue
+		}
+
+		fixture := dmx.Fixture{
+			LightID:  lightID,
+			Universe: f.Universe,
+			Address:  f.Address,
+			Channels: channels,
+		}
+		if err := fixture.Validate(); err != nil {
+			return nil, err
+		}
+		fixtures = append(fixtures, fixture)
+	}
+	return fixtures, nil
+}
+
+// startDMXInput listens for Art-Net / sACN frames if configured and feeds changes to the OSC handlers, returns nil otherwise
+func startDMXInput(cfg *config.Config, ctrl *controller, oscServer *osc.Server) *dmx.Receiver {
+	if cfg.DMXInput == nil {
+		return nil
+	}
+
+	var fixtures []dmx.InputFixture
+	for _, f := range cfg.DMXInput.Fixtures {
+		lightID, ok := ctrl.resolveLight(f.Light)
+		if !ok {
+			dmxLog.Warn("Skipping DMX input fixture for unknown light", "light", f.Light)
+			continue
+		}
+
+		fixture := dmx.InputFixture{
+			LightID:     lightID,
+			Universe:    f.Universe,
+			Address:     f.Address,
+			Personality: dmx.Personality(f.Personality),
+		}
+		if err := fixture.Validate(); err != nil {
+			dmxLog.Error("DMX input disabled", "error", err)
+			return nil
+		}
+		fixtures = append(fixtures, fixture)
+	}
+
+	input := dmx.NewInput(fixtures, func(cmd dmx.Command) {
+		oscServer.Dispatch(dmxCommandMessage(cmd))
+	})
+
+	var receiver *dmx.Receiver
+	var err error
+	switch cfg.DMXInput.Protocol {
+	case "artnet":
+		receiver, err = dmx.ListenArtNet()
+	case "sacn":
+		receiver, err = dmx.ListenSACN(cfg.DMXInput.Interface, input.Universes())
+	default:
+		err = fmt.Errorf("unknown protocol %q (expected artnet or sacn)", cfg.DMXInput.Protocol)
+	}
+	if err != nil {
+		dmxLog.Error("DMX input disabled", "error", err)
+		return nil
+	}
+
+	go receiver.Serve(input.HandleFrame)
+	dmxLog.Info("DMX input", "protocol", cfg.DMXInput.Protocol, "fixtures", len(fixtures))
+	return receiver
+}
+
+// dmxCommandMessage converts a DMX change into the equivalent OSC message
+func dmxCommandMessage(cmd dmx.Command) *gosc.Message {
+	if !cmd.HasColor {
+		return gosc.NewMessage(fmt.Sprintf("/hue/%s/brightness", cmd.LightID), float32(cmd.Brightness))
+	}
+	return gosc.NewMessage(fmt.Sprintf("/hue/%s/set", cmd.LightID),
+		float32(cmd.X), float32(cmd.Y), float32(cmd.Brightness), int32(-1))
+}
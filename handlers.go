@@ -2,137 +2,143 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"strings"
+	"sync"
 
+	"osc2hue/internal/command"
 	"osc2hue/internal/osc"
 
 	gosc "github.com/hypebeast/go-osc/osc"
-	"github.com/openhue/openhue-go"
 )
 
-// addAllHandlers adds all OSC handlers (individual lights and global commands)
-func addAllHandlers(oscServer *osc.Server, home *openhue.Home, lights []openhue.LightGet) {
+// addAllHandlers adds all OSC handlers (individual lights, groups, scenes and global commands)
+func addAllHandlers(oscServer osc.HandlerAdder, ctrl *controller) {
 	// Add individual light handlers
-	addLightHandlers(oscServer, home, lights)
+	addLightHandlers(oscServer, ctrl)
+
+	// Add room and scene handlers
+	addGroupHandlers(oscServer, ctrl)
+	addSceneHandlers(oscServer, ctrl)
 
 	// Add global handlers
-	addGlobalHandlers(oscServer, home, lights)
+	addGlobalHandlers(oscServer, ctrl)
+	addMasterHandlers(oscServer, ctrl)
+}
+
+// addGlobalHandlers adds OSC handlers for "all lights" commands, across all
+// bridges and for each bridge
+func addGlobalHandlers(oscServer osc.HandlerAdder, ctrl *controller) {
+	addAllLightsHandlers(oscServer, ctrl, "/hue/all", ctrl.allLights())
+	for _, b := range ctrl.bridges {
+		addAllLightsHandlers(oscServer, ctrl, fmt.Sprintf("/hue/%s/all", b.name), b.allLights())
+	}
 }
 
-// addGlobalHandlers adds OSC handlers for global "all lights" commands
-func addGlobalHandlers(oscServer *osc.Server, home *openhue.Home, lights []openhue.LightGet) {
-	oscServer.AddHandler("/hue/all/on", func(msg *gosc.Message) {
-		handleAllOn(msg, home, lights)
+// addAllLightsHandlers adds the group commands for a set of lights under prefix
+func addAllLightsHandlers(oscServer osc.HandlerAdder, ctrl *controller, prefix string, group lightGroup) {
+	oscServer.AddHandler(prefix+"/on", func(msg *gosc.Message) {
+		handleGroupOn(msg, ctrl, group)
 	})
 
-	oscServer.AddHandler("/hue/all/brightness", func(msg *gosc.Message) {
-		handleAllBrightness(msg, home, lights)
+	oscServer.AddHandler(prefix+"/brightness", func(msg *gosc.Message) {
+		handleGroupBrightness(msg, ctrl, group)
 	})
 
-	oscServer.AddHandler("/hue/all/color", func(msg *gosc.Message) {
-		handleAllColor(msg, home, lights)
+	oscServer.AddHandler(prefix+"/color", func(msg *gosc.Message) {
+		handleGroupColor(msg, ctrl, group)
 	})
 
-	oscServer.AddHandler("/hue/all/set", func(msg *gosc.Message) {
-		handleAllSet(msg, home, lights)
+	oscServer.AddHandler(prefix+"/set", func(msg *gosc.Message) {
+		handleGroupSet(msg, ctrl, group)
 	})
 }
 
-// addLightHandlers adds OSC handlers for all discovered lights
-func addLightHandlers(oscServer *osc.Server, home *openhue.Home, lights []openhue.LightGet) {
-	if home == nil {
-		return
+// addGroupHandlers adds OSC handlers for the rooms discovered on the bridges and the groups from the config
+func addGroupHandlers(oscServer osc.HandlerAdder, ctrl *controller) {
+	for i, group := range ctrl.groups {
+		// do it with group and numeric ids
+		for _, id := range []string{group.ID, fmt.Sprintf("%d", i+1)} {
+			addAllLightsHandlers(oscServer, ctrl, fmt.Sprintf("/hue/group/%s", id), group)
+		}
 	}
+}
 
-	for i, light := range lights {
-		// Convert light ID to string for the closure
-		lightID := *light.Id
-		numericID := i + 1
+// addSceneHandlers adds OSC handlers to recall the scenes stored on the bridge
+func addSceneHandlers(oscServer osc.HandlerAdder, ctrl *controller) {
+	for _, sc := range ctrl.scenes {
+		sceneID := sc.ID
+		oscServer.AddHandler(fmt.Sprintf("/hue/scene/%s/recall", sceneID), func(msg *gosc.Message) {
+			handleSceneRecall(msg, ctrl, sceneID)
+		})
+	}
+}
 
+// addLightHandlers adds OSC handlers for all discovered lights, numbered
+// across all bridges as /hue/{id}/... and on their bridge as /hue/{bridge}/{id}/...
+func addLightHandlers(oscServer osc.HandlerAdder, ctrl *controller) {
+	for i, id := range ctrl.numbers {
+		if id == "" {
+			continue // removed
+		}
 		// do it with light and numeric ids
-		for _, id := range []string{lightID, fmt.Sprintf("%d", numericID)} {
-			// Add handlers for both light ID and numeric ID
-			oscServer.AddHandler(fmt.Sprintf("/hue/%s/on", id), func(msg *gosc.Message) {
-				handleLightOn(msg, home, lightID)
-			})
-
-			oscServer.AddHandler(fmt.Sprintf("/hue/%s/brightness", id), func(msg *gosc.Message) {
-				handleLightBrightness(msg, home, lightID)
-			})
-
-			oscServer.AddHandler(fmt.Sprintf("/hue/%s/color", id), func(msg *gosc.Message) {
-				handleLightColor(msg, home, lightID)
-			})
-
-			// Combined color+brightness handler
-			oscServer.AddHandler(fmt.Sprintf("/hue/%s/set", id), func(msg *gosc.Message) {
-				handleLightSet(msg, home, lightID)
-			})
+		addSingleLightHandlers(oscServer, ctrl, id, "/hue/"+id, fmt.Sprintf("/hue/%d", i+1))
+	}
+
+	for _, b := range ctrl.bridges {
+		for i, id := range b.numbers {
+			if id == "" {
+				continue
+			}
+			addSingleLightHandlers(oscServer, ctrl, id,
+				fmt.Sprintf("/hue/%s/%s", b.name, id), fmt.Sprintf("/hue/%s/%d", b.name, i+1))
 		}
 	}
 }
 
-func handleLightOn(msg *gosc.Message, home *openhue.Home, lightID string) {
-	if home == nil {
-		log.Printf("Hue bridge not connected")
-		return
-	}
+// addSingleLightHandlers adds the light commands for one light under each prefix
+func addSingleLightHandlers(oscServer osc.HandlerAdder, ctrl *controller, lightID string, prefixes ...string) {
+	for _, prefix := range prefixes {
+		oscServer.AddHandler(prefix+"/on", func(msg *gosc.Message) {
+			handleLightOn(msg, ctrl, lightID)
+		})
 
-	if len(msg.Arguments) < 1 {
-		log.Printf("No arguments provided for light on/off")
-		return
-	}
+		oscServer.AddHandler(prefix+"/brightness", func(msg *gosc.Message) {
+			handleLightBrightness(msg, ctrl, lightID)
+		})
 
-	var on bool
-	switch v := msg.Arguments[0].(type) {
-	case int32:
-		on = v > 0
-	case float32:
-		on = v > 0
-	case bool:
-		on = v
-	default:
-		log.Printf("Invalid argument type for light on/off: %T", v)
-		return
-	}
+		oscServer.AddHandler(prefix+"/color", func(msg *gosc.Message) {
+			handleLightColor(msg, ctrl, lightID)
+		})
 
-	// Create light state update
-	state := openhue.LightPut{
-		On: &openhue.On{On: &on},
+		// Combined color+brightness handler
+		oscServer.AddHandler(prefix+"/set", func(msg *gosc.Message) {
+			handleLightSet(msg, ctrl, lightID)
+		})
 	}
+}
 
-	// Check if transition duration is provided as second argument
-	if len(msg.Arguments) >= 2 {
-		var transitionMs int
-		switch v := msg.Arguments[1].(type) {
-		case int32:
-			transitionMs = int(v)
-		case float32:
-			transitionMs = int(v)
-		default:
-			log.Printf("Invalid transition duration type: %T", v)
-		}
-		if transitionMs > 0 {
-			state.Dynamics = &openhue.LightDynamics{Duration: &transitionMs}
-		}
+// handleLightOn turns a light on or off
+func handleLightOn(msg *gosc.Message, ctrl *controller, lightID string) {
+	if !ctrl.connected() {
+		oscLog.Warn("Hue bridge not connected", "address", msg.Address)
+		return
 	}
 
-	if err := home.UpdateLight(lightID, state); err != nil {
-		log.Printf("Error setting light state: %v", err)
-	} else {
-		log.Printf("Light %s turned %v", lightID, on)
+	cmd, err := onCommand(msg)
+	if err != nil {
+		oscLog.Warn("Invalid light on/off", "address", msg.Address, "error", err)
+		return
 	}
+	applyLightCommand(msg, ctrl, lightID, cmd)
 }
 
-func handleLightBrightness(msg *gosc.Message, home *openhue.Home, lightID string) {
-	if home == nil {
-		log.Printf("Hue bridge not connected")
+func handleLightBrightness(msg *gosc.Message, ctrl *controller, lightID string) {
+	if !ctrl.connected() {
+		oscLog.Warn("Hue bridge not connected", "address", msg.Address)
 		return
 	}
 
 	if len(msg.Arguments) < 1 {
-		log.Printf("No arguments provided for brightness")
+		oscLog.Warn("No arguments provided for brightness", "address", msg.Address)
 		return
 	}
 
@@ -148,17 +154,17 @@ func handleLightBrightness(msg *gosc.Message, home *openhue.Home, lightID string
 	}
 
 	// Delegate to the set handler
-	handleLightSet(setMsg, home, lightID)
+	handleLightSet(setMsg, ctrl, lightID)
 }
 
-func handleLightColor(msg *gosc.Message, home *openhue.Home, lightID string) {
-	if home == nil {
-		log.Printf("Hue bridge not connected")
+func handleLightColor(msg *gosc.Message, ctrl *controller, lightID string) {
+	if !ctrl.connected() {
+		oscLog.Warn("Hue bridge not connected", "address", msg.Address)
 		return
 	}
 
 	if len(msg.Arguments) < 2 {
-		log.Printf("Not enough arguments for color (need X and Y coordinates)")
+		oscLog.Warn("Not enough arguments for color (need X and Y coordinates)", "address", msg.Address)
 		return
 	}
 
@@ -174,186 +180,121 @@ func handleLightColor(msg *gosc.Message, home *openhue.Home, lightID string) {
 	}
 
 	// Delegate to the set handler
-	handleLightSet(setMsg, home, lightID)
+	handleLightSet(setMsg, ctrl, lightID)
 }
 
-func handleLightSet(msg *gosc.Message, home *openhue.Home, lightID string) {
-	if home == nil {
-		log.Printf("Hue bridge not connected")
+// handleLightSet sets the color, brightness and transition of a light at once
+func handleLightSet(msg *gosc.Message, ctrl *controller, lightID string) {
+	if !ctrl.connected() {
+		oscLog.Warn("Hue bridge not connected", "address", msg.Address)
 		return
 	}
 
 	// Allow flexible number of arguments, but require at least 1
 	if len(msg.Arguments) < 1 {
-		log.Printf("Set command requires at least 1 argument. Use -1 for null values.")
-		log.Printf("Usage: /hue/light/{id}/set {x|-1} [y|-1] [brightness|-1] [duration_ms|-1]")
+		oscLog.Warn("Set command requires at least 1 argument, use -1 for null values",
+			"address", msg.Address, "usage", "/hue/light/{id}/set {x|-1} [y|-1] [brightness|-1] [duration_ms|-1]")
 		return
 	}
 
-	// Create light state update
-	state := openhue.LightPut{}
-
-	var hasColor, hasBrightness bool
-	var x, y float64
-	var brightness float64
-	var logParts []string
+	cmd, err := setCommand(msg)
+	if err != nil {
+		oscLog.Warn("Invalid set command", "address", msg.Address, "error", err)
+		return
+	}
+	applyLightCommand(msg, ctrl, lightID, cmd)
+}
 
-	// Parse X coordinate (argument 0)
-	if len(msg.Arguments) >= 1 {
-		switch v := msg.Arguments[0].(type) {
-		case int32:
-			if v != -1 {
-				x = float64(v)
-				hasColor = true
-			}
-		case float32:
-			if v != -1.0 {
-				x = float64(v)
-				hasColor = true
-			}
-		default:
-			log.Printf("Invalid X coordinate type: %T", v)
-			return
-		}
+// onCommand converts the arguments of /on, on or off and an optional
+// transition duration in milliseconds, into a light command
+func onCommand(msg *gosc.Message) (command.Light, error) {
+	if len(msg.Arguments) < 1 {
+		return command.Light{}, fmt.Errorf("no arguments provided")
 	}
 
-	// Parse Y coordinate (argument 1)
-	if len(msg.Arguments) >= 2 && hasColor {
-		switch v := msg.Arguments[1].(type) {
-		case int32:
-			if v != -1 {
-				y = float64(v)
-			} else {
-				hasColor = false // If Y is null, disable color
-			}
-		case float32:
-			if v != -1.0 {
-				y = float64(v)
-			} else {
-				hasColor = false // If Y is null, disable color
-			}
-		default:
-			log.Printf("Invalid Y coordinate type: %T", v)
-			return
-		}
-	} else if hasColor && len(msg.Arguments) < 2 {
-		log.Printf("Color requires both X and Y coordinates")
-		return
+	var on bool
+	switch v := msg.Arguments[0].(type) {
+	case int32:
+		on = v > 0
+	case float32:
+		on = v > 0
+	case bool:
+		on = v
+	default:
+		return command.Light{}, fmt.Errorf("invalid argument type %T", v)
 	}
+	cmd := command.Light{On: &on}
 
-	// Parse brightness (argument 2)
-	if len(msg.Arguments) >= 3 {
-		switch v := msg.Arguments[2].(type) {
-		case int32:
-			if v == 1 || v == 0 {
-				brightness = float64(v)
-				hasBrightness = true
-			}
-		case float32:
-			if v != -1.0 {
-				brightness = float64(v) // 0.0-1.0 range
-				if v > 1.0 {
-					brightness = float64(1.0)
-				}
-				hasBrightness = true
-			}
-		default:
-			log.Printf("Invalid brightness type: %T", v)
-			return
-		}
+	// A duration of 0 or less keeps the bridge's default transition
+	if duration := durationArg(msg, 1); duration > 0 {
+		cmd.DurationMs = &duration
 	}
+	return cmd, nil
+}
 
-	// Apply color if specified
-	if hasColor {
-		// Validate and clamp values
-		if x < 0 {
-			x = 0
-		} else if x > 1 {
-			x = 1
+// setArgs names the arguments of /set
+var setArgs = [...]string{"x", "y", "brightness", "duration"}
+
+// setCommand converts the arguments of /set, x, y, brightness and transition
+// duration in milliseconds with -1 for null, into a light command
+func setCommand(msg *gosc.Message) (command.Light, error) {
+	var args [len(setArgs)]*float64
+	for i := 0; i < len(args) && i < len(msg.Arguments); i++ {
+		v, ok := floatArg(msg, i)
+		if !ok {
+			return command.Light{}, fmt.Errorf("invalid %s type %T", setArgs[i], msg.Arguments[i])
 		}
-		if y < 0 {
-			y = 0
-		} else if y > 1 {
-			y = 1
-		}
-
-		// Convert coordinates to float32 for the API
-		xf := float32(x)
-		yf := float32(y)
-
-		state.Color = &openhue.Color{
-			Xy: &openhue.GamutPosition{
-				X: &xf,
-				Y: &yf,
-			},
+		if v != -1 {
+			args[i] = &v
 		}
-		logParts = append(logParts, fmt.Sprintf("color=x:%.3f,y:%.3f", x, y))
 	}
 
-	// Apply brightness if specified
-	if hasBrightness {
-		// Validate and clamp brightness
-		if brightness < 0 {
-			brightness = 0
-		} else if brightness > 1 {
-			brightness = 1
+	var cmd command.Light
+	// Color needs both coordinates, a null Y leaves it unchanged
+	if args[0] != nil {
+		if len(msg.Arguments) < 2 {
+			return cmd, fmt.Errorf("color requires both X and Y coordinates")
 		}
-
-		// Convert brightness to percentage for OpenHue
-		brightnessPercent := float32(brightness * 100)
-		on := brightness > 0
-
-		state.On = &openhue.On{On: &on}
-		state.Dimming = &openhue.Dimming{Brightness: &brightnessPercent}
-		logParts = append(logParts, fmt.Sprintf("brightness=%.1f%%", brightnessPercent))
-	}
-
-	// Check if transition duration is provided as fourth argument
-	if len(msg.Arguments) >= 4 {
-		var transitionMs int
-		switch v := msg.Arguments[3].(type) {
-		case int32:
-			if v != -1 {
-				transitionMs = int(v)
-			}
-		case float32:
-			if v != -1.0 {
-				transitionMs = int(v)
-			}
-		default:
-			log.Printf("Invalid transition duration type: %T", v)
+		if args[1] != nil {
+			cmd.X, cmd.Y = args[0], args[1]
 		}
-		if transitionMs >= 0 {
-			state.Dynamics = &openhue.LightDynamics{Duration: &transitionMs}
-			logParts = append(logParts, fmt.Sprintf("duration=%dms", transitionMs))
+	}
+	// Integer brightness is off (0) or full (1), other integers are ignored
+	if brightness := args[2]; brightness != nil {
+		if _, isInt := msg.Arguments[2].(int32); !isInt || *brightness == 0 || *brightness == 1 {
+			cmd.Brightness = brightness
 		}
 	}
+	if duration := args[3]; duration != nil {
+		ms := int(*duration)
+		cmd.DurationMs = &ms
+	}
+	return cmd, nil
+}
 
-	// Check if we have anything to update
-	if !hasColor && !hasBrightness && state.Dynamics == nil {
-		log.Printf("No valid parameters provided for light %s", lightID)
+// applyLightCommand applies a light command parsed from an OSC message to a light
+func applyLightCommand(msg *gosc.Message, ctrl *controller, lightID string, cmd command.Light) {
+	put, err := cmd.LightPut()
+	if err != nil {
+		oscLog.Warn("No valid parameters provided", "address", msg.Address, "light", lightID, "error", err)
 		return
 	}
-
-	if err := home.UpdateLight(lightID, state); err != nil {
-		log.Printf("Error updating light %s: %v", lightID, err)
+	if err := ctrl.updateLight(lightID, put); err != nil {
+		hueLog.Error("Failed to update light", "light", lightID, "error", err)
 	} else {
-		if len(logParts) > 0 {
-			log.Printf("Light %s updated: %s", lightID, fmt.Sprintf("[%s]", strings.Join(logParts, ", ")))
-		} else {
-			log.Printf("Light %s updated (no changes applied)", lightID)
-		}
+		oscLog.Debug("Light updated", "light", lightID, "address", msg.Address)
 	}
 }
 
-func handleAllOn(msg *gosc.Message, home *openhue.Home, lights []openhue.LightGet) {
-	if home == nil {
-		log.Printf("Hue bridge not connected")
+// handleGroupOn turns every light of a group on or off
+func handleGroupOn(msg *gosc.Message, ctrl *controller, group lightGroup) {
+	if !ctrl.connected() {
+		oscLog.Warn("Hue bridge not connected", "address", msg.Address)
 		return
 	}
 
 	if len(msg.Arguments) < 1 {
-		log.Printf("No arguments provided for all lights on/off")
+		oscLog.Warn("No arguments provided for group on/off", "address", msg.Address, "group", group.Name)
 		return
 	}
 
@@ -367,32 +308,38 @@ func handleAllOn(msg *gosc.Message, home *openhue.Home, lights []openhue.LightGe
 	case bool:
 		on = v
 	default:
-		log.Printf("Invalid argument type for all lights on/off: %T", v)
+		oscLog.Warn("Invalid argument type for group on/off", "address", msg.Address, "group", group.Name, "type", fmt.Sprintf("%T", v))
 		return
 	}
 
-	// Apply to all lights simultaneously using goroutines
-	for _, light := range lights {
+	// Apply to all lights simultaneously using goroutines, and return once
+	// every light was updated so shutdown can wait for the message
+	var wg sync.WaitGroup
+	for _, lightID := range group.LightIDs {
+		wg.Add(1)
 		go func(lightID string) {
-			handleLightOn(msg, home, lightID)
-		}(*light.Id)
+			defer wg.Done()
+			handleLightOn(msg, ctrl, lightID)
+		}(lightID)
 	}
-	log.Printf("All lights turned %v", on)
+	wg.Wait()
+	oscLog.Debug("Group turned on/off", "group", group.Name, "on", on)
 }
 
-func handleAllBrightness(msg *gosc.Message, home *openhue.Home, lights []openhue.LightGet) {
-	if home == nil {
-		log.Printf("Hue bridge not connected")
+// handleGroupBrightness sets the brightness of every light of a group
+func handleGroupBrightness(msg *gosc.Message, ctrl *controller, group lightGroup) {
+	if !ctrl.connected() {
+		oscLog.Warn("Hue bridge not connected", "address", msg.Address)
 		return
 	}
 
 	if len(msg.Arguments) < 1 {
-		log.Printf("No arguments provided for all lights brightness")
+		oscLog.Warn("No arguments provided for group brightness", "address", msg.Address, "group", group.Name)
 		return
 	}
 
 	// Create a new message for the set handler with null color values
-	setMsg := gosc.NewMessage("/hue/all/set")
+	setMsg := gosc.NewMessage(msg.Address)
 	setMsg.Append(int32(-1))        // x = null (skip color)
 	setMsg.Append(int32(-1))        // y = null (skip color)
 	setMsg.Append(msg.Arguments[0]) // brightness value from original message
@@ -403,22 +350,23 @@ func handleAllBrightness(msg *gosc.Message, home *openhue.Home, lights []openhue
 	}
 
 	// Delegate to the set handler
-	handleAllSet(setMsg, home, lights)
+	handleGroupSet(setMsg, ctrl, group)
 }
 
-func handleAllColor(msg *gosc.Message, home *openhue.Home, lights []openhue.LightGet) {
-	if home == nil {
-		log.Printf("Hue bridge not connected")
+// handleGroupColor sets the color of every light of a group
+func handleGroupColor(msg *gosc.Message, ctrl *controller, group lightGroup) {
+	if !ctrl.connected() {
+		oscLog.Warn("Hue bridge not connected", "address", msg.Address)
 		return
 	}
 
 	if len(msg.Arguments) < 2 {
-		log.Printf("Not enough arguments for all lights color (need X and Y coordinates)")
+		oscLog.Warn("Not enough arguments for group color (need X and Y coordinates)", "address", msg.Address, "group", group.Name)
 		return
 	}
 
 	// Create a new message for the set handler with null brightness value
-	setMsg := gosc.NewMessage("/hue/all/set")
+	setMsg := gosc.NewMessage(msg.Address)
 	setMsg.Append(msg.Arguments[0]) // x coordinate from original message
 	setMsg.Append(msg.Arguments[1]) // y coordinate from original message
 	setMsg.Append(int32(-1))        // brightness = null (skip)
@@ -429,27 +377,77 @@ func handleAllColor(msg *gosc.Message, home *openhue.Home, lights []openhue.Ligh
 	}
 
 	// Delegate to the set handler
-	handleAllSet(setMsg, home, lights)
+	handleGroupSet(setMsg, ctrl, group)
 }
 
-func handleAllSet(msg *gosc.Message, home *openhue.Home, lights []openhue.LightGet) {
-	if home == nil {
-		log.Printf("Hue bridge not connected")
+// handleGroupSet applies the unified set command to every light of a group
+func handleGroupSet(msg *gosc.Message, ctrl *controller, group lightGroup) {
+	if !ctrl.connected() {
+		oscLog.Warn("Hue bridge not connected", "address", msg.Address)
 		return
 	}
 
 	// Allow flexible number of arguments, but require at least 1
 	if len(msg.Arguments) < 1 {
-		log.Printf("Set command requires at least 1 argument. Use -1 for null values.")
-		log.Printf("Usage: /hue/all/set {x|-1} [y|-1] [brightness|-1] [duration_ms|-1]")
+		oscLog.Warn("Set command requires at least 1 argument, use -1 for null values",
+			"address", msg.Address, "usage", "/hue/{all|group/id}/set {x|-1} [y|-1] [brightness|-1] [duration_ms|-1]")
 		return
 	}
 
-	// Apply to all lights simultaneously using goroutines
-	for _, light := range lights {
+	// Apply to all lights simultaneously using goroutines, and return once
+	// every light was updated so shutdown can wait for the message
+	var wg sync.WaitGroup
+	for _, lightID := range group.LightIDs {
+		wg.Add(1)
 		go func(lightID string) {
-			handleLightSet(msg, home, lightID)
-		}(*light.Id)
+			defer wg.Done()
+			handleLightSet(msg, ctrl, lightID)
+		}(lightID)
+	}
+	wg.Wait()
+	oscLog.Debug("Group updated", "group", group.Name)
+}
+
+// handleSceneRecall recalls a bridge scene with an optional transition duration
+func handleSceneRecall(msg *gosc.Message, ctrl *controller, sceneID string) {
+	if !ctrl.connected() {
+		oscLog.Warn("Hue bridge not connected", "address", msg.Address)
+		return
+	}
+
+	transitionMs := -1
+	if len(msg.Arguments) >= 1 {
+		switch v := msg.Arguments[0].(type) {
+		case int32:
+			transitionMs = int(v)
+		case float32:
+			transitionMs = int(v)
+		default:
+			oscLog.Warn("Invalid transition duration type", "address", msg.Address, "type", fmt.Sprintf("%T", v))
+		}
+	}
+
+	if err := ctrl.recallScene(sceneID, transitionMs); err != nil {
+		hueLog.Error("Failed to recall scene", "scene", sceneID, "error", err)
+	} else {
+		oscLog.Debug("Scene recalled", "scene", sceneID)
+	}
+}
+
+// applyCommand applies a JSON light command to a light (UUID, numeric ID or
+// "all") the way the OSC handlers would. MQTT and the HTTP API use it.
+func applyCommand(ctrl *controller, target string, cmd command.Light) error {
+	lightIDs := ctrl.allLights().LightIDs
+	if target != "all" {
+		lightID, ok := ctrl.resolveLight(target)
+		if !ok {
+			return fmt.Errorf("light %s: %w", target, errUnknownLight)
+		}
+		lightIDs = []string{lightID}
+	}
+	put, err := cmd.LightPut()
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidCommand, err)
 	}
-	log.Printf("All lights updated")
+	return ctrl.updateLights(lightIDs, put)
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"osc2hue/internal/api"
+	"osc2hue/internal/hue"
+)
+
+// pollStaleAfter is how long after the last light poll a bridge counts as no longer updating
+const pollStaleAfter = 3 * lightPollInterval
+
+// Health reports whether the OSC listener is bound and each bridge is
+// reachable, authenticated, has lights and is polled for changes
+func (b *apiBackend) Health() api.Health {
+	cfg, ctrl := b.svc.current()
+	health := api.Health{Bridges: make([]api.BridgeHealth, 0, len(ctrl.bridges))}
+
+	if addr := b.svc.oscServer.Addr(); addr != nil {
+		health.OSCListener = api.Check{OK: true, Detail: addr.String()}
+	} else {
+		health.OSCListener = api.Check{Detail: fmt.Sprintf("not listening on %s:%d", cfg.OSC.Host, cfg.OSC.Port)}
+	}
+
+	b.svc.mu.Lock()
+	connErrors := make(map[string]error, len(b.svc.connErrors))
+	for name, err := range b.svc.connErrors {
+		connErrors[name] = err
+	}
+	b.svc.mu.Unlock()
+
+	for _, br := range ctrl.bridges {
+		health.Bridges = append(health.Bridges, bridgeHealth(br, connErrors[br.name], time.Now()))
+	}
+	return health
+}
+
+// bridgeHealth runs the health checks of a bridge, given the error of the last attempt to connect to it
+func bridgeHealth(b *bridge, connErr error, now time.Time) api.BridgeHealth {
+	h := api.BridgeHealth{Name: b.name}
+	up := b.up.Load()
+
+	var statusErr *hue.StatusError
+	rejected := errors.As(connErr, &statusErr) &&
+		(statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden)
+	switch {
+	case b.home == nil:
+		h.Authenticated.Detail = fmt.Sprintf("not paired, send /hue/pair %s", b.name)
+	case rejected:
+		h.Authenticated.Detail = fmt.Sprintf("API key rejected: %v", connErr)
+	default:
+		h.Authenticated.OK = true
+	}
+
+	switch {
+	case up:
+		h.Reachable = api.Check{OK: true, Detail: b.ip}
+	case connErr != nil && !rejected:
+		h.Reachable.Detail = connErr.Error()
+	default:
+		h.Reachable.Detail = "not connected"
+	}
+
+	if len(b.lights) > 0 {
+		h.LightsDiscovered = api.Check{OK: true, Detail: fmt.Sprintf("%d lights", len(b.lights))}
+	} else {
+		h.LightsDiscovered.Detail = "no lights found"
+	}
+
+	polled := time.Unix(0, b.polled.Load())
+	switch {
+	case !up:
+		h.Polling.Detail = "not connected"
+	case now.Sub(polled) > pollStaleAfter:
+		h.Polling.Detail = fmt.Sprintf("lights last fetched %v ago", now.Sub(polled).Round(time.Second))
+	default:
+		h.Polling = api.Check{OK: true, Detail: fmt.Sprintf("lights fetched %v ago", now.Sub(polled).Round(time.Second))}
+	}
+	return h
+}
@@ -0,0 +1,335 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"osc2hue/internal/command"
+	"osc2hue/internal/state"
+
+	"github.com/gorilla/websocket"
+)
+
+type fakeBackend struct {
+	mu     sync.Mutex
+	health Health
+	lights map[string]command.Light
+	groups map[string]command.Light
+	scenes map[string]int
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		lights: make(map[string]command.Light),
+		groups: make(map[string]command.Light),
+		scenes: make(map[string]int),
+	}
+}
+
+func (b *fakeBackend) Status() Status {
+	return Status{BridgeIP: "192.168.1.2", BridgeConnected: true, Lights: 1}
+}
+
+func (b *fakeBackend) Health() Health {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.health
+}
+
+func (b *fakeBackend) Lights() []Light {
+	return []Light{{ID: "light-1", Number: 1, Name: "Desk"}}
+}
+
+func (b *fakeBackend) SetLight(id string, cmd command.Light) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if id != "1" && id != "light-1" {
+		return ErrNotFound
+	}
+	if _, err := cmd.LightPut(); err != nil {
+		return err
+	}
+	b.lights[id] = cmd
+	return nil
+}
+
+func (b *fakeBackend) SetGroup(id string, cmd command.Light) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.groups[id] = cmd
+	return nil
+}
+
+func (b *fakeBackend) RecallScene(id string, durationMs int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch id {
+	case "blackout":
+		return fmt.Errorf("%w: blackout is on", ErrConflict)
+	case "failing":
+		return fmt.Errorf("%w: bridge returned 500 Internal Server Error", ErrBridge)
+	case "offline":
+		return ErrUnavailable
+	}
+	b.scenes[id] = durationMs
+	return nil
+}
+
+func TestRESTEndpoints(t *testing.T) {
+	backend := newFakeBackend()
+	server := NewServer("127.0.0.1:0", backend, state.NewStore())
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"Status", http.MethodGet, "/status", "", http.StatusOK},
+		{"List lights", http.MethodGet, "/lights", "", http.StatusOK},
+		{"Set light", http.MethodPut, "/lights/1", `{"brightness": 0.5}`, http.StatusNoContent},
+		{"Unknown light", http.MethodPut, "/lights/9", `{"brightness": 0.5}`, http.StatusNotFound},
+		{"Invalid command", http.MethodPut, "/lights/1", `{"x": 0.5}`, http.StatusBadRequest},
+		{"Invalid JSON", http.MethodPut, "/lights/1", `{`, http.StatusBadRequest},
+		{"Set group", http.MethodPut, "/groups/2", `{"on": false}`, http.StatusNoContent},
+		{"Recall scene", http.MethodPost, "/scenes/abc/recall", `{"duration_ms": 500}`, http.StatusNoContent},
+		{"Recall scene without body", http.MethodPost, "/scenes/def/recall", "", http.StatusNoContent},
+		{"Recall scene during blackout", http.MethodPost, "/scenes/blackout/recall", "", http.StatusConflict},
+		{"Recall scene failing on the bridge", http.MethodPost, "/scenes/failing/recall", "", http.StatusBadGateway},
+		{"Recall scene of a disconnected bridge", http.MethodPost, "/scenes/offline/recall", "", http.StatusServiceUnavailable},
+		{"Wrong method", http.MethodPost, "/lights", "", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("Failed to create request: %v", err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+
+	if cmd, ok := backend.lights["1"]; !ok || *cmd.Brightness != 0.5 {
+		t.Errorf("Expected light 1 brightness command, got %+v", backend.lights)
+	}
+	if cmd, ok := backend.groups["2"]; !ok || *cmd.On {
+		t.Errorf("Expected group 2 off command, got %+v", backend.groups)
+	}
+	if backend.scenes["abc"] != 500 || backend.scenes["def"] != -1 {
+		t.Errorf("Unexpected scene recalls: %v", backend.scenes)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	backend := newFakeBackend()
+	store := state.NewStore()
+	store.Set("light-1", state.LightState{On: true, Brightness: 1})
+
+	server := NewServer("127.0.0.1:0", backend, store)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect WebSocket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Current state is sent on connect
+	var event wsEvent
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	if event.Type != "state" || event.ID != "light-1" || !event.State.On {
+		t.Errorf("Unexpected snapshot event: %+v", event)
+	}
+
+	// State changes are streamed
+	store.Set("light-1", state.LightState{On: false})
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("Failed to read change: %v", err)
+	}
+	if event.Type != "state" || event.State.On {
+		t.Errorf("Unexpected change event: %+v", event)
+	}
+
+	// Commands use the same JSON as the REST API, errors are reported back
+	if err := conn.WriteJSON(map[string]interface{}{"type": "light", "id": "9", "command": map[string]bool{"on": true}}); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("Failed to read error: %v", err)
+	}
+	if event.Type != "error" || event.ID != "9" {
+		t.Errorf("Expected error event for unknown light, got %+v", event)
+	}
+
+	if err := conn.WriteJSON(map[string]interface{}{"type": "scene", "id": "abc"}); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		backend.mu.Lock()
+		_, ok := backend.scenes["abc"]
+		backend.mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected scene to be recalled over WebSocket")
+}
+
+func TestStopClosesWebSockets(t *testing.T) {
+	store := state.NewStore()
+	store.Set("light-1", state.LightState{On: true})
+	server := NewServer("127.0.0.1:0", newFakeBackend(), store)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect WebSocket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// The snapshot shows the client is registered
+	var event wsEvent
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+
+	server.Stop()
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected the connection to be closed as going away, got %v", err)
+	}
+
+	// Clients connecting after Stop are closed right away
+	late, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect WebSocket: %v", err)
+	}
+	defer late.Close()
+	late.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := late.ReadMessage(); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected a connection after Stop to be closed, got %v", err)
+	}
+}
+
+func TestLightsJSON(t *testing.T) {
+	server := NewServer("127.0.0.1:0", newFakeBackend(), state.NewStore())
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/lights", nil))
+
+	var lights []Light
+	if err := json.NewDecoder(rec.Body).Decode(&lights); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if len(lights) != 1 || lights[0].Name != "Desk" {
+		t.Errorf("Unexpected lights: %+v", lights)
+	}
+}
+
+func TestPublishMessage(t *testing.T) {
+	server := NewServer("127.0.0.1:0", newFakeBackend(), state.NewStore())
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Failed to connect WebSocket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// The client is registered asynchronously, publish until it shows up
+	go func() {
+		for i := 0; i < 50; i++ {
+			server.PublishMessage("/hue/1/on", []interface{}{int32(1)})
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	var event wsEvent
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("Failed to read message event: %v", err)
+	}
+	if event.Type != "message" || event.Address != "/hue/1/on" || len(event.Arguments) != 1 {
+		t.Errorf("Unexpected message event: %+v", event)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	backend := newFakeBackend()
+	server := NewServer("127.0.0.1:0", backend, state.NewStore())
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	get := func(path string) (int, Health) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var health Health
+		if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+			t.Fatalf("Failed to decode health: %v", err)
+		}
+		return resp.StatusCode, health
+	}
+
+	// Listening for OSC, but the bridge has no lights yet
+	ok := Check{OK: true}
+	backend.health = Health{
+		OSCListener: ok,
+		Bridges: []BridgeHealth{{
+			Name: "main", Reachable: ok, Authenticated: ok, Polling: ok,
+			LightsDiscovered: Check{Detail: "no lights found"},
+		}},
+	}
+	if status, health := get("/healthz"); status != http.StatusOK || health.Status != "ok" {
+		t.Errorf("Expected to be live, got %d %+v", status, health)
+	}
+	status, health := get("/readyz")
+	if status != http.StatusServiceUnavailable || health.Status != "unavailable" || health.Bridges[0].LightsDiscovered.Detail != "no lights found" {
+		t.Errorf("Expected not to be ready with details, got %d %+v", status, health)
+	}
+
+	backend.mu.Lock()
+	backend.health.Bridges[0].LightsDiscovered = ok
+	backend.mu.Unlock()
+	if status, _ := get("/readyz"); status != http.StatusOK {
+		t.Errorf("Expected to be ready, got %d", status)
+	}
+
+	backend.mu.Lock()
+	backend.health.OSCListener = Check{Detail: "not listening"}
+	backend.mu.Unlock()
+	if status, _ := get("/healthz"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected not to be live without the OSC listener, got %d", status)
+	}
+}
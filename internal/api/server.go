@@ -0,0 +1,415 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"osc2hue/internal/command"
+	"osc2hue/internal/logging"
+	"osc2hue/internal/state"
+
+	"github.com/gorilla/websocket"
+)
+
+// logger is the log of the http subsystem
+var logger = logging.For("http")
+
+// Errors a Backend wraps to choose the status of the response, other errors
+// are the client's fault
+var (
+	ErrNotFound    = errors.New("not found")             // unknown light, group or scene: 404
+	ErrConflict    = errors.New("refused")               // refused in the current state, such as during a blackout: 409
+	ErrBridge      = errors.New("bridge request failed") // the bridge rejected or did not answer the request: 502
+	ErrUnavailable = errors.New("bridge not connected")  // the bridge of the light or scene is not connected: 503
+)
+
+// Light describes a light and its current state
+type Light struct {
+	ID     string           `json:"id"`
+	Number int              `json:"number"`
+	Bridge string           `json:"bridge"`
+	Name   string           `json:"name"`
+	State  state.LightState `json:"state"`
+}
+
+// BridgeStatus describes the connection to one bridge
+type BridgeStatus struct {
+	Name      string `json:"name"`
+	IP        string `json:"ip"`
+	ID        string `json:"id,omitempty"`
+	Connected bool   `json:"connected"`
+	Lights    int    `json:"lights"`
+}
+
+// Status describes the state of the bridge connections
+type Status struct {
+	BridgeIP        string         `json:"bridge_ip"`        // IP of the first bridge
+	BridgeConnected bool           `json:"bridge_connected"` // Whether any bridge is connected
+	Lights          int            `json:"lights"`
+	Bridges         []BridgeStatus `json:"bridges"`
+	OSCAddress      string         `json:"osc_address"`
+}
+
+// Check is the outcome of one health check, with the reason if it failed
+type Check struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// BridgeHealth holds the health checks of one bridge
+type BridgeHealth struct {
+	Name             string `json:"name"`
+	Reachable        Check  `json:"reachable"`
+	Authenticated    Check  `json:"authenticated"`
+	LightsDiscovered Check  `json:"lights_discovered"`
+	Polling          Check  `json:"polling"` // light updates from the bridge are current
+}
+
+// Ready reports whether every check of the bridge passed
+func (b BridgeHealth) Ready() bool {
+	return b.Reachable.OK && b.Authenticated.OK && b.LightsDiscovered.OK && b.Polling.OK
+}
+
+// Health describes whether osc2hue is working
+type Health struct {
+	Status      string         `json:"status"` // "ok" or "unavailable", set by the server
+	OSCListener Check          `json:"osc_listener"`
+	Bridges     []BridgeHealth `json:"bridges"`
+}
+
+// Live reports whether osc2hue accepts OSC messages
+func (h Health) Live() bool {
+	return h.OSCListener.OK
+}
+
+// Ready reports whether osc2hue accepts OSC messages and every bridge is ready to apply them
+func (h Health) Ready() bool {
+	if !h.Live() || len(h.Bridges) == 0 {
+		return false
+	}
+	for _, b := range h.Bridges {
+		if !b.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
+// Backend performs the actions requested through the API
+type Backend interface {
+	Status() Status
+	Health() Health
+	Lights() []Light
+	SetLight(id string, cmd command.Light) error
+	SetGroup(id string, cmd command.Light) error
+	RecallScene(id string, durationMs int) error
+}
+
+// Server exposes the REST and WebSocket control API over HTTP
+type Server struct {
+	backend   Backend
+	store     *state.Store
+	mux       *http.ServeMux
+	http      *http.Server
+	upgrader  websocket.Upgrader
+	clientsMu sync.Mutex
+	clients   map[*wsConn]struct{}
+	stopped   bool // no new WebSocket clients once stopped
+}
+
+// NewServer creates an API server listening on addr
+func NewServer(addr string, backend Backend, store *state.Store) *Server {
+	s := &Server{
+		backend: backend,
+		store:   store,
+		mux:     http.NewServeMux(),
+		clients: make(map[*wsConn]struct{}),
+	}
+	s.http = &http.Server{Addr: addr, Handler: s.mux}
+
+	s.mux.HandleFunc("GET /status", s.handleGetStatus)
+	s.mux.HandleFunc("GET /healthz", s.handleHealth(Health.Live))
+	s.mux.HandleFunc("GET /readyz", s.handleHealth(Health.Ready))
+	s.mux.HandleFunc("GET /lights", s.handleGetLights)
+	s.mux.HandleFunc("PUT /lights/{id}", s.handlePutLight)
+	s.mux.HandleFunc("PUT /groups/{id}", s.handlePutGroup)
+	s.mux.HandleFunc("POST /scenes/{id}/recall", s.handleRecallScene)
+	s.mux.HandleFunc("GET /ws", s.handleWebSocket)
+
+	return s
+}
+
+// Handle registers an additional handler on the server
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Handler returns the HTTP handler serving the API
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// Start serves HTTP requests in the background
+func (s *Server) Start() {
+	logger.Info("Starting HTTP API", "address", s.http.Addr)
+	go func() {
+		if err := s.http.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP API stopped", "error", err)
+		}
+	}()
+}
+
+// Stop closes the server and all WebSocket connections. The HTTP server does
+// not track upgraded connections, so they are closed here, telling clients
+// the server is going away.
+func (s *Server) Stop() {
+	logger.Info("Stopping HTTP API")
+	if err := s.http.Close(); err != nil {
+		logger.Error("Failed to close HTTP API", "error", err)
+	}
+
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.stopped = true
+	goingAway := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server stopping")
+	for client := range s.clients {
+		client.conn.WriteControl(websocket.CloseMessage, goingAway, time.Now().Add(wsCloseTimeout))
+		client.conn.Close()
+	}
+}
+
+func (s *Server) handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.backend.Status())
+}
+
+// handleHealth replies with the health checks, with 200 if passed reports
+// them as passing and 503 otherwise
+func (s *Server) handleHealth(passed func(Health) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		health := s.backend.Health()
+		status := http.StatusOK
+		health.Status = "ok"
+		if !passed(health) {
+			status = http.StatusServiceUnavailable
+			health.Status = "unavailable"
+		}
+		writeJSON(w, status, health)
+	}
+}
+
+func (s *Server) handleGetLights(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.backend.Lights())
+}
+
+func (s *Server) handlePutLight(w http.ResponseWriter, r *http.Request) {
+	var cmd command.Light
+	if !readJSON(w, r, &cmd) {
+		return
+	}
+	writeResult(w, s.backend.SetLight(r.PathValue("id"), cmd))
+}
+
+func (s *Server) handlePutGroup(w http.ResponseWriter, r *http.Request) {
+	var cmd command.Light
+	if !readJSON(w, r, &cmd) {
+		return
+	}
+	writeResult(w, s.backend.SetGroup(r.PathValue("id"), cmd))
+}
+
+// sceneRecall is the optional body of a scene recall request
+type sceneRecall struct {
+	DurationMs *int `json:"duration_ms,omitempty"`
+}
+
+func (s *Server) handleRecallScene(w http.ResponseWriter, r *http.Request) {
+	var body sceneRecall
+	if r.ContentLength != 0 && !readJSON(w, r, &body) {
+		return
+	}
+
+	durationMs := -1
+	if body.DurationMs != nil {
+		durationMs = *body.DurationMs
+	}
+	writeResult(w, s.backend.RecallScene(r.PathValue("id"), durationMs))
+}
+
+// wsRequest is a command received over the WebSocket
+type wsRequest struct {
+	Type       string        `json:"type"` // light, group or scene
+	ID         string        `json:"id"`
+	Command    command.Light `json:"command"`
+	DurationMs *int          `json:"duration_ms,omitempty"` // scene transition
+}
+
+// wsEvent is a message sent over the WebSocket
+type wsEvent struct {
+	Type      string            `json:"type"` // state, message or error
+	ID        string            `json:"id,omitempty"`
+	State     *state.LightState `json:"state,omitempty"`
+	Address   string            `json:"address,omitempty"`
+	Arguments []interface{}     `json:"arguments,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// wsBuffer is the number of events a WebSocket client may lag behind before missing some
+const wsBuffer = 256
+
+// wsCloseTimeout is how long Stop waits to tell a WebSocket client it is closing
+const wsCloseTimeout = 100 * time.Millisecond
+
+// wsConn queues events for a WebSocket connection so slow clients never block the sender
+type wsConn struct {
+	conn *websocket.Conn
+	out  chan wsEvent
+}
+
+// send queues an event, dropping it if the client is too slow
+func (c *wsConn) send(event wsEvent) {
+	select {
+	case c.out <- event:
+	default:
+	}
+}
+
+// writeLoop writes queued events until the queue is closed or the connection fails
+func (c *wsConn) writeLoop() {
+	for event := range c.out {
+		if err := c.conn.WriteJSON(event); err != nil {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// PublishMessage sends an OSC message to every WebSocket client for the live message log
+func (s *Server) PublishMessage(address string, arguments []interface{}) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+
+	for client := range s.clients {
+		client.send(wsEvent{Type: "message", Address: address, Arguments: arguments})
+	}
+}
+
+// handleWebSocket streams state changes and OSC messages, and accepts commands as JSON
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Warn("WebSocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	// Register the client for Stop to close, unless the server already stopped
+	ws := &wsConn{conn: conn, out: make(chan wsEvent, wsBuffer)}
+	s.clientsMu.Lock()
+	if s.stopped {
+		s.clientsMu.Unlock()
+		return
+	}
+	s.clients[ws] = struct{}{}
+	s.clientsMu.Unlock()
+	go ws.writeLoop()
+
+	// Subscribe before sending the snapshot so no change is lost in between
+	changes, unsubscribe := s.store.Subscribe()
+
+	changesDone := make(chan struct{})
+	defer func() {
+		unsubscribe()
+		<-changesDone
+		s.clientsMu.Lock()
+		delete(s.clients, ws)
+		close(ws.out)
+		s.clientsMu.Unlock()
+	}()
+
+	for id, st := range s.store.All() {
+		ws.send(wsEvent{Type: "state", ID: id, State: &st})
+	}
+
+	go func() {
+		defer close(changesDone)
+		for change := range changes {
+			st := change.State
+			ws.send(wsEvent{Type: "state", ID: change.LightID, State: &st})
+		}
+	}()
+
+	for {
+		var req wsRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+
+		if err := s.handleRequest(req); err != nil {
+			ws.send(wsEvent{Type: "error", ID: req.ID, Error: err.Error()})
+		}
+	}
+}
+
+// handleRequest performs a WebSocket command
+func (s *Server) handleRequest(req wsRequest) error {
+	switch req.Type {
+	case "light":
+		return s.backend.SetLight(req.ID, req.Command)
+	case "group":
+		return s.backend.SetGroup(req.ID, req.Command)
+	case "scene":
+		durationMs := -1
+		if req.DurationMs != nil {
+			durationMs = *req.DurationMs
+		}
+		return s.backend.RecallScene(req.ID, durationMs)
+	default:
+		return fmt.Errorf("unknown request type %q", req.Type)
+	}
+}
+
+// readJSON decodes a request body, replying with 400 on failure
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %v", err))
+		return false
+	}
+	return true
+}
+
+// writeResult replies with 204 on success, the status of the Backend error it
+// wraps, or 400 otherwise
+func writeResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrConflict):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, ErrBridge):
+		writeError(w, http.StatusBadGateway, err)
+	case errors.Is(err, ErrUnavailable):
+		writeError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeError(w, http.StatusBadRequest, err)
+	}
+}
+
+// writeError replies with a JSON error body
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeJSON replies with a JSON body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("Failed to write HTTP response", "error", err)
+	}
+}
@@ -0,0 +1,96 @@
+package color
+
+import "math"
+
+// D65 white point in CIE XY, used when a light has no known color
+const (
+	WhiteX = 0.3127
+	WhiteY = 0.3290
+)
+
+// XYToRGB converts CIE XY coordinates to normalized sRGB (0.0-1.0).
+// The result is scaled so the brightest component is 1.0, brightness is applied separately.
+func XYToRGB(x, y float64) (r, g, b float64) {
+	if y <= 0 {
+		return 1, 1, 1
+	}
+
+	// Convert to XYZ with full luminance
+	z := 1.0 - x - y
+	Y := 1.0
+	X := (Y / y) * x
+	Z := (Y / y) * z
+
+	// Wide gamut conversion matrix from the Philips Hue documentation
+	r = X*1.656492 - Y*0.354851 - Z*0.255038
+	g = -X*0.707196 + Y*1.655397 + Z*0.036152
+	b = X*0.051713 - Y*0.121364 + Z*1.011530
+
+	r, g, b = gammaCorrect(math.Max(r, 0)), gammaCorrect(math.Max(g, 0)), gammaCorrect(math.Max(b, 0))
+
+	// Normalize so the brightest channel is fully on
+	maxValue := math.Max(r, math.Max(g, b))
+	if maxValue <= 0 {
+		return 0, 0, 0
+	}
+	return r / maxValue, g / maxValue, b / maxValue
+}
+
+// RGBToXY converts normalized sRGB (0.0-1.0) to CIE XY coordinates, black maps to D65 white
+func RGBToXY(r, g, b float64) (x, y float64) {
+	r, g, b = inverseGamma(r), inverseGamma(g), inverseGamma(b)
+
+	// Wide gamut conversion matrix from the Philips Hue documentation
+	X := r*0.664511 + g*0.154324 + b*0.162028
+	Y := r*0.283881 + g*0.668433 + b*0.047685
+	Z := r*0.000088 + g*0.072310 + b*0.986039
+
+	sum := X + Y + Z
+	if sum <= 0 {
+		return WhiteX, WhiteY
+	}
+	return X / sum, Y / sum
+}
+
+// KelvinToXY returns the CIE XY point on the Planckian locus for a color temperature (Kim et al. approximation)
+func KelvinToXY(kelvin float64) (x, y float64) {
+	t := math.Max(1667, math.Min(25000, kelvin))
+
+	if t <= 4000 {
+		x = -0.2661239e9/(t*t*t) - 0.2343589e6/(t*t) + 0.8776956e3/t + 0.179910
+	} else {
+		x = -3.0258469e9/(t*t*t) + 2.1070379e6/(t*t) + 0.2226347e3/t + 0.240390
+	}
+
+	switch {
+	case t <= 2222:
+		y = -1.1063814*x*x*x - 1.34811020*x*x + 2.18555832*x - 0.20219683
+	case t <= 4000:
+		y = -0.9549476*x*x*x - 1.37418593*x*x + 2.09137015*x - 0.16748867
+	default:
+		y = 3.0817580*x*x*x - 5.87338670*x*x + 3.75112997*x - 0.37001483
+	}
+	return x, y
+}
+
+// XYToKelvin approximates the correlated color temperature of a CIE XY point (McCamy's formula)
+func XYToKelvin(x, y float64) float64 {
+	n := (x - 0.3320) / (0.1858 - y)
+	return 449*n*n*n + 3525*n*n + 6823.3*n + 5520.33
+}
+
+// gammaCorrect applies the sRGB companding curve to a linear value
+func gammaCorrect(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1.0/2.4) - 0.055
+}
+
+// inverseGamma removes the sRGB companding curve from a value
+func inverseGamma(v float64) float64 {
+	if v > 0.04045 {
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+	return v / 12.92
+}
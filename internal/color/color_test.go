@@ -0,0 +1,85 @@
+package color
+
+import (
+	"math"
+	"testing"
+)
+
+func TestXYToRGB(t *testing.T) {
+	tests := []struct {
+		name    string
+		x, y    float64
+		r, g, b float64
+	}{
+		{
+			name: "Red",
+			x:    0.7006, y: 0.2993,
+			r: 1, g: 0, b: 0,
+		},
+		{
+			name: "Green",
+			x:    0.1724, y: 0.7468,
+			r: 0, g: 1, b: 0,
+		},
+		{
+			name: "Blue",
+			x:    0.1355, y: 0.0399,
+			r: 0, g: 0, b: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, g, b := XYToRGB(tt.x, tt.y)
+			if math.Abs(r-tt.r) > 0.15 || math.Abs(g-tt.g) > 0.15 || math.Abs(b-tt.b) > 0.15 {
+				t.Errorf("XYToRGB(%.4f, %.4f) = (%.2f, %.2f, %.2f), expected about (%.2f, %.2f, %.2f)",
+					tt.x, tt.y, r, g, b, tt.r, tt.g, tt.b)
+			}
+		})
+	}
+}
+
+func TestXYToRGBWhite(t *testing.T) {
+	r, g, b := XYToRGB(WhiteX, WhiteY)
+	if r < 0.9 || g < 0.9 || b < 0.9 {
+		t.Errorf("Expected D65 white to be close to (1, 1, 1), got (%.2f, %.2f, %.2f)", r, g, b)
+	}
+}
+
+func TestXYToKelvin(t *testing.T) {
+	k := XYToKelvin(WhiteX, WhiteY)
+	if math.Abs(k-6500) > 100 {
+		t.Errorf("Expected D65 white to be about 6500K, got %.0fK", k)
+	}
+}
+
+func TestRGBToXYRoundTrip(t *testing.T) {
+	colors := [][3]float64{
+		{1, 0, 0},
+		{0, 1, 0},
+		{0, 0, 1},
+		{1, 0.5, 0},
+	}
+
+	for _, c := range colors {
+		x, y := RGBToXY(c[0], c[1], c[2])
+		r, g, b := XYToRGB(x, y)
+		if math.Abs(r-c[0]) > 0.1 || math.Abs(g-c[1]) > 0.1 || math.Abs(b-c[2]) > 0.1 {
+			t.Errorf("Round trip of %v gave (%.2f, %.2f, %.2f)", c, r, g, b)
+		}
+	}
+
+	// Black has no chromaticity and falls back to white
+	if x, y := RGBToXY(0, 0, 0); x != WhiteX || y != WhiteY {
+		t.Errorf("Expected black to map to white point, got x:%.4f y:%.4f", x, y)
+	}
+}
+
+func TestKelvinToXY(t *testing.T) {
+	for _, k := range []float64{2000, 2700, 4000, 5000, 6500} {
+		x, y := KelvinToXY(k)
+		if back := XYToKelvin(x, y); math.Abs(back-k) > k*0.03 {
+			t.Errorf("KelvinToXY(%.0f) = (%.4f, %.4f) which maps back to %.0fK", k, x, y, back)
+		}
+	}
+}
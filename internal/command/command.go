@@ -0,0 +1,58 @@
+package command
+
+import (
+	"fmt"
+
+	"github.com/openhue/openhue-go"
+)
+
+// Light is a JSON light command mirroring the arguments of /hue/{id}/set, omitted fields are left unchanged
+type Light struct {
+	On         *bool    `json:"on,omitempty"`
+	X          *float64 `json:"x,omitempty"`
+	Y          *float64 `json:"y,omitempty"`
+	Brightness *float64 `json:"brightness,omitempty"` // 0.0-1.0
+	DurationMs *int     `json:"duration_ms,omitempty"`
+}
+
+// LightPut converts the command into a single light update. The OSC
+// handlers, MQTT and the HTTP API all convert commands with it: coordinates
+// and brightness are clamped to 0-1, and a brightness turns the light on, or
+// off at 0 and below
+func (c Light) LightPut() (openhue.LightPut, error) {
+	var put openhue.LightPut
+	if (c.X == nil) != (c.Y == nil) {
+		return put, fmt.Errorf("color requires both x and y")
+	}
+	if c.On == nil && c.X == nil && c.Brightness == nil {
+		return put, fmt.Errorf("command has no on, color or brightness")
+	}
+
+	if c.DurationMs != nil && *c.DurationMs >= 0 {
+		duration := *c.DurationMs
+		put.Dynamics = &openhue.LightDynamics{Duration: &duration}
+	}
+	if c.On != nil {
+		on := *c.On
+		put.On = &openhue.On{On: &on}
+		if !on {
+			return put, nil
+		}
+	}
+	if c.X != nil {
+		x, y := float32(clamp(*c.X)), float32(clamp(*c.Y))
+		put.Color = &openhue.Color{Xy: &openhue.GamutPosition{X: &x, Y: &y}}
+	}
+	if c.Brightness != nil {
+		brightness := clamp(*c.Brightness)
+		percent, on := float32(brightness*100), brightness > 0
+		put.On = &openhue.On{On: &on}
+		put.Dimming = &openhue.Dimming{Brightness: &percent}
+	}
+	return put, nil
+}
+
+// clamp limits v to 0-1
+func clamp(v float64) float64 {
+	return min(max(v, 0), 1)
+}
@@ -0,0 +1,59 @@
+package command
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestLightPut(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    string
+		on         *bool
+		brightness float32 // -1 if not set
+		color      bool
+		wantErr    bool
+	}{
+		{name: "Turn on", payload: `{"on": true}`, on: ptr(true), brightness: -1},
+		{name: "Turn off ignores color", payload: `{"on": false, "x": 0.4, "y": 0.5}`, on: ptr(false), brightness: -1},
+		{name: "Brightness turns on", payload: `{"brightness": 0.3, "x": 0.4, "y": 0.5}`, on: ptr(true), brightness: 30, color: true},
+		{name: "Zero brightness turns off", payload: `{"on": true, "brightness": 0}`, on: ptr(false), brightness: 0},
+		{name: "Brightness is clamped", payload: `{"brightness": 1.5}`, on: ptr(true), brightness: 100},
+		{name: "Negative brightness turns off", payload: `{"brightness": -0.2}`, on: ptr(false), brightness: 0},
+		{name: "Missing y", payload: `{"x": 0.4}`, wantErr: true},
+		{name: "Empty command", payload: `{"duration_ms": 100}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cmd Light
+			if err := json.Unmarshal([]byte(tt.payload), &cmd); err != nil {
+				t.Fatalf("Failed to decode payload: %v", err)
+			}
+
+			put, err := cmd.LightPut()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LightPut() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (put.On == nil) != (tt.on == nil) || (put.On != nil && *put.On.On != *tt.on) {
+				t.Errorf("Expected on %v, got %+v", tt.on, put.On)
+			}
+			switch {
+			case put.Dimming == nil && tt.brightness != -1:
+				t.Errorf("Expected brightness %v, got none", tt.brightness)
+			case put.Dimming != nil && *put.Dimming.Brightness != tt.brightness:
+				t.Errorf("Expected brightness %v, got %v", tt.brightness, *put.Dimming.Brightness)
+			}
+			if (put.Color != nil) != tt.color {
+				t.Errorf("Expected color %v, got %+v", tt.color, put.Color)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
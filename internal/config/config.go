@@ -1,55 +1,391 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
 )
 
 // Config holds the application configuration
 type Config struct {
-	OSC OSCConfig `json:"osc"`
-	Hue HueConfig `json:"hue"`
+	Version   int              `json:"version"` // Config format version, see CurrentVersion
+	OSC       OSCConfig        `json:"osc"`
+	Hue       []HueConfig      `json:"hue"`              // One entry per bridge
+	Groups    []GroupConfig    `json:"groups,omitempty"` // Groups of lights, may span bridges
+	DMXOutput *DMXOutputConfig `json:"dmx_output,omitempty"`
+	DMXInput  *DMXInputConfig  `json:"dmx_input,omitempty"`
+	MQTT      *MQTTConfig      `json:"mqtt,omitempty"`
+	HTTP      *HTTPConfig      `json:"http,omitempty"`
+	Safety    *SafetyConfig    `json:"safety,omitempty"`
+	Policies  []PolicyConfig   `json:"policies,omitempty"` // Limits for some lights, the strictest applies
+	Panic     *PanicConfig     `json:"panic,omitempty"`
 }
 
 // OSCConfig holds OSC server configuration
 type OSCConfig struct {
 	Port int    `json:"port"`
 	Host string `json:"host"`
+
+	// Feedback is the host:port status messages such as /hue/{bridge}/connected are sent to
+	Feedback string `json:"feedback,omitempty"`
 }
 
-// HueConfig holds Philips Hue configuration
+// HueConfig holds the connection to a Philips Hue bridge
 type HueConfig struct {
+	Name     string `json:"name"` // Used in OSC addresses: /hue/{name}/{id}/...
 	BridgeIP string `json:"bridge_ip"`
+	BridgeID string `json:"bridge_id,omitempty"` // Recorded on first connect to find the bridge again if its IP changes
 	APIKey   string `json:"api_key"`
+
+	// CertFingerprint pins the bridge certificate, recorded on first connect
+	CertFingerprint string `json:"cert_fingerprint,omitempty"`
+}
+
+// GroupConfig defines a named group of lights, which may be on different bridges
+type GroupConfig struct {
+	Name   string   `json:"name"`
+	Lights []string `json:"lights"` // Light UUIDs or numeric IDs, "bridge/id" for an ID on one bridge
+}
+
+// SafetyConfig holds the flash limiter that protects people with photosensitive epilepsy
+type SafetyConfig struct {
+	MaxFlashes int     `json:"max_flashes,omitempty"` // Flashes allowed per second per light and room, 1-3, defaults to 2
+	Threshold  float64 `json:"threshold,omitempty"`   // Luminance change counted towards a flash, 0-1, defaults to 0.1
+}
+
+// PolicyConfig limits what some lights may do, e.g. in bedrooms or next to the audience
+type PolicyConfig struct {
+	Lights        []string           `json:"lights,omitempty"`         // Light UUIDs or numeric IDs, "bridge/id" for an ID on one bridge
+	Groups        []string           `json:"groups,omitempty"`         // Group names, room names or room IDs
+	MinBrightness float64            `json:"min_brightness,omitempty"` // 0-1, while the light is on
+	MaxBrightness float64            `json:"max_brightness,omitempty"` // 0-1, 0 for no cap
+	MinKelvin     int                `json:"min_kelvin,omitempty"`     // Allowed color temperatures, other colors become a white in the range
+	MaxKelvin     int                `json:"max_kelvin,omitempty"`
+	KeepOn        bool               `json:"keep_on,omitempty"` // The lights may not be turned off, e.g. safety lights
+	QuietHours    []QuietHoursConfig `json:"quiet_hours,omitempty"`
+}
+
+// QuietHoursConfig lowers the brightness cap during part of the day
+type QuietHoursConfig struct {
+	Start         string  `json:"start"`          // HH:MM
+	End           string  `json:"end"`            // HH:MM, before start to span midnight
+	MaxBrightness float64 `json:"max_brightness"` // 0-1
+}
+
+// PanicConfig is the safe look /hue/panic sets on every light
+type PanicConfig struct {
+	Brightness float64 `json:"brightness,omitempty"` // 0-1, defaults to 1
+	Kelvin     int     `json:"kelvin,omitempty"`     // Color temperature, defaults to 4000
+}
+
+// DefaultBridgeName names the bridge of a new config, and of configs written
+// before multiple bridges were supported
+const DefaultBridgeName = "main"
+
+// DMXOutputConfig holds Art-Net / sACN output configuration
+type DMXOutputConfig struct {
+	Protocol  string              `json:"protocol"`             // "artnet" or "sacn"
+	Target    string              `json:"target,omitempty"`     // Destination IP, empty for broadcast (Art-Net) or multicast (sACN)
+	RefreshHz int                 `json:"refresh_hz,omitempty"` // Frames per second, defaults to 30
+	Profiles  map[string][]string `json:"profiles,omitempty"`   // Custom fixture profiles: name -> channel functions
+	Fixtures  []DMXFixture        `json:"fixtures"`
+}
+
+// DMXFixture maps an osc2hue light onto DMX channels
+type DMXFixture struct {
+	Light    string `json:"light"`    // Light UUID or numeric ID
+	Universe int    `json:"universe"` // Art-Net port-address or sACN universe
+	Address  int    `json:"address"`  // 1-based start channel
+	Profile  string `json:"profile"`  // Builtin (rgb, rgbw, dimmer, cct) or custom profile name
+}
+
+// DMXInputConfig holds Art-Net / sACN input configuration
+type DMXInputConfig struct {
+	Protocol  string            `json:"protocol"`            // "artnet" or "sacn"
+	Interface string            `json:"interface,omitempty"` // Network interface for sACN multicast, empty for default
+	Fixtures  []DMXInputFixture `json:"fixtures"`
+}
+
+// DMXInputFixture maps DMX channels onto an osc2hue light
+type DMXInputFixture struct {
+	Light       string `json:"light"`       // Light UUID or numeric ID
+	Universe    int    `json:"universe"`    // Art-Net port-address or sACN universe
+	Address     int    `json:"address"`     // 1-based start channel
+	Personality string `json:"personality"` // dimmer, rgb, xy or ct
+}
+
+// MQTTConfig holds MQTT bridge configuration
+type MQTTConfig struct {
+	Broker          string `json:"broker"`              // Broker URL, e.g. "tcp://localhost:1883"
+	ClientID        string `json:"client_id,omitempty"` // Defaults to the topic prefix
+	Username        string `json:"username,omitempty"`
+	Password        string `json:"password,omitempty"`
+	TopicPrefix     string `json:"topic_prefix,omitempty"`     // Defaults to "osc2hue"
+	HomeAssistant   bool   `json:"home_assistant,omitempty"`   // Publish Home Assistant discovery config
+	DiscoveryPrefix string `json:"discovery_prefix,omitempty"` // Defaults to "homeassistant"
+}
+
+// HTTPConfig holds HTTP control API configuration
+type HTTPConfig struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
 }
 
-// LoadConfig loads configuration from a JSON file
+// Default returns the configuration used when no config file exists yet
+func Default() *Config {
+	return &Config{
+		Version: CurrentVersion,
+		OSC: OSCConfig{
+			Host: "0.0.0.0",
+			Port: 8080,
+		},
+		Hue: []HueConfig{{
+			Name:     DefaultBridgeName,
+			BridgeIP: "", // Empty, will be discovered
+			APIKey:   "", // Empty, will be authenticated
+		}},
+	}
+}
+
+// Bridge returns the bridge with the given name, or nil if there is none
+func (c *Config) Bridge(name string) *HueConfig {
+	for i := range c.Hue {
+		if c.Hue[i].Name == name {
+			return &c.Hue[i]
+		}
+	}
+	return nil
+}
+
+// LoadConfig loads and validates configuration from a JSON, YAML or TOML
+// file, chosen by extension, resolving includes and migrating legacy fields
 func LoadConfig(filename string) (*Config, error) {
-	file, err := os.Open(filename)
+	config, _, err := Load(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return config, nil
+}
+
+// Load is LoadConfig without validation that also describes the migrations
+// applied to bring the file up to CurrentVersion, so callers can report them
+// or save the result. Callers validate the config once they applied their own
+// changes to it, such as environment overrides.
+func Load(filename string) (*Config, []string, error) {
+	doc, err := loadDoc(filename, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	config, changes, err := fromDoc(doc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return config, changes, nil
+}
+
+// parse decodes, migrates and validates a config document without includes
+func parse(data []byte, format string) (*Config, []string, error) {
+	doc, err := decodeDoc(data, format)
+	if err != nil {
+		return nil, nil, err
+	}
+	config, changes, err := fromDoc(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return config, changes, nil
+}
+
+// fromDoc migrates a decoded config document and checks it for unknown keys
+func fromDoc(doc map[string]interface{}) (*Config, []string, error) {
+	changes, err := migrate(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if problems := checkUnknownKeys(doc, reflect.TypeOf(Config{}), ""); len(problems) > 0 {
+		return nil, nil, &ValidationError{Problems: problems}
+	}
 
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
 	var config Config
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&config)
+	if err := json.Unmarshal(migrated, &config); err != nil {
+		return nil, nil, describeJSONError(migrated, err)
+	}
+	return &config, changes, nil
+}
+
+// toDoc converts a Config into a generic document
+func toDoc(config *Config) (map[string]interface{}, error) {
+	data, err := json.Marshal(config)
 	if err != nil {
 		return nil, err
 	}
+	var doc map[string]interface{}
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
 
-	return &config, nil
+// describeJSONError turns JSON decoding errors into messages with a line number or field path
+func describeJSONError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line := 1 + bytes.Count(data[:syntaxErr.Offset], []byte("\n"))
+		return fmt.Errorf("line %d: %v", line, syntaxErr)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return fmt.Errorf("config must be a JSON object, got %s", typeErr.Value)
+		}
+		return &ValidationError{Problems: []string{
+			fmt.Sprintf("%s: expected %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value),
+		}}
+	}
+	return err
 }
 
-// SaveConfig saves configuration to a JSON file
+// SaveConfig saves configuration in the current format version, as JSON,
+// YAML or TOML depending on the file extension. The file is replaced
+// atomically and is only readable by the owner since it holds the API key.
+// The comments of an existing YAML file are kept, and an existing TOML file
+// with comments is not replaced, see writeDoc.
 func SaveConfig(config *Config, filename string) error {
-	file, err := os.Create(filename)
+	config.Version = CurrentVersion
+	return writeDoc(filename, config)
+}
+
+// writeDoc saves a Config or generic document to filename in the format of
+// its extension. Saving into an existing YAML file keeps its comments and the
+// style of the values that did not change. The TOML encoder cannot keep
+// comments, so a TOML file with comments is left alone and an error returned.
+func writeDoc(filename string, v interface{}) error {
+	format := formatOf(filename)
+	data, err := encodeDoc(v, format)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(config)
+	existing, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(existing) > 0 {
+		switch format {
+		case formatYAML:
+			if data, err = keepComments(existing, data); err != nil {
+				return err
+			}
+		case formatTOML:
+			if hasTOMLComments(existing) {
+				return fmt.Errorf("%s has comments that saving would remove, make the change by hand or use a YAML or JSON file", filename)
+			}
+		}
+	}
+	return writeFile(filename, data)
+}
+
+// writeFile atomically replaces filename with data, readable only by the owner
+func writeFile(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// Clean up on failure, a no-op once renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// UpdateConfig applies update to the configuration stored in filename and
+// saves it, starting from Default if the file does not exist yet. It reads
+// the file rather than taking a loaded Config so values that came from
+// environment overrides are never written to disk. If filename has includes,
+// only the changed values are saved to it, and a changed list is saved to
+// the included file defining it. A list merged from several files is not
+// saved and an error returned, since saving it would duplicate its entries.
+func UpdateConfig(filename string, update func(*Config)) error {
+	main, err := readDoc(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		config := Default()
+		update(config)
+		return SaveConfig(config, filename)
+	} else if err != nil {
+		return fmt.Errorf("failed to read %s: %v", filename, err)
+	}
+
+	config, _, err := Load(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", filename, err)
+	}
+	if _, ok := main[includeKey]; !ok {
+		update(config)
+		return SaveConfig(config, filename)
+	}
+
+	before, err := toDoc(config)
+	if err != nil {
+		return err
+	}
+	update(config)
+	after, err := toDoc(config)
+	if err != nil {
+		return err
+	}
+
+	if _, err := migrate(main); err != nil {
+		return err
+	}
+	included, err := includedDocs(filename, main)
+	if err != nil {
+		return err
+	}
+	files := append([]fileDoc{{filename: filename, doc: main}}, included...)
+	changed, err := applyChanges(files, before, after)
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", filename, err)
+	}
+	// The main file is saved even without changes to record migrations
+	if len(changed) == 0 || changed[0] != 0 {
+		changed = append([]int{0}, changed...)
+	}
+	for _, i := range changed {
+		if err := writeDoc(files[i].filename, files[i].doc); err != nil {
+			return err
+		}
+	}
+	return nil
 }
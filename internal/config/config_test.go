@@ -1,9 +1,13 @@
 package config
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -25,10 +29,11 @@ func TestSaveAndLoadConfig(t *testing.T) {
 			Host: "127.0.0.1",
 			Port: 9000,
 		},
-		Hue: HueConfig{
+		Hue: []HueConfig{{
+			Name:     "main",
 			BridgeIP: "192.168.1.100",
 			APIKey:   "test-api-key-123",
-		},
+		}},
 	}
 
 	// Save config
@@ -57,11 +62,533 @@ func TestSaveAndLoadConfig(t *testing.T) {
 		t.Errorf("Expected OSC port %d, got %d", originalConfig.OSC.Port, loadedConfig.OSC.Port)
 	}
 
-	if loadedConfig.Hue.BridgeIP != originalConfig.Hue.BridgeIP {
-		t.Errorf("Expected Hue bridge IP %s, got %s", originalConfig.Hue.BridgeIP, loadedConfig.Hue.BridgeIP)
+	if loadedConfig.Hue[0].BridgeIP != originalConfig.Hue[0].BridgeIP {
+		t.Errorf("Expected Hue bridge IP %s, got %s", originalConfig.Hue[0].BridgeIP, loadedConfig.Hue[0].BridgeIP)
+	}
+
+	if loadedConfig.Hue[0].APIKey != originalConfig.Hue[0].APIKey {
+		t.Errorf("Expected Hue API key %s, got %s", originalConfig.Hue[0].APIKey, loadedConfig.Hue[0].APIKey)
+	}
+}
+
+func TestSaveConfigPermissionsAndAtomicity(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nested", "osc2hue")
+	configPath := filepath.Join(dir, "config.json")
+
+	if err := SaveConfig(Default(), configPath); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if err := SaveConfig(Default(), configPath); err != nil {
+		t.Fatalf("Failed to overwrite config: %v", err)
+	}
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		t.Fatalf("Config file was not created: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected permissions 0600, got %o", perm)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the config file in %s, found %d entries", dir, len(entries))
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+
+	// Creates the file from defaults
+	err := UpdateConfig(configPath, func(c *Config) { c.Hue[0].BridgeIP = "192.168.1.100" })
+	if err != nil {
+		t.Fatalf("UpdateConfig failed: %v", err)
+	}
+	err = UpdateConfig(configPath, func(c *Config) { c.Hue[0].APIKey = "new-key" })
+	if err != nil {
+		t.Fatalf("UpdateConfig failed: %v", err)
+	}
+
+	loaded, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if loaded.OSC.Port != 8080 || loaded.Hue[0].BridgeIP != "192.168.1.100" || loaded.Hue[0].APIKey != "new-key" {
+		t.Errorf("Unexpected config after updates: %+v", loaded)
+	}
+
+	// Refuses to overwrite a file it cannot parse
+	os.WriteFile(configPath, []byte("{broken"), 0600)
+	if err := UpdateConfig(configPath, func(c *Config) {}); err == nil {
+		t.Error("Expected error updating an unreadable config")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"OSC2HUE_OSC_PORT":            "9000",
+		"OSC2HUE_HUE_0_API_KEY":       "env-key",
+		"OSC2HUE_HUE_1_NAME":          "annex",
+		"OSC2HUE_HUE_1_BRIDGE_IP":     "192.168.1.101",
+		"OSC2HUE_MQTT_BROKER":         "tcp://localhost:1883",
+		"OSC2HUE_MQTT_HOME_ASSISTANT": "true",
+		"OSC2HUE_DMX_OUTPUT_FIXTURES": `[{"light":"1","universe":0,"address":1,"profile":"rgb"}]`,
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	cfg := Default()
+	if _, err := applyEnv(reflect.ValueOf(cfg).Elem(), EnvPrefix, lookup); err != nil {
+		t.Fatalf("applyEnv failed: %v", err)
+	}
+
+	if cfg.OSC.Port != 9000 || cfg.OSC.Host != "0.0.0.0" {
+		t.Errorf("Expected port override only, got %+v", cfg.OSC)
+	}
+	if cfg.Hue[0].APIKey != "env-key" {
+		t.Errorf("Expected API key from env, got %q", cfg.Hue[0].APIKey)
+	}
+	if len(cfg.Hue) != 2 || cfg.Hue[1].Name != "annex" || cfg.Hue[1].BridgeIP != "192.168.1.101" {
+		t.Errorf("Expected a second bridge from env, got %+v", cfg.Hue)
+	}
+	if cfg.MQTT == nil || cfg.MQTT.Broker != "tcp://localhost:1883" || !cfg.MQTT.HomeAssistant {
+		t.Errorf("Expected MQTT section from env, got %+v", cfg.MQTT)
+	}
+	if cfg.DMXOutput == nil || len(cfg.DMXOutput.Fixtures) != 1 || cfg.DMXOutput.Fixtures[0].Profile != "rgb" {
+		t.Errorf("Expected DMX fixtures from env, got %+v", cfg.DMXOutput)
+	}
+	if cfg.HTTP != nil || cfg.DMXInput != nil {
+		t.Error("Expected sections without variables to stay disabled")
+	}
+
+	env = map[string]string{"OSC2HUE_OSC_PORT": "eighty"}
+	if _, err := applyEnv(reflect.ValueOf(Default()).Elem(), EnvPrefix, lookup); err == nil ||
+		!strings.Contains(err.Error(), "OSC2HUE_OSC_PORT") {
+		t.Errorf("Expected error naming the variable, got %v", err)
+	}
+}
+
+func TestEnvVars(t *testing.T) {
+	names := strings.Join(EnvVars(), " ")
+	for _, want := range []string{"OSC2HUE_OSC_HOST", "OSC2HUE_HUE_0_BRIDGE_IP", "OSC2HUE_HTTP_PORT", "OSC2HUE_DMX_INPUT_INTERFACE"} {
+		if !strings.Contains(names, want) {
+			t.Errorf("Expected %s in %s", want, names)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	xdg := t.TempDir()
+	work := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", xdg)
+	t.Setenv(PathEnv, "")
+	wd, _ := os.Getwd()
+	os.Chdir(work)
+	defer os.Chdir(wd)
+
+	userPath := filepath.Join(xdg, "osc2hue", "config.json")
+
+	// Nothing exists yet: new configs go to the user config directory
+	if got := Path(""); got != userPath {
+		t.Errorf("Expected %s without any config, got %s", userPath, got)
+	}
+
+	// A legacy ./config.json is still used
+	os.WriteFile(FileName, []byte("{}"), 0600)
+	if got := Path(""); got != FileName {
+		t.Errorf("Expected ./config.json, got %s", got)
+	}
+
+	// The user config wins over ./config.json
+	os.MkdirAll(filepath.Dir(userPath), 0700)
+	os.WriteFile(userPath, []byte("{}"), 0600)
+	if got := Path(""); got != userPath {
+		t.Errorf("Expected %s, got %s", userPath, got)
+	}
+
+	// The environment wins over the search path, and the flag over everything
+	t.Setenv(PathEnv, "/etc/osc2hue.json")
+	if got := Path(""); got != "/etc/osc2hue.json" {
+		t.Errorf("Expected path from %s, got %s", PathEnv, got)
+	}
+	if got := Path("custom.json"); got != "custom.json" {
+		t.Errorf("Expected explicit path, got %s", got)
+	}
+
+	// YAML and TOML files are found too, JSON first
+	t.Setenv(PathEnv, "")
+	os.Remove(userPath)
+	yamlPath := filepath.Join(xdg, "osc2hue", "config.yaml")
+	os.WriteFile(yamlPath, []byte("{}"), 0600)
+	if got := Path(""); got != yamlPath {
+		t.Errorf("Expected %s, got %s", yamlPath, got)
+	}
+}
+
+func TestLoadMigratesLegacyConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	legacy := `{"osc": {"host": "0.0.0.0", "port": 8080}, "hue": {"bridge_ip": "192.168.1.100", "username": "legacy-key"}}`
+	os.WriteFile(configPath, []byte(legacy), 0600)
+
+	cfg, changes, err := Load(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load legacy config: %v", err)
+	}
+	if len(cfg.Hue) != 1 || cfg.Hue[0].Name != DefaultBridgeName || cfg.Hue[0].APIKey != "legacy-key" {
+		t.Errorf("Expected username to become the API key of the main bridge, got %+v", cfg.Hue)
+	}
+	if cfg.Version != CurrentVersion || len(changes) != 2 {
+		t.Errorf("Expected version %d and two changes, got %d and %v", CurrentVersion, cfg.Version, changes)
+	}
+
+	// Once saved, the file is current and loads without changes
+	if err := SaveConfig(cfg, configPath); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+	if _, changes, err := Load(configPath); err != nil || len(changes) != 0 {
+		t.Errorf("Expected no further migrations, got %v, %v", changes, err)
+	}
+}
+
+func TestLoadLeavesValidationToCaller(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(configPath, []byte(`{"version": 2, "osc": {"host": "127.0.0.1", "port": 70000}, "hue": [{"name": "main"}]}`), 0600)
+
+	cfg, _, err := Load(configPath)
+	if err != nil {
+		t.Fatalf("Expected Load not to validate, got %v", err)
+	}
+	if cfg.OSC.Port != 70000 {
+		t.Errorf("Expected the port from the file, got %d", cfg.OSC.Port)
+	}
+	if _, err := LoadConfig(configPath); err == nil || !strings.Contains(err.Error(), "osc.port: 70000 is out of range") {
+		t.Errorf("Expected LoadConfig to validate, got %v", err)
+	}
+
+	// Files only valid with environment overrides can still be updated
+	if err := UpdateConfig(configPath, func(c *Config) { c.Hue[0].APIKey = "key" }); err != nil {
+		t.Errorf("UpdateConfig failed: %v", err)
+	}
+}
+
+func TestLoadRejectsInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want []string
+	}{
+		{"unknown keys", `{"osc": {"host": "0.0.0.0", "port": 8080, "prot": 1}, "hue": {"usrname": ""}, "dmx_output": {"protocol": "artnet", "fixtures": [{"light": "1", "universe": 0, "address": 1, "profile": "rgb", "x": 1}]}}`,
+			[]string{"hue[0].usrname: unknown key", "osc.prot: unknown key", "dmx_output.fixtures[0].x: unknown key"}},
+		{"bad port", `{"osc": {"host": "0.0.0.0", "port": 70000}, "hue": {}}`,
+			[]string{"osc.port: 70000 is out of range"}},
+		{"malformed IP", `{"osc": {"host": "192.168.1.300", "port": 8080}, "hue": {"bridge_ip": "192.168.1"}}`,
+			[]string{`osc.host: "192.168.1.300" is not a valid IP address`, `hue[0].bridge_ip: "192.168.1" is not a valid IP address`}},
+		{"bridges", `{"version": 2, "osc": {"host": "0.0.0.0", "port": 8080}, "hue": [{"name": "main", "bridge_ip": "192.168.1.2"}, {"name": "main", "bridge_ip": "192.168.1.2"}, {"name": "all"}, {"name": "2"}]}`,
+			[]string{`hue[1].name: duplicate bridge name "main"`, "hue[1].bridge_ip: 192.168.1.2 is used by another bridge", `hue[2].name: "all" is reserved`, `hue[3].name: "2" cannot be a number`}},
+		{"bridge ids", `{"version": 2, "osc": {"host": "0.0.0.0", "port": 8080}, "hue": [{"name": "main", "bridge_id": "001788FFFE123456"}, {"name": "annex", "bridge_id": "001788fffe123456"}, {"name": "garage", "bridge_id": "001788fffe123456", "cert_fingerprint": "AB:CD"}]}`,
+			[]string{`hue[0].bridge_id: "001788FFFE123456" is not a bridge ID`, "hue[2].bridge_id: 001788fffe123456 is used by another bridge", `hue[2].cert_fingerprint: "AB:CD" is not a SHA-256 fingerprint`}},
+		{"feedback", `{"version": 2, "osc": {"host": "0.0.0.0", "port": 8080, "feedback": "192.168.1.20"}, "hue": [{"name": "main"}]}`,
+			[]string{`osc.feedback: "192.168.1.20" is not a host:port address`}},
+		{"feedback port", `{"version": 2, "osc": {"host": "0.0.0.0", "port": 8080, "feedback": "192.168.1.20:0"}, "hue": [{"name": "main"}]}`,
+			[]string{"osc.feedback: 0 is out of range (1-65535)"}},
+		{"safety", `{"version": 2, "osc": {"host": "0.0.0.0", "port": 8080}, "hue": [{"name": "main"}], "safety": {"max_flashes": 5, "threshold": 1.5}}`,
+			[]string{"safety.max_flashes: 5 is out of range (1-3", "safety.threshold: 1.5 is out of range (0-1"}},
+		{"policies", `{"version": 2, "osc": {"host": "0.0.0.0", "port": 8080}, "hue": [{"name": "main"}], "policies": [{"min_brightness": 0.5, "max_brightness": 0.3}, {"lights": ["annex/1"], "min_kelvin": 500, "quiet_hours": [{"start": "22:00", "end": "7:00", "max_brightness": 2}]}]}`,
+			[]string{"policies[0]: lights or groups is required", "policies[0].min_brightness: 0.5 is above max_brightness 0.3", `policies[1].lights[0]: "annex/1" does not name`, "policies[1].min_kelvin: 500 is out of range", `policies[1].quiet_hours[0].end: "7:00" is not a time of day`, "policies[1].quiet_hours[0].max_brightness: 2 is out of range"}},
+		{"no bridges", `{"version": 2, "osc": {"host": "0.0.0.0", "port": 8080}, "hue": []}`,
+			[]string{"hue: at least one bridge is required"}},
+		{"groups", `{"version": 2, "osc": {"host": "0.0.0.0", "port": 8080}, "hue": [{"name": "main"}], "groups": [{"name": "stage left", "lights": ["main/1", "annex/2"]}, {"name": "empty", "lights": []}]}`,
+			[]string{`groups[0].name: "stage left" may only contain`, `groups[0].lights[1]: "annex/2" does not name a configured bridge`, "groups[1].lights: is required"}},
+		{"wrong type", `{"osc": {"host": "0.0.0.0", "port": "8080"}, "hue": {}}`,
+			[]string{"osc.port: expected int, got string"}},
+		{"DMX patch", `{"osc": {"host": "0.0.0.0", "port": 8080}, "hue": {}, "dmx_input": {"protocol": "sacn", "fixtures": [{"light": "1", "universe": 0, "address": 513, "personality": "rgbw"}]}}`,
+			[]string{"dmx_input.fixtures[0].universe: 0 is out of range for sACN", "dmx_input.fixtures[0].address: 513", "dmx_input.fixtures[0].personality"}},
+		{"DMX loop", `{"osc": {"host": "0.0.0.0", "port": 8080}, "hue": {}, "dmx_output": {"protocol": "artnet", "fixtures": [{"light": "1", "universe": 1, "address": 1, "profile": "rgb"}]}, "dmx_input": {"protocol": "artnet", "fixtures": [{"light": "2", "universe": 1, "address": 10, "personality": "rgb"}]}}`,
+			[]string{"dmx_input.fixtures[0].universe: artnet universe 1 is also used by dmx_output"}},
+		{"MQTT broker", `{"osc": {"host": "0.0.0.0", "port": 8080}, "hue": {}, "mqtt": {"broker": "http://localhost:1883"}}`,
+			[]string{`mqtt.broker: unsupported scheme "http"`}},
+		{"newer version", `{"version": 99, "osc": {"host": "0.0.0.0", "port": 8080}, "hue": {}}`,
+			[]string{"newer than the newest supported format"}},
+		{"syntax error", "{\n  \"osc\": {\n    \"port\": 8080,\n  }\n}",
+			[]string{"line 4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parse([]byte(tt.json), formatJSON)
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Expected %q in error:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Errorf("Default config is invalid: %v", err)
+	}
+
+	data, err := os.ReadFile("../../config.example.json")
+	if err != nil {
+		t.Fatalf("Failed to read example config: %v", err)
+	}
+	if _, changes, err := parse(data, formatJSON); err != nil || len(changes) != 0 {
+		t.Errorf("Example config should be current and valid, got %v, %v", changes, err)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	original := Default()
+	original.Hue[0].APIKey = "key"
+	original.MQTT = &MQTTConfig{Broker: "tcp://localhost:1883", HomeAssistant: true}
+	original.DMXOutput = &DMXOutputConfig{
+		Protocol: "artnet",
+		Profiles: map[string][]string{"par": {"dimmer", "red", "green", "blue"}},
+		Fixtures: []DMXFixture{{Light: "1", Universe: 0, Address: 1, Profile: "par"}},
+	}
+
+	for _, name := range []string{"config.json", "config.yaml", "config.yml", "config.toml"} {
+		t.Run(name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), name)
+			if err := SaveConfig(original, configPath); err != nil {
+				t.Fatalf("Failed to save config: %v", err)
+			}
+			loaded, err := LoadConfig(configPath)
+			if err != nil {
+				data, _ := os.ReadFile(configPath)
+				t.Fatalf("Failed to load config: %v\n%s", err, data)
+			}
+			if !reflect.DeepEqual(loaded, original) {
+				t.Errorf("Expected %+v, got %+v", original, loaded)
+			}
+		})
+	}
+}
+
+func TestLoadYAMLAndTOML(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "config.yaml")
+	os.WriteFile(yamlPath, []byte(`# Stage rig
+osc:
+  host: 0.0.0.0
+  port: 9000
+hue:
+  bridge_ip: 192.168.1.100
+  username: legacy-key # migrated like in JSON
+`), 0600)
+	cfg, changes, err := Load(yamlPath)
+	if err != nil {
+		t.Fatalf("Failed to load YAML: %v", err)
+	}
+	if cfg.OSC.Port != 9000 || cfg.Hue[0].APIKey != "legacy-key" || len(changes) != 2 {
+		t.Errorf("Unexpected YAML config %+v, changes %v", cfg, changes)
+	}
+
+	tomlPath := filepath.Join(dir, "config.toml")
+	os.WriteFile(tomlPath, []byte(`version = 1
+
+[osc]
+host = "0.0.0.0"
+port = 9000
+
+[hue]
+bridge_ip = "192.168.1.100"
+api_kee = ""
+`), 0600)
+	if _, err := LoadConfig(tomlPath); err == nil || !strings.Contains(err.Error(), "hue[0].api_kee: unknown key") {
+		t.Errorf("Expected unknown key error from TOML, got %v", err)
+	}
+
+	os.WriteFile(yamlPath, []byte("osc:\n  port: [\n"), 0600)
+	if _, err := LoadConfig(yamlPath); err == nil || !strings.Contains(err.Error(), "line") {
+		t.Errorf("Expected YAML syntax error with a line number, got %v", err)
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "rigs"), 0700)
+	os.WriteFile(filepath.Join(dir, "mqtt.toml"), []byte(`[mqtt]
+broker = "tcp://localhost:1883"
+`), 0600)
+	os.WriteFile(filepath.Join(dir, "rigs", "a.yaml"), []byte(`dmx_output:
+  protocol: artnet
+  fixtures:
+    - {light: "1", universe: 0, address: 1, profile: rgb}
+`), 0600)
+	os.WriteFile(filepath.Join(dir, "rigs", "b.json"), []byte(`{"dmx_output": {"fixtures": [{"light": "2", "universe": 0, "address": 4, "profile": "rgb"}]}}`), 0600)
+
+	configPath := filepath.Join(dir, "config.yaml")
+	os.WriteFile(configPath, []byte(`version: 1
+include:
+  - mqtt.toml
+  - rigs/*
+osc: {host: 0.0.0.0, port: 8080}
+hue: {bridge_ip: "", api_key: ""}
+mqtt:
+  topic_prefix: stage
+`), 0600)
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config with includes: %v", err)
+	}
+	if cfg.MQTT == nil || cfg.MQTT.Broker != "tcp://localhost:1883" || cfg.MQTT.TopicPrefix != "stage" {
+		t.Errorf("Expected MQTT merged from include and main file, got %+v", cfg.MQTT)
+	}
+	if cfg.DMXOutput == nil || len(cfg.DMXOutput.Fixtures) != 2 || cfg.DMXOutput.Fixtures[1].Light != "2" {
+		t.Errorf("Expected fixtures appended from both includes, got %+v", cfg.DMXOutput)
+	}
+
+	// Updates only touch the main file and keep the include
+	err = UpdateConfig(configPath, func(c *Config) { c.Hue[0].APIKey = "new-key" })
+	if err != nil {
+		t.Fatalf("UpdateConfig failed: %v", err)
+	}
+	main, _ := readDoc(configPath)
+	if _, ok := main["dmx_output"]; ok {
+		t.Error("Included values were written to the main file")
+	}
+	cfg, err = LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	if cfg.Hue[0].APIKey != "new-key" || len(cfg.DMXOutput.Fixtures) != 2 {
+		t.Errorf("Unexpected config after update: %+v", cfg)
+	}
+
+	// A missing include is an error, not a missing config
+	os.WriteFile(configPath, []byte("include: missing.yaml\n"), 0600)
+	if _, err := LoadConfig(configPath); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected error for missing include, got %v", err)
+	}
+
+	// Cycles are detected
+	os.WriteFile(configPath, []byte("include: config.yaml\n"), 0600)
+	if _, err := LoadConfig(configPath); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Expected include cycle error, got %v", err)
+	}
+}
+
+func TestUpdateIncludedList(t *testing.T) {
+	dir := t.TempDir()
+	bridgesPath := filepath.Join(dir, "bridges.yaml")
+	os.WriteFile(bridgesPath, []byte(`hue:
+  # The stage bridge
+  - name: a
+    bridge_ip: 192.168.1.2
+    api_key: key
+`), 0600)
+	configPath := filepath.Join(dir, "config.yaml")
+	os.WriteFile(configPath, []byte("version: 2\ninclude: bridges.yaml\nosc: {host: 0.0.0.0, port: 8080}\n"), 0600)
+
+	// The list is saved to the include defining it, not appended to the main file
+	err := UpdateConfig(configPath, func(c *Config) { c.Hue[0].BridgeID = "001788fffe000000" })
+	if err != nil {
+		t.Fatalf("UpdateConfig failed: %v", err)
+	}
+	if main, _ := readDoc(configPath); main["hue"] != nil {
+		t.Errorf("Expected the bridges to stay out of the main file, got %v", main["hue"])
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	if len(cfg.Hue) != 1 || cfg.Hue[0].BridgeID != "001788fffe000000" || cfg.Hue[0].APIKey != "key" {
+		t.Errorf("Expected the bridge ID saved once, got %+v", cfg.Hue)
+	}
+	if data, _ := os.ReadFile(bridgesPath); !strings.Contains(string(data), "# The stage bridge") {
+		t.Errorf("Expected the comment of the include to be kept:\n%s", data)
+	}
+
+	// A list merged from several files cannot be saved without duplicating it
+	os.WriteFile(configPath, []byte("version: 2\ninclude: bridges.yaml\nhue: [{name: b, bridge_ip: 192.168.1.3, api_key: key}]\n"), 0600)
+	before, _ := os.ReadFile(bridgesPath)
+	err = UpdateConfig(configPath, func(c *Config) { c.Hue[0].APIKey = "new-key" })
+	if err == nil || !strings.Contains(err.Error(), "hue: the list is merged from") {
+		t.Errorf("Expected the save to be refused, got %v", err)
+	}
+	if after, _ := os.ReadFile(bridgesPath); string(after) != string(before) {
+		t.Error("Expected the include to be left alone")
+	}
+}
+
+func TestSaveKeepsComments(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "config.yaml")
+	os.WriteFile(yamlPath, []byte(`# Stage setup
+version: 2
+osc:
+  host: 0.0.0.0 # all interfaces
+  port: 8080
+hue:
+  - name: main
+    bridge_ip: "192.168.1.2"
+    api_key: ""
+`), 0600)
+	if err := UpdateConfig(yamlPath, func(c *Config) { c.Hue[0].APIKey = "new-key" }); err != nil {
+		t.Fatalf("UpdateConfig failed: %v", err)
+	}
+	data, _ := os.ReadFile(yamlPath)
+	for _, want := range []string{"# Stage setup\n", "host: 0.0.0.0 # all interfaces\n", `bridge_ip: "192.168.1.2"`, "api_key: new-key\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected %q in:\n%s", want, data)
+		}
+	}
+	if cfg, err := LoadConfig(yamlPath); err != nil || cfg.Hue[0].APIKey != "new-key" {
+		t.Errorf("Expected the saved file to load, got %v", err)
+	}
+
+	// TOML files with comments are not overwritten
+	tomlPath := filepath.Join(dir, "config.toml")
+	commented := "version = 2\n[osc]\nhost = \"0.0.0.0\" # all interfaces\nport = 8080\n"
+	os.WriteFile(tomlPath, []byte(commented), 0600)
+	if err := UpdateConfig(tomlPath, func(c *Config) { c.OSC.Port = 9000 }); err == nil || !strings.Contains(err.Error(), "comments") {
+		t.Errorf("Expected the save to be refused, got %v", err)
+	}
+	if data, _ := os.ReadFile(tomlPath); string(data) != commented {
+		t.Errorf("Expected the TOML file to be left alone, got:\n%s", data)
+	}
+	os.WriteFile(tomlPath, []byte("version = 2\n[osc]\nhost = \"# not a comment\"\nport = 8080\n"), 0600)
+	if err := UpdateConfig(tomlPath, func(c *Config) { c.OSC.Port = 9000 }); err != nil {
+		t.Errorf("Expected a TOML file without comments to be saved, got %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	includePath := filepath.Join(dir, "mqtt.yaml")
+	os.WriteFile(configPath, []byte("include: mqtt.yaml\n"), 0600)
+	os.WriteFile(includePath, []byte("mqtt: {broker: \"tcp://localhost:1883\"}\n"), 0600)
+
+	if files := Files(configPath); len(files) != 2 || files[1] != includePath {
+		t.Errorf("Expected the config and its include, got %v", files)
+	}
+
+	changed := make(chan struct{}, 16)
+	stop := make(chan struct{})
+	defer close(stop)
+	go Watch(configPath, 10*time.Millisecond, stop, func() { changed <- struct{}{} })
+
+	// Changes to included files are noticed too
+	time.Sleep(30 * time.Millisecond)
+	os.WriteFile(includePath, []byte("mqtt: {broker: \"tcp://broker:1883\"}\n"), 0600)
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for change")
 	}
 
-	if loadedConfig.Hue.APIKey != originalConfig.Hue.APIKey {
-		t.Errorf("Expected Hue API key %s, got %s", originalConfig.Hue.APIKey, loadedConfig.Hue.APIKey)
+	time.Sleep(50 * time.Millisecond)
+	if len(changed) != 0 {
+		t.Errorf("Expected a single notification, got %d more", len(changed))
 	}
 }
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of environment variables overriding config fields
+const EnvPrefix = "OSC2HUE_"
+
+// ApplyEnv overrides config fields from OSC2HUE_* environment variables.
+// Variable names are the JSON keys of the field path in upper case joined by
+// underscores, e.g. OSC2HUE_OSC_PORT or OSC2HUE_MQTT_BROKER. Lists and maps
+// such as OSC2HUE_DMX_OUTPUT_FIXTURES take JSON values, and fields of list
+// entries are set by index, e.g. OSC2HUE_HUE_0_API_KEY. Setting a field of the
+// entry after the last adds an entry. Setting any variable of an optional
+// section such as MQTT enables that section.
+func ApplyEnv(config *Config) error {
+	_, err := applyEnv(reflect.ValueOf(config).Elem(), EnvPrefix, os.LookupEnv)
+	return err
+}
+
+// EnvVars lists the names of every environment variable ApplyEnv reads
+func EnvVars() []string {
+	var names []string
+	applyEnv(reflect.ValueOf(&Config{}).Elem(), EnvPrefix, func(name string) (string, bool) {
+		names = append(names, name)
+		return "", false
+	})
+	sort.Strings(names)
+	return names
+}
+
+// applyEnv sets the fields of struct v from the variables starting with prefix
+// and reports whether any variable was set
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) (bool, error) {
+	t := v.Type()
+	anySet := false
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+		fv := v.Field(i)
+
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			set, err := applyEnv(fv, name+"_", lookup)
+			if err != nil {
+				return false, err
+			}
+			anySet = anySet || set
+
+		case field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct:
+			// Optional sections are only allocated when one of their variables is set
+			target := fv
+			if fv.IsNil() {
+				target = reflect.New(field.Type.Elem())
+			}
+			set, err := applyEnv(target.Elem(), name+"_", lookup)
+			if err != nil {
+				return false, err
+			}
+			if set && fv.IsNil() {
+				fv.Set(target)
+			}
+			anySet = anySet || set
+
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct:
+			// The whole list as JSON first, then fields of single entries
+			if value, ok := lookup(name); ok {
+				if err := setFromEnv(fv, value); err != nil {
+					return false, fmt.Errorf("%s: %v", name, err)
+				}
+				anySet = true
+			}
+			for i := 0; i <= fv.Len(); i++ {
+				elem := reflect.New(field.Type.Elem()).Elem()
+				if i < fv.Len() {
+					elem.Set(fv.Index(i))
+				}
+				set, err := applyEnv(elem, fmt.Sprintf("%s_%d_", name, i), lookup)
+				if err != nil {
+					return false, err
+				}
+				if !set {
+					continue
+				}
+				if i < fv.Len() {
+					fv.Index(i).Set(elem)
+				} else {
+					fv.Set(reflect.Append(fv, elem))
+				}
+				anySet = true
+			}
+
+		default:
+			value, ok := lookup(name)
+			if !ok {
+				continue
+			}
+			if err := setFromEnv(fv, value); err != nil {
+				return false, fmt.Errorf("%s: %v", name, err)
+			}
+			anySet = true
+		}
+	}
+	return anySet, nil
+}
+
+// setFromEnv parses an environment variable value into a field
+func setFromEnv(fv reflect.Value, value string) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		fv.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		fv.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		fv.SetBool(b)
+	default:
+		if err := json.Unmarshal([]byte(value), fv.Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid JSON: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file formats, chosen by file extension
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+	formatTOML = "toml"
+)
+
+// formatOf returns the format of a config file: .yaml and .yml are YAML,
+// .toml is TOML and anything else is JSON
+func formatOf(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	}
+	return formatJSON
+}
+
+// decodeDoc decodes a config document into the generic form produced by
+// encoding/json, whatever its format, so migrations and checks only deal with one shape
+func decodeDoc(data []byte, format string) (map[string]interface{}, error) {
+	var raw interface{}
+	switch format {
+	case formatYAML:
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+	case formatTOML:
+		var table map[string]interface{}
+		if err := toml.Unmarshal(data, &table); err != nil {
+			return nil, err
+		}
+		raw = table
+	default:
+		var doc map[string]interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, describeJSONError(data, err)
+		}
+		if doc == nil {
+			return nil, fmt.Errorf("config must be a JSON object")
+		}
+		return doc, nil
+	}
+
+	if _, ok := raw.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("config must be a %s mapping with string keys", strings.ToUpper(format))
+	}
+	// Round trip through JSON so numbers are float64 and dates are strings, as with JSON files
+	normalized, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(normalized, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// encodeDoc encodes a Config or generic document in the given format. Values
+// are converted through JSON first so the json tags name the keys in every format.
+func encodeDoc(v interface{}, format string) ([]byte, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	switch format {
+	case formatYAML:
+		// JSON is YAML, so the node keeps the key order of the struct
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return nil, err
+		}
+		clearStyle(&node)
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(&node); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+	case formatTOML:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var doc interface{}
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, err
+		}
+		encoder := toml.NewEncoder(&buf)
+		encoder.Indent = ""
+		if err := encoder.Encode(tomlValues(doc)); err != nil {
+			return nil, err
+		}
+	default:
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// clearStyle switches a YAML node tree decoded from JSON to block style
+func clearStyle(node *yaml.Node) {
+	node.Style = 0
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" && node.Value == "" {
+		node.Style = yaml.DoubleQuotedStyle
+	}
+	for _, child := range node.Content {
+		clearStyle(child)
+	}
+}
+
+// keepComments returns the YAML document updated with the values of the
+// document encoded, keeping the comments of updated, the order of its keys
+// and the style of the values that did not change
+func keepComments(updated, encoded []byte) ([]byte, error) {
+	var dst, src yaml.Node
+	if err := yaml.Unmarshal(updated, &dst); err != nil || dst.Kind == 0 {
+		return encoded, nil // nothing to keep
+	}
+	if err := yaml.Unmarshal(encoded, &src); err != nil {
+		return nil, err
+	}
+	mergeNode(&dst, &src)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&dst); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mergeNode makes dst hold the values of src, keeping the comments of dst.
+// Existing keys keep their order and new keys are added after them.
+func mergeNode(dst, src *yaml.Node) {
+	if dst.Kind != src.Kind {
+		dst.Kind, dst.Tag, dst.Value, dst.Style = src.Kind, src.Tag, src.Value, src.Style
+		dst.Content, dst.Anchor, dst.Alias = src.Content, "", nil
+		return
+	}
+
+	switch dst.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for i, child := range src.Content {
+			if i < len(dst.Content) {
+				mergeNode(dst.Content[i], child)
+			} else {
+				dst.Content = append(dst.Content, child)
+			}
+		}
+		dst.Content = dst.Content[:len(src.Content)]
+	case yaml.MappingNode:
+		content := make([]*yaml.Node, 0, len(src.Content))
+		for i := 0; i+1 < len(dst.Content); i += 2 {
+			if value := mappingValue(src, dst.Content[i].Value); value != nil {
+				mergeNode(dst.Content[i+1], value)
+				content = append(content, dst.Content[i], dst.Content[i+1])
+			}
+		}
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			if mappingValue(dst, src.Content[i].Value) == nil {
+				content = append(content, src.Content[i], src.Content[i+1])
+			}
+		}
+		dst.Content = content
+	case yaml.ScalarNode:
+		if dst.Tag != src.Tag || dst.Value != src.Value {
+			dst.Tag, dst.Value, dst.Style = src.Tag, src.Value, src.Style
+		}
+	}
+}
+
+// mappingValue returns the value of key in a YAML mapping node, nil if it has none
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// hasTOMLComments reports whether a TOML document has a comment, a # outside
+// of strings
+func hasTOMLComments(data []byte) bool {
+	s := string(data)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '#':
+			return true
+		case strings.HasPrefix(s[i:], `"""`), strings.HasPrefix(s[i:], "'''"):
+			end := strings.Index(s[i+3:], s[i:i+3])
+			if end < 0 {
+				return false
+			}
+			i += end + 5
+		case s[i] == '"':
+			for i++; i < len(s) && s[i] != '"' && s[i] != '\n'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case s[i] == '\'':
+			for i++; i < len(s) && s[i] != '\'' && s[i] != '\n'; i++ {
+			}
+		}
+	}
+	return false
+}
+
+// tomlValues converts json.Number values to int64 or float64 so TOML writes
+// 8080 rather than 8080.0 or "8080"
+func tomlValues(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, elem := range value {
+			value[key] = tomlValues(elem)
+		}
+	case []interface{}:
+		for i, elem := range value {
+			value[i] = tomlValues(elem)
+		}
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			return n
+		}
+		f, _ := value.Float64()
+		return f
+	}
+	return v
+}
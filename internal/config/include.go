@@ -0,0 +1,280 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// includeKey names the files a config document includes
+const includeKey = "include"
+
+// readDoc reads and decodes a single config file without resolving its includes
+func readDoc(filename string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDoc(data, formatOf(filename))
+}
+
+// loadDoc reads a config file and merges the files it includes into it.
+// Includes are paths or glob patterns relative to the including file, in any
+// supported format. They are merged in order and the including file is merged
+// last, so its values win. stack holds the files being loaded to detect cycles.
+func loadDoc(filename string, stack []string) (map[string]interface{}, error) {
+	doc, err := readDoc(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	includes, err := includePaths(doc, filepath.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
+	delete(doc, includeKey)
+	if len(includes) == 0 {
+		return doc, nil
+	}
+
+	abs, _ := filepath.Abs(filename)
+	stack = append(stack, abs)
+	merged := make(map[string]interface{})
+	for _, include := range includes {
+		includeAbs, _ := filepath.Abs(include)
+		for _, parent := range stack {
+			if parent == includeAbs {
+				return nil, fmt.Errorf("include %s: include cycle", include)
+			}
+		}
+		// %v rather than %w: a missing include must not look like a missing config file
+		included, err := loadDoc(include, stack)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %v", include, err)
+		}
+		mergeDoc(merged, included)
+	}
+	mergeDoc(merged, doc)
+	return merged, nil
+}
+
+// includePaths returns the files named by the include key of doc, which may
+// be a single string or a list, resolved against dir
+func includePaths(doc map[string]interface{}, dir string) ([]string, error) {
+	var patterns []string
+	switch value := doc[includeKey].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		patterns = []string{value}
+	case []interface{}:
+		for _, elem := range value {
+			pattern, ok := elem.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: expected file names, got %v", includeKey, elem)
+			}
+			patterns = append(patterns, pattern)
+		}
+	default:
+		return nil, fmt.Errorf("%s: expected a file name or a list of file names", includeKey)
+	}
+
+	var paths []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		if !strings.ContainsAny(pattern, "*?[") {
+			paths = append(paths, pattern)
+			continue
+		}
+		// Glob matches are sorted, and a pattern matching nothing is not an error
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", includeKey, err)
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// mergeDoc merges src into dst: objects are merged key by key, lists are
+// appended and any other value in src replaces the one in dst
+func mergeDoc(dst, src map[string]interface{}) {
+	for key, value := range src {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if existing, ok := dst[key].(map[string]interface{}); ok {
+				mergeDoc(existing, value)
+				continue
+			}
+		case []interface{}:
+			if existing, ok := dst[key].([]interface{}); ok {
+				dst[key] = append(existing, value...)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
+
+// fileDoc is a config file and its decoded document
+type fileDoc struct {
+	filename string
+	doc      map[string]interface{}
+}
+
+// includedDocs reads the files included by doc, read from filename, and the
+// files they include in turn, in merge order
+func includedDocs(filename string, doc map[string]interface{}) ([]fileDoc, error) {
+	includes, err := includePaths(doc, filepath.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
+	var docs []fileDoc
+	for _, include := range includes {
+		included, err := readDoc(include)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %v", include, err)
+		}
+		docs = append(docs, fileDoc{filename: include, doc: included})
+		nested, err := includedDocs(include, included)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, nested...)
+	}
+	return docs, nil
+}
+
+// applyChanges writes the differences between before and after into the
+// documents of a config file, first in files, and of the files it includes,
+// leaving every value that did not change alone. Changes go to the main file
+// and win over included values, except lists: merging appends them, so a
+// changed list is written to the one file defining it. It returns the
+// indexes of the files it changed.
+func applyChanges(files []fileDoc, before, after map[string]interface{}) ([]int, error) {
+	changed := make(map[int]bool)
+	if err := applyChangesAt(files, nil, before, after, changed); err != nil {
+		return nil, err
+	}
+	indexes := make([]int, 0, len(changed))
+	for i := range files {
+		if changed[i] {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, nil
+}
+
+// applyChangesAt applies the changes to the objects at path, recording the
+// files it changed
+func applyChangesAt(files []fileDoc, path []string, before, after map[string]interface{}, changed map[int]bool) error {
+	for key, value := range after {
+		keyPath := append(slices.Clip(path), key)
+		afterMap, afterIsMap := value.(map[string]interface{})
+		beforeMap, beforeIsMap := before[key].(map[string]interface{})
+		if afterIsMap && beforeIsMap {
+			if err := applyChangesAt(files, keyPath, beforeMap, afterMap, changed); err != nil {
+				return err
+			}
+			continue
+		}
+		if reflect.DeepEqual(before[key], value) {
+			continue
+		}
+		owner, err := ownerOf(files, keyPath, before[key], value)
+		if err != nil {
+			return err
+		}
+		setPath(files[owner].doc, keyPath, value)
+		changed[owner] = true
+	}
+	for key, value := range before {
+		if _, ok := after[key]; ok {
+			continue
+		}
+		keyPath := append(slices.Clip(path), key)
+		owner, err := ownerOf(files, keyPath, value, nil)
+		if err != nil {
+			return err
+		}
+		if deletePath(files[owner].doc, keyPath) {
+			changed[owner] = true
+		}
+	}
+	return nil
+}
+
+// ownerOf returns the index of the file a changed value at path is written
+// to: the main file, or for a list the only file that has it
+func ownerOf(files []fileDoc, path []string, before, after interface{}) (int, error) {
+	_, beforeIsList := before.([]interface{})
+	_, afterIsList := after.([]interface{})
+	if !beforeIsList && !afterIsList {
+		return 0, nil
+	}
+
+	owner := 0
+	var names []string
+	for i, file := range files {
+		if _, ok := getPath(file.doc, path); ok {
+			owner = i
+			names = append(names, file.filename)
+		}
+	}
+	if len(names) > 1 {
+		return 0, fmt.Errorf("%s: the list is merged from %s, change it by hand", strings.Join(path, "."), strings.Join(names, ", "))
+	}
+	return owner, nil
+}
+
+// getPath returns the value at a path of keys in doc
+func getPath(doc map[string]interface{}, path []string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// setPath sets the value at a path of keys in doc, creating the objects on the way
+func setPath(doc map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := doc[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			doc[key] = next
+		}
+		doc = next
+	}
+	doc[path[len(path)-1]] = value
+}
+
+// deletePath removes the value at a path of keys in doc, reporting whether it was there
+func deletePath(doc map[string]interface{}, path []string) bool {
+	parent, ok := getPath(doc, path[:len(path)-1])
+	if !ok {
+		return false
+	}
+	m, ok := parent.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	if _, ok := m[path[len(path)-1]]; !ok {
+		return false
+	}
+	delete(m, path[len(path)-1])
+	return true
+}
@@ -0,0 +1,71 @@
+package config
+
+import "fmt"
+
+// CurrentVersion is the config format version written by SaveConfig.
+// Files without a version field are version 0.
+const CurrentVersion = 2
+
+// migration upgrades a raw config document from version-1 to version,
+// returning a description of every change it made
+type migration func(doc map[string]interface{}) []string
+
+// migrations[i] upgrades a document from version i to version i+1
+var migrations = []migration{
+	migrateV0,
+	migrateV1,
+}
+
+// migrate upgrades a raw config document to CurrentVersion in place
+func migrate(doc map[string]interface{}) ([]string, error) {
+	version := 0
+	if v, ok := doc["version"]; ok {
+		f, isNumber := v.(float64)
+		if !isNumber || f != float64(int(f)) || f < 0 {
+			return nil, fmt.Errorf("version: must be a whole number, got %v", v)
+		}
+		version = int(f)
+	}
+	if version > CurrentVersion {
+		return nil, fmt.Errorf("version: config format %d is newer than the newest supported format %d, upgrade osc2hue", version, CurrentVersion)
+	}
+
+	var changes []string
+	for ; version < CurrentVersion; version++ {
+		changes = append(changes, migrations[version](doc)...)
+	}
+	doc["version"] = float64(CurrentVersion)
+	return changes, nil
+}
+
+// migrateV0 renames hue.username, used by early releases and the old example config, to hue.api_key
+func migrateV0(doc map[string]interface{}) []string {
+	hue, ok := doc["hue"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	username, ok := hue["username"]
+	if !ok {
+		return nil
+	}
+
+	delete(hue, "username")
+	if key, _ := hue["api_key"].(string); key != "" {
+		return []string{"removed hue.username, hue.api_key is already set"}
+	}
+	hue["api_key"] = username
+	return []string{"renamed hue.username to hue.api_key"}
+}
+
+// migrateV1 turns the single hue section into a list of bridges, naming the bridge DefaultBridgeName
+func migrateV1(doc map[string]interface{}) []string {
+	hue, ok := doc["hue"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if _, named := hue["name"]; !named {
+		hue["name"] = DefaultBridgeName
+	}
+	doc["hue"] = []interface{}{hue}
+	return []string{fmt.Sprintf("moved the hue section into a list of bridges, named %q", hue["name"])}
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// FileName is the name of the config file in every search location
+const FileName = "config.json"
+
+// fileNames are the config file names looked for in each search location, in order
+var fileNames = []string{FileName, "config.yaml", "config.yml", "config.toml"}
+
+// PathEnv is the environment variable naming the config file
+const PathEnv = "OSC2HUE_CONFIG"
+
+// UserPath returns $XDG_CONFIG_HOME/osc2hue/config.json, falling back to the
+// platform's user config directory (~/.config on Linux) when XDG_CONFIG_HOME is not set
+func UserPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		var err error
+		dir, err = os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, "osc2hue", FileName), nil
+}
+
+// Path returns the config file to use. The first of these wins: the explicit
+// path (from --config), $OSC2HUE_CONFIG, a config file in the user config
+// directory, a config file in the current directory. config.json is preferred
+// over config.yaml, config.yml and config.toml in the same directory. If no
+// config file exists yet, the user config path is returned so a new config is
+// created there.
+func Path(explicit string) string {
+	if explicit != "" {
+		return explicit
+	}
+	if env := os.Getenv(PathEnv); env != "" {
+		return env
+	}
+
+	userPath, err := UserPath()
+	if err == nil {
+		if found := findConfig(filepath.Dir(userPath)); found != "" {
+			return found
+		}
+	}
+	if found := findConfig("."); found != "" {
+		return found
+	}
+	if err == nil {
+		return userPath
+	}
+	return FileName
+}
+
+// findConfig returns the first config file found in dir, or ""
+func findConfig(dir string) string {
+	for _, name := range fileNames {
+		path := name
+		if dir != "." {
+			path = filepath.Join(dir, name)
+		}
+		if fileExists(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+// fileExists reports whether path exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
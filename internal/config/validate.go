@@ -0,0 +1,426 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationError lists every problem found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid config: " + e.Problems[0]
+	}
+	return "invalid config:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// validator collects problems with their field paths
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+// Validate checks every field of the configuration and returns a *ValidationError
+// naming each invalid field, or nil if the configuration is usable
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.port("osc.port", c.OSC.Port)
+	v.host("osc.host", c.OSC.Host, false)
+	if c.OSC.Feedback != "" {
+		v.hostPort("osc.feedback", c.OSC.Feedback)
+	}
+	v.bridges(c.Hue)
+	v.groups(c.Groups, c)
+
+	if c.DMXOutput != nil {
+		v.protocol("dmx_output.protocol", c.DMXOutput.Protocol)
+		if c.DMXOutput.Target != "" {
+			v.ip("dmx_output.target", c.DMXOutput.Target)
+		}
+		if c.DMXOutput.RefreshHz < 0 || c.DMXOutput.RefreshHz > 44 {
+			v.addf("dmx_output.refresh_hz", "%d is out of range (1-44, 0 for the default)", c.DMXOutput.RefreshHz)
+		}
+		for i, f := range c.DMXOutput.Fixtures {
+			path := fmt.Sprintf("dmx_output.fixtures[%d]", i)
+			v.fixture(path, c.DMXOutput.Protocol, f.Light, f.Universe, f.Address)
+			if f.Profile == "" {
+				v.addf(path+".profile", "is required")
+			}
+		}
+	}
+
+	if c.DMXInput != nil {
+		v.protocol("dmx_input.protocol", c.DMXInput.Protocol)
+		for i, f := range c.DMXInput.Fixtures {
+			path := fmt.Sprintf("dmx_input.fixtures[%d]", i)
+			v.fixture(path, c.DMXInput.Protocol, f.Light, f.Universe, f.Address)
+			switch f.Personality {
+			case "dimmer", "rgb", "xy", "ct":
+			default:
+				v.addf(path+".personality", "must be dimmer, rgb, xy or ct, got %q", f.Personality)
+			}
+		}
+	}
+
+	if c.DMXOutput != nil && c.DMXInput != nil {
+		v.dmxLoop(c.DMXOutput, c.DMXInput)
+	}
+
+	if c.MQTT != nil {
+		v.broker("mqtt.broker", c.MQTT.Broker)
+	}
+
+	if c.HTTP != nil {
+		v.port("http.port", c.HTTP.Port)
+		v.host("http.host", c.HTTP.Host, true)
+	}
+
+	for i, p := range c.Policies {
+		v.policy(fmt.Sprintf("policies[%d]", i), p, c)
+	}
+
+	if c.Panic != nil {
+		v.fraction("panic.brightness", c.Panic.Brightness)
+		v.kelvin("panic.kelvin", c.Panic.Kelvin)
+	}
+
+	if c.Safety != nil {
+		if c.Safety.MaxFlashes < 0 || c.Safety.MaxFlashes > 3 {
+			v.addf("safety.max_flashes", "%d is out of range (1-3, 0 for the default)", c.Safety.MaxFlashes)
+		}
+		if c.Safety.Threshold < 0 || c.Safety.Threshold > 1 {
+			v.addf("safety.threshold", "%g is out of range (0-1, 0 for the default)", c.Safety.Threshold)
+		}
+	}
+
+	return v.err()
+}
+
+// dmxLoop checks that DMX input does not listen to a universe of the DMX
+// output on the same protocol, since it would read the output back as desk
+// input and fight the desk
+func (v *validator) dmxLoop(output *DMXOutputConfig, input *DMXInputConfig) {
+	if output.Protocol != input.Protocol {
+		return
+	}
+	outputs := make(map[int]bool)
+	for _, f := range output.Fixtures {
+		outputs[f.Universe] = true
+	}
+	reported := make(map[int]bool)
+	for i, f := range input.Fixtures {
+		if outputs[f.Universe] && !reported[f.Universe] {
+			reported[f.Universe] = true
+			v.addf(fmt.Sprintf("dmx_input.fixtures[%d].universe", i), "%s universe %d is also used by dmx_output, input would read the output back", input.Protocol, f.Universe)
+		}
+	}
+}
+
+// bridges checks the bridge names and addresses
+func (v *validator) bridges(bridges []HueConfig) {
+	if len(bridges) == 0 {
+		v.addf("hue", "at least one bridge is required")
+	}
+	names := make(map[string]bool)
+	ips := make(map[string]bool)
+	ids := make(map[string]bool)
+	for i, b := range bridges {
+		path := fmt.Sprintf("hue[%d]", i)
+		v.name(path+".name", b.Name)
+		if names[b.Name] {
+			v.addf(path+".name", "duplicate bridge name %q", b.Name)
+		}
+		names[b.Name] = true
+
+		if b.BridgeIP != "" {
+			v.ip(path+".bridge_ip", b.BridgeIP)
+			if ips[b.BridgeIP] {
+				v.addf(path+".bridge_ip", "%s is used by another bridge", b.BridgeIP)
+			}
+			ips[b.BridgeIP] = true
+		}
+
+		if b.BridgeID != "" {
+			if !bridgeIDPattern.MatchString(b.BridgeID) {
+				v.addf(path+".bridge_id", "%q is not a bridge ID (16 lowercase hex digits)", b.BridgeID)
+			}
+			if ids[b.BridgeID] {
+				v.addf(path+".bridge_id", "%s is used by another bridge", b.BridgeID)
+			}
+			ids[b.BridgeID] = true
+		}
+		if b.CertFingerprint != "" && !fingerprintPattern.MatchString(b.CertFingerprint) {
+			v.addf(path+".cert_fingerprint", "%q is not a SHA-256 fingerprint (64 lowercase hex digits)", b.CertFingerprint)
+		}
+	}
+}
+
+// groups checks the group names and that light references name known bridges
+func (v *validator) groups(groups []GroupConfig, c *Config) {
+	names := make(map[string]bool)
+	for i, g := range groups {
+		path := fmt.Sprintf("groups[%d]", i)
+		v.name(path+".name", g.Name)
+		if names[g.Name] {
+			v.addf(path+".name", "duplicate group name %q", g.Name)
+		}
+		names[g.Name] = true
+
+		if len(g.Lights) == 0 {
+			v.addf(path+".lights", "is required")
+		}
+		for j, light := range g.Lights {
+			v.lightRef(fmt.Sprintf("%s.lights[%d]", path, j), light, c)
+		}
+	}
+}
+
+// lightRef checks that a "bridge/id" light reference names a configured bridge
+func (v *validator) lightRef(path, light string, c *Config) {
+	if bridge, id, ok := strings.Cut(light, "/"); ok && (id == "" || c.Bridge(bridge) == nil) {
+		v.addf(path, "%q does not name a configured bridge and light", light)
+	}
+}
+
+// policy checks the lights and limits of a policy
+func (v *validator) policy(path string, p PolicyConfig, c *Config) {
+	if len(p.Lights) == 0 && len(p.Groups) == 0 {
+		v.addf(path, "lights or groups is required")
+	}
+	for i, light := range p.Lights {
+		v.lightRef(fmt.Sprintf("%s.lights[%d]", path, i), light, c)
+	}
+	v.fraction(path+".min_brightness", p.MinBrightness)
+	v.fraction(path+".max_brightness", p.MaxBrightness)
+	if p.MaxBrightness > 0 && p.MinBrightness > p.MaxBrightness {
+		v.addf(path+".min_brightness", "%g is above max_brightness %g", p.MinBrightness, p.MaxBrightness)
+	}
+	v.kelvin(path+".min_kelvin", p.MinKelvin)
+	v.kelvin(path+".max_kelvin", p.MaxKelvin)
+	if p.MaxKelvin > 0 && p.MinKelvin > p.MaxKelvin {
+		v.addf(path+".min_kelvin", "%d is above max_kelvin %d", p.MinKelvin, p.MaxKelvin)
+	}
+	for i, q := range p.QuietHours {
+		qpath := fmt.Sprintf("%s.quiet_hours[%d]", path, i)
+		v.clock(qpath+".start", q.Start)
+		v.clock(qpath+".end", q.End)
+		if q.Start == q.End && q.Start != "" {
+			v.addf(qpath, "start and end are the same")
+		}
+		v.fraction(qpath+".max_brightness", q.MaxBrightness)
+	}
+}
+
+// fraction checks a value from 0 to 1
+func (v *validator) fraction(path string, value float64) {
+	if value < 0 || value > 1 {
+		v.addf(path, "%g is out of range (0-1)", value)
+	}
+}
+
+// kelvin checks a color temperature, 0 meaning none
+func (v *validator) kelvin(path string, value int) {
+	if value != 0 && (value < 1000 || value > 20000) {
+		v.addf(path, "%d is out of range (1000-20000)", value)
+	}
+}
+
+// clock checks a time of day
+func (v *validator) clock(path, value string) {
+	if !clockPattern.MatchString(value) {
+		v.addf(path, "%q is not a time of day (HH:MM)", value)
+	}
+}
+
+// clockPattern matches a time of day such as 22:30
+var clockPattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+// bridgeIDPattern matches the IDs Hue bridges report, e.g. 001788fffe123456
+var bridgeIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// fingerprintPattern matches a SHA-256 certificate fingerprint in hex
+var fingerprintPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// reservedNames are OSC address segments that cannot be used as bridge or group names
+var reservedNames = map[string]bool{
+	"all": true, "blackout": true, "group": true, "master": true, "pair": true, "panic": true, "scene": true,
+}
+
+// name checks a bridge or group name used as an OSC address segment
+func (v *validator) name(path, value string) {
+	switch {
+	case value == "":
+		v.addf(path, "is required")
+	case strings.Trim(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_") != "":
+		v.addf(path, "%q may only contain letters, digits, - and _", value)
+	case strings.Trim(value, "0123456789") == "":
+		v.addf(path, "%q cannot be a number, numbers are light and group IDs", value)
+	case reservedNames[value]:
+		v.addf(path, "%q is reserved", value)
+	}
+}
+
+// port checks a UDP/TCP port number
+func (v *validator) port(path string, port int) {
+	if port < 1 || port > 65535 {
+		v.addf(path, "%d is out of range (1-65535)", port)
+	}
+}
+
+// ip checks an IPv4 or IPv6 address
+func (v *validator) ip(path, value string) {
+	if net.ParseIP(value) == nil {
+		v.addf(path, "%q is not a valid IP address", value)
+	}
+}
+
+// host checks a listen address, which may be an IP address or a host name
+func (v *validator) host(path, value string, allowEmpty bool) {
+	if value == "" {
+		if !allowEmpty {
+			v.addf(path, "is required (use 0.0.0.0 to listen on all interfaces)")
+		}
+		return
+	}
+	if net.ParseIP(value) != nil {
+		return
+	}
+	// Anything made of digits and dots was meant to be an IPv4 address
+	if strings.Trim(value, "0123456789.") == "" {
+		v.addf(path, "%q is not a valid IP address", value)
+		return
+	}
+	for _, label := range strings.Split(value, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") ||
+			strings.Trim(label, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-") != "" {
+			v.addf(path, "%q is not a valid IP address or host name", value)
+			return
+		}
+	}
+}
+
+// hostPort checks a host:port address to send to
+func (v *validator) hostPort(path, value string) {
+	host, portStr, err := net.SplitHostPort(value)
+	if err != nil {
+		v.addf(path, "%q is not a host:port address", value)
+		return
+	}
+	v.host(path, host, false)
+	if port, err := strconv.Atoi(portStr); err != nil {
+		v.addf(path, "%q is not a valid port", portStr)
+	} else {
+		v.port(path, port)
+	}
+}
+
+// protocol checks a DMX protocol name
+func (v *validator) protocol(path, value string) {
+	if value != "artnet" && value != "sacn" {
+		v.addf(path, "must be artnet or sacn, got %q", value)
+	}
+}
+
+// fixture checks the light reference and DMX patch of a fixture
+func (v *validator) fixture(path, protocol, light string, universe, address int) {
+	if light == "" {
+		v.addf(path+".light", "is required")
+	}
+	if protocol == "sacn" && (universe < 1 || universe > 63999) {
+		v.addf(path+".universe", "%d is out of range for sACN (1-63999)", universe)
+	} else if protocol != "sacn" && (universe < 0 || universe > 32767) {
+		v.addf(path+".universe", "%d is out of range for Art-Net (0-32767)", universe)
+	}
+	if address < 1 || address > 512 {
+		v.addf(path+".address", "%d is out of range (1-512)", address)
+	}
+}
+
+// broker checks an MQTT broker URL
+func (v *validator) broker(path, value string) {
+	if value == "" {
+		v.addf(path, "is required, e.g. tcp://localhost:1883")
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		v.addf(path, "%q is not a valid broker URL, e.g. tcp://localhost:1883", value)
+		return
+	}
+	switch u.Scheme {
+	case "tcp", "ssl", "tls", "mqtt", "mqtts", "ws", "wss":
+	default:
+		v.addf(path, "unsupported scheme %q (use tcp, ssl, tls, mqtt, mqtts, ws or wss)", u.Scheme)
+	}
+}
+
+// checkUnknownKeys reports every key of a decoded JSON document that does not
+// correspond to a field of t, with its full path
+func checkUnknownKeys(doc interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var problems []string
+	switch value := doc.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			// Maps such as custom DMX profiles accept any key
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			fieldType, ok := fields[key]
+			if !ok {
+				problems = append(problems, keyPath+": unknown key")
+				continue
+			}
+			problems = append(problems, checkUnknownKeys(value[key], fieldType, keyPath)...)
+		}
+
+	case []interface{}:
+		if t.Kind() != reflect.Slice {
+			return nil
+		}
+		for i, elem := range value {
+			problems = append(problems, checkUnknownKeys(elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return problems
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files returns a config file followed by every file it includes, directly or
+// indirectly. Files that cannot be read or parsed are listed without their
+// includes, so a watcher still sees them being fixed.
+func Files(filename string) []string {
+	files := []string{filename}
+	seen := map[string]bool{}
+	var walk func(string)
+	walk = func(name string) {
+		abs, _ := filepath.Abs(name)
+		if seen[abs] {
+			return
+		}
+		seen[abs] = true
+
+		doc, err := readDoc(name)
+		if err != nil {
+			return
+		}
+		includes, err := includePaths(doc, filepath.Dir(name))
+		if err != nil {
+			return
+		}
+		for _, include := range includes {
+			files = append(files, include)
+			walk(include)
+		}
+	}
+	walk(filename)
+	return files
+}
+
+// Watch polls a config file and the files it includes every interval and calls
+// onChange once they changed and then stayed unchanged for an interval, so an
+// editor saving several files triggers a single call. It returns when stop is closed.
+func Watch(filename string, interval time.Duration, stop <-chan struct{}, onChange func()) {
+	last := fingerprint(filename)
+	pending := false
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		current := fingerprint(filename)
+		if current != last {
+			last = current
+			pending = true
+			continue
+		}
+		if pending {
+			pending = false
+			onChange()
+		}
+	}
+}
+
+// fingerprint describes the size and modification time of a config file and its includes
+func fingerprint(filename string) string {
+	var b strings.Builder
+	for _, name := range Files(filename) {
+		info, err := os.Stat(name)
+		if err != nil {
+			fmt.Fprintf(&b, "%s missing\n", name)
+			continue
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", name, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String()
+}
@@ -0,0 +1,104 @@
+package dmx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// ArtNetPort is the UDP port used by Art-Net
+const ArtNetPort = 6454
+
+const (
+	artNetOpDMX   = 0x5000
+	artNetVersion = 14
+)
+
+var artNetID = []byte("Art-Net\x00")
+
+// ArtDMXPacket encodes an ArtDmx packet for a 15-bit port-address universe
+func ArtDMXPacket(universe int, sequence byte, data []byte) []byte {
+	length := len(data)
+	if length%2 != 0 {
+		length++ // Art-Net requires an even data length
+	}
+
+	packet := make([]byte, 18+length)
+	copy(packet, artNetID)
+	binary.LittleEndian.PutUint16(packet[8:], artNetOpDMX)
+	binary.BigEndian.PutUint16(packet[10:], artNetVersion)
+	packet[12] = sequence
+	packet[13] = 0 // physical port
+	packet[14] = byte(universe & 0xff)
+	packet[15] = byte((universe >> 8) & 0x7f)
+	binary.BigEndian.PutUint16(packet[16:], uint16(length))
+	copy(packet[18:], data)
+	return packet
+}
+
+// ParseArtDMX decodes an ArtDmx packet, ok is false for other or malformed packets
+func ParseArtDMX(packet []byte) (universe int, data []byte, ok bool) {
+	if len(packet) < 18 || !bytes.Equal(packet[:8], artNetID) {
+		return 0, nil, false
+	}
+	if binary.LittleEndian.Uint16(packet[8:]) != artNetOpDMX {
+		return 0, nil, false
+	}
+
+	length := int(binary.BigEndian.Uint16(packet[16:]))
+	if length > UniverseSize || 18+length > len(packet) {
+		return 0, nil, false
+	}
+
+	universe = int(packet[15]&0x7f)<<8 | int(packet[14])
+	return universe, packet[18 : 18+length], true
+}
+
+// ArtNetSender transmits universes as Art-Net frames
+type ArtNetSender struct {
+	conn     net.PacketConn
+	target   *net.UDPAddr
+	sequence map[int]byte
+}
+
+// NewArtNetSender creates an Art-Net sender, target defaults to the broadcast address
+func NewArtNetSender(target string) (*ArtNetSender, error) {
+	if target == "" {
+		target = "255.255.255.255"
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(target, fmt.Sprintf("%d", ArtNetPort)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Art-Net target: %v", err)
+	}
+
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open Art-Net socket: %v", err)
+	}
+
+	return &ArtNetSender{
+		conn:     conn,
+		target:   addr,
+		sequence: make(map[int]byte),
+	}, nil
+}
+
+// Send transmits one universe
+func (s *ArtNetSender) Send(universe int, data []byte) error {
+	// Sequence 0 disables reordering on receivers, so wrap from 255 to 1
+	seq := s.sequence[universe] + 1
+	if seq == 0 {
+		seq = 1
+	}
+	s.sequence[universe] = seq
+
+	_, err := s.conn.WriteTo(ArtDMXPacket(universe, seq, data), s.target)
+	return err
+}
+
+// Close releases the socket
+func (s *ArtNetSender) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,303 @@
+package dmx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	"osc2hue/internal/color"
+	"osc2hue/internal/state"
+)
+
+func TestArtDMXPacket(t *testing.T) {
+	data := []byte{10, 20, 30}
+	packet := ArtDMXPacket(0x1234, 7, data)
+
+	if !bytes.Equal(packet[:8], []byte("Art-Net\x00")) {
+		t.Errorf("Invalid Art-Net ID: %q", packet[:8])
+	}
+	if op := binary.LittleEndian.Uint16(packet[8:]); op != 0x5000 {
+		t.Errorf("Expected OpDmx 0x5000, got 0x%04x", op)
+	}
+	if packet[12] != 7 {
+		t.Errorf("Expected sequence 7, got %d", packet[12])
+	}
+	if packet[14] != 0x34 || packet[15] != 0x12 {
+		t.Errorf("Expected SubUni 0x34 and Net 0x12, got 0x%02x and 0x%02x", packet[14], packet[15])
+	}
+	// Odd lengths are padded to an even number of channels
+	if length := binary.BigEndian.Uint16(packet[16:]); length != 4 {
+		t.Errorf("Expected padded length 4, got %d", length)
+	}
+	if !bytes.Equal(packet[18:21], data) {
+		t.Errorf("Unexpected DMX data: %v", packet[18:])
+	}
+}
+
+func TestSACNPacket(t *testing.T) {
+	var cid [16]byte
+	cid[0] = 0xab
+	data := make([]byte, UniverseSize)
+	data[0] = 255
+	packet := SACNPacket(cid, "osc2hue", 3, 42, data)
+
+	if len(packet) != 638 {
+		t.Fatalf("Expected full universe packet of 638 bytes, got %d", len(packet))
+	}
+	if !bytes.Equal(packet[4:16], sacnACNID) {
+		t.Errorf("Invalid ACN packet identifier: %v", packet[4:16])
+	}
+	if packet[22] != 0xab {
+		t.Errorf("CID not copied into packet")
+	}
+	if name := string(bytes.TrimRight(packet[44:108], "\x00")); name != "osc2hue" {
+		t.Errorf("Expected source name osc2hue, got %q", name)
+	}
+	if packet[111] != 42 {
+		t.Errorf("Expected sequence 42, got %d", packet[111])
+	}
+	if universe := binary.BigEndian.Uint16(packet[113:]); universe != 3 {
+		t.Errorf("Expected universe 3, got %d", universe)
+	}
+	if count := binary.BigEndian.Uint16(packet[123:]); count != 513 {
+		t.Errorf("Expected property value count 513, got %d", count)
+	}
+	if packet[125] != 0 || packet[126] != 255 {
+		t.Errorf("Expected start code 0 followed by channel data")
+	}
+}
+
+func TestResolveProfile(t *testing.T) {
+	custom := map[string][]string{
+		"par":    {"dimmer", "red", "green", "blue"},
+		"broken": {"dimmer", "strobe"},
+	}
+
+	channels, err := ResolveProfile("par", custom)
+	if err != nil || len(channels) != 4 {
+		t.Errorf("Expected custom profile with 4 channels, got %v (%v)", channels, err)
+	}
+
+	channels, err = ResolveProfile("rgbw", custom)
+	if err != nil || len(channels) != 4 {
+		t.Errorf("Expected builtin rgbw profile, got %v (%v)", channels, err)
+	}
+
+	if _, err := ResolveProfile("broken", custom); err == nil {
+		t.Error("Expected error for unknown channel function")
+	}
+	if _, err := ResolveProfile("missing", custom); err == nil {
+		t.Error("Expected error for unknown profile")
+	}
+}
+
+func TestFixtureValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture Fixture
+		valid   bool
+	}{
+		{"First channel", Fixture{Address: 1, Channels: BuiltinProfiles["rgb"]}, true},
+		{"Last channels", Fixture{Address: 510, Channels: BuiltinProfiles["rgb"]}, true},
+		{"Past the end", Fixture{Address: 511, Channels: BuiltinProfiles["rgb"]}, false},
+		{"Zero address", Fixture{Address: 0, Channels: BuiltinProfiles["dimmer"]}, false},
+		{"No channels", Fixture{Address: 1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.fixture.Validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, expected valid=%v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestFixtureRender(t *testing.T) {
+	red := state.LightState{On: true, Brightness: 0.5, X: 0.7006, Y: 0.2993}
+
+	// RGB fixture without a dimmer scales the color by brightness
+	frame := make([]byte, UniverseSize)
+	Fixture{Address: 1, Channels: BuiltinProfiles["rgb"]}.Render(frame, red)
+	if frame[0] < 120 || frame[0] > 130 || frame[2] > 20 {
+		t.Errorf("Expected half-brightness red, got %v", frame[:3])
+	}
+
+	// Dimmer fixture carries the brightness on its own channel
+	frame = make([]byte, UniverseSize)
+	Fixture{Address: 10, Channels: []Channel{ChannelDimmer, ChannelRed, ChannelGreen, ChannelBlue}}.Render(frame, red)
+	if frame[9] != 128 || frame[10] != 255 {
+		t.Errorf("Expected dimmer 128 and full red, got %v", frame[9:13])
+	}
+
+	// Lights that are off render dark
+	frame = make([]byte, UniverseSize)
+	off := red
+	off.On = false
+	Fixture{Address: 1, Channels: BuiltinProfiles["rgb"]}.Render(frame, off)
+	if frame[0] != 0 || frame[1] != 0 || frame[2] != 0 {
+		t.Errorf("Expected dark fixture, got %v", frame[:3])
+	}
+
+	// White moves to the white emitter of an RGBW fixture
+	frame = make([]byte, UniverseSize)
+	white := state.LightState{On: true, Brightness: 1, X: color.WhiteX, Y: color.WhiteY}
+	Fixture{Address: 1, Channels: BuiltinProfiles["rgbw"]}.Render(frame, white)
+	if frame[3] < 230 {
+		t.Errorf("Expected white channel to carry white, got %v", frame[:4])
+	}
+}
+
+type recordingSender struct {
+	mu     sync.Mutex
+	frames map[int][]byte
+	closed bool
+}
+
+func (s *recordingSender) Send(universe int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames[universe] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *recordingSender) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestOutputFrames(t *testing.T) {
+	store := state.NewStore()
+	store.Set("light-1", state.LightState{On: true, Brightness: 1, X: color.WhiteX, Y: color.WhiteY})
+
+	fixtures := []Fixture{
+		{LightID: "light-1", Universe: 0, Address: 1, Channels: BuiltinProfiles["dimmer"]},
+		{LightID: "light-2", Universe: 1, Address: 1, Channels: BuiltinProfiles["dimmer"]},
+	}
+
+	sender := &recordingSender{frames: make(map[int][]byte)}
+	output := NewOutput(sender, fixtures, store, 30)
+
+	frames := output.Frames()
+	if len(frames) != 2 {
+		t.Fatalf("Expected frames for 2 universes, got %d", len(frames))
+	}
+	if frames[0][0] != 255 {
+		t.Errorf("Expected light-1 at full, got %d", frames[0][0])
+	}
+	if frames[1][0] != 0 {
+		t.Errorf("Expected unknown light-2 to stay dark, got %d", frames[1][0])
+	}
+
+	output.Start()
+	output.Stop()
+	if !sender.closed {
+		t.Error("Expected sender to be closed on stop")
+	}
+	if sender.frames[0][0] != 0 {
+		t.Error("Expected universes to be blacked out on stop")
+	}
+}
+
+func TestParseArtDMX(t *testing.T) {
+	data := []byte{1, 2, 3, 4}
+	universe, parsed, ok := ParseArtDMX(ArtDMXPacket(0x0102, 1, data))
+	if !ok {
+		t.Fatal("Expected ArtDmx packet to parse")
+	}
+	if universe != 0x0102 || !bytes.Equal(parsed, data) {
+		t.Errorf("Unexpected parse result: universe %d, data %v", universe, parsed)
+	}
+
+	if _, _, ok := ParseArtDMX([]byte("Art-Net\x00\x00\x20")); ok {
+		t.Error("Expected short or non-DMX packet to be rejected")
+	}
+}
+
+func TestParseSACN(t *testing.T) {
+	var cid [16]byte
+	data := []byte{9, 8, 7}
+	universe, parsed, ok := ParseSACN(SACNPacket(cid, "desk", 12, 1, data))
+	if !ok {
+		t.Fatal("Expected sACN packet to parse")
+	}
+	if universe != 12 || !bytes.Equal(parsed, data) {
+		t.Errorf("Unexpected parse result: universe %d, data %v", universe, parsed)
+	}
+
+	// Non-zero start codes are not dimmer data
+	packet := SACNPacket(cid, "desk", 12, 1, data)
+	packet[125] = 0xdd
+	if _, _, ok := ParseSACN(packet); ok {
+		t.Error("Expected packet with alternate start code to be rejected")
+	}
+}
+
+func TestInputFixtureValidate(t *testing.T) {
+	if err := (InputFixture{Address: 509, Personality: PersonalityRGB}).Validate(); err != nil {
+		t.Errorf("Expected RGB fixture at 509 to fit: %v", err)
+	}
+	if err := (InputFixture{Address: 510, Personality: PersonalityRGB}).Validate(); err == nil {
+		t.Error("Expected RGB fixture at 510 to overflow the universe")
+	}
+	if err := (InputFixture{Address: 1, Personality: "strobe"}).Validate(); err == nil {
+		t.Error("Expected unknown personality to be rejected")
+	}
+}
+
+func TestInputChangeDetection(t *testing.T) {
+	var commands []Command
+	input := NewInput([]InputFixture{
+		{LightID: "rgb", Universe: 1, Address: 1, Personality: PersonalityRGB},
+		{LightID: "dim", Universe: 1, Address: 5, Personality: PersonalityDimmer},
+		{LightID: "other", Universe: 2, Address: 1, Personality: PersonalityDimmer},
+	}, func(cmd Command) {
+		commands = append(commands, cmd)
+	})
+
+	frame := make([]byte, UniverseSize)
+	frame[0], frame[1] = 255, 255 // full red
+	frame[4] = 128
+
+	// First frame reports every fixture of the universe
+	input.HandleFrame(1, frame)
+	if len(commands) != 2 {
+		t.Fatalf("Expected 2 commands on first frame, got %d", len(commands))
+	}
+	if !commands[0].HasColor || commands[0].Brightness != 1 {
+		t.Errorf("Unexpected RGB command: %+v", commands[0])
+	}
+	if commands[1].HasColor || commands[1].Brightness < 0.5 || commands[1].Brightness > 0.51 {
+		t.Errorf("Unexpected dimmer command: %+v", commands[1])
+	}
+
+	// Unchanged frame reports nothing
+	commands = nil
+	input.HandleFrame(1, frame)
+	if len(commands) != 0 {
+		t.Errorf("Expected no commands for unchanged frame, got %d", len(commands))
+	}
+
+	// Only the changed fixture is reported
+	frame[4] = 0
+	input.HandleFrame(1, frame)
+	if len(commands) != 1 || commands[0].LightID != "dim" || commands[0].Brightness != 0 {
+		t.Errorf("Expected dimmer off command, got %+v", commands)
+	}
+
+	// Color changes on a dark fixture are ignored
+	commands = nil
+	frame[0] = 0
+	input.HandleFrame(1, frame)
+	frame[2] = 255
+	input.HandleFrame(1, frame)
+	if len(commands) != 1 || commands[0].Brightness != 0 {
+		t.Errorf("Expected a single off command, got %+v", commands)
+	}
+
+	if universes := input.Universes(); len(universes) != 2 {
+		t.Errorf("Expected 2 universes, got %v", universes)
+	}
+}
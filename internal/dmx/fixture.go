@@ -0,0 +1,151 @@
+package dmx
+
+import (
+	"fmt"
+	"math"
+
+	"osc2hue/internal/color"
+	"osc2hue/internal/state"
+)
+
+// UniverseSize is the number of channels in a DMX universe
+const UniverseSize = 512
+
+// Channel is the function of a single DMX channel within a fixture
+type Channel string
+
+// Supported channel functions
+const (
+	ChannelDimmer Channel = "dimmer"
+	ChannelRed    Channel = "red"
+	ChannelGreen  Channel = "green"
+	ChannelBlue   Channel = "blue"
+	ChannelWhite  Channel = "white"
+	ChannelCCT    Channel = "cct"  // color temperature, 0 = warm (2000K) to 255 = cool (6500K)
+	ChannelWarm   Channel = "warm" // warm white emitter of a tunable white fixture
+	ChannelCool   Channel = "cool" // cool white emitter of a tunable white fixture
+)
+
+// Color temperature range covered by the cct, warm and cool channels
+const (
+	minKelvin = 2000.0
+	maxKelvin = 6500.0
+)
+
+// BuiltinProfiles are the fixture profiles available without any configuration
+var BuiltinProfiles = map[string][]Channel{
+	"rgb":    {ChannelRed, ChannelGreen, ChannelBlue},
+	"rgbw":   {ChannelRed, ChannelGreen, ChannelBlue, ChannelWhite},
+	"dimmer": {ChannelDimmer},
+	"cct":    {ChannelDimmer, ChannelCCT},
+}
+
+// ResolveProfile returns the channel layout for a profile name, custom profiles take precedence
+func ResolveProfile(name string, custom map[string][]string) ([]Channel, error) {
+	if layout, ok := custom[name]; ok {
+		channels := make([]Channel, 0, len(layout))
+		for _, ch := range layout {
+			c := Channel(ch)
+			switch c {
+			case ChannelDimmer, ChannelRed, ChannelGreen, ChannelBlue, ChannelWhite, ChannelCCT, ChannelWarm, ChannelCool:
+				channels = append(channels, c)
+			default:
+				return nil, fmt.Errorf("profile %q: unknown channel %q", name, ch)
+			}
+		}
+		return channels, nil
+	}
+
+	if channels, ok := BuiltinProfiles[name]; ok {
+		return channels, nil
+	}
+	return nil, fmt.Errorf("unknown profile %q", name)
+}
+
+// Fixture maps a light onto a range of channels in a DMX universe
+type Fixture struct {
+	LightID  string
+	Universe int
+	Address  int // 1-based start channel
+	Channels []Channel
+}
+
+// Validate checks that the fixture fits in its universe
+func (f Fixture) Validate() error {
+	if len(f.Channels) == 0 {
+		return fmt.Errorf("fixture for light %s has no channels", f.LightID)
+	}
+	if f.Address < 1 || f.Address+len(f.Channels)-1 > UniverseSize {
+		return fmt.Errorf("fixture for light %s does not fit in universe %d at address %d", f.LightID, f.Universe, f.Address)
+	}
+	return nil
+}
+
+// Render writes the fixture's channel values for a light state into a universe buffer
+func (f Fixture) Render(universe []byte, st state.LightState) {
+	intensity := 0.0
+	if st.On {
+		intensity = clamp(st.Brightness)
+	}
+
+	// Fixtures with a dimmer channel get full color values and dim separately
+	colorLevel := intensity
+	for _, ch := range f.Channels {
+		if ch == ChannelDimmer {
+			colorLevel = 1
+			break
+		}
+	}
+
+	r, g, b := color.XYToRGB(st.X, st.Y)
+	var w float64
+	for _, ch := range f.Channels {
+		if ch == ChannelWhite {
+			// Move the common part of the RGB mix to the white emitter
+			w = math.Min(r, math.Min(g, b))
+			r, g, b = r-w, g-w, b-w
+			break
+		}
+	}
+
+	cool := (color.XYToKelvin(st.X, st.Y) - minKelvin) / (maxKelvin - minKelvin)
+	cool = clamp(cool)
+
+	for i, ch := range f.Channels {
+		var v float64
+		switch ch {
+		case ChannelDimmer:
+			v = intensity
+		case ChannelRed:
+			v = r * colorLevel
+		case ChannelGreen:
+			v = g * colorLevel
+		case ChannelBlue:
+			v = b * colorLevel
+		case ChannelWhite:
+			v = w * colorLevel
+		case ChannelCCT:
+			v = cool
+		case ChannelWarm:
+			v = (1 - cool) * colorLevel
+		case ChannelCool:
+			v = cool * colorLevel
+		}
+		universe[f.Address-1+i] = toByte(v)
+	}
+}
+
+// clamp limits a value to the 0.0-1.0 range
+func clamp(v float64) float64 {
+	if v < 0 {
+		return 0
+	} else if v > 1 {
+		return 1
+	}
+	return v
+}
+
+// toByte converts a 0.0-1.0 level to a DMX value
+func toByte(v float64) byte {
+	return byte(math.Round(clamp(v) * 255))
+}
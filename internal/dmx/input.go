@@ -0,0 +1,153 @@
+package dmx
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"osc2hue/internal/color"
+)
+
+// Personality describes how an input fixture's channels control a light
+type Personality string
+
+// Supported input personalities, every personality starts with a dimmer channel
+const (
+	PersonalityDimmer Personality = "dimmer" // dimmer
+	PersonalityRGB    Personality = "rgb"    // dimmer, red, green, blue
+	PersonalityXY     Personality = "xy"     // dimmer, x, y
+	PersonalityCT     Personality = "ct"     // dimmer, color temperature (0 = 2000K to 255 = 6500K)
+)
+
+// Footprint returns the number of channels used by a personality
+func (p Personality) Footprint() int {
+	switch p {
+	case PersonalityDimmer:
+		return 1
+	case PersonalityRGB:
+		return 4
+	case PersonalityXY:
+		return 3
+	case PersonalityCT:
+		return 2
+	}
+	return 0
+}
+
+// InputFixture maps a range of DMX channels onto a light
+type InputFixture struct {
+	LightID     string
+	Universe    int
+	Address     int // 1-based start channel
+	Personality Personality
+}
+
+// Validate checks the personality and that the fixture fits in its universe
+func (f InputFixture) Validate() error {
+	footprint := f.Personality.Footprint()
+	if footprint == 0 {
+		return fmt.Errorf("input fixture for light %s: unknown personality %q", f.LightID, f.Personality)
+	}
+	if f.Address < 1 || f.Address+footprint-1 > UniverseSize {
+		return fmt.Errorf("input fixture for light %s does not fit in universe %d at address %d", f.LightID, f.Universe, f.Address)
+	}
+	return nil
+}
+
+// Command is a light change decoded from DMX
+type Command struct {
+	LightID    string
+	Brightness float64 // 0.0-1.0
+	HasColor   bool
+	X, Y       float64
+}
+
+// Input decodes incoming universes into commands for the fixtures that changed
+type Input struct {
+	mu       sync.Mutex
+	fixtures []InputFixture
+	last     [][]byte // last channel values per fixture, nil until first seen
+	onChange func(Command)
+}
+
+// NewInput creates an input decoder calling onChange for every changed fixture
+func NewInput(fixtures []InputFixture, onChange func(Command)) *Input {
+	return &Input{
+		fixtures: fixtures,
+		last:     make([][]byte, len(fixtures)),
+		onChange: onChange,
+	}
+}
+
+// Universes returns the distinct universes used by the input fixtures
+func (in *Input) Universes() []int {
+	seen := make(map[int]bool)
+	var universes []int
+	for _, f := range in.fixtures {
+		if !seen[f.Universe] {
+			seen[f.Universe] = true
+			universes = append(universes, f.Universe)
+		}
+	}
+	return universes
+}
+
+// HandleFrame compares a received universe with the previous one and emits commands for changed fixtures
+func (in *Input) HandleFrame(universe int, data []byte) {
+	in.mu.Lock()
+	var commands []Command
+	for i, f := range in.fixtures {
+		if f.Universe != universe {
+			continue
+		}
+
+		start := f.Address - 1
+		end := start + f.Personality.Footprint()
+		if end > len(data) {
+			continue // frame too short for this fixture
+		}
+		channels := data[start:end]
+
+		previous := in.last[i]
+		if previous != nil && bytes.Equal(previous, channels) {
+			continue
+		}
+		in.last[i] = append([]byte(nil), channels...)
+
+		// Color changes on a light that stays dark are not worth a bridge request
+		if previous != nil && previous[0] == 0 && channels[0] == 0 {
+			continue
+		}
+		commands = append(commands, f.decode(channels))
+	}
+	in.mu.Unlock()
+
+	for _, cmd := range commands {
+		in.onChange(cmd)
+	}
+}
+
+// decode converts fixture channel values to a command
+func (f InputFixture) decode(channels []byte) Command {
+	cmd := Command{
+		LightID:    f.LightID,
+		Brightness: float64(channels[0]) / 255,
+	}
+	if cmd.Brightness == 0 {
+		return cmd // only turn the light off
+	}
+
+	switch f.Personality {
+	case PersonalityRGB:
+		cmd.X, cmd.Y = color.RGBToXY(float64(channels[1])/255, float64(channels[2])/255, float64(channels[3])/255)
+		cmd.HasColor = true
+	case PersonalityXY:
+		cmd.X, cmd.Y = float64(channels[1])/255, float64(channels[2])/255
+		cmd.HasColor = true
+	case PersonalityCT:
+		kelvin := minKelvin + float64(channels[1])/255*(maxKelvin-minKelvin)
+		cmd.X, cmd.Y = color.KelvinToXY(kelvin)
+		cmd.HasColor = true
+	}
+	return cmd
+}
@@ -0,0 +1,114 @@
+package dmx
+
+import (
+	"sort"
+	"time"
+
+	"osc2hue/internal/state"
+)
+
+// Sender transmits DMX universes over the network
+type Sender interface {
+	Send(universe int, data []byte) error
+	Close() error
+}
+
+// Source provides the current state of a light
+type Source interface {
+	Get(lightID string) (state.LightState, bool)
+}
+
+// Output periodically renders fixtures from a state source and transmits every universe
+type Output struct {
+	sender   Sender
+	fixtures []Fixture
+	source   Source
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewOutput creates a DMX output refreshing at the given rate in frames per second
+func NewOutput(sender Sender, fixtures []Fixture, source Source, refreshHz int) *Output {
+	if refreshHz <= 0 {
+		refreshHz = 30
+	}
+
+	return &Output{
+		sender:   sender,
+		fixtures: fixtures,
+		source:   source,
+		interval: time.Second / time.Duration(refreshHz),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Frames renders the current state of every fixture, keyed by universe
+func (o *Output) Frames() map[int][]byte {
+	frames := make(map[int][]byte)
+	for _, f := range o.fixtures {
+		frame, ok := frames[f.Universe]
+		if !ok {
+			frame = make([]byte, UniverseSize)
+			frames[f.Universe] = frame
+		}
+
+		// Lights without a known state stay dark
+		if st, ok := o.source.Get(f.LightID); ok {
+			f.Render(frame, st)
+		}
+	}
+	return frames
+}
+
+// Start begins transmitting frames in the background
+func (o *Output) Start() {
+	go func() {
+		defer close(o.done)
+
+		ticker := time.NewTicker(o.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-o.stop:
+				return
+			case <-ticker.C:
+				o.transmit()
+			}
+		}
+	}()
+}
+
+// Stop blacks out every universe and closes the sender
+func (o *Output) Stop() {
+	close(o.stop)
+	<-o.done
+
+	for universe := range o.Frames() {
+		if err := o.sender.Send(universe, make([]byte, UniverseSize)); err != nil {
+			logger.Error("Failed to black out DMX universe", "universe", universe, "error", err)
+		}
+	}
+	if err := o.sender.Close(); err != nil {
+		logger.Error("Failed to close DMX sender", "error", err)
+	}
+}
+
+// transmit sends one frame for every universe, in universe order
+func (o *Output) transmit() {
+	frames := o.Frames()
+
+	universes := make([]int, 0, len(frames))
+	for universe := range frames {
+		universes = append(universes, universe)
+	}
+	sort.Ints(universes)
+
+	for _, universe := range universes {
+		if err := o.sender.Send(universe, frames[universe]); err != nil {
+			logger.Warn("Failed to send DMX universe", "universe", universe, "error", err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package dmx
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"osc2hue/internal/logging"
+)
+
+// logger is the log of the dmx subsystem
+var logger = logging.For("dmx")
+
+// FrameHandler is called for every DMX frame received
+type FrameHandler func(universe int, data []byte)
+
+// Receiver listens for incoming Art-Net or sACN frames
+type Receiver struct {
+	conns []net.PacketConn
+	parse func(packet []byte) (int, []byte, bool)
+}
+
+// ListenArtNet listens for Art-Net frames on all interfaces
+func ListenArtNet() (*Receiver, error) {
+	conn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", ArtNetPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for Art-Net: %v", err)
+	}
+
+	return &Receiver{
+		conns: []net.PacketConn{conn},
+		parse: ParseArtDMX,
+	}, nil
+}
+
+// ListenSACN joins the multicast groups of the given sACN universes, an empty interface name uses the system default
+func ListenSACN(interfaceName string, universes []int) (*Receiver, error) {
+	var ifi *net.Interface
+	if interfaceName != "" {
+		var err error
+		ifi, err = net.InterfaceByName(interfaceName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sACN interface: %v", err)
+		}
+	}
+
+	r := &Receiver{parse: ParseSACN}
+	for _, universe := range universes {
+		group := &net.UDPAddr{IP: SACNMulticastAddr(universe), Port: SACNPort}
+		conn, err := net.ListenMulticastUDP("udp4", ifi, group)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("failed to join sACN universe %d: %v", universe, err)
+		}
+		r.conns = append(r.conns, conn)
+	}
+	return r, nil
+}
+
+// Serve reads frames until the receiver is closed
+func (r *Receiver) Serve(handler FrameHandler) {
+	var wg sync.WaitGroup
+	for _, conn := range r.conns {
+		wg.Add(1)
+		go func(conn net.PacketConn) {
+			defer wg.Done()
+
+			buf := make([]byte, 1024)
+			for {
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					if !errors.Is(err, net.ErrClosed) {
+						logger.Warn("Failed to read DMX frame", "error", err)
+					}
+					return
+				}
+
+				if universe, data, ok := r.parse(buf[:n]); ok {
+					handler(universe, data)
+				}
+			}
+		}(conn)
+	}
+	wg.Wait()
+}
+
+// Close stops listening
+func (r *Receiver) Close() {
+	for _, conn := range r.conns {
+		if err := conn.Close(); err != nil {
+			logger.Error("Failed to close DMX receiver", "error", err)
+		}
+	}
+}
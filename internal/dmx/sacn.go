@@ -0,0 +1,146 @@
+package dmx
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// SACNPort is the UDP port used by sACN (E1.31)
+const SACNPort = 5568
+
+const (
+	sacnRootVector    = 0x00000004
+	sacnFrameVector   = 0x00000002
+	sacnDMPVector     = 0x02
+	sacnDefaultPrio   = 100
+	sacnHeaderLength  = 126
+	sacnSourceNameLen = 64
+)
+
+var sacnACNID = []byte{0x41, 0x53, 0x43, 0x2d, 0x45, 0x31, 0x2e, 0x31, 0x37, 0x00, 0x00, 0x00}
+
+// SACNPacket encodes an E1.31 data packet
+func SACNPacket(cid [16]byte, sourceName string, universe int, sequence byte, data []byte) []byte {
+	packet := make([]byte, sacnHeaderLength+len(data))
+	length := len(packet)
+
+	// Root layer
+	binary.BigEndian.PutUint16(packet[0:], 0x0010) // preamble size
+	binary.BigEndian.PutUint16(packet[2:], 0x0000) // postamble size
+	copy(packet[4:16], sacnACNID)
+	binary.BigEndian.PutUint16(packet[16:], 0x7000|uint16(length-16))
+	binary.BigEndian.PutUint32(packet[18:], sacnRootVector)
+	copy(packet[22:38], cid[:])
+
+	// Framing layer
+	binary.BigEndian.PutUint16(packet[38:], 0x7000|uint16(length-38))
+	binary.BigEndian.PutUint32(packet[40:], sacnFrameVector)
+	name := []byte(sourceName)
+	if len(name) > sacnSourceNameLen-1 {
+		name = name[:sacnSourceNameLen-1]
+	}
+	copy(packet[44:44+sacnSourceNameLen], name)
+	packet[108] = sacnDefaultPrio
+	binary.BigEndian.PutUint16(packet[109:], 0) // synchronization address
+	packet[111] = sequence
+	packet[112] = 0 // options
+	binary.BigEndian.PutUint16(packet[113:], uint16(universe))
+
+	// DMP layer
+	binary.BigEndian.PutUint16(packet[115:], 0x7000|uint16(length-115))
+	packet[117] = sacnDMPVector
+	packet[118] = 0xa1                               // address and data type
+	binary.BigEndian.PutUint16(packet[119:], 0x0000) // first property address
+	binary.BigEndian.PutUint16(packet[121:], 0x0001) // address increment
+	binary.BigEndian.PutUint16(packet[123:], uint16(len(data)+1))
+	packet[125] = 0 // DMX start code
+	copy(packet[126:], data)
+	return packet
+}
+
+// ParseSACN decodes an E1.31 data packet, ok is false for other or malformed packets.
+// Packets with a non-zero start code carry no dimmer data and are rejected too.
+func ParseSACN(packet []byte) (universe int, data []byte, ok bool) {
+	if len(packet) < sacnHeaderLength || !bytes.Equal(packet[4:16], sacnACNID) {
+		return 0, nil, false
+	}
+	if binary.BigEndian.Uint32(packet[18:]) != sacnRootVector ||
+		binary.BigEndian.Uint32(packet[40:]) != sacnFrameVector ||
+		packet[117] != sacnDMPVector {
+		return 0, nil, false
+	}
+
+	count := int(binary.BigEndian.Uint16(packet[123:]))
+	if count < 1 || count-1 > UniverseSize || sacnHeaderLength-1+count > len(packet) || packet[125] != 0 {
+		return 0, nil, false
+	}
+
+	universe = int(binary.BigEndian.Uint16(packet[113:]))
+	return universe, packet[sacnHeaderLength : sacnHeaderLength-1+count], true
+}
+
+// SACNMulticastAddr returns the multicast group of an sACN universe
+func SACNMulticastAddr(universe int) net.IP {
+	return net.IPv4(239, 255, byte(universe>>8), byte(universe&0xff))
+}
+
+// SACNSender transmits universes as sACN frames
+type SACNSender struct {
+	conn       net.PacketConn
+	target     net.IP // nil for multicast
+	cid        [16]byte
+	sourceName string
+	sequence   map[int]byte
+}
+
+// NewSACNSender creates an sACN sender, an empty target uses per-universe multicast
+func NewSACNSender(target, sourceName string) (*SACNSender, error) {
+	var cid [16]byte
+	if _, err := rand.Read(cid[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate sACN CID: %v", err)
+	}
+
+	var targetIP net.IP
+	if target != "" {
+		addr, err := net.ResolveIPAddr("ip4", target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sACN target: %v", err)
+		}
+		targetIP = addr.IP
+	}
+
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sACN socket: %v", err)
+	}
+
+	return &SACNSender{
+		conn:       conn,
+		target:     targetIP,
+		cid:        cid,
+		sourceName: sourceName,
+		sequence:   make(map[int]byte),
+	}, nil
+}
+
+// Send transmits one universe
+func (s *SACNSender) Send(universe int, data []byte) error {
+	ip := s.target
+	if ip == nil {
+		ip = SACNMulticastAddr(universe)
+	}
+
+	seq := s.sequence[universe] + 1
+	s.sequence[universe] = seq
+
+	_, err := s.conn.WriteTo(SACNPacket(s.cid, s.sourceName, universe, seq, data), &net.UDPAddr{IP: ip, Port: SACNPort})
+	return err
+}
+
+// Close releases the socket
+func (s *SACNSender) Close() error {
+	return s.conn.Close()
+}
@@ -1,14 +1,29 @@
 package hue
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/grandcat/zeroconf"
 	"github.com/openhue/openhue-go"
 )
 
+// discoveryURL is the Philips Hue cloud discovery endpoint, used when mDNS finds nothing
+var discoveryURL = "https://discovery.meethue.com"
+
 // Bridge represents a discovered Hue bridge
 type Bridge struct {
+	ID        string
+	Name      string
 	IPAddress string
 }
 
@@ -28,36 +43,295 @@ func DiscoverBridge(timeout time.Duration) (*Bridge, error) {
 	}, nil
 }
 
-// AuthenticateWithBridge performs bridge authentication
-func AuthenticateWithBridge(bridgeIP string) (string, error) {
+// DiscoverBridges lists every Hue bridge answering mDNS within timeout,
+// falling back to cloud discovery if none answer
+func DiscoverBridges(timeout time.Duration) ([]Bridge, error) {
+	bridges, err := discoverMDNS(timeout)
+	if err == nil && len(bridges) > 0 {
+		return bridges, nil
+	}
+
+	bridges, cloudErr := discoverCloud(timeout)
+	if cloudErr != nil {
+		if err != nil {
+			return nil, fmt.Errorf("bridge discovery failed: mDNS: %v, cloud: %v", err, cloudErr)
+		}
+		return nil, fmt.Errorf("bridge discovery failed: %v", cloudErr)
+	}
+	return bridges, nil
+}
+
+// discoverMDNS browses for _hue._tcp services until timeout
+func discoverMDNS(timeout time.Duration) ([]Bridge, error) {
+	resolver, err := zeroconf.NewResolver()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	if err := resolver.Browse(ctx, "_hue._tcp", "local.", entries); err != nil {
+		return nil, err
+	}
+
+	// Browse closes entries once the context expires
+	seen := make(map[string]bool)
+	var bridges []Bridge
+	for entry := range entries {
+		if len(entry.AddrIPv4) == 0 {
+			continue
+		}
+		bridge := bridgeFromTXT(entry.Text)
+		bridge.Name = strings.ReplaceAll(entry.Instance, "\\", "")
+		bridge.IPAddress = entry.AddrIPv4[0].String()
+		if seen[bridge.IPAddress] {
+			continue
+		}
+		seen[bridge.IPAddress] = true
+		bridges = append(bridges, bridge)
+	}
+
+	sortBridges(bridges)
+	return bridges, nil
+}
+
+// bridgeFromTXT reads the bridge ID from an mDNS TXT record
+func bridgeFromTXT(txt []string) Bridge {
+	var bridge Bridge
+	for _, field := range txt {
+		if key, value, ok := strings.Cut(field, "="); ok && key == "bridgeid" {
+			bridge.ID = strings.ToLower(value)
+		}
+	}
+	return bridge
+}
+
+// discoverCloud queries the Philips Hue cloud discovery endpoint
+func discoverCloud(timeout time.Duration) ([]Bridge, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(discoveryURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var found []struct {
+		ID                string `json:"id"`
+		InternalIPAddress string `json:"internalipaddress"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&found); err != nil {
+		return nil, fmt.Errorf("invalid discovery response: %v", err)
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no bridges found")
+	}
+
+	bridges := make([]Bridge, 0, len(found))
+	for _, f := range found {
+		bridges = append(bridges, Bridge{
+			ID:        strings.ToLower(f.ID),
+			IPAddress: f.InternalIPAddress,
+		})
+	}
+
+	sortBridges(bridges)
+	return bridges, nil
+}
+
+// sortBridges orders bridges by IP address so listings are stable
+func sortBridges(bridges []Bridge) {
+	sort.Slice(bridges, func(i, j int) bool {
+		return bridges[i].IPAddress < bridges[j].IPAddress
+	})
+}
+
+// Identity is how a bridge presents itself on a TLS connection
+type Identity struct {
+	IPAddress   string
+	ID          string // bridge ID, 16 lowercase hex digits
+	Fingerprint string // SHA-256 fingerprint of its certificate, see Fingerprint
+	Signed      bool   // the certificate is signed by the Signify root CA for ID
+}
+
+// Identify connects to the bridge at bridgeIP and returns its identity. Hue
+// bridges use their ID as the common name of their TLS certificate, bridges
+// whose certificate does not carry it are asked for their config instead.
+// The certificate is not verified, this is what trust is established from.
+func Identify(bridgeIP string, timeout time.Duration) (*Identity, error) {
+	identity, err := identify(net.JoinHostPort(bridgeIP, "443"), timeout)
+	if err != nil {
+		return nil, err
+	}
+	identity.IPAddress = bridgeIP
+	return identity, nil
+}
+
+// identify reads the identity of the bridge answering on addr
+func identify(addr string, timeout time.Duration) (*Identity, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	conn.Close()
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s presented no certificate", addr)
+	}
+
+	identity := &Identity{Fingerprint: Fingerprint(certs[0])}
+	if id := strings.ToLower(certs[0].Subject.CommonName); isBridgeID(id) {
+		identity.ID = id
+	} else if identity.ID, err = fetchBridgeID(addr, identity.Fingerprint, timeout); err != nil {
+		return nil, err
+	}
+	identity.Signed = verifySigned(certs, identity.ID) == nil
+	return identity, nil
+}
+
+// fetchBridgeID asks the bridge on addr for its ID, over a connection pinned
+// to the certificate it was identified by
+func fetchBridgeID(addr, fingerprint string, timeout time.Duration) (string, error) {
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: TLSConfig("", fingerprint)},
+	}
+	resp, err := client.Get("https://" + addr + "/api/0/config")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var info struct {
+		BridgeID string `json:"bridgeid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("invalid bridge config response: %v", err)
+	}
+	id := strings.ToLower(info.BridgeID)
+	if !isBridgeID(id) {
+		return "", fmt.Errorf("%s does not identify as a Hue bridge", addr)
+	}
+	return id, nil
+}
+
+// isBridgeID reports whether s looks like a lowercase bridge ID, 16 hex digits
+func isBridgeID(s string) bool {
+	if len(s) != 16 {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Rediscover searches the network for the bridge with the given ID, for when
+// its IP address changed, and returns its identity. The bridge found is
+// identified again, so a stale discovery entry never leads to another bridge.
+func Rediscover(bridgeID string, timeout time.Duration) (*Identity, error) {
+	bridges, err := DiscoverBridges(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return findBridge(bridges, bridgeID, func(ip string) (*Identity, error) {
+		return Identify(ip, timeout)
+	})
+}
+
+// findBridge returns the identity of the discovered bridge that identifies as
+// bridgeID. Bridges announced without an ID are identified as well.
+func findBridge(bridges []Bridge, bridgeID string, identify func(ip string) (*Identity, error)) (*Identity, error) {
+	for _, b := range bridges {
+		if b.ID != "" && b.ID != bridgeID {
+			continue
+		}
+		identity, err := identify(b.IPAddress)
+		if err != nil || identity.ID != bridgeID {
+			continue
+		}
+		return identity, nil
+	}
+	return nil, fmt.Errorf("bridge %s not found on the network", bridgeID)
+}
+
+// AuthenticateWithBridge performs bridge authentication, polling until the
+// link button is pressed or ctx is done. progress, if not nil, is called about
+// once per second with the time spent waiting. The bridge certificate is
+// verified with tlsConfig, see TLSConfig.
+func AuthenticateWithBridge(ctx context.Context, bridgeIP string, tlsConfig *tls.Config, progress func(elapsed time.Duration)) (string, error) {
 	if bridgeIP == "" {
 		return "", fmt.Errorf("bridge IP not set")
 	}
 
-	// Create authenticator
-	authenticator, err := openhue.NewAuthenticator(bridgeIP)
+	api, err := newAPI(bridgeIP, tlsConfig)
 	if err != nil {
 		return "", fmt.Errorf("failed to create authenticator: %v", err)
 	}
+	// Bridges limit the device name to 19 characters
+	deviceType := "osc2hue"
+	if hostname, err := os.Hostname(); err == nil {
+		if len(hostname) > 19 {
+			hostname = hostname[:19]
+		}
+		deviceType = "osc2hue#" + hostname
+	}
+	generateClientKey := true
+	body := openhue.AuthenticateJSONRequestBody{Devicetype: &deviceType, Generateclientkey: &generateClientKey}
 
 	// Keep trying to authenticate until button is pressed or we get an error
-	var apiKey string
-	for len(apiKey) == 0 {
-		key, retry, err := authenticator.Authenticate()
-
-		if err != nil && retry {
-			// Link button not pressed yet, continue waiting
-			time.Sleep(500 * time.Millisecond)
-		} else if err != nil && !retry {
-			// Real error occurred
+	start := time.Now()
+	lastProgress := start
+	for {
+		resp, err := api.AuthenticateWithResponse(ctx, body)
+		if ctx.Err() != nil {
+			return "", pairingError(ctx)
+		}
+		if err != nil {
 			return "", fmt.Errorf("authentication failed: %v", err)
-		} else {
-			// Success!
-			apiKey = key
+		}
+		if resp.JSON200 == nil || len(*resp.JSON200) == 0 {
+			return "", fmt.Errorf("authentication failed: %v", statusError(resp.HTTPResponse))
+		}
+
+		result := (*resp.JSON200)[0]
+		if result.Success != nil && result.Success.Username != nil {
+			return *result.Success.Username, nil
+		}
+		if result.Error == nil || result.Error.Type == nil || *result.Error.Type != linkButtonNotPressed {
+			description := "unexpected response"
+			if result.Error != nil && result.Error.Description != nil {
+				description = *result.Error.Description
+			}
+			return "", fmt.Errorf("authentication failed: %s", description)
+		}
+
+		// Link button not pressed yet, continue waiting
+		if progress != nil && time.Since(lastProgress) >= time.Second {
+			lastProgress = time.Now()
+			progress(time.Since(start))
+		}
+		select {
+		case <-ctx.Done():
+			return "", pairingError(ctx)
+		case <-time.After(500 * time.Millisecond):
 		}
 	}
+}
 
-	return apiKey, nil
+// pairingError describes why pairing stopped when ctx is done
+func pairingError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("link button not pressed in time")
+	}
+	return fmt.Errorf("pairing cancelled")
 }
 
 // IsValidAPIKey checks if an API key is valid (not empty or placeholder)
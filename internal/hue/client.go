@@ -0,0 +1,141 @@
+package hue
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/openhue/openhue-go"
+)
+
+// requestTimeout bounds every request to a bridge
+const requestTimeout = 10 * time.Second
+
+// linkButtonNotPressed is the error type a bridge returns while waiting for the link button
+const linkButtonNotPressed = 101
+
+// Client talks to the API of one bridge over a verified TLS connection. It has
+// the methods of openhue.Home that osc2hue uses, without openhue's global
+// skip-verify transport.
+type Client struct {
+	api *openhue.ClientWithResponses
+}
+
+// NewClient creates a client for the bridge at bridgeIP, see TLSConfig
+func NewClient(bridgeIP, apiKey string, tlsConfig *tls.Config) (*Client, error) {
+	if bridgeIP == "" || apiKey == "" {
+		return nil, fmt.Errorf("bridge IP and API key must be set")
+	}
+	api, err := newAPI(bridgeIP, tlsConfig, func(ctx context.Context, req *http.Request) error {
+		req.Header.Set("hue-application-key", apiKey)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{api: api}, nil
+}
+
+// newAPI creates the generated API client with its own HTTP transport
+func newAPI(bridgeIP string, tlsConfig *tls.Config, editors ...openhue.RequestEditorFn) (*openhue.ClientWithResponses, error) {
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: requestTimeout,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConnsPerHost: 4,
+	}
+	opts := []openhue.ClientOption{openhue.WithHTTPClient(&http.Client{Transport: transport, Timeout: requestTimeout})}
+	for _, editor := range editors {
+		opts = append(opts, openhue.WithRequestEditorFn(editor))
+	}
+	return openhue.NewClientWithResponses("https://"+bridgeIP, opts...)
+}
+
+// GetLights returns the lights of the bridge by ID
+func (c *Client) GetLights(ctx context.Context) (map[string]openhue.LightGet, error) {
+	resp, err := c.api.GetLightsWithResponse(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if resp.JSON200 == nil || resp.JSON200.Data == nil {
+		return nil, statusError(resp.HTTPResponse)
+	}
+	lights := make(map[string]openhue.LightGet)
+	for _, light := range *resp.JSON200.Data {
+		lights[*light.Id] = light
+	}
+	return lights, nil
+}
+
+// GetRooms returns the rooms of the bridge by ID
+func (c *Client) GetRooms(ctx context.Context) (map[string]openhue.RoomGet, error) {
+	resp, err := c.api.GetRoomsWithResponse(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if resp.JSON200 == nil || resp.JSON200.Data == nil {
+		return nil, statusError(resp.HTTPResponse)
+	}
+	rooms := make(map[string]openhue.RoomGet)
+	for _, room := range *resp.JSON200.Data {
+		rooms[*room.Id] = room
+	}
+	return rooms, nil
+}
+
+// GetScenes returns the scenes of the bridge by ID
+func (c *Client) GetScenes(ctx context.Context) (map[string]openhue.SceneGet, error) {
+	resp, err := c.api.GetScenesWithResponse(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if resp.JSON200 == nil || resp.JSON200.Data == nil {
+		return nil, statusError(resp.HTTPResponse)
+	}
+	scenes := make(map[string]openhue.SceneGet)
+	for _, scene := range *resp.JSON200.Data {
+		scenes[*scene.Id] = scene
+	}
+	return scenes, nil
+}
+
+// UpdateLight sends a light update
+func (c *Client) UpdateLight(ctx context.Context, lightID string, body openhue.LightPut) error {
+	resp, err := c.api.UpdateLightWithResponse(ctx, lightID, body)
+	if err != nil {
+		return err
+	}
+	if resp.HTTPResponse.StatusCode >= 300 {
+		return statusError(resp.HTTPResponse)
+	}
+	return nil
+}
+
+// UpdateScene sends a scene update, such as a recall
+func (c *Client) UpdateScene(ctx context.Context, sceneID string, body openhue.ScenePut) error {
+	resp, err := c.api.UpdateSceneWithResponse(ctx, sceneID, body)
+	if err != nil {
+		return err
+	}
+	if resp.HTTPResponse.StatusCode >= 300 {
+		return statusError(resp.HTTPResponse)
+	}
+	return nil
+}
+
+// StatusError is an unexpected HTTP status returned by a bridge
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("bridge returned %s", e.Status)
+}
+
+// statusError describes an unexpected bridge response
+func statusError(resp *http.Response) error {
+	return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+}
@@ -1,7 +1,22 @@
 package hue
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestIsValidAPIKey(t *testing.T) {
@@ -52,3 +67,274 @@ func TestBridge(t *testing.T) {
 		t.Errorf("Expected bridge IP 192.168.1.100, got %s", bridge.IPAddress)
 	}
 }
+
+func TestBridgeFromTXT(t *testing.T) {
+	bridge := bridgeFromTXT([]string{"modelid=BSB002", "bridgeid=001788FFFE123456"})
+	if bridge.ID != "001788fffe123456" {
+		t.Errorf("Expected bridge ID 001788fffe123456, got %q", bridge.ID)
+	}
+}
+
+func TestDiscoverCloud(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"ECB5FAFFFE000002","internalipaddress":"192.168.1.20","port":443},` +
+			`{"id":"ecb5fafffe000001","internalipaddress":"192.168.1.10","port":443}]`))
+	}))
+	defer server.Close()
+
+	original := discoveryURL
+	discoveryURL = server.URL
+	defer func() { discoveryURL = original }()
+
+	bridges, err := discoverCloud(time.Second)
+	if err != nil {
+		t.Fatalf("discoverCloud failed: %v", err)
+	}
+	if len(bridges) != 2 {
+		t.Fatalf("Expected 2 bridges, got %d", len(bridges))
+	}
+	if bridges[0].IPAddress != "192.168.1.10" || bridges[0].ID != "ecb5fafffe000001" {
+		t.Errorf("Unexpected first bridge: %+v", bridges[0])
+	}
+	if bridges[1].ID != "ecb5fafffe000002" {
+		t.Errorf("Expected lowercased bridge ID, got %q", bridges[1].ID)
+	}
+}
+
+// testCertificate creates a certificate for commonName, signed by parent or self-signed
+func testCertificate(t *testing.T, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestIdentifyFromCertificate(t *testing.T) {
+	cert, key := testCertificate(t, "001788FFFE123456", nil, nil, false)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected the certificate to identify the bridge without a request")
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}}
+	server.StartTLS()
+	defer server.Close()
+
+	identity, err := identify(server.Listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("identify failed: %v", err)
+	}
+	if identity.ID != "001788fffe123456" {
+		t.Errorf("Expected bridge ID 001788fffe123456, got %q", identity.ID)
+	}
+	if identity.Fingerprint != Fingerprint(cert) || identity.Signed {
+		t.Errorf("Expected the self-signed certificate fingerprint, got %+v", identity)
+	}
+}
+
+func TestIdentifyFromConfig(t *testing.T) {
+	bridgeID := "ECB5FAFFFE000001"
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/0/config" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"name":"Hue Bridge","bridgeid":%q}`, bridgeID)
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "https://")
+
+	identity, err := identify(addr, time.Second)
+	if err != nil {
+		t.Fatalf("identify failed: %v", err)
+	}
+	if identity.ID != "ecb5fafffe000001" {
+		t.Errorf("Expected bridge ID ecb5fafffe000001, got %q", identity.ID)
+	}
+	if identity.Fingerprint != Fingerprint(server.Certificate()) {
+		t.Errorf("Expected the server certificate fingerprint, got %s", identity.Fingerprint)
+	}
+
+	bridgeID = ""
+	if _, err := identify(addr, time.Second); err == nil {
+		t.Error("Expected error for a server that is not a bridge")
+	}
+}
+
+func TestFindBridge(t *testing.T) {
+	ids := map[string]string{
+		"192.168.1.10": "ecb5fafffe000001",
+		"192.168.1.20": "ecb5fafffe000002",
+		"192.168.1.30": "ecb5fafffe000003",
+	}
+	identify := func(ip string) (*Identity, error) {
+		if id, ok := ids[ip]; ok {
+			return &Identity{IPAddress: ip, ID: id}, nil
+		}
+		return nil, fmt.Errorf("unreachable")
+	}
+	bridges := []Bridge{
+		{ID: "ecb5fafffe000001", IPAddress: "192.168.1.10"},
+		{ID: "", IPAddress: "192.168.1.20"},
+		// A stale entry: the announced ID no longer answers at this IP
+		{ID: "ecb5fafffe000003", IPAddress: "192.168.1.40"},
+	}
+
+	found, err := findBridge(bridges, "ecb5fafffe000002", identify)
+	if err != nil {
+		t.Fatalf("findBridge failed: %v", err)
+	}
+	if found.IPAddress != "192.168.1.20" || found.ID != "ecb5fafffe000002" {
+		t.Errorf("Unexpected bridge: %+v", found)
+	}
+
+	if _, err := findBridge(bridges, "ecb5fafffe000003", identify); err == nil {
+		t.Error("Expected error when the bridge does not identify at its announced IP")
+	}
+}
+
+func TestVerifyCertificate(t *testing.T) {
+	selfSigned, _ := testCertificate(t, "001788fffe123456", nil, nil, false)
+	pinned := Fingerprint(selfSigned)
+	if err := verifyCertificate([]*x509.Certificate{selfSigned}, "001788fffe123456", pinned); err != nil {
+		t.Errorf("Expected the pinned certificate to be trusted: %v", err)
+	}
+	if err := verifyCertificate([]*x509.Certificate{selfSigned}, "001788fffe123456", ""); err == nil {
+		t.Error("Expected a self-signed certificate without a pin to be rejected")
+	}
+	other, _ := testCertificate(t, "001788fffe123456", nil, nil, false)
+	if err := verifyCertificate([]*x509.Certificate{other}, "001788fffe123456", pinned); err == nil {
+		t.Error("Expected a certificate not matching the pin to be rejected")
+	}
+
+	// A certificate chaining to a trusted root must also be issued to the bridge
+	root, rootKey := testCertificate(t, "root-bridge", nil, nil, true)
+	original := rootCAs
+	rootCAs = x509.NewCertPool()
+	rootCAs.AddCert(root)
+	defer func() { rootCAs = original }()
+
+	signed, _ := testCertificate(t, "001788fffe123456", root, rootKey, false)
+	if err := verifyCertificate([]*x509.Certificate{signed}, "001788fffe123456", ""); err != nil {
+		t.Errorf("Expected a signed certificate to be trusted: %v", err)
+	}
+	if err := verifyCertificate([]*x509.Certificate{signed}, "001788fffe654321", ""); err == nil {
+		t.Error("Expected a signed certificate of another bridge to be rejected")
+	}
+}
+
+func TestRootCA(t *testing.T) {
+	block, _ := pem.Decode(rootCAPEM)
+	if block == nil {
+		t.Fatal("Expected a PEM root CA")
+	}
+	root, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("Failed to parse root CA: %v", err)
+	}
+	if err := root.CheckSignatureFrom(root); err != nil {
+		t.Errorf("Expected a self-signed root CA: %v", err)
+	}
+	if root.Subject.CommonName != "root-bridge" {
+		t.Errorf("Expected the Hue root-bridge CA, got %s", root.Subject)
+	}
+}
+
+func TestClientVerifiesCertificate(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("hue-application-key") != "key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"errors":[],"data":[{"id":"light-1","type":"light"}]}`))
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "https://")
+
+	client, err := NewClient(addr, "key", TLSConfig("", Fingerprint(server.Certificate())))
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	lights, err := client.GetLights(context.Background())
+	if err != nil {
+		t.Fatalf("Expected the pinned bridge to be reached: %v", err)
+	}
+	if _, ok := lights["light-1"]; !ok || len(lights) != 1 {
+		t.Errorf("Unexpected lights: %v", lights)
+	}
+
+	// Errors from the bridge carry the HTTP status
+	forbidden, _ := NewClient(addr, "wrong", TLSConfig("", Fingerprint(server.Certificate())))
+	var statusErr *StatusError
+	if _, err := forbidden.GetLights(context.Background()); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a 403 status error, got %v", err)
+	}
+
+	other, _ := testCertificate(t, "001788fffe123456", nil, nil, false)
+	client, err = NewClient(addr, "key", TLSConfig("", Fingerprint(other)))
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	if _, err := client.GetLights(context.Background()); err == nil || !strings.Contains(err.Error(), "does not match the pinned") {
+		t.Errorf("Expected a fingerprint mismatch error, got %v", err)
+	}
+}
+
+func TestAuthenticateWithBridge(t *testing.T) {
+	attempts := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		attempts++
+		if attempts < 3 {
+			w.Write([]byte(`[{"error":{"type":101,"address":"","description":"link button not pressed"}}]`))
+			return
+		}
+		w.Write([]byte(`[{"success":{"username":"new-key","clientkey":"client"}}]`))
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "https://")
+	tlsConfig := TLSConfig("", Fingerprint(server.Certificate()))
+
+	apiKey, err := AuthenticateWithBridge(context.Background(), addr, tlsConfig, nil)
+	if err != nil {
+		t.Fatalf("AuthenticateWithBridge failed: %v", err)
+	}
+	if apiKey != "new-key" || attempts != 3 {
+		t.Errorf("Expected new-key after 3 attempts, got %q after %d", apiKey, attempts)
+	}
+
+	// Without the link button pressed, pairing ends with the context
+	attempts = -1000
+	ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+	defer cancel()
+	if _, err := AuthenticateWithBridge(ctx, addr, tlsConfig, nil); err == nil || !strings.Contains(err.Error(), "in time") {
+		t.Errorf("Expected a timeout error, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := AuthenticateWithBridge(ctx, addr, tlsConfig, nil); err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Errorf("Expected a cancellation error, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package hue
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// rootCAPEM is the Signify root CA that signs the certificates of current Hue bridges
+//
+//go:embed hue_root_ca.pem
+var rootCAPEM []byte
+
+// rootCAs holds the Signify root CA
+var rootCAs = func() *x509.CertPool {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rootCAPEM) {
+		panic("hue: invalid root CA")
+	}
+	return pool
+}()
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate in lowercase hex
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// TLSConfig returns the TLS configuration for talking to a bridge. The bridge
+// must present a certificate signed by the Signify root CA for bridgeID, or a
+// certificate with the pinned fingerprint, as older bridges sign their own.
+// With neither a bridge ID nor a fingerprint, any certificate signed by the
+// Signify root CA is accepted.
+func TLSConfig(bridgeID, fingerprint string) *tls.Config {
+	return &tls.Config{
+		// Bridges are reached by IP, which their certificates do not name, so
+		// the standard verification is replaced by VerifyConnection
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyCertificate(cs.PeerCertificates, bridgeID, fingerprint)
+		},
+	}
+}
+
+// verifyCertificate checks a bridge certificate chain against the Signify root
+// CA and bridge ID, falling back to the pinned fingerprint
+func verifyCertificate(certs []*x509.Certificate, bridgeID, fingerprint string) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("bridge presented no certificate")
+	}
+	signedErr := verifySigned(certs, bridgeID)
+	if signedErr == nil {
+		return nil
+	}
+	if fingerprint == "" {
+		return fmt.Errorf("bridge certificate not trusted: %v, and no fingerprint is pinned", signedErr)
+	}
+	if got := Fingerprint(certs[0]); got != fingerprint {
+		return fmt.Errorf("bridge certificate not trusted: %v, and its fingerprint %s does not match the pinned %s", signedErr, got, fingerprint)
+	}
+	return nil
+}
+
+// verifySigned checks that a certificate chain leads to the Signify root CA
+// and, if bridgeID is set, that the certificate was issued to that bridge
+func verifySigned(certs []*x509.Certificate, bridgeID string) error {
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         rootCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return err
+	}
+	if id := strings.ToLower(certs[0].Subject.CommonName); bridgeID != "" && id != bridgeID {
+		return fmt.Errorf("certificate issued to bridge %s, expected %s", id, bridgeID)
+	}
+	return nil
+}
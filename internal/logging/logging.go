@@ -0,0 +1,229 @@
+// Package logging provides leveled, structured loggers per subsystem on top
+// of log/slog. Output is text or JSON, levels can be set per subsystem, and
+// messages repeated faster than a burst per second are dropped with a count
+// of what was suppressed, so a flood of OSC traffic cannot flood the log.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBurst is how many messages with the same text a subsystem may log per second
+const DefaultBurst = 50
+
+// sampleInterval is the period bursts are counted over
+const sampleInterval = time.Second
+
+// Options configure the log output
+type Options struct {
+	Level  string    // "info", or with levels per subsystem such as "info,osc=debug"
+	Format string    // "text" (default) or "json"
+	Output io.Writer // standard error if nil
+	Burst  int       // messages with the same text per subsystem and second, DefaultBurst if 0, unlimited if negative
+}
+
+// setup is the log output shared by every subsystem logger
+type setup struct {
+	handler slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level // subsystem -> level
+	sampler *sampler
+}
+
+var current atomic.Pointer[setup]
+
+func init() {
+	current.Store(&setup{
+		handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		levels:  map[string]slog.Level{},
+		sampler: newSampler(DefaultBurst),
+	})
+}
+
+// Setup configures the output of every logger, including those created
+// before, and routes the standard log package through the "main" subsystem
+func Setup(opts Options) error {
+	level, levels, err := ParseLevel(opts.Level)
+	if err != nil {
+		return err
+	}
+	out := opts.Output
+	if out == nil {
+		out = os.Stderr
+	}
+
+	// Levels are checked per subsystem before records reach the handler
+	handlerOpts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var handler slog.Handler
+	switch opts.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(out, handlerOpts)
+	case "json":
+		handler = slog.NewJSONHandler(out, handlerOpts)
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", opts.Format)
+	}
+
+	burst := opts.Burst
+	if burst == 0 {
+		burst = DefaultBurst
+	}
+	current.Store(&setup{handler: handler, level: level, levels: levels, sampler: newSampler(burst)})
+	slog.SetDefault(For("main"))
+	return nil
+}
+
+// ParseLevel parses a level such as "debug", or a default level followed by
+// levels per subsystem such as "warn,osc=debug,hue=info"
+func ParseLevel(spec string) (slog.Level, map[string]slog.Level, error) {
+	level := slog.LevelInfo
+	levels := make(map[string]slog.Level)
+	for i, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, name, found := strings.Cut(part, "=")
+		if !found {
+			name, subsystem = subsystem, ""
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(name)); err != nil {
+			return 0, nil, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", name)
+		}
+		switch {
+		case found && subsystem == "":
+			return 0, nil, fmt.Errorf("missing subsystem in log level %q", part)
+		case found:
+			levels[subsystem] = l
+		case i > 0:
+			return 0, nil, fmt.Errorf("the default log level must come first, got %q", part)
+		default:
+			level = l
+		}
+	}
+	return level, levels, nil
+}
+
+// For returns the logger of a subsystem such as "osc", "hue" or "config"
+func For(subsystem string) *slog.Logger {
+	return slog.New(&handler{subsystem: subsystem})
+}
+
+// handler adds the subsystem to records and passes them on to the current setup
+type handler struct {
+	subsystem string
+	wrap      []func(slog.Handler) slog.Handler // WithAttrs and WithGroup, in order
+}
+
+// Enabled reports whether the subsystem logs at level
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	s := current.Load()
+	min, ok := s.levels[h.subsystem]
+	if !ok {
+		min = s.level
+	}
+	return level >= min
+}
+
+// Handle writes a record unless it is repeated too often, first noting how
+// many of its repetitions were suppressed before
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	s := current.Load()
+	ok, suppressed := s.sampler.allow(h.subsystem, r.Level, r.Message, r.Time)
+	if !ok {
+		return nil
+	}
+	out := s.handler.WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	if suppressed > 0 {
+		note := slog.NewRecord(r.Time, r.Level, "Suppressed repeated messages", r.PC)
+		note.AddAttrs(slog.String("message", r.Message), slog.Int("count", suppressed))
+		if err := out.Handle(ctx, note); err != nil {
+			return err
+		}
+	}
+	for _, wrap := range h.wrap {
+		out = wrap(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+// WithAttrs returns a handler adding attrs to every record
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+// WithGroup returns a handler putting the attributes that follow into a group
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *handler) with(wrap func(slog.Handler) slog.Handler) slog.Handler {
+	return &handler{subsystem: h.subsystem, wrap: append(append([]func(slog.Handler) slog.Handler(nil), h.wrap...), wrap)}
+}
+
+// sampler counts messages by subsystem, level and text per interval
+type sampler struct {
+	mu     sync.Mutex
+	burst  int
+	counts map[string]*sample
+}
+
+// sample is the count of one message in the current interval
+type sample struct {
+	start      time.Time
+	n          int
+	suppressed int
+}
+
+func newSampler(burst int) *sampler {
+	return &sampler{burst: burst, counts: make(map[string]*sample)}
+}
+
+// allow reports whether a message may be logged at t, and how many of its
+// repetitions were suppressed since it was last logged
+func (s *sampler) allow(subsystem string, level slog.Level, msg string, t time.Time) (bool, int) {
+	if s.burst < 0 {
+		return true, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := subsystem + "\x00" + level.String() + "\x00" + msg
+	c := s.counts[key]
+	if c == nil {
+		if len(s.counts) >= 1000 {
+			s.prune(t)
+		}
+		c = &sample{start: t}
+		s.counts[key] = c
+	}
+	if t.Sub(c.start) >= sampleInterval {
+		c.start, c.n = t, 0
+	}
+	if c.n >= s.burst {
+		c.suppressed++
+		return false, 0
+	}
+	c.n++
+	suppressed := c.suppressed
+	c.suppressed = 0
+	return true, suppressed
+}
+
+// prune forgets messages not seen within the interval before t. The caller holds the lock.
+func (s *sampler) prune(t time.Time) {
+	for key, c := range s.counts {
+		if t.Sub(c.start) >= sampleInterval && c.suppressed == 0 {
+			delete(s.counts, key)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLevel(t *testing.T) {
+	level, levels, err := ParseLevel("warn,osc=debug,hue=error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level != slog.LevelWarn || levels["osc"] != slog.LevelDebug || levels["hue"] != slog.LevelError {
+		t.Errorf("Unexpected levels: %v %v", level, levels)
+	}
+	if level, _, err := ParseLevel(""); err != nil || level != slog.LevelInfo {
+		t.Errorf("Expected info by default, got %v, %v", level, err)
+	}
+	for _, spec := range []string{"loud", "osc=debug,info", "=debug", "info,osc=chatty"} {
+		if _, _, err := ParseLevel(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestSetupLevelsAndFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Setup(Options{Level: "info,osc=debug", Format: "json", Output: &buf}); err != nil {
+		t.Fatal(err)
+	}
+	defer Setup(Options{Level: "info"})
+
+	For("osc").Debug("Light updated", "light", "1")
+	For("hue").Debug("Request sent")
+	For("hue").Warn("Bridge unreachable", "bridge", "main")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got:\n%s", buf.String())
+	}
+	var rec map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["subsystem"] != "osc" || rec["msg"] != "Light updated" || rec["light"] != "1" || rec["level"] != "DEBUG" {
+		t.Errorf("Unexpected record: %v", rec)
+	}
+	if !strings.Contains(lines[1], `"bridge":"main"`) {
+		t.Errorf("Expected the hue warning, got %s", lines[1])
+	}
+
+	// The standard log package goes through the main subsystem
+	buf.Reset()
+	log.Printf("Starting %s", "up")
+	if !strings.Contains(buf.String(), `"subsystem":"main"`) || !strings.Contains(buf.String(), `"msg":"Starting up"`) {
+		t.Errorf("Expected log.Printf to be routed through slog, got %s", buf.String())
+	}
+}
+
+func TestSampler(t *testing.T) {
+	s := newSampler(2)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	passed := 0
+	for i := 0; i < 5; i++ {
+		if ok, _ := s.allow("osc", slog.LevelInfo, "Light updated", start.Add(time.Duration(i)*time.Millisecond)); ok {
+			passed++
+		}
+	}
+	if passed != 2 {
+		t.Errorf("Expected 2 messages to pass, got %d", passed)
+	}
+
+	// Other messages and subsystems are counted apart
+	if ok, _ := s.allow("hue", slog.LevelInfo, "Light updated", start); !ok {
+		t.Error("Expected another subsystem to log")
+	}
+
+	// The next interval reports what was suppressed
+	ok, suppressed := s.allow("osc", slog.LevelInfo, "Light updated", start.Add(time.Second))
+	if !ok || suppressed != 3 {
+		t.Errorf("Expected the message with 3 suppressed, got %v, %d", ok, suppressed)
+	}
+}
+
+func TestSuppressedNote(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Setup(Options{Level: "info", Output: &buf, Burst: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer Setup(Options{Level: "info"})
+
+	h := For("osc").Handler()
+	start := time.Now()
+	for _, at := range []time.Time{start, start.Add(time.Millisecond), start.Add(sampleInterval)} {
+		h.Handle(context.Background(), slog.NewRecord(at, slog.LevelInfo, "Light updated", 0))
+	}
+
+	out := buf.String()
+	if strings.Count(out, `msg="Light updated"`) != 2 || !strings.Contains(out, `msg="Suppressed repeated messages" subsystem=osc message="Light updated" count=1`) {
+		t.Errorf("Unexpected output:\n%s", out)
+	}
+}
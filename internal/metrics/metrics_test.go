@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Requests sent", "outcome", "status")
+	depth := r.Gauge("queue_depth", "Changes waiting", "light")
+	latency := r.Histogram("request_duration_seconds", "Request latency", []float64{0.1, 1})
+
+	requests.Inc("ok", "200")
+	requests.Inc("ok", "200")
+	requests.Inc("error", "429")
+	depth.Add(2, `a"b`)
+	depth.Add(-1, `a"b`)
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(3)
+
+	var b strings.Builder
+	if err := r.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP requests_total Requests sent
+# TYPE requests_total counter
+requests_total{outcome="error",status="429"} 1
+requests_total{outcome="ok",status="200"} 2
+# HELP queue_depth Changes waiting
+# TYPE queue_depth gauge
+queue_depth{light="a\"b"} 1
+# HELP request_duration_seconds Request latency
+# TYPE request_duration_seconds histogram
+request_duration_seconds_bucket{le="0.1"} 1
+request_duration_seconds_bucket{le="1"} 2
+request_duration_seconds_bucket{le="+Inf"} 3
+request_duration_seconds_sum 3.55
+request_duration_seconds_count 3
+`
+	if b.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", b.String(), expected)
+	}
+}
+
+func TestCounterIgnoresNegative(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("c", "Counter")
+	c.Add(2)
+	c.Add(-1)
+	if v := c.Value(); v != 2 {
+		t.Errorf("Expected 2, got %g", v)
+	}
+}
+
+func TestGaugeReset(t *testing.T) {
+	r := NewRegistry()
+	g := r.Gauge("up", "Up", "bridge")
+	g.Set(1, "main")
+	g.Reset()
+	g.Set(0, "attic")
+
+	var b strings.Builder
+	r.Write(&b)
+	if strings.Contains(b.String(), "main") || !strings.Contains(b.String(), `up{bridge="attic"} 0`) {
+		t.Errorf("Expected only the series set after the reset, got:\n%s", b.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	g := r.Gauge("connected", "Connected")
+	handler := r.Handler(func() { g.Set(1) })
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "connected 1\n") {
+		t.Errorf("Expected the gauge set before the scrape, got:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,184 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"osc2hue/internal/osc"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+)
+
+// timeFormat is the timestamp printed at the start of every line
+const timeFormat = "15:04:05.000"
+
+// Monitor pretty-prints OSC traffic and the Hue requests it causes
+type Monitor struct {
+	mu      sync.Mutex
+	w       io.Writer
+	filters []string
+	now     func() time.Time
+}
+
+// New creates a monitor writing to w. If filters are given only OSC messages
+// whose address matches one of them, or lies below one of them, are shown.
+func New(w io.Writer, filters []string) *Monitor {
+	return &Monitor{w: w, filters: filters, now: time.Now}
+}
+
+// Matches reports whether an address passes the monitor's filters
+func (m *Monitor) Matches(address string) bool {
+	if len(m.filters) == 0 {
+		return true
+	}
+	for _, filter := range m.filters {
+		// A filter also matches everything below it, so /hue/group shows /hue/group/1/on
+		prefix := address
+		for prefix != "" {
+			if osc.Match(filter, prefix) {
+				return true
+			}
+			i := strings.LastIndex(prefix, "/")
+			if i < 0 {
+				break
+			}
+			prefix = prefix[:i]
+		}
+	}
+	return false
+}
+
+// PacketReceived prints a packet read from the network
+func (m *Monitor) PacketReceived(from net.Addr, packet gosc.Packet) {
+	var lines []string
+	switch p := packet.(type) {
+	case *gosc.Message:
+		if m.Matches(p.Address) {
+			lines = append(lines, fmt.Sprintf("%-21s %s", from, FormatMessage(p)))
+		}
+	case *gosc.Bundle:
+		body := m.bundleLines(p, "  ")
+		if len(body) > 0 {
+			lines = append(lines, fmt.Sprintf("%-21s #bundle %s", from, formatTimetag(p.Timetag, m.now())))
+			lines = append(lines, body...)
+		}
+	}
+	m.print(lines...)
+}
+
+// bundleLines formats the messages of a bundle that pass the filters, recursing into nested bundles
+func (m *Monitor) bundleLines(b *gosc.Bundle, indent string) []string {
+	var lines []string
+	for _, msg := range b.Messages {
+		if m.Matches(msg.Address) {
+			lines = append(lines, indent+FormatMessage(msg))
+		}
+	}
+	for _, nested := range b.Bundles {
+		body := m.bundleLines(nested, indent+"  ")
+		if len(body) > 0 {
+			lines = append(lines, indent+"#bundle "+formatTimetag(nested.Timetag, m.now()))
+			lines = append(lines, body...)
+		}
+	}
+	return lines
+}
+
+// PacketError prints a packet that could not be parsed
+func (m *Monitor) PacketError(from net.Addr, err error) {
+	m.print(fmt.Sprintf("%-21s invalid packet: %v", from, err))
+}
+
+// MessageDispatched prints the handlers a message is routed to
+func (m *Monitor) MessageDispatched(msg *gosc.Message, matched []string) {
+	if !m.Matches(msg.Address) {
+		return
+	}
+	if len(matched) == 0 {
+		m.print(fmt.Sprintf("%-21s %s -> no handler", "dispatch", msg.Address))
+		return
+	}
+	m.print(fmt.Sprintf("%-21s %s -> %s", "dispatch", msg.Address, strings.Join(matched, ", ")))
+}
+
+// HueRequest prints a request sent to the Hue bridge and its outcome
+func (m *Monitor) HueRequest(resource, id string, body interface{}, took time.Duration, err error) {
+	payload, jsonErr := json.Marshal(body)
+	if jsonErr != nil {
+		payload = []byte(fmt.Sprintf("%+v", body))
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = err.Error()
+	}
+	m.print(fmt.Sprintf("%-21s PUT %s/%s %s -> %s (%v)", "hue", resource, id, payload, outcome, took.Round(time.Millisecond)))
+}
+
+// print writes lines prefixed with the current time
+func (m *Monitor) print(lines ...string) {
+	if len(lines) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stamp := m.now().Format(timeFormat)
+	for _, line := range lines {
+		fmt.Fprintf(m.w, "%s  %s\n", stamp, line)
+	}
+}
+
+// FormatMessage formats a message as its address, type tags and decoded arguments
+func FormatMessage(msg *gosc.Message) string {
+	var b strings.Builder
+	b.WriteString(msg.Address)
+	tags, err := msg.TypeTags()
+	if err != nil {
+		tags = ",?"
+	}
+	b.WriteString(" ")
+	b.WriteString(tags)
+	for _, arg := range msg.Arguments {
+		b.WriteString(" ")
+		b.WriteString(formatArgument(arg))
+	}
+	return b.String()
+}
+
+// formatArgument formats one OSC argument
+func formatArgument(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case float32:
+		return fmt.Sprintf("%g", v)
+	case float64:
+		return fmt.Sprintf("%g", v)
+	case []byte:
+		return fmt.Sprintf("<blob %d bytes>", len(v))
+	case nil:
+		return "nil"
+	case gosc.Timetag:
+		return v.Time().Format(timeFormat)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// formatTimetag formats a bundle timetag relative to now, 1 meaning immediately
+func formatTimetag(tt gosc.Timetag, now time.Time) string {
+	if tt.TimeTag() <= 1 {
+		return "immediate"
+	}
+	t := tt.Time()
+	d := t.Sub(now).Round(time.Millisecond)
+	if d < 0 {
+		return fmt.Sprintf("%s (%v late)", t.Format(timeFormat), -d)
+	}
+	return fmt.Sprintf("%s (in %v)", t.Format(timeFormat), d)
+}
@@ -0,0 +1,105 @@
+package monitor
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+)
+
+func newTestMonitor(filters ...string) (*Monitor, *bytes.Buffer) {
+	var buf bytes.Buffer
+	m := New(&buf, filters)
+	m.now = func() time.Time { return time.Date(2024, 1, 1, 12, 0, 1, 234e6, time.Local) }
+	return m, &buf
+}
+
+func TestMatches(t *testing.T) {
+	m, _ := newTestMonitor("/hue/1/*", "/hue/group")
+
+	tests := []struct {
+		address  string
+		expected bool
+	}{
+		{"/hue/1/on", true},
+		{"/hue/2/on", false},
+		{"/hue/group/1/set", true},
+		{"/hue/groups", false},
+	}
+
+	for _, tt := range tests {
+		if got := m.Matches(tt.address); got != tt.expected {
+			t.Errorf("Matches(%q) = %v, expected %v", tt.address, got, tt.expected)
+		}
+	}
+
+	if unfiltered, _ := newTestMonitor(); !unfiltered.Matches("/anything") {
+		t.Error("Expected a monitor without filters to match everything")
+	}
+}
+
+func TestPacketReceived(t *testing.T) {
+	m, buf := newTestMonitor()
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 57120}
+
+	m.PacketReceived(from, gosc.NewMessage("/hue/1/set", float32(0.3), float32(0.3), float32(0.8), int32(-1)))
+
+	expected := "12:00:01.234  192.168.1.5:57120     /hue/1/set ,fffi 0.3 0.3 0.8 -1\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%q\nexpected:\n%q", buf.String(), expected)
+	}
+}
+
+func TestPacketReceivedBundle(t *testing.T) {
+	m, buf := newTestMonitor("/hue/1/*")
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 57120}
+
+	bundle := gosc.NewBundle(time.Date(2024, 1, 1, 12, 0, 1, 734e6, time.Local))
+	bundle.Append(gosc.NewMessage("/hue/1/on", int32(1)))
+	bundle.Append(gosc.NewMessage("/hue/2/on", int32(1)))
+	m.PacketReceived(from, bundle)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected bundle header and one message, got:\n%s", buf.String())
+	}
+	if !strings.Contains(lines[0], "#bundle 12:00:01.734 (in 500ms)") {
+		t.Errorf("Expected bundle timetag in %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "  /hue/1/on ,i 1") {
+		t.Errorf("Expected indented message in %q", lines[1])
+	}
+
+	buf.Reset()
+	filtered := gosc.NewBundle(time.Now())
+	filtered.Append(gosc.NewMessage("/hue/2/on", int32(1)))
+	m.PacketReceived(from, filtered)
+	if buf.Len() != 0 {
+		t.Errorf("Expected filtered bundle to print nothing, got %q", buf.String())
+	}
+}
+
+func TestMessageDispatchedAndHueRequest(t *testing.T) {
+	m, buf := newTestMonitor()
+
+	m.MessageDispatched(gosc.NewMessage("/hue/1/on", int32(1)), []string{"/hue/1/on"})
+	m.MessageDispatched(gosc.NewMessage("/hue/9/on", int32(1)), nil)
+	m.HueRequest("light", "uuid-a", map[string]bool{"on": true}, 42*time.Millisecond, nil)
+	m.HueRequest("light", "uuid-b", nil, time.Millisecond, errors.New("timeout"))
+
+	output := buf.String()
+	for _, want := range []string{
+		"/hue/1/on -> /hue/1/on",
+		"/hue/9/on -> no handler",
+		`PUT light/uuid-a {"on":true} -> ok (42ms)`,
+		"PUT light/uuid-b null -> timeout",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected %q in output:\n%s", want, output)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"osc2hue/internal/command"
+	"osc2hue/internal/logging"
+	"osc2hue/internal/state"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// logger is the log of the mqtt subsystem
+var logger = logging.For("mqtt")
+
+const (
+	defaultTopicPrefix     = "osc2hue"
+	defaultDiscoveryPrefix = "homeassistant"
+	publishTimeout         = 5 * time.Second
+)
+
+// Options holds MQTT connection settings
+type Options struct {
+	Broker          string // e.g. tcp://localhost:1883
+	ClientID        string
+	Username        string
+	Password        string
+	TopicPrefix     string // defaults to osc2hue
+	HomeAssistant   bool   // publish Home Assistant discovery config
+	DiscoveryPrefix string // defaults to homeassistant
+}
+
+// Light identifies a light exposed over MQTT
+type Light struct {
+	ID   string
+	Name string
+}
+
+// CommandHandler receives a decoded command for the light reference found in the topic
+type CommandHandler func(light string, cmd command.Light)
+
+// Client bridges lights to an MQTT broker: it receives commands and publishes retained state
+type Client struct {
+	opts        Options
+	client      paho.Client
+	lights      []Light
+	store       *state.Store
+	onCommand   CommandHandler
+	unsubscribe func()
+	done        chan struct{}
+}
+
+// Connect connects to the broker, subscribes to light commands and starts publishing state changes
+func Connect(opts Options, lights []Light, store *state.Store, onCommand CommandHandler) (*Client, error) {
+	if opts.TopicPrefix == "" {
+		opts.TopicPrefix = defaultTopicPrefix
+	}
+	if opts.DiscoveryPrefix == "" {
+		opts.DiscoveryPrefix = defaultDiscoveryPrefix
+	}
+	if opts.ClientID == "" {
+		opts.ClientID = opts.TopicPrefix
+	}
+
+	c := &Client{
+		opts:      opts,
+		lights:    lights,
+		store:     store,
+		onCommand: onCommand,
+		done:      make(chan struct{}),
+	}
+
+	clientOpts := paho.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientID).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetAutoReconnect(true).
+		SetOrderMatters(false).
+		SetWill(c.availabilityTopic(), "offline", 1, true).
+		SetOnConnectHandler(c.onConnect).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			logger.Warn("MQTT connection lost", "error", err)
+		})
+
+	c.client = paho.NewClient(clientOpts)
+	token := c.client.Connect()
+	if !token.WaitTimeout(publishTimeout) {
+		return nil, fmt.Errorf("timed out connecting to MQTT broker %s", opts.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("failed to connect to MQTT broker %s: %v", opts.Broker, err)
+	}
+
+	changes, unsubscribe := store.Subscribe()
+	c.unsubscribe = unsubscribe
+	go c.publishChanges(changes)
+
+	return c, nil
+}
+
+// Close publishes offline availability and disconnects
+func (c *Client) Close() {
+	c.unsubscribe()
+	<-c.done
+
+	c.publish(c.availabilityTopic(), "offline")
+	c.client.Disconnect(250)
+}
+
+// onConnect (re)subscribes and publishes availability, discovery and current state after every connection
+func (c *Client) onConnect(client paho.Client) {
+	logger.Info("Connected to MQTT broker", "broker", c.opts.Broker)
+
+	token := client.Subscribe(c.opts.TopicPrefix+"/light/+/set", 1, c.handleSet)
+	if token.WaitTimeout(publishTimeout) && token.Error() != nil {
+		logger.Error("Failed to subscribe to MQTT commands", "error", token.Error())
+	}
+
+	c.publish(c.availabilityTopic(), "online")
+
+	if c.opts.HomeAssistant {
+		for _, light := range c.lights {
+			if err := c.publishDiscovery(light); err != nil {
+				logger.Error("Failed to publish Home Assistant discovery", "light", light.ID, "error", err)
+			}
+		}
+	}
+
+	for lightID, st := range c.store.All() {
+		c.publishState(lightID, st)
+	}
+}
+
+// handleSet decodes a command published on {prefix}/light/{id}/set
+func (c *Client) handleSet(_ paho.Client, msg paho.Message) {
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) < 3 {
+		return
+	}
+	light := parts[len(parts)-2]
+
+	var cmd command.Light
+	if err := json.Unmarshal(msg.Payload(), &cmd); err != nil {
+		logger.Warn("Invalid MQTT command", "light", light, "error", err)
+		return
+	}
+	c.onCommand(light, cmd)
+}
+
+// publishChanges publishes every state change until unsubscribed
+func (c *Client) publishChanges(changes <-chan state.Change) {
+	defer close(c.done)
+	for change := range changes {
+		c.publishState(change.LightID, change.State)
+	}
+}
+
+// publishState publishes the retained state of a light
+func (c *Client) publishState(lightID string, st state.LightState) {
+	payload, err := json.Marshal(st)
+	if err != nil {
+		logger.Error("Failed to encode MQTT state", "light", lightID, "error", err)
+		return
+	}
+	c.publish(c.stateTopic(lightID), payload)
+}
+
+// publishDiscovery publishes the Home Assistant MQTT light config for a light
+func (c *Client) publishDiscovery(light Light) error {
+	payload, err := json.Marshal(c.discoveryConfig(light))
+	if err != nil {
+		return err
+	}
+	c.publish(fmt.Sprintf("%s/light/%s_%s/config", c.opts.DiscoveryPrefix, c.opts.TopicPrefix, light.ID), payload)
+	return nil
+}
+
+// discoveryConfig builds a Home Assistant template schema light translating to and from osc2hue payloads
+func (c *Client) discoveryConfig(light Light) map[string]interface{} {
+	uniqueID := fmt.Sprintf("%s_%s", c.opts.TopicPrefix, light.ID)
+	duration := `{%- if transition is defined -%},"duration_ms":{{ (transition * 1000) | int }}{%- endif -%}`
+
+	return map[string]interface{}{
+		"name":                 light.Name,
+		"unique_id":            uniqueID,
+		"schema":               "template",
+		"command_topic":        fmt.Sprintf("%s/light/%s/set", c.opts.TopicPrefix, light.ID),
+		"state_topic":          c.stateTopic(light.ID),
+		"availability_topic":   c.availabilityTopic(),
+		"command_on_template":  `{"on":true{%- if brightness is defined -%},"brightness":{{ brightness / 255 }}{%- endif -%}` + duration + `}`,
+		"command_off_template": `{"on":false` + duration + `}`,
+		"state_template":       "{{ 'on' if value_json.on else 'off' }}",
+		"brightness_template":  "{{ (value_json.brightness * 255) | round(0) | int }}",
+		"device": map[string]interface{}{
+			"identifiers": []string{uniqueID},
+			"name":        light.Name,
+		},
+	}
+}
+
+// publish sends a retained message and logs failures
+func (c *Client) publish(topic string, payload interface{}) {
+	token := c.client.Publish(topic, 1, true, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		logger.Warn("Timed out publishing MQTT message", "topic", topic)
+	} else if err := token.Error(); err != nil {
+		logger.Error("Failed to publish MQTT message", "topic", topic, "error", err)
+	}
+}
+
+// stateTopic returns the retained state topic of a light
+func (c *Client) stateTopic(lightID string) string {
+	return fmt.Sprintf("%s/light/%s/state", c.opts.TopicPrefix, lightID)
+}
+
+// availabilityTopic returns the retained online/offline topic
+func (c *Client) availabilityTopic() string {
+	return c.opts.TopicPrefix + "/status"
+}
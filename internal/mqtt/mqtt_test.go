@@ -0,0 +1,149 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"osc2hue/internal/command"
+	"osc2hue/internal/state"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// startBroker runs an embedded MQTT broker on a random local port and returns its URL
+func startBroker(t *testing.T) string {
+	t.Helper()
+
+	server := mochi.New(&mochi.Options{
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		InlineClient: true,
+	})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatalf("Failed to add auth hook: %v", err)
+	}
+
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := server.AddListener(tcp); err != nil {
+		t.Fatalf("Failed to add listener: %v", err)
+	}
+
+	go func() {
+		if err := server.Serve(); err != nil {
+			t.Errorf("Broker failed: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	return "tcp://" + tcp.Address()
+}
+
+// connectTestClient connects a plain MQTT client to the broker
+func connectTestClient(t *testing.T, broker string) paho.Client {
+	t.Helper()
+
+	client := paho.NewClient(paho.NewClientOptions().AddBroker(broker).SetClientID("test-client"))
+	token := client.Connect()
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Failed to connect test client: %v", token.Error())
+	}
+	t.Cleanup(func() {
+		client.Disconnect(100)
+	})
+	return client
+}
+
+func TestClientReceivesCommands(t *testing.T) {
+	broker := startBroker(t)
+
+	commands := make(chan command.Light, 1)
+	lights := make(chan string, 1)
+	client, err := Connect(Options{Broker: broker}, nil, state.NewStore(), func(light string, cmd command.Light) {
+		lights <- light
+		commands <- cmd
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	publisher := connectTestClient(t, broker)
+
+	// The subscription is set up asynchronously after connecting
+	deadline := time.After(5 * time.Second)
+	for {
+		publisher.Publish("osc2hue/light/1/set", 1, false, `{"x": 0.4, "y": 0.5, "brightness": 0.8}`).Wait()
+		select {
+		case light := <-lights:
+			cmd := <-commands
+			if light != "1" {
+				t.Errorf("Expected light 1, got %s", light)
+			}
+			if cmd.X == nil || *cmd.X != 0.4 || cmd.Brightness == nil || *cmd.Brightness != 0.8 {
+				t.Errorf("Unexpected command: %+v", cmd)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Timed out waiting for command")
+		}
+	}
+}
+
+func TestClientPublishesState(t *testing.T) {
+	broker := startBroker(t)
+	store := state.NewStore()
+
+	client, err := Connect(Options{Broker: broker, HomeAssistant: true}, []Light{{ID: "light-1", Name: "Desk"}}, store, func(string, command.Light) {})
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	store.Set("light-1", state.LightState{On: true, Brightness: 0.25, X: 0.3, Y: 0.3})
+
+	subscriber := connectTestClient(t, broker)
+	received := make(chan paho.Message, 16)
+	subscriber.Subscribe("#", 1, func(_ paho.Client, msg paho.Message) {
+		received <- msg
+	}).Wait()
+
+	// Retained messages are delivered on subscription, state may be republished once more
+	seen := make(map[string][]byte)
+	timeout := time.After(5 * time.Second)
+	for len(seen) < 3 {
+		select {
+		case msg := <-received:
+			seen[msg.Topic()] = msg.Payload()
+		case <-timeout:
+			t.Fatalf("Timed out waiting for retained messages, got %v", seen)
+		}
+	}
+
+	if string(seen["osc2hue/status"]) != "online" {
+		t.Errorf("Expected online availability, got %q", seen["osc2hue/status"])
+	}
+
+	var st state.LightState
+	if err := json.Unmarshal(seen["osc2hue/light/light-1/state"], &st); err != nil {
+		t.Fatalf("Invalid state payload: %v", err)
+	}
+	if !st.On || st.Brightness != 0.25 {
+		t.Errorf("Unexpected published state: %+v", st)
+	}
+
+	var discovery map[string]interface{}
+	if err := json.Unmarshal(seen["homeassistant/light/osc2hue_light-1/config"], &discovery); err != nil {
+		t.Fatalf("Invalid discovery payload: %v", err)
+	}
+	if discovery["command_topic"] != "osc2hue/light/light-1/set" || discovery["name"] != "Desk" {
+		t.Errorf("Unexpected discovery config: %v", discovery)
+	}
+}
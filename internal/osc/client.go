@@ -0,0 +1,45 @@
+package osc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+)
+
+// ParseArgument converts a command line argument to an OSC argument:
+// integers become int32, decimals float32, true/false bool, anything else a string
+func ParseArgument(s string) interface{} {
+	if i, err := strconv.ParseInt(s, 10, 32); err == nil {
+		return int32(i)
+	}
+	if f, err := strconv.ParseFloat(s, 32); err == nil {
+		return float32(f)
+	}
+	switch strings.ToLower(s) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return s
+}
+
+// Send sends a single OSC message to host:port
+func Send(host string, port int, address string, args ...interface{}) error {
+	if !strings.HasPrefix(address, "/") {
+		return fmt.Errorf("invalid OSC address %q: must start with /", address)
+	}
+
+	return SendPacket(host, port, gosc.NewMessage(address, args...))
+}
+
+// SendPacket sends an OSC message or bundle to host:port
+func SendPacket(host string, port int, packet gosc.Packet) error {
+	client := gosc.NewClient(host, port)
+	if err := client.Send(packet); err != nil {
+		return fmt.Errorf("failed to send packet to %s:%d: %v", host, port, err)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package osc
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+)
+
+// dispatcher routes messages to handlers by address. Unlike gosc.StandardDispatcher
+// it is safe for concurrent use and reports which handlers matched each message.
+type dispatcher struct {
+	mu              sync.RWMutex
+	handlers        map[string]gosc.HandlerFunc
+	defaultHandlers []gosc.HandlerFunc
+	observers       []Observer
+
+	// pending counts the packets being dispatched, including bundles waiting
+	// for their timetag. Once closed, packets are dropped and done is closed
+	// to cancel the bundles that are not due yet.
+	workMu  sync.Mutex
+	closed  bool
+	pending sync.WaitGroup
+	done    chan struct{}
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{handlers: make(map[string]gosc.HandlerFunc), done: make(chan struct{})}
+}
+
+// begin counts a packet as being dispatched, it returns false once the dispatcher is closed
+func (d *dispatcher) begin() bool {
+	d.workMu.Lock()
+	defer d.workMu.Unlock()
+	if d.closed {
+		return false
+	}
+	d.pending.Add(1)
+	return true
+}
+
+// close drops the packets dispatched from now on and cancels the bundles that are not due yet
+func (d *dispatcher) close() {
+	d.workMu.Lock()
+	defer d.workMu.Unlock()
+	if !d.closed {
+		d.closed = true
+		close(d.done)
+	}
+}
+
+// wait waits until no packet is being dispatched, or ctx is done
+func (d *dispatcher) wait(ctx context.Context) error {
+	idle := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// addHandler registers a handler for an exact address, or for every message if addr is "*"
+func (d *dispatcher) addHandler(addr string, handler gosc.HandlerFunc) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if addr == "*" {
+		d.defaultHandlers = append(d.defaultHandlers, handler)
+		return nil
+	}
+	if strings.ContainsAny(addr, "*?,[]{}# ") {
+		return errors.New("OSC address may not contain any characters in \"*?,[]{}# \"")
+	}
+	if _, exists := d.handlers[addr]; exists {
+		return errors.New("OSC address exists already")
+	}
+
+	d.handlers[addr] = handler
+	return nil
+}
+
+// replaceHandlers swaps in a new set of address handlers, keeping the default handlers
+func (d *dispatcher) replaceHandlers(handlers map[string]gosc.HandlerFunc) {
+	d.mu.Lock()
+	d.handlers = handlers
+	d.mu.Unlock()
+}
+
+// addObserver adds an observer notified of every dispatched message
+func (d *dispatcher) addObserver(o Observer) {
+	d.mu.Lock()
+	d.observers = append(d.observers, o)
+	d.mu.Unlock()
+}
+
+// dispatch routes a message to its handlers, or a bundle's messages once its
+// timetag is due. Nothing is dispatched once the dispatcher is closed.
+func (d *dispatcher) dispatch(packet gosc.Packet) {
+	if !d.begin() {
+		return
+	}
+	switch p := packet.(type) {
+	case *gosc.Message:
+		defer d.pending.Done()
+		d.dispatchMessage(p)
+	case *gosc.Bundle:
+		timer := time.NewTimer(p.Timetag.ExpiresIn())
+		go func() {
+			defer d.pending.Done()
+			select {
+			case <-timer.C:
+			case <-d.done:
+				timer.Stop()
+				return
+			}
+			for _, msg := range p.Messages {
+				d.dispatchMessage(msg)
+			}
+			for _, b := range p.Bundles {
+				d.dispatch(b)
+			}
+		}()
+	default:
+		d.pending.Done()
+	}
+}
+
+// dispatchMessage runs every handler whose address matches the message address pattern
+func (d *dispatcher) dispatchMessage(msg *gosc.Message) {
+	d.mu.RLock()
+	var matched []string
+	var handlers []gosc.HandlerFunc
+	for addr, handler := range d.handlers {
+		if Match(msg.Address, addr) {
+			matched = append(matched, addr)
+			handlers = append(handlers, handler)
+		}
+	}
+	handlers = append(handlers, d.defaultHandlers...)
+	observers := d.observers
+	d.mu.RUnlock()
+
+	sort.Strings(matched)
+	for _, o := range observers {
+		o.MessageDispatched(msg, matched)
+	}
+	for _, handler := range handlers {
+		handler(msg)
+	}
+}
+
+// patternCache holds compiled address patterns
+var patternCache sync.Map
+
+// Match reports whether an OSC address matches an OSC address pattern.
+// * matches any run of characters and ? any single character within one
+// path segment, [abc] and [!a-z] match character sets and {foo,bar} matches
+// any of the listed strings.
+func Match(pattern, address string) bool {
+	if !strings.ContainsAny(pattern, "*?[{") {
+		return pattern == address
+	}
+
+	re, ok := patternCache.Load(pattern)
+	if !ok {
+		compiled, err := compilePattern(pattern)
+		if err != nil {
+			return false
+		}
+		re, _ = patternCache.LoadOrStore(pattern, compiled)
+	}
+	return re.(*regexp.Regexp).MatchString(address)
+}
+
+// compilePattern translates an OSC address pattern into an anchored regular expression
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	inSet, inAlt := false, false
+	for i, r := range pattern {
+		switch {
+		case inSet:
+			switch r {
+			case ']':
+				inSet = false
+				b.WriteRune(r)
+			case '!':
+				if pattern[i-1] == '[' {
+					b.WriteRune('^')
+				} else {
+					b.WriteString(`\!`)
+				}
+			case '-':
+				b.WriteRune(r)
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		case r == '*':
+			b.WriteString(`[^/]*`)
+		case r == '?':
+			b.WriteString(`[^/]`)
+		case r == '[':
+			inSet = true
+			b.WriteRune(r)
+		case r == '{':
+			inAlt = true
+			b.WriteString(`(?:`)
+		case r == '}' && inAlt:
+			inAlt = false
+			b.WriteString(`)`)
+		case r == ',' && inAlt:
+			b.WriteString(`|`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
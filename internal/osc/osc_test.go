@@ -1,7 +1,13 @@
 package osc
 
 import (
+	"context"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	gosc "github.com/hypebeast/go-osc/osc"
 )
 
 func TestNewServer(t *testing.T) {
@@ -46,3 +52,315 @@ func TestServerConfiguration(t *testing.T) {
 		})
 	}
 }
+
+func TestDispatch(t *testing.T) {
+	server := NewServer("127.0.0.1", 8080)
+
+	var received *gosc.Message
+	server.AddHandler("/hue/1/on", func(msg *gosc.Message) {
+		received = msg
+	})
+
+	server.Dispatch(gosc.NewMessage("/hue/1/on", int32(1)))
+	if received == nil {
+		t.Fatal("Expected handler to receive dispatched message")
+	}
+	if received.Arguments[0] != int32(1) {
+		t.Errorf("Expected argument 1, got %v", received.Arguments[0])
+	}
+
+	received = nil
+	server.Dispatch(gosc.NewMessage("/hue/2/on", int32(1)))
+	if received != nil {
+		t.Error("Expected no handler for unregistered address")
+	}
+}
+
+func TestParseArgument(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected interface{}
+	}{
+		{"1", int32(1)},
+		{"-1", int32(-1)},
+		{"0.5", float32(0.5)},
+		{"true", true},
+		{"False", false},
+		{"kitchen", "kitchen"},
+	}
+
+	for _, tt := range tests {
+		if got := ParseArgument(tt.in); got != tt.expected {
+			t.Errorf("ParseArgument(%q) = %#v, expected %#v", tt.in, got, tt.expected)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if err := Send("127.0.0.1", port, "/hue/1/on", int32(1)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Failed to read packet: %v", err)
+	}
+
+	packet, err := gosc.ParsePacket(string(buf[:n]))
+	if err != nil {
+		t.Fatalf("Failed to parse packet: %v", err)
+	}
+	msg, ok := packet.(*gosc.Message)
+	if !ok || msg.Address != "/hue/1/on" || msg.Arguments[0] != int32(1) {
+		t.Errorf("Unexpected packet: %v", packet)
+	}
+
+	if err := Send("127.0.0.1", port, "hue/1/on"); err == nil {
+		t.Error("Expected error for address without leading slash")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		address  string
+		expected bool
+	}{
+		{"/hue/1/on", "/hue/1/on", true},
+		{"/hue/1/on", "/hue/11/on", false},
+		{"/hue/*/on", "/hue/12/on", true},
+		{"/hue/*/on", "/hue/group/1/on", false},
+		{"/hue/?/on", "/hue/1/on", true},
+		{"/hue/?/on", "/hue/12/on", false},
+		{"/hue/[1-3]/on", "/hue/2/on", true},
+		{"/hue/[!1-3]/on", "/hue/2/on", false},
+		{"/hue/1/{on,set}", "/hue/1/set", true},
+		{"/hue/1/{on,set}", "/hue/1/color", false},
+		{"/hue/1.5/on", "/hue/1x5/on", false},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.pattern, tt.address); got != tt.expected {
+			t.Errorf("Match(%q, %q) = %v, expected %v", tt.pattern, tt.address, got, tt.expected)
+		}
+	}
+}
+
+type recordingObserver struct {
+	from     chan net.Addr
+	matched  chan []string
+	received chan gosc.Packet
+}
+
+func (o *recordingObserver) PacketReceived(from net.Addr, packet gosc.Packet) {
+	o.from <- from
+	o.received <- packet
+}
+
+func (o *recordingObserver) PacketError(from net.Addr, err error) {}
+
+func (o *recordingObserver) MessageDispatched(msg *gosc.Message, matched []string) {
+	o.matched <- matched
+}
+
+func TestServerObserver(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve port: %v", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	server := NewServer("127.0.0.1", port)
+	handled := make(chan *gosc.Message, 16)
+	server.AddHandler("/hue/1/on", func(msg *gosc.Message) { handled <- msg })
+	server.AddHandler("/hue/2/on", func(msg *gosc.Message) { handled <- msg })
+	observer := &recordingObserver{
+		from:     make(chan net.Addr, 16),
+		matched:  make(chan []string, 16),
+		received: make(chan gosc.Packet, 16),
+	}
+	server.AddObserver(observer)
+
+	done := make(chan error, 1)
+	go func() { done <- server.Start() }()
+	defer func() {
+		server.Stop()
+		if err := <-done; err != nil {
+			t.Errorf("Start returned error after Stop: %v", err)
+		}
+	}()
+
+	// Retry until the server is listening
+	var from net.Addr
+	deadline := time.After(2 * time.Second)
+	for from == nil {
+		if err := Send("127.0.0.1", port, "/hue/1/on", int32(1)); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		select {
+		case from = <-observer.from:
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Timed out waiting for packet")
+		}
+	}
+
+	if from.(*net.UDPAddr).IP.String() != "127.0.0.1" {
+		t.Errorf("Expected source 127.0.0.1, got %v", from)
+	}
+	if msg := (<-observer.received).(*gosc.Message); msg.Address != "/hue/1/on" {
+		t.Errorf("Expected /hue/1/on, got %s", msg.Address)
+	}
+	if matched := <-observer.matched; len(matched) != 1 || matched[0] != "/hue/1/on" {
+		t.Errorf("Expected only /hue/1/on to match, got %v", matched)
+	}
+	if msg := <-handled; msg.Arguments[0] != int32(1) {
+		t.Errorf("Expected argument 1, got %v", msg.Arguments[0])
+	}
+}
+
+func TestServerRebindAndReplaceHandlers(t *testing.T) {
+	server := NewServer("127.0.0.1", 0)
+	old := make(chan string, 16)
+	replaced := make(chan string, 16)
+	defaults := make(chan string, 16)
+	server.AddHandler("/hue/1/on", func(msg *gosc.Message) { old <- msg.Address })
+	server.AddHandler("*", func(msg *gosc.Message) { defaults <- msg.Address })
+
+	done := make(chan error, 1)
+	go func() { done <- server.Start() }()
+	defer func() {
+		server.Stop()
+		if err := <-done; err != nil {
+			t.Errorf("Start returned error after Stop: %v", err)
+		}
+	}()
+
+	// sendUntil retries until a message reaches the channel, the server may still be starting
+	sendUntil := func(port int, address string, received chan string) {
+		t.Helper()
+		deadline := time.After(2 * time.Second)
+		for {
+			Send("127.0.0.1", port, address, int32(1))
+			select {
+			case got := <-received:
+				if got != address {
+					t.Errorf("Expected %s, got %s", address, got)
+				}
+				return
+			case <-time.After(50 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("Timed out waiting for %s on port %d", address, port)
+			}
+		}
+	}
+	for server.Addr() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	sendUntil(server.Addr().(*net.UDPAddr).Port, "/hue/1/on", old)
+
+	table := NewHandlerTable()
+	table.AddHandler("/hue/2/on", func(msg *gosc.Message) { replaced <- msg.Address })
+	server.ReplaceHandlers(table)
+
+	if err := server.Rebind("127.0.0.1", 0); err != nil {
+		t.Fatalf("Rebind failed: %v", err)
+	}
+	port := server.Addr().(*net.UDPAddr).Port
+	for len(defaults) > 0 {
+		<-defaults
+	}
+	sendUntil(port, "/hue/2/on", replaced)
+	if got := <-defaults; got != "/hue/2/on" {
+		t.Errorf("Expected default handler to be kept, got %s", got)
+	}
+
+	server.Dispatch(gosc.NewMessage("/hue/1/on"))
+	select {
+	case <-old:
+		t.Error("Replaced handler still called")
+	default:
+	}
+}
+
+func TestErrorReason(t *testing.T) {
+	tests := []struct {
+		packet   string
+		expected string
+	}{
+		{"/hue/1", "truncated"},
+		{"/hue/1\x00\x00,x\x00\x00", "type_tag"},
+		{"#bundl\x00\x00", "bundle"},
+	}
+	for _, tt := range tests {
+		_, err := gosc.ParsePacket(tt.packet)
+		if err == nil {
+			t.Errorf("Expected %q not to parse", tt.packet)
+			continue
+		}
+		if reason := ErrorReason(err); reason != tt.expected {
+			t.Errorf("ErrorReason(%v) = %s, expected %s", err, reason, tt.expected)
+		}
+	}
+	if reason := ErrorReason(ErrNotOSC); reason != "not_osc" {
+		t.Errorf("Expected not_osc, got %s", reason)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	server := NewServer("127.0.0.1", 0)
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	var handled, late atomic.Int32
+	server.AddHandler("/slow", func(msg *gosc.Message) {
+		close(started)
+		<-finish
+		handled.Add(1)
+	})
+	server.AddHandler("/late", func(msg *gosc.Message) {
+		late.Add(1)
+	})
+
+	// A bundle that is not due yet is cancelled rather than waited for
+	bundle := gosc.NewBundle(time.Now().Add(time.Hour))
+	bundle.Append(gosc.NewMessage("/late"))
+	server.DispatchPacket(bundle)
+
+	go server.Dispatch(gosc.NewMessage("/slow"))
+	<-started
+
+	// Shutdown gives up once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to pass while the handler runs, got %v", err)
+	}
+
+	// Messages dispatched after Shutdown are dropped
+	server.Dispatch(gosc.NewMessage("/late"))
+
+	done := make(chan error, 1)
+	go func() { done <- server.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Expected Shutdown to wait for the handler, returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(finish)
+	if err := <-done; err != nil {
+		t.Errorf("Expected Shutdown to return once the handler returned, got %v", err)
+	}
+	if handled.Load() != 1 || late.Load() != 0 {
+		t.Errorf("Expected only the message in progress to be handled, got %d and %d late", handled.Load(), late.Load())
+	}
+}
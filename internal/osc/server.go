@@ -1,32 +1,99 @@
 package osc
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"osc2hue/internal/logging"
 
 	gosc "github.com/hypebeast/go-osc/osc"
 )
 
+// logger is the log of the osc subsystem
+var logger = logging.For("osc")
+
+// Observer is notified of the traffic passing through a server
+type Observer interface {
+	// PacketReceived is called for every packet read from the network
+	PacketReceived(from net.Addr, packet gosc.Packet)
+	// PacketError is called when a packet from the network cannot be parsed
+	PacketError(from net.Addr, err error)
+	// MessageDispatched is called before a message is handed to the handlers
+	// registered for the addresses in matched
+	MessageDispatched(msg *gosc.Message, matched []string)
+}
+
+// ErrNotOSC is reported for packets that are neither an OSC message nor a bundle
+var ErrNotOSC = errors.New("not an OSC message or bundle")
+
+// ErrorReason sorts an error parsing a packet into a short reason for statistics:
+// not_osc, truncated, type_tag, bundle, blob or other
+func ErrorReason(err error) string {
+	msg := err.Error()
+	switch {
+	case errors.Is(err, ErrNotOSC):
+		return "not_osc"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "truncated"
+	case strings.Contains(msg, "type tag"):
+		return "type_tag"
+	case strings.Contains(msg, "bundle"):
+		return "bundle"
+	case strings.Contains(msg, "blob"):
+		return "blob"
+	}
+	return "other"
+}
+
+// HandlerAdder is implemented by Server and HandlerTable, so the same code can
+// register handlers on a running server or build a table to replace them with
+type HandlerAdder interface {
+	AddHandler(pattern string, handler gosc.HandlerFunc)
+}
+
+// HandlerTable collects address handlers to install on a server at once with ReplaceHandlers
+type HandlerTable struct {
+	dispatcher *dispatcher
+}
+
+// NewHandlerTable creates an empty handler table
+func NewHandlerTable() *HandlerTable {
+	return &HandlerTable{dispatcher: newDispatcher()}
+}
+
+// AddHandler adds a message handler for a specific OSC address to the table.
+// Default handlers ("*") belong to the server and cannot be replaced.
+func (t *HandlerTable) AddHandler(pattern string, handler gosc.HandlerFunc) {
+	if pattern == "*" {
+		logger.Error("Default handlers must be added to the server", "pattern", pattern)
+		return
+	}
+	if err := t.dispatcher.addHandler(pattern, handler); err != nil {
+		logger.Error("Failed to add handler", "pattern", pattern, "error", err)
+	}
+}
+
 // Server represents an OSC server
 type Server struct {
-	server     *gosc.Server
-	dispatcher *gosc.StandardDispatcher
+	dispatcher *dispatcher
 	addr       string
 	port       int
+
+	mu        sync.Mutex
+	conn      net.PacketConn
+	observers []Observer
+	stopped   bool
 }
 
 // NewServer creates a new OSC server
 func NewServer(addr string, port int) *Server {
-	dispatcher := gosc.NewStandardDispatcher()
-
-	server := &gosc.Server{
-		Addr:       fmt.Sprintf("%s:%d", addr, port),
-		Dispatcher: dispatcher,
-	}
-
 	return &Server{
-		server:     server,
-		dispatcher: dispatcher,
+		dispatcher: newDispatcher(),
 		addr:       addr,
 		port:       port,
 	}
@@ -34,22 +101,187 @@ func NewServer(addr string, port int) *Server {
 
 // AddHandler adds a message handler for a specific OSC address pattern
 func (s *Server) AddHandler(pattern string, handler gosc.HandlerFunc) {
-	err := s.dispatcher.AddMsgHandler(pattern, handler)
+	err := s.dispatcher.addHandler(pattern, handler)
 	if err != nil {
-		log.Printf("Error adding handler for pattern %s: %v", pattern, err)
+		logger.Error("Failed to add handler", "pattern", pattern, "error", err)
 	}
 }
 
-// Start starts the OSC server
+// ReplaceHandlers atomically replaces every address handler with the handlers
+// in t. Default handlers ("*") and observers are kept. Messages dispatched
+// after ReplaceHandlers returns only reach the new handlers.
+func (s *Server) ReplaceHandlers(t *HandlerTable) {
+	t.dispatcher.mu.RLock()
+	handlers := make(map[string]gosc.HandlerFunc, len(t.dispatcher.handlers))
+	for addr, handler := range t.dispatcher.handlers {
+		handlers[addr] = handler
+	}
+	t.dispatcher.mu.RUnlock()
+	s.dispatcher.replaceHandlers(handlers)
+}
+
+// AddObserver adds an observer notified of every received packet and dispatched message
+func (s *Server) AddObserver(o Observer) {
+	s.mu.Lock()
+	s.observers = append(s.observers, o)
+	s.mu.Unlock()
+	s.dispatcher.addObserver(o)
+}
+
+// Dispatch routes a message to the registered handlers as if it had been received over the network
+func (s *Server) Dispatch(msg *gosc.Message) {
+	s.dispatcher.dispatch(msg)
+}
+
+// DispatchPacket routes a message or bundle to the registered handlers, bundles
+// are delivered once their timetag is due
+func (s *Server) DispatchPacket(packet gosc.Packet) {
+	s.dispatcher.dispatch(packet)
+}
+
+// Start starts the OSC server and blocks until it is stopped
 func (s *Server) Start() error {
-	log.Printf("Starting OSC server on %s:%d", s.addr, s.port)
-	return s.server.ListenAndServe()
+	s.mu.Lock()
+	addr, port := s.addr, s.port
+	s.mu.Unlock()
+
+	logger.Info("Starting OSC server", "address", fmt.Sprintf("%s:%d", addr, port))
+	conn, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", addr, port))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	for {
+		err := s.serve(conn)
+
+		// Keep serving on the new connection after Rebind closed the old one
+		s.mu.Lock()
+		stopped, next := s.stopped, s.conn
+		s.mu.Unlock()
+		if stopped {
+			return nil
+		}
+		if next == conn {
+			return err
+		}
+		conn = next
+	}
+}
+
+// Rebind moves a server to a new listen address. The new address is bound
+// before the old one is released, so on error the server keeps listening
+// where it was. Before Start, Rebind only changes the address Start uses.
+func (s *Server) Rebind(addr string, port int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil || s.stopped {
+		s.addr, s.port = addr, port
+		return nil
+	}
+	old := s.conn
+	conn, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", addr, port))
+	if err != nil && port == s.port {
+		// Changing only the host of a port we hold conflicts with ourselves,
+		// so release the port first and take the old address back on failure
+		old.Close()
+		conn, err = net.ListenPacket("udp", fmt.Sprintf("%s:%d", addr, port))
+		if err != nil {
+			restored, restoreErr := net.ListenPacket("udp", fmt.Sprintf("%s:%d", s.addr, s.port))
+			if restoreErr != nil {
+				return fmt.Errorf("%v, and failed to listen on %s:%d again: %v", err, s.addr, s.port, restoreErr)
+			}
+			s.conn = restored
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	s.conn = conn
+	s.addr, s.port = addr, port
+	logger.Info("OSC server moved", "address", fmt.Sprintf("%s:%d", addr, port))
+	old.Close()
+	return nil
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// serve reads packets until the connection is closed
+func (s *Server) serve(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			s.mu.Lock()
+			stopped := s.stopped
+			s.mu.Unlock()
+			if stopped || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		observers := s.observers
+		s.mu.Unlock()
+
+		packet, err := gosc.ParsePacket(string(buf[:n]))
+		if err == nil && packet == nil {
+			err = ErrNotOSC
+		}
+		if err != nil {
+			for _, o := range observers {
+				o.PacketError(from, err)
+			}
+			logger.Warn("Invalid OSC packet", "from", from.String(), "error", err)
+			continue
+		}
+		for _, o := range observers {
+			o.PacketReceived(from, packet)
+		}
+
+		go s.dispatcher.dispatch(packet)
+	}
 }
 
 // Stop stops the OSC server
 func (s *Server) Stop() {
-	log.Println("Stopping OSC server")
-	if err := s.server.CloseConnection(); err != nil {
-		log.Printf("Error closing server connection: %v", err)
+	logger.Info("Stopping OSC server")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	if s.conn == nil {
+		return
 	}
+	if err := s.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Error("Failed to close server connection", "error", err)
+	}
+}
+
+// Shutdown stops the server and waits until the handlers of the messages being
+// dispatched returned, or ctx is done. Messages dispatched afterwards, over the
+// network or with Dispatch, are dropped, as are bundles that are not due yet.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Stop()
+	s.dispatcher.close()
+	return s.dispatcher.wait(ctx)
 }
@@ -0,0 +1,126 @@
+// Package policy limits what lights may do: brightness caps, the allowed
+// color temperatures, lights that must stay on, and lower caps during quiet
+// hours. Policies apply to the state a light is asked to take, whatever the
+// input protocol.
+package policy
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"osc2hue/internal/color"
+	"osc2hue/internal/state"
+)
+
+// minOnBrightness is the brightness a light that must stay on is kept at, at least
+const minOnBrightness = 0.01
+
+// Clock is a time of day in minutes after midnight
+type Clock int
+
+// ParseClock parses a time of day such as "22:30"
+func ParseClock(s string) (Clock, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 || h < 0 || h > 23 || m < 0 || m > 59 {
+		return 0, fmt.Errorf("%q is not a time of day (HH:MM)", s)
+	}
+	return Clock(h*60 + m), nil
+}
+
+// QuietHours lowers the brightness cap between Start and End, which may span midnight
+type QuietHours struct {
+	Start, End    Clock
+	MaxBrightness float64
+}
+
+// Active reports whether t is within the quiet hours
+func (q QuietHours) Active(t time.Time) bool {
+	now := Clock(t.Hour()*60 + t.Minute())
+	if q.Start <= q.End {
+		return now >= q.Start && now < q.End
+	}
+	return now >= q.Start || now < q.End
+}
+
+// Policy holds the limits of a light. Zero values mean no limit.
+type Policy struct {
+	MinBrightness float64 // 0.0-1.0, applies while the light is on
+	MaxBrightness float64 // 0.0-1.0
+	MinKelvin     float64 // Colors are replaced by the nearest white in the range
+	MaxKelvin     float64
+	KeepOn        bool // The light may not be turned off, e.g. an emergency light
+	QuietHours    []QuietHours
+}
+
+// Merge returns a policy with the stricter limit of p and o for every setting
+func (p Policy) Merge(o Policy) Policy {
+	p.MinBrightness = math.Max(p.MinBrightness, o.MinBrightness)
+	p.MaxBrightness = stricterMax(p.MaxBrightness, o.MaxBrightness)
+	p.MinKelvin = math.Max(p.MinKelvin, o.MinKelvin)
+	p.MaxKelvin = stricterMax(p.MaxKelvin, o.MaxKelvin)
+	p.KeepOn = p.KeepOn || o.KeepOn
+	p.QuietHours = append(append([]QuietHours(nil), p.QuietHours...), o.QuietHours...)
+	return p
+}
+
+// stricterMax returns the lower of two maximums, where 0 means none
+func stricterMax(a, b float64) float64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// MaxBrightnessAt returns the brightness cap at time t, 1 if there is none
+func (p Policy) MaxBrightnessAt(t time.Time) float64 {
+	limit := p.MaxBrightness
+	for _, q := range p.QuietHours {
+		if q.Active(t) {
+			limit = stricterMax(limit, q.MaxBrightness)
+		}
+	}
+	if limit == 0 {
+		return 1
+	}
+	return limit
+}
+
+// Limit returns the state closest to st that the policy allows at time t
+func (p Policy) Limit(st state.LightState, t time.Time) state.LightState {
+	if p.KeepOn && (!st.On || st.Brightness < minOnBrightness) {
+		st.On = true
+		st.Brightness = math.Max(st.Brightness, minOnBrightness)
+	}
+	if !st.On {
+		return st
+	}
+
+	// The minimum wins over a quiet hours cap below it, the light must stay visible
+	st.Brightness = math.Max(math.Min(st.Brightness, p.MaxBrightnessAt(t)), p.MinBrightness)
+
+	if p.MinKelvin > 0 || p.MaxKelvin > 0 {
+		kelvin := color.XYToKelvin(st.X, st.Y)
+		limited := kelvin
+		if p.MinKelvin > 0 && limited < p.MinKelvin {
+			limited = p.MinKelvin
+		}
+		if p.MaxKelvin > 0 && limited > p.MaxKelvin {
+			limited = p.MaxKelvin
+		}
+		// Colors off the white line are replaced even within the range
+		if limited != kelvin || !isWhite(st.X, st.Y, kelvin) {
+			st.X, st.Y = color.KelvinToXY(limited)
+		}
+	}
+	return st
+}
+
+// whiteTolerance is how far in XY a color may be from the white of its color temperature to count as white
+const whiteTolerance = 0.02
+
+// isWhite reports whether an XY color is close to the white of the given color temperature
+func isWhite(x, y, kelvin float64) bool {
+	wx, wy := color.KelvinToXY(kelvin)
+	return math.Hypot(x-wx, y-wy) <= whiteTolerance
+}
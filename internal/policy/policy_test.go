@@ -0,0 +1,133 @@
+package policy
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"osc2hue/internal/color"
+	"osc2hue/internal/state"
+)
+
+func at(hour, minute int) time.Time {
+	return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+}
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Clock
+		ok       bool
+	}{
+		{"00:00", 0, true},
+		{"07:30", 450, true},
+		{"23:59", 1439, true},
+		{"24:00", 0, false},
+		{"7:30", 0, false},
+		{"07:60", 0, false},
+		{"noon", 0, false},
+	}
+	for _, tt := range tests {
+		clock, err := ParseClock(tt.input)
+		if (err == nil) != tt.ok || (tt.ok && clock != tt.expected) {
+			t.Errorf("ParseClock(%q) = (%d, %v), expected %d, ok %v", tt.input, clock, err, tt.expected, tt.ok)
+		}
+	}
+}
+
+func TestQuietHoursActive(t *testing.T) {
+	overnight := QuietHours{Start: 22 * 60, End: 7 * 60}
+	afternoon := QuietHours{Start: 13 * 60, End: 15 * 60}
+	tests := []struct {
+		q        QuietHours
+		t        time.Time
+		expected bool
+	}{
+		{overnight, at(23, 0), true},
+		{overnight, at(3, 0), true},
+		{overnight, at(7, 0), false},
+		{overnight, at(12, 0), false},
+		{afternoon, at(14, 59), true},
+		{afternoon, at(15, 0), false},
+		{afternoon, at(12, 0), false},
+	}
+	for _, tt := range tests {
+		if active := tt.q.Active(tt.t); active != tt.expected {
+			t.Errorf("%+v at %s: expected active %v", tt.q, tt.t.Format("15:04"), tt.expected)
+		}
+	}
+}
+
+func TestLimitBrightness(t *testing.T) {
+	p := Policy{
+		MinBrightness: 0.2,
+		MaxBrightness: 0.8,
+		QuietHours:    []QuietHours{{Start: 22 * 60, End: 7 * 60, MaxBrightness: 0.3}},
+	}
+	tests := []struct {
+		brightness float64
+		t          time.Time
+		expected   float64
+	}{
+		{1, at(12, 0), 0.8},
+		{0.5, at(12, 0), 0.5},
+		{0.05, at(12, 0), 0.2},
+		{1, at(23, 0), 0.3},
+		{0.1, at(23, 0), 0.2},
+	}
+	for _, tt := range tests {
+		st := p.Limit(state.LightState{On: true, Brightness: tt.brightness}, tt.t)
+		if math.Abs(st.Brightness-tt.expected) > 1e-9 {
+			t.Errorf("Brightness %g at %s: expected %g, got %g", tt.brightness, tt.t.Format("15:04"), tt.expected, st.Brightness)
+		}
+	}
+
+	// Lights that are off stay off
+	if st := p.Limit(state.LightState{Brightness: 0}, at(12, 0)); st.On || st.Brightness != 0 {
+		t.Errorf("Expected the light to stay off, got %+v", st)
+	}
+}
+
+func TestLimitKeepOn(t *testing.T) {
+	p := Policy{KeepOn: true}
+	if st := p.Limit(state.LightState{On: false, Brightness: 0.6}, at(12, 0)); !st.On || st.Brightness != 0.6 {
+		t.Errorf("Expected the light to stay on at its brightness, got %+v", st)
+	}
+	if st := p.Limit(state.LightState{On: false, Brightness: 0}, at(12, 0)); !st.On || st.Brightness != minOnBrightness {
+		t.Errorf("Expected the light to stay on at the lowest brightness, got %+v", st)
+	}
+}
+
+func TestLimitColor(t *testing.T) {
+	p := Policy{MinKelvin: 2200, MaxKelvin: 3000}
+
+	// A warm white within the range is kept
+	x, y := color.KelvinToXY(2700)
+	if st := p.Limit(state.LightState{On: true, Brightness: 1, X: x, Y: y}, at(12, 0)); st.X != x || st.Y != y {
+		t.Errorf("Expected 2700K to be kept, got x:%.4f y:%.4f", st.X, st.Y)
+	}
+
+	// Cool white is warmed to the limit
+	st := p.Limit(state.LightState{On: true, Brightness: 1, X: color.WhiteX, Y: color.WhiteY}, at(12, 0))
+	if k := color.XYToKelvin(st.X, st.Y); math.Abs(k-3000) > 50 {
+		t.Errorf("Expected cool white to become 3000K, got %.0fK", k)
+	}
+
+	// Saturated colors become a white in the range
+	st = p.Limit(state.LightState{On: true, Brightness: 1, X: 0.17, Y: 0.05}, at(12, 0))
+	if k := color.XYToKelvin(st.X, st.Y); k < 2150 || k > 3050 {
+		t.Errorf("Expected blue to become a white between 2200K and 3000K, got %.0fK", k)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := Policy{MaxBrightness: 0.8, MinKelvin: 2000, QuietHours: []QuietHours{{Start: 0, End: 60, MaxBrightness: 0.5}}}
+	b := Policy{MinBrightness: 0.1, MaxBrightness: 0.6, MaxKelvin: 4000, KeepOn: true}
+	m := a.Merge(b)
+	if m.MinBrightness != 0.1 || m.MaxBrightness != 0.6 || m.MinKelvin != 2000 || m.MaxKelvin != 4000 || !m.KeepOn || len(m.QuietHours) != 1 {
+		t.Errorf("Unexpected merged policy: %+v", m)
+	}
+	if m := (Policy{}).Merge(a); m.MaxBrightness != 0.8 {
+		t.Errorf("Expected no cap to leave the other cap, got %g", m.MaxBrightness)
+	}
+}
@@ -0,0 +1,246 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"osc2hue/internal/logging"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+)
+
+// logger is the log of the osc subsystem
+var logger = logging.For("osc")
+
+// Format identifies osc2hue recordings in the file header
+const Format = "osc2hue-recording"
+
+// Version is the current recording format version
+const Version = 1
+
+// header is the first line of a recording
+type header struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Started time.Time `json:"started"`
+}
+
+// Entry is one recorded packet
+type Entry struct {
+	// Offset is the time since the recording started
+	Offset time.Duration
+	// From is the source address of the packet
+	From string
+	// Packet is the decoded message or bundle
+	Packet gosc.Packet
+}
+
+// Messages returns the entry's message, or every message of a bundle and its nested bundles
+func (e Entry) Messages() []*gosc.Message {
+	return messages(e.Packet)
+}
+
+// messages flattens a packet into its messages
+func messages(packet gosc.Packet) []*gosc.Message {
+	switch p := packet.(type) {
+	case *gosc.Message:
+		return []*gosc.Message{p}
+	case *gosc.Bundle:
+		msgs := append([]*gosc.Message(nil), p.Messages...)
+		for _, b := range p.Bundles {
+			msgs = append(msgs, messages(b)...)
+		}
+		return msgs
+	}
+	return nil
+}
+
+// line is the JSON form of an entry, the packet is stored as raw OSC
+type line struct {
+	OffsetMs float64 `json:"offset_ms"`
+	From     string  `json:"from,omitempty"`
+	Data     []byte  `json:"data"`
+}
+
+// Recorder writes received packets to a recording, one JSON line per packet.
+// It implements osc.Observer so it can be attached to a server.
+type Recorder struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	started time.Time
+}
+
+// NewRecorder writes a recording header to w and returns a recorder appending to it
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	r := &Recorder{enc: json.NewEncoder(w), started: time.Now()}
+	if err := r.enc.Encode(header{Format: Format, Version: Version, Started: r.started}); err != nil {
+		return nil, fmt.Errorf("failed to write recording header: %v", err)
+	}
+	return r, nil
+}
+
+// Record appends a packet with the time elapsed since the recording started
+func (r *Recorder) Record(from net.Addr, packet gosc.Packet) error {
+	data, err := packet.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to encode packet: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l := line{
+		OffsetMs: float64(time.Since(r.started).Microseconds()) / 1000,
+		Data:     data,
+	}
+	if from != nil {
+		l.From = from.String()
+	}
+	if err := r.enc.Encode(l); err != nil {
+		return err
+	}
+	return nil
+}
+
+// PacketReceived records a packet read by the OSC server
+func (r *Recorder) PacketReceived(from net.Addr, packet gosc.Packet) {
+	if err := r.Record(from, packet); err != nil {
+		logger.Error("Failed to record packet", "error", err)
+	}
+}
+
+// PacketError ignores packets that could not be parsed
+func (r *Recorder) PacketError(from net.Addr, err error) {}
+
+// MessageDispatched ignores dispatched messages, only network packets are recorded
+func (r *Recorder) MessageDispatched(msg *gosc.Message, matched []string) {}
+
+// Load reads every entry of a recording
+func Load(rd io.Reader) ([]Entry, error) {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("empty recording")
+	}
+	var h header
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil || h.Format != Format {
+		return nil, fmt.Errorf("not an osc2hue recording")
+	}
+	if h.Version > Version {
+		return nil, fmt.Errorf("unsupported recording version %d (newest supported is %d)", h.Version, Version)
+	}
+
+	var entries []Entry
+	for n := 2; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var l line
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		packet, err := gosc.ParsePacket(string(l.Data))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid OSC packet: %v", n, err)
+		}
+		entries = append(entries, Entry{
+			Offset: time.Duration(l.OffsetMs * float64(time.Millisecond)),
+			From:   l.From,
+			Packet: packet,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// PlayOptions controls playback of a recording
+type PlayOptions struct {
+	// Speed scales the original timing, 2 plays twice as fast. Zero means 1.
+	Speed float64
+	// Seek skips every entry recorded before this offset
+	Seek time.Duration
+	// Loop restarts playback from Seek after the last entry
+	Loop bool
+}
+
+// Player replays recorded entries with their original timing
+type Player struct {
+	entries []Entry
+	opts    PlayOptions
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// NewPlayer creates a player for a loaded recording
+func NewPlayer(entries []Entry, opts PlayOptions) *Player {
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	return &Player{entries: entries, opts: opts, stop: make(chan struct{})}
+}
+
+// Play sends every entry to send at its scheduled time and blocks until
+// playback ends or Stop is called. An error from send stops playback.
+func (p *Player) Play(send func(Entry) error) error {
+	for {
+		played, err := p.playOnce(send)
+		if err != nil || !p.opts.Loop || played == 0 {
+			return err
+		}
+		select {
+		case <-p.stop:
+			return nil
+		default:
+		}
+	}
+}
+
+// playOnce plays the entries from Seek to the end once, returning how many were sent
+func (p *Player) playOnce(send func(Entry) error) (int, error) {
+	start := time.Now()
+	played := 0
+	for _, entry := range p.entries {
+		if entry.Offset < p.opts.Seek {
+			continue
+		}
+
+		due := start.Add(time.Duration(float64(entry.Offset-p.opts.Seek) / p.opts.Speed))
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-p.stop:
+				timer.Stop()
+				return played, nil
+			}
+		} else {
+			select {
+			case <-p.stop:
+				return played, nil
+			default:
+			}
+		}
+
+		if err := send(entry); err != nil {
+			return played, err
+		}
+		played++
+	}
+	return played, nil
+}
+
+// Stop ends playback
+func (p *Player) Stop() {
+	p.once.Do(func() { close(p.stop) })
+}
@@ -0,0 +1,130 @@
+package recording
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+)
+
+func TestRecordAndLoad(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := NewRecorder(&buf)
+	if err != nil {
+		t.Fatalf("NewRecorder failed: %v", err)
+	}
+
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 57120}
+	r.PacketReceived(from, gosc.NewMessage("/hue/1/on", int32(1)))
+	time.Sleep(5 * time.Millisecond)
+	bundle := gosc.NewBundle(time.Now())
+	bundle.Append(gosc.NewMessage("/hue/1/set", float32(0.3), float32(0.3), float32(0.8), int32(-1)))
+	bundle.Append(gosc.NewMessage("/hue/2/on", int32(0)))
+	r.PacketReceived(from, bundle)
+
+	entries, err := Load(&buf)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].From != "192.168.1.5:57120" {
+		t.Errorf("Expected source address, got %q", entries[0].From)
+	}
+	if entries[1].Offset < 5*time.Millisecond {
+		t.Errorf("Expected second entry at least 5ms in, got %v", entries[1].Offset)
+	}
+
+	msg, ok := entries[0].Packet.(*gosc.Message)
+	if !ok || msg.Address != "/hue/1/on" || msg.Arguments[0] != int32(1) {
+		t.Errorf("Unexpected first packet: %v", entries[0].Packet)
+	}
+	msgs := entries[1].Messages()
+	if len(msgs) != 2 || msgs[1].Address != "/hue/2/on" {
+		t.Errorf("Expected bundle messages, got %v", msgs)
+	}
+}
+
+func TestLoadRejectsOtherFiles(t *testing.T) {
+	tests := map[string]string{
+		"empty":      "",
+		"not json":   "hello\n",
+		"wrong":      `{"format":"something-else","version":1}` + "\n",
+		"too new":    `{"format":"osc2hue-recording","version":99}` + "\n",
+		"bad packet": `{"format":"osc2hue-recording","version":1}` + "\n" + `{"offset_ms":1,"data":"I2J1bmRsZQA="}` + "\n",
+		"bad entry":  `{"format":"osc2hue-recording","version":1}` + "\n" + "{\n",
+	}
+
+	for name, content := range tests {
+		if _, err := Load(strings.NewReader(content)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func testEntries() []Entry {
+	return []Entry{
+		{Offset: 0, Packet: gosc.NewMessage("/a")},
+		{Offset: 100 * time.Millisecond, Packet: gosc.NewMessage("/b")},
+		{Offset: 200 * time.Millisecond, Packet: gosc.NewMessage("/c")},
+	}
+}
+
+func TestPlayerSpeedAndSeek(t *testing.T) {
+	player := NewPlayer(testEntries(), PlayOptions{Speed: 4, Seek: 50 * time.Millisecond})
+
+	var played []string
+	start := time.Now()
+	err := player.Play(func(e Entry) error {
+		played = append(played, e.Packet.(*gosc.Message).Address)
+		return nil
+	})
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.Fatalf("Play failed: %v", err)
+	}
+	if strings.Join(played, "") != "/b/c" {
+		t.Errorf("Expected /b and /c after seeking, got %v", played)
+	}
+	// 150ms of recording at 4x speed
+	if elapsed < 30*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("Expected playback to take about 37ms, took %v", elapsed)
+	}
+}
+
+func TestPlayerLoopAndStop(t *testing.T) {
+	player := NewPlayer(testEntries(), PlayOptions{Speed: 20, Loop: true})
+
+	var mu sync.Mutex
+	count := 0
+	done := make(chan error, 1)
+	go func() {
+		done <- player.Play(func(e Entry) error {
+			mu.Lock()
+			count++
+			if count == 7 {
+				player.Stop()
+			}
+			mu.Unlock()
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Play failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Loop did not stop")
+	}
+	if count != 7 {
+		t.Errorf("Expected playback to stop after 7 packets, got %d", count)
+	}
+}
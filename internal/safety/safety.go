@@ -0,0 +1,439 @@
+// Package safety limits how fast lights flash, to protect people with
+// photosensitive epilepsy. It follows the general and red flash thresholds of
+// WCAG 2.3.1: a flash is a pair of opposing changes in relative luminance of
+// at least 10% where the darker state is below 0.8, and changes to or from
+// saturated red count as well. Flashes are limited per light and per room, as
+// a room of lights flashing together reaches more of the field of view.
+package safety
+
+import (
+	"maps"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"osc2hue/internal/color"
+	"osc2hue/internal/logging"
+)
+
+// logger is the log of the safety subsystem
+var logger = logging.For("safety")
+
+// Defaults for the limits, below the WCAG limit of three flashes per second
+const (
+	DefaultMaxFlashes = 2
+	DefaultThreshold  = 0.1
+)
+
+// window is the period flashes are counted over
+const window = time.Second
+
+// darkLimit is the relative luminance below which the darker state of a change must be to count
+const darkLimit = 0.8
+
+// logInterval is the minimum time between log messages about the same light or room
+const logInterval = 10 * time.Second
+
+// Level is the light a fixture emits, as far as flashing is concerned
+type Level struct {
+	Luminance float64 // Relative luminance, 0.0-1.0
+	Red       bool    // Saturated red
+}
+
+// LevelOf returns the level of a light in the given state
+func LevelOf(on bool, brightness, x, y float64) Level {
+	if !on || brightness <= 0 {
+		return Level{}
+	}
+	r, g, b := color.XYToRGB(x, y)
+	luminance := 0.2126*linear(r) + 0.7152*linear(g) + 0.0722*linear(b)
+	return Level{
+		Luminance: math.Min(brightness*luminance, 1),
+		Red:       r+g+b > 0 && r/(r+g+b) >= 0.8,
+	}
+}
+
+// linear converts an sRGB component to linear light, as in the WCAG definition of relative luminance
+func linear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// Limits configure a Limiter
+type Limits struct {
+	MaxFlashes int     // Flashes allowed in any one second, per light and per room
+	Threshold  float64 // Luminance change that counts towards a flash, 0.0-1.0
+}
+
+// withDefaults fills in the default for every limit not set
+func (l Limits) withDefaults() Limits {
+	if l.MaxFlashes <= 0 {
+		l.MaxFlashes = DefaultMaxFlashes
+	}
+	if l.Threshold <= 0 {
+		l.Threshold = DefaultThreshold
+	}
+	return l
+}
+
+// track follows the level of a light or room and when it changed
+type track struct {
+	anchor      float64     // luminance at the last counted change, or the extreme since
+	dir         int         // direction of the last counted change, 0 before the first
+	red         bool        // saturated red at the last change
+	transitions []time.Time // counted changes within the window, oldest first
+}
+
+// step returns the track after moving to level, and whether the move counts
+// towards a flash. Luminance counts once per swing: a slow fade up is one
+// change, a strobe is a change on every step.
+func (t track) step(level Level, threshold float64) (track, bool) {
+	counted := level.Red != t.red
+	t.red = level.Red
+
+	v := level.Luminance
+	switch {
+	case t.dir > 0 && v >= t.anchor, t.dir < 0 && v <= t.anchor:
+		t.anchor = v // still rising or falling
+	case math.Abs(v-t.anchor) >= threshold && math.Min(v, t.anchor) < darkLimit:
+		counted = true
+		t.dir = 1
+		if v < t.anchor {
+			t.dir = -1
+		}
+		t.anchor = v
+	}
+	return t, counted
+}
+
+// recent returns the transitions within the window before now
+func (t track) recent(now time.Time) []time.Time {
+	i := 0
+	for i < len(t.transitions) && now.Sub(t.transitions[i]) >= window {
+		i++
+	}
+	return t.transitions[i:]
+}
+
+// held is a light change waiting until it may be sent
+type held struct {
+	level   Level
+	release func()
+	timer   *time.Timer
+}
+
+// Event is what happens to a light change the limiter holds back
+type Event int
+
+const (
+	Held      Event = iota // a change is held back
+	Coalesced              // a held change is replaced by a later one
+	Released               // a held change is sent
+	Dropped                // a held change is discarded as the limiter stops
+	Refused                // a change of several lights at once is refused
+)
+
+// String names an event in statistics
+func (e Event) String() string {
+	return [...]string{"held", "coalesced", "released", "dropped", "refused"}[e]
+}
+
+// Limiter holds back light changes that would make a light or room flash
+// faster than allowed, and sends the latest held change of each light once
+// it is allowed
+type Limiter struct {
+	mu      sync.Mutex
+	limits  Limits
+	rooms   map[string][]string // room name -> light IDs
+	levels  map[string]Level    // light ID -> level last sent
+	tracks  map[string]*track   // "light:ID" or "room:name" -> track
+	held    map[string]*held    // light ID -> held change
+	sending int                 // released changes still being sent
+	lastLog map[string]time.Time
+	stopped bool
+	onEvent func(lightID string, e Event)
+
+	now func() time.Time
+}
+
+// New creates a limiter
+func New(limits Limits) *Limiter {
+	return &Limiter{
+		limits:  limits.withDefaults(),
+		rooms:   make(map[string][]string),
+		levels:  make(map[string]Level),
+		tracks:  make(map[string]*track),
+		held:    make(map[string]*held),
+		lastLog: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// SetLimits replaces the limits, keeping the flash history
+func (l *Limiter) SetLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits.withDefaults()
+}
+
+// SetRooms replaces the rooms whose lights are limited together
+func (l *Limiter) SetRooms(rooms map[string][]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rooms = rooms
+	for name := range l.tracks {
+		if strings.HasPrefix(name, "room:") {
+			delete(l.tracks, name)
+		}
+	}
+	for name := range rooms {
+		level := l.roomLevel(name, "", Level{})
+		l.tracks["room:"+name] = &track{anchor: level.Luminance, red: level.Red}
+	}
+}
+
+// OnEvent sets a function called for every change held, coalesced, released
+// or dropped. It is called with the limiter locked and must not use it.
+func (l *Limiter) OnEvent(fn func(lightID string, e Event)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onEvent = fn
+}
+
+// event passes an event to onEvent, if set. The caller holds the lock.
+func (l *Limiter) event(lightID string, e Event) {
+	if l.onEvent != nil {
+		l.onEvent(lightID, e)
+	}
+}
+
+// Seed sets the level of a light not seen before, such as the state reported by its bridge
+func (l *Limiter) Seed(lightID string, level Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.levels[lightID]; !ok {
+		l.levels[lightID] = level
+		l.tracks["light:"+lightID] = &track{anchor: level.Luminance, red: level.Red}
+	}
+}
+
+// Submit reports whether a light may change to level now, recording the
+// change if so. Otherwise the change is held and release is called once it
+// is allowed, to send the state of the light at that time. A later change
+// of a light with a held change replaces it.
+func (l *Limiter) Submit(lightID string, level Level, release func()) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if h := l.held[lightID]; h != nil {
+		h.level, h.release = level, release
+		l.event(lightID, Coalesced)
+		return false
+	}
+	if l.stopped {
+		return true
+	}
+	now := l.now()
+	wait, area := l.check(lightID, level, now)
+	if wait == 0 {
+		l.commit(lightID, level, now)
+		return true
+	}
+
+	h := &held{level: level, release: release}
+	h.timer = time.AfterFunc(wait, func() { l.release(lightID) })
+	l.held[lightID] = h
+	l.event(lightID, Held)
+	if now.Sub(l.lastLog[area]) >= logInterval {
+		l.lastLog[area] = now
+		logger.Warn("Flash limiter: holding back changes that would flash too fast", "area", area, "max_flashes_per_second", l.limits.MaxFlashes)
+	}
+	return false
+}
+
+// SubmitAll reports whether several lights may change to their levels at
+// once, such as when a scene is recalled, recording the changes if so. The
+// changes cannot be held back, so they are refused as a whole if any light or
+// room would flash too fast, or if one of the lights has a held change.
+func (l *Limiter) SubmitAll(levels map[string]Level) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return true
+	}
+
+	ids := make([]string, 0, len(levels))
+	for id := range levels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// Commit light by light so rooms see the lights changed before, and
+	// restore the tracks if one of them may not change
+	tracks, lastLevels := maps.Clone(l.tracks), maps.Clone(l.levels)
+	now := l.now()
+	for _, id := range ids {
+		allowed, area := l.held[id] == nil, describe("light:"+id)
+		if allowed {
+			var wait time.Duration
+			wait, area = l.check(id, levels[id], now)
+			allowed = wait == 0
+		}
+		if !allowed {
+			l.tracks, l.levels = tracks, lastLevels
+			for _, id := range ids {
+				l.event(id, Refused)
+			}
+			if now.Sub(l.lastLog[area]) >= logInterval {
+				l.lastLog[area] = now
+				logger.Warn("Flash limiter: refusing a change of several lights that would flash too fast", "area", area, "max_flashes_per_second", l.limits.MaxFlashes)
+			}
+			return false
+		}
+		l.commit(id, levels[id], now)
+	}
+	return true
+}
+
+// release sends the held change of a light if it is allowed by now, or waits longer
+func (l *Limiter) release(lightID string) {
+	l.mu.Lock()
+	h := l.held[lightID]
+	if h == nil || l.stopped {
+		l.mu.Unlock()
+		return
+	}
+	now := l.now()
+	if wait, _ := l.check(lightID, h.level, now); wait > 0 {
+		h.timer.Reset(wait)
+		l.mu.Unlock()
+		return
+	}
+	l.commit(lightID, h.level, now)
+	delete(l.held, lightID)
+	l.event(lightID, Released)
+	l.sending++
+	l.mu.Unlock()
+
+	h.release()
+	l.mu.Lock()
+	l.sending--
+	l.mu.Unlock()
+}
+
+// Pending returns the number of changes held back or being sent after their release
+func (l *Limiter) Pending() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.held) + l.sending
+}
+
+// Stop drops every held change and lets every later change through
+func (l *Limiter) Stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopped = true
+	for id, h := range l.held {
+		h.timer.Stop()
+		delete(l.held, id)
+		l.event(id, Dropped)
+	}
+}
+
+// check returns how long a light must wait before changing to level, and
+// the light or room that limits it. The caller holds the lock.
+func (l *Limiter) check(lightID string, level Level, now time.Time) (time.Duration, string) {
+	var wait time.Duration
+	var area string
+	for name, next := range l.steps(lightID, level) {
+		if !next.counted {
+			continue
+		}
+		recent := l.tracks[name].recent(now)
+		if limit := 2 * l.limits.MaxFlashes; len(recent) >= limit {
+			if w := recent[len(recent)-limit].Add(window).Sub(now); w > wait {
+				wait, area = w, describe(name)
+			}
+		}
+	}
+	return wait, area
+}
+
+// commit records a light changing to level. The caller holds the lock.
+func (l *Limiter) commit(lightID string, level Level, now time.Time) {
+	for name, next := range l.steps(lightID, level) {
+		t := next.track
+		t.transitions = t.recent(now)
+		if next.counted {
+			t.transitions = append(t.transitions, now)
+		}
+		l.tracks[name] = &t
+	}
+	l.levels[lightID] = level
+}
+
+// step is the next state of a track and whether reaching it counts towards a flash
+type step struct {
+	track   track
+	counted bool
+}
+
+// steps returns the next state of the tracks of a light and of its rooms if
+// it changes to level. The caller holds the lock.
+func (l *Limiter) steps(lightID string, level Level) map[string]step {
+	steps := make(map[string]step)
+	add := func(name string, level Level) {
+		t, ok := l.tracks[name]
+		if !ok {
+			// Nothing is known yet, so the first change does not count
+			t = &track{anchor: level.Luminance, red: level.Red}
+		}
+		next, counted := t.step(level, l.limits.Threshold)
+		steps[name] = step{track: next, counted: counted}
+	}
+
+	add("light:"+lightID, level)
+	for name, ids := range l.rooms {
+		for _, id := range ids {
+			if id == lightID {
+				add("room:"+name, l.roomLevel(name, lightID, level))
+				break
+			}
+		}
+	}
+	return steps
+}
+
+// roomLevel returns the average luminance of a room, red if most of its
+// lights are, with lightID at level. The caller holds the lock.
+func (l *Limiter) roomLevel(name, lightID string, level Level) Level {
+	ids := l.rooms[name]
+	if len(ids) == 0 {
+		return Level{}
+	}
+	var sum float64
+	red := 0
+	for _, id := range ids {
+		lv := l.levels[id]
+		if id == lightID {
+			lv = level
+		}
+		sum += lv.Luminance
+		if lv.Red {
+			red++
+		}
+	}
+	return Level{Luminance: sum / float64(len(ids)), Red: 2*red > len(ids)}
+}
+
+// describe names a track in log messages
+func describe(name string) string {
+	if room, ok := strings.CutPrefix(name, "room:"); ok {
+		return "room " + room
+	}
+	return "light " + strings.TrimPrefix(name, "light:")
+}
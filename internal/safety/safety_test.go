@@ -0,0 +1,238 @@
+package safety
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"osc2hue/internal/color"
+)
+
+// fakeClock is a settable time source for a limiter
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func newTestLimiter(limits Limits) (*Limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)}
+	l := New(limits)
+	l.now = clock.now
+	return l, clock
+}
+
+var (
+	dark  = Level{}
+	white = Level{Luminance: 1}
+)
+
+func TestLevelOf(t *testing.T) {
+	if level := LevelOf(false, 1, color.WhiteX, color.WhiteY); level != (Level{}) {
+		t.Errorf("Expected a light that is off to be dark, got %+v", level)
+	}
+	if level := LevelOf(true, 1, color.WhiteX, color.WhiteY); level.Luminance < 0.95 || level.Red {
+		t.Errorf("Expected full white to have luminance 1, got %+v", level)
+	}
+	if level := LevelOf(true, 0.5, color.WhiteX, color.WhiteY); level.Luminance < 0.45 || level.Luminance > 0.55 {
+		t.Errorf("Expected half white to have luminance 0.5, got %+v", level)
+	}
+	red := LevelOf(true, 1, 0.7, 0.3)
+	if !red.Red || red.Luminance > 0.5 {
+		t.Errorf("Expected saturated red, got %+v", red)
+	}
+	if LevelOf(true, 1, 0.45, 0.41).Red {
+		t.Error("Expected warm white not to be saturated red")
+	}
+}
+
+func TestLimiterCapsStrobe(t *testing.T) {
+	l, clock := newTestLimiter(Limits{MaxFlashes: 2})
+	defer l.Stop()
+	l.Seed("a", dark)
+
+	// A 10 Hz strobe: 4 changes (2 flashes) pass in the first second
+	var released atomic.Int32
+	passed := 0
+	for i := 0; i < 5; i++ {
+		level := white
+		if i%2 == 1 {
+			level = dark
+		}
+		if l.Submit("a", level, func() { released.Add(1) }) {
+			passed++
+		}
+		clock.t = clock.t.Add(100 * time.Millisecond)
+	}
+	if passed != 4 {
+		t.Errorf("Expected 4 changes to pass, got %d", passed)
+	}
+
+	// The last change is held until the oldest one leaves the window
+	l.release("a")
+	if released.Load() != 0 {
+		t.Error("Expected the held change to wait")
+	}
+	clock.t = clock.t.Add(500 * time.Millisecond)
+	l.release("a")
+	if released.Load() != 1 {
+		t.Errorf("Expected the held change to be released once, got %d", released.Load())
+	}
+}
+
+func TestLimiterAllowsFades(t *testing.T) {
+	l, clock := newTestLimiter(Limits{})
+	defer l.Stop()
+	l.Seed("a", dark)
+
+	// Fading up and down in small steps is two changes, not a flash per step
+	for i := 0; i <= 40; i++ {
+		v := float64(i) / 20
+		if v > 1 {
+			v = 2 - v
+		}
+		if !l.Submit("a", Level{Luminance: v}, func() {}) {
+			t.Fatalf("Expected step %d of the fade to pass", i)
+		}
+		clock.t = clock.t.Add(10 * time.Millisecond)
+	}
+}
+
+func TestLimiterIgnoresBrightChanges(t *testing.T) {
+	l, clock := newTestLimiter(Limits{})
+	defer l.Stop()
+	l.Seed("a", white)
+
+	// Flicker between bright levels is not a flash
+	for i := 0; i < 20; i++ {
+		level := white
+		if i%2 == 1 {
+			level = Level{Luminance: 0.85}
+		}
+		if !l.Submit("a", level, func() {}) {
+			t.Fatalf("Expected change %d to pass", i)
+		}
+		clock.t = clock.t.Add(50 * time.Millisecond)
+	}
+}
+
+func TestLimiterCountsRed(t *testing.T) {
+	l, clock := newTestLimiter(Limits{MaxFlashes: 1})
+	defer l.Stop()
+	l.Seed("a", Level{Luminance: 0.3})
+
+	// Switching to and from saturated red at the same luminance is a flash
+	red := Level{Luminance: 0.3, Red: true}
+	blue := Level{Luminance: 0.3}
+	passed := 0
+	for i := 0; i < 6; i++ {
+		level := red
+		if i%2 == 1 {
+			level = blue
+		}
+		if l.Submit("a", level, func() {}) {
+			passed++
+		}
+		clock.t = clock.t.Add(100 * time.Millisecond)
+	}
+	if passed != 2 {
+		t.Errorf("Expected 2 changes to pass, got %d", passed)
+	}
+}
+
+func TestLimiterLimitsRooms(t *testing.T) {
+	l, clock := newTestLimiter(Limits{MaxFlashes: 1})
+	defer l.Stop()
+	l.SetRooms(map[string][]string{"stage": {"a", "b"}})
+	l.Seed("a", dark)
+	l.Seed("b", dark)
+
+	// Alternating two lights keeps each under the limit, but the room
+	// flashes on every change
+	passed := 0
+	for i := 0; i < 8; i++ {
+		id := []string{"a", "b"}[i/2%2]
+		level := white
+		if i%2 == 1 {
+			level = dark
+		}
+		if l.Submit(id, level, func() {}) {
+			passed++
+		}
+		clock.t = clock.t.Add(50 * time.Millisecond)
+	}
+	if passed != 2 {
+		t.Errorf("Expected 2 changes to pass, got %d", passed)
+	}
+}
+
+func TestLimiterSubmitAll(t *testing.T) {
+	l, clock := newTestLimiter(Limits{MaxFlashes: 1})
+	defer l.Stop()
+	l.SetRooms(map[string][]string{"stage": {"a", "b"}})
+	l.Seed("a", dark)
+	l.Seed("b", dark)
+	var refused int
+	l.OnEvent(func(lightID string, e Event) {
+		if e == Refused {
+			refused++
+		}
+	})
+
+	// A scene switching the whole room on and off flashes it once per recall
+	if !l.SubmitAll(map[string]Level{"a": white, "b": white}) || !l.SubmitAll(map[string]Level{"a": dark, "b": dark}) {
+		t.Fatal("Expected the first two recalls to pass")
+	}
+	if l.SubmitAll(map[string]Level{"a": white, "b": white}) {
+		t.Error("Expected the third recall within a second to be refused")
+	}
+	if refused != 2 || l.levels["a"] != dark || l.levels["b"] != dark {
+		t.Errorf("Expected the refused recall not to be recorded, got %d refused and levels %v", refused, l.levels)
+	}
+
+	// Nothing can be recalled over a held change
+	clock.t = clock.t.Add(window)
+	l.Submit("a", white, func() {})
+	l.Submit("a", dark, func() {})
+	if l.Submit("a", white, func() {}) {
+		t.Fatal("Expected the third change of a to be held")
+	}
+	if l.SubmitAll(map[string]Level{"a": dark}) {
+		t.Error("Expected a recall over a held change to be refused")
+	}
+
+	clock.t = clock.t.Add(window)
+	if !l.SubmitAll(map[string]Level{"b": white}) {
+		t.Error("Expected a recall to pass once the window passed")
+	}
+}
+
+func TestLimiterReplacesHeldChange(t *testing.T) {
+	l, clock := newTestLimiter(Limits{MaxFlashes: 1})
+	defer l.Stop()
+	l.Seed("a", dark)
+
+	var events []Event
+	l.OnEvent(func(lightID string, e Event) { events = append(events, e) })
+	l.Submit("a", white, func() {})
+	l.Submit("a", dark, func() {})
+	var released atomic.Value
+	l.Submit("a", white, func() { released.Store("first") })
+	var sending int
+	l.Submit("a", dark, func() { released.Store("second"); sending = l.Pending() })
+	if n := l.Pending(); n != 1 {
+		t.Errorf("Expected 1 pending change, got %d", n)
+	}
+
+	clock.t = clock.t.Add(window)
+	l.release("a")
+	if released.Load() != "second" {
+		t.Errorf("Expected the latest held change to be released, got %v", released.Load())
+	}
+	if sending != 1 || l.Pending() != 0 {
+		t.Errorf("Expected the change to be pending until sent, got %d while sending and %d after", sending, l.Pending())
+	}
+	if len(events) != 3 || events[0] != Held || events[1] != Coalesced || events[2] != Released {
+		t.Errorf("Expected held, coalesced and released events, got %v", events)
+	}
+}
@@ -0,0 +1,120 @@
+package state
+
+import (
+	"sync"
+
+	"osc2hue/internal/color"
+)
+
+// LightState holds the last commanded state of a light
+type LightState struct {
+	On         bool    `json:"on"`
+	Brightness float64 `json:"brightness"` // 0.0-1.0
+	X          float64 `json:"x"`
+	Y          float64 `json:"y"`
+}
+
+// DefaultLightState returns the state assumed for a light we know nothing about
+func DefaultLightState() LightState {
+	return LightState{X: color.WhiteX, Y: color.WhiteY}
+}
+
+// Change notifies subscribers of a new light state
+type Change struct {
+	LightID string
+	State   LightState
+}
+
+// subscriberBuffer is the number of changes a subscriber may lag behind before missing some
+const subscriberBuffer = 256
+
+// Store is a concurrency-safe cache of light states keyed by light ID
+type Store struct {
+	mu          sync.RWMutex
+	lights      map[string]LightState
+	subscribers map[chan Change]struct{}
+}
+
+// NewStore creates an empty state store
+func NewStore() *Store {
+	return &Store{
+		lights:      make(map[string]LightState),
+		subscribers: make(map[chan Change]struct{}),
+	}
+}
+
+// Subscribe returns a channel receiving every state change and a function to unsubscribe.
+// Slow subscribers miss changes rather than blocking updates.
+func (s *Store) Subscribe() (<-chan Change, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan Change, subscriberBuffer)
+	s.subscribers[ch] = struct{}{}
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			delete(s.subscribers, ch)
+			close(ch)
+		})
+	}
+}
+
+// Get returns the cached state of a light
+func (s *Store) Get(lightID string) (LightState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	st, ok := s.lights[lightID]
+	return st, ok
+}
+
+// Set replaces the cached state of a light
+func (s *Store) Set(lightID string, st LightState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lights[lightID] = st
+	s.notify(lightID, st)
+}
+
+// Update applies fn to the cached state of a light, starting from the default state if unknown
+func (s *Store) Update(lightID string, fn func(st *LightState)) LightState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.lights[lightID]
+	if !ok {
+		st = DefaultLightState()
+	}
+	fn(&st)
+	s.lights[lightID] = st
+	s.notify(lightID, st)
+	return st
+}
+
+// All returns a snapshot of every cached light state
+func (s *Store) All() map[string]LightState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := make(map[string]LightState, len(s.lights))
+	for id, st := range s.lights {
+		all[id] = st
+	}
+	return all
+}
+
+// notify sends a change to every subscriber, the caller must hold the lock
+func (s *Store) notify(lightID string, st LightState) {
+	for ch := range s.subscribers {
+		select {
+		case ch <- Change{LightID: lightID, State: st}:
+		default:
+		}
+	}
+}
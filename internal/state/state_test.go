@@ -0,0 +1,92 @@
+package state
+
+import (
+	"testing"
+
+	"osc2hue/internal/color"
+)
+
+func TestStoreGetSet(t *testing.T) {
+	store := NewStore()
+
+	if _, ok := store.Get("unknown"); ok {
+		t.Error("Expected unknown light to be missing from the store")
+	}
+
+	store.Set("light-1", LightState{On: true, Brightness: 0.5, X: 0.4, Y: 0.4})
+
+	st, ok := store.Get("light-1")
+	if !ok {
+		t.Fatal("Expected light-1 to be in the store")
+	}
+	if !st.On || st.Brightness != 0.5 || st.X != 0.4 || st.Y != 0.4 {
+		t.Errorf("Unexpected state for light-1: %+v", st)
+	}
+}
+
+func TestStoreUpdate(t *testing.T) {
+	store := NewStore()
+
+	// Updating an unknown light starts from the default state
+	st := store.Update("light-1", func(st *LightState) {
+		st.On = true
+	})
+	if !st.On {
+		t.Error("Expected light to be on after update")
+	}
+	if st.X != color.WhiteX || st.Y != color.WhiteY {
+		t.Errorf("Expected default white color, got x:%.4f y:%.4f", st.X, st.Y)
+	}
+
+	// Updating keeps the fields that were not touched
+	store.Update("light-1", func(st *LightState) {
+		st.Brightness = 0.8
+	})
+	st, _ = store.Get("light-1")
+	if !st.On || st.Brightness != 0.8 {
+		t.Errorf("Unexpected state after second update: %+v", st)
+	}
+}
+
+func TestStoreAll(t *testing.T) {
+	store := NewStore()
+	store.Set("a", LightState{On: true})
+	store.Set("b", LightState{On: false})
+
+	all := store.All()
+	if len(all) != 2 {
+		t.Fatalf("Expected 2 lights, got %d", len(all))
+	}
+
+	// Snapshot must not alias the store
+	delete(all, "a")
+	if _, ok := store.Get("a"); !ok {
+		t.Error("Deleting from snapshot should not affect the store")
+	}
+}
+
+func TestStoreSubscribe(t *testing.T) {
+	store := NewStore()
+	changes, unsubscribe := store.Subscribe()
+
+	store.Set("a", LightState{On: true})
+	store.Update("a", func(st *LightState) {
+		st.Brightness = 0.5
+	})
+
+	first := <-changes
+	if first.LightID != "a" || !first.State.On {
+		t.Errorf("Unexpected first change: %+v", first)
+	}
+	second := <-changes
+	if second.State.Brightness != 0.5 {
+		t.Errorf("Unexpected second change: %+v", second)
+	}
+
+	unsubscribe()
+	unsubscribe() // safe to call twice
+	store.Set("a", LightState{})
+	if _, ok := <-changes; ok {
+		t.Error("Expected channel to be closed after unsubscribe")
+	}
+}
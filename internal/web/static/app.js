@@ -0,0 +1,231 @@
+// OSC2Hue control panel: renders lights from the state cache and sends commands over the WebSocket
+
+const MAX_LOG_ENTRIES = 200;
+const SEND_INTERVAL_MS = 100;
+
+const lightsList = document.getElementById("lights");
+const logList = document.getElementById("log");
+const logPause = document.getElementById("log-pause");
+const wsStatus = document.getElementById("ws-status");
+const bridgeStatus = document.getElementById("bridge-status");
+const template = document.getElementById("light-template");
+
+const lights = new Map(); // light ID -> { element, state }
+let socket = null;
+
+// Color conversions, same formulas as internal/color
+
+function gammaCorrect(v) {
+  return v <= 0.0031308 ? 12.92 * v : 1.055 * Math.pow(v, 1 / 2.4) - 0.055;
+}
+
+function inverseGamma(v) {
+  return v > 0.04045 ? Math.pow((v + 0.055) / 1.055, 2.4) : v / 12.92;
+}
+
+function xyToRGB(x, y) {
+  if (y <= 0) {
+    return [1, 1, 1];
+  }
+  const z = 1 - x - y;
+  const X = x / y;
+  const Z = z / y;
+  let r = X * 1.656492 - 0.354851 - Z * 0.255038;
+  let g = -X * 0.707196 + 1.655397 + Z * 0.036152;
+  let b = X * 0.051713 - 0.121364 + Z * 1.01153;
+  [r, g, b] = [r, g, b].map((v) => gammaCorrect(Math.max(v, 0)));
+  const max = Math.max(r, g, b);
+  return max > 0 ? [r / max, g / max, b / max] : [0, 0, 0];
+}
+
+function rgbToXY(r, g, b) {
+  [r, g, b] = [r, g, b].map(inverseGamma);
+  const X = r * 0.664511 + g * 0.154324 + b * 0.162028;
+  const Y = r * 0.283881 + g * 0.668433 + b * 0.047685;
+  const Z = r * 0.000088 + g * 0.07231 + b * 0.986039;
+  const sum = X + Y + Z;
+  return sum > 0 ? [X / sum, Y / sum] : [0.3127, 0.329];
+}
+
+function toHex(rgb) {
+  return "#" + rgb.map((v) => Math.round(v * 255).toString(16).padStart(2, "0")).join("");
+}
+
+function fromHex(hex) {
+  return [1, 3, 5].map((i) => parseInt(hex.substr(i, 2), 16) / 255);
+}
+
+// Commands
+
+function send(request) {
+  if (socket && socket.readyState === WebSocket.OPEN) {
+    socket.send(JSON.stringify(request));
+  }
+}
+
+// throttle limits how often fn runs while a control is being dragged, the last value always gets through
+function throttle(fn) {
+  let timer = null;
+  let pending = null;
+  return (...args) => {
+    pending = args;
+    if (timer) {
+      return;
+    }
+    fn(...pending);
+    pending = null;
+    timer = setTimeout(() => {
+      timer = null;
+      if (pending) {
+        fn(...pending);
+        pending = null;
+      }
+    }, SEND_INTERVAL_MS);
+  };
+}
+
+// Lights
+
+function addLight(light) {
+  const element = template.content.firstElementChild.cloneNode(true);
+  element.querySelector(".name").textContent = `${light.number}. ${light.name}`;
+
+  const sendBrightness = throttle((value) =>
+    send({ type: "light", id: light.id, command: { brightness: value / 100 } })
+  );
+  const sendColor = throttle((hex) => {
+    const [x, y] = rgbToXY(...fromHex(hex));
+    send({ type: "light", id: light.id, command: { x, y } });
+  });
+
+  element.querySelector(".on").addEventListener("change", (e) =>
+    send({ type: "light", id: light.id, command: { on: e.target.checked } })
+  );
+  element.querySelector(".brightness").addEventListener("input", (e) => sendBrightness(Number(e.target.value)));
+  element.querySelector(".color").addEventListener("input", (e) => sendColor(e.target.value));
+
+  lightsList.appendChild(element);
+  lights.set(light.id, { element, state: light.state });
+  renderLight(light.id);
+}
+
+function renderLight(id) {
+  const light = lights.get(id);
+  if (!light || !light.state) {
+    return;
+  }
+
+  const { element, state } = light;
+  const hex = toHex(xyToRGB(state.x, state.y));
+  element.querySelector(".on").checked = state.on;
+  element.querySelector(".swatch").style.background = state.on ? hex : "transparent";
+
+  // Do not fight the user while they are dragging a control
+  const brightness = element.querySelector(".brightness");
+  if (document.activeElement !== brightness) {
+    brightness.value = Math.round(state.brightness * 100);
+  }
+  const color = element.querySelector(".color");
+  if (document.activeElement !== color) {
+    color.value = hex;
+  }
+}
+
+// OSC message log
+
+function formatArgument(arg) {
+  return typeof arg === "number" && !Number.isInteger(arg) ? arg.toFixed(3) : String(arg);
+}
+
+function logMessage(address, args) {
+  if (logPause.checked) {
+    return;
+  }
+
+  const entry = document.createElement("li");
+  const time = document.createElement("span");
+  time.className = "time";
+  time.textContent = new Date().toLocaleTimeString();
+  entry.appendChild(time);
+  entry.appendChild(document.createTextNode(`${address} ${(args || []).map(formatArgument).join(" ")}`));
+
+  logList.prepend(entry);
+  while (logList.children.length > MAX_LOG_ENTRIES) {
+    logList.lastChild.remove();
+  }
+}
+
+// Connection
+
+function setBadge(element, online, text) {
+  element.textContent = text;
+  element.classList.toggle("online", online);
+  element.classList.toggle("offline", !online);
+}
+
+async function refreshStatus() {
+  try {
+    const status = await (await fetch("status")).json();
+    const bridges = status.bridges || [];
+    let text = status.bridge_connected ? `Bridge ${status.bridge_ip} (${status.lights} lights)` : "Bridge not connected";
+    if (bridges.length > 1) {
+      const connected = bridges.filter((b) => b.connected).length;
+      text = `${connected}/${bridges.length} bridges (${status.lights} lights)`;
+    }
+    setBadge(bridgeStatus, status.bridge_connected, text);
+  } catch (e) {
+    setBadge(bridgeStatus, false, "osc2hue unreachable");
+  }
+}
+
+async function loadLights() {
+  const list = await (await fetch("lights")).json();
+  lightsList.replaceChildren();
+  lights.clear();
+  list.forEach(addLight);
+}
+
+function connect() {
+  const protocol = location.protocol === "https:" ? "wss:" : "ws:";
+  socket = new WebSocket(`${protocol}//${location.host}${location.pathname.replace(/[^/]*$/, "")}ws`);
+
+  socket.addEventListener("open", () => {
+    setBadge(wsStatus, true, "Connected");
+    loadLights().catch(() => {});
+  });
+
+  socket.addEventListener("close", () => {
+    setBadge(wsStatus, false, "Disconnected");
+    setTimeout(connect, 2000);
+  });
+
+  socket.addEventListener("message", (e) => {
+    const event = JSON.parse(e.data);
+    switch (event.type) {
+      case "state": {
+        const light = lights.get(event.id);
+        if (light) {
+          light.state = event.state;
+          renderLight(event.id);
+        }
+        break;
+      }
+      case "message":
+        logMessage(event.address, event.arguments);
+        break;
+      case "error":
+        logMessage("error", [event.error]);
+        break;
+    }
+  });
+}
+
+document.querySelectorAll("[data-all]").forEach((button) =>
+  button.addEventListener("click", () =>
+    send({ type: "light", id: "all", command: { on: button.dataset.all === "on" } })
+  )
+);
+
+connect();
+refreshStatus();
+setInterval(refreshStatus, 5000);
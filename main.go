@@ -1,7 +1,9 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -9,187 +11,349 @@ import (
 
 	"osc2hue/internal/config"
 	"osc2hue/internal/hue"
+	"osc2hue/internal/logging"
+	"osc2hue/internal/monitor"
 	"osc2hue/internal/osc"
 
 	"github.com/openhue/openhue-go"
 )
 
+// Loggers of the subsystems, their levels are set with -log-level
+var (
+	oscLog    = logging.For("osc")
+	hueLog    = logging.For("hue")
+	configLog = logging.For("config")
+	dmxLog    = logging.For("dmx")
+	mqttLog   = logging.For("mqtt")
+	httpLog   = logging.For("http")
+	safetyLog = logging.For("safety")
+)
+
 func main() {
-	configPath := "config.json"
+	if err := runCLI(os.Args[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "osc2hue: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runServe runs the OSC to Hue bridge until interrupted
+func runServe(args []string) error {
+	var filters stringList
+	fs := newFlagSet("serve")
+	monitorTraffic := fs.Bool("monitor", false, "print incoming OSC packets and the resulting Hue requests")
+	fs.Var(&filters, "filter", "with -monitor, only show addresses matching this OSC pattern (repeatable)")
+	recordPath := fs.String("record", "", "record incoming OSC packets to this file")
+	watchConfig := fs.Bool("watch", true, "reload the config file when it changes (SIGHUP always reloads)")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 5*time.Second, "on SIGINT or SIGTERM, how long to wait for pending light updates")
+	configFile := configFlag(fs)
+	logOpts := logFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if err := logging.Setup(*logOpts); err != nil {
+		return err
+	}
+
+	configPath := config.Path(*configFile)
+	configLog.Info("Using config file", "path", configPath)
 
 	// Load and setup configuration
-	cfg := loadOrCreateConfig(configPath)
+	cfg, err := loadOrCreateConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	// Connect to the bridge and discover lights, rooms and scenes
+	ctrl := setupController(cfg, configPath)
+
+	// Create OSC server and add all OSC handlers
+	oscServer := osc.NewServer(cfg.OSC.Host, cfg.OSC.Port)
+	svc := newService(configPath, cfg, ctrl, oscServer)
+	oscServer.AddObserver(metricsObserver{})
+
+	if *monitorTraffic {
+		mon := monitor.New(os.Stdout, filters)
+		oscServer.AddObserver(mon)
+		ctrl.onRequest = mon.HueRequest
+	}
+
+	// Record incoming packets if requested
+	var recordFile *os.File
+	if *recordPath != "" {
+		recordFile, err = startRecording(*recordPath, oscServer)
+		if err != nil {
+			return err
+		}
+		defer recordFile.Close()
+	}
 
-	// Setup bridge discovery and authentication
-	setupBridgeConnection(cfg, configPath)
+	// Start DMX output and input, MQTT and the HTTP API if configured
+	svc.start()
 
-	// Create client and discover lights
-	home, lights := setupHueClient(cfg)
+	// Pair new bridges in the background, serving the paired ones meanwhile
+	svc.pairUnpaired()
 
-	// Setup and start OSC server
-	startOSCServer(cfg, home, lights)
+	// Apply config changes while running
+	stopWatching := svc.watch(*watchConfig)
+
+	// Serve OSC until SIGINT or SIGTERM, then finish the pending light updates.
+	// Once the first signal arrived, a second one exits right away.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	err = serveOSC(ctx, cfg, oscServer)
+	stopSignals()
+	stopWatching()
+	svc.shutdown(*shutdownTimeout)
+	return err
 }
 
-// startOSCServer creates, configures and starts the OSC server
-func startOSCServer(cfg *config.Config, home *openhue.Home, lights []openhue.LightGet) {
-	// Create OSC server
-	oscServer := osc.NewServer(cfg.OSC.Host, cfg.OSC.Port)
+// setupController connects to the bridges and creates a controller for their lights, rooms and scenes
+func setupController(cfg *config.Config, configPath string) *controller {
+	var bridges []*bridge
+	for i := range cfg.Hue {
+		b := &cfg.Hue[i]
+
+		// Setup bridge discovery and authentication
+		if err := setupBridgeConnection(cfg, b, configPath); err != nil {
+			hueLog.Error("Continuing without bridge", "bridge", b.Name, "error", err)
+			bridges = append(bridges, newBridge(b.Name, b.BridgeIP, nil, nil, false))
+			continue
+		}
+
+		if b.BridgeIP == "" || !hue.IsValidAPIKey(b.APIKey) {
+			hueLog.Warn("Bridge is not paired yet, continuing without it until it is", "bridge", b.Name)
+			bridges = append(bridges, newBridge(b.Name, b.BridgeIP, nil, nil, false))
+			continue
+		}
+
+		// Create client and discover lights
+		bridges = append(bridges, setupHueClient(*b))
+	}
 
-	// Add all OSC handlers
-	addAllHandlers(oscServer, home, lights)
-
-	// Setup graceful shutdown
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-
-	go func() {
-		<-c
-		log.Println("Shutting down...")
-		oscServer.Stop()
-		os.Exit(0)
-	}()
-
-	// Start the OSC server
-	log.Printf("Starting OSC2Hue bridge...")
-	log.Printf("OSC Server: %s:%d", cfg.OSC.Host, cfg.OSC.Port)
-	log.Printf("Hue Bridge: %s", cfg.Hue.BridgeIP)
-	log.Printf("Available OSC commands:")
-	log.Printf("  /hue/{id}/on {0|1} [duration_ms]")
-	log.Printf("  /hue/{id}/set {x|-1} [y|-1] [brightness|-1] [duration_ms|-1]")
-	log.Printf("  /hue/{id}/brightness {0-1} [duration_ms]")
-	log.Printf("  /hue/{id}/color {x} {y} [duration_ms]")
-	log.Printf("  /hue/all/on {0|1} [duration_ms]")
-	log.Printf("  /hue/all/set {x|-1} [y|-1] [brightness|-1] [duration_ms|-1]")
-	log.Printf("  /hue/all/brightness {0-1} [duration_ms]")
-	log.Printf("  /hue/all/color {x} {y} [duration_ms]")
-	log.Printf("Note: Use -1 for null values in /set commands to skip color, brightness, or duration")
-
-	if err := oscServer.Start(); err != nil {
-		log.Fatalf("Failed to start OSC server: %v", err)
+	ctrl := newController(bridges)
+	if len(bridges) > 1 {
+		hueLog.Info("Lights on all bridges", "lights", len(ctrl.lights), "bridges", len(bridges))
 	}
+	ctrl.discoverGroupsAndScenes()
+	ctrl.addConfigGroups(cfg.Groups)
+	setupPolicies(cfg, ctrl)
+	setupSafety(cfg, ctrl, nil)
+	setupMaster(cfg, ctrl, nil)
+	return ctrl
 }
 
-// setupHueClient creates the Hue client and discovers lights
-func setupHueClient(cfg *config.Config) (*openhue.Home, []openhue.LightGet) {
-	// Create client for Hue API
-	home, err := openhue.NewHome(cfg.Hue.BridgeIP, cfg.Hue.APIKey)
-	if err != nil {
-		log.Printf("Failed to create Hue client: %v", err)
-		log.Printf("Continuing anyway - you can test OSC messages but they won't control lights")
-		return nil, nil
+// oscUsage lists the OSC commands, logged at debug level on startup
+var oscUsage = []string{
+	"/hue/{id}/on {0|1} [duration_ms]",
+	"/hue/{id}/set {x|-1} [y|-1] [brightness|-1] [duration_ms|-1] (-1 skips a value)",
+	"/hue/{id}/brightness {0-1} [duration_ms]",
+	"/hue/{id}/color {x} {y} [duration_ms]",
+	"/hue/all/{on|set|brightness|color} (same arguments as lights)",
+	"/hue/{bridge}/{id|all}/{on|set|brightness|color} (lights of one bridge)",
+	"/hue/group/{id}/{on|set|brightness|color} (same arguments as lights)",
+	"/hue/scene/{id}/recall [duration_ms]",
+	"/hue/pair [bridge] (pair bridges without an API key, or the named bridge)",
+}
+
+// serveOSC runs the OSC server until ctx is done, and returns the error it failed with, if any
+func serveOSC(ctx context.Context, cfg *config.Config, oscServer *osc.Server) error {
+	oscLog.Info("Starting OSC2Hue bridge", "address", fmt.Sprintf("%s:%d", cfg.OSC.Host, cfg.OSC.Port))
+	for _, b := range cfg.Hue {
+		hueLog.Info("Hue bridge", "bridge", b.Name, "ip", b.BridgeIP)
+	}
+	for _, usage := range oscUsage {
+		oscLog.Debug("Available OSC command", "usage", usage)
 	}
 
-	var lights []openhue.LightGet
-	if home != nil {
-		// Test connection and discover lights
-		log.Printf("Testing connection to Hue Bridge at %s...", cfg.Hue.BridgeIP)
-		lightsMap, err := home.GetLights()
+	errc := make(chan error, 1)
+	go func() { errc <- oscServer.Start() }()
+	select {
+	case err := <-errc:
 		if err != nil {
-			log.Printf("Warning: Failed to connect to Hue Bridge: %v", err)
-			log.Printf("Continuing anyway - you can test OSC messages but they won't control lights")
-			return home, lights
-		} else {
-			// Convert map to slice
-			for _, light := range lightsMap {
-				lights = append(lights, light)
-			}
-			log.Printf("Successfully connected! Found %d lights:", len(lights))
-			for id, light := range lights {
-				log.Printf("  Light #%d %s: %s", id+1, *light.Id, *light.Metadata.Name)
-			}
+			return fmt.Errorf("failed to start OSC server: %v", err)
 		}
+		return nil
+	case <-ctx.Done():
+		oscLog.Info("Shutting down")
+		return nil
 	}
-	return home, lights
 }
 
-// loadOrCreateConfig loads configuration from file or creates a default one
-func loadOrCreateConfig(configPath string) *config.Config {
-	cfg, err := config.LoadConfig(configPath)
+// setupHueClient creates the Hue client for a bridge and discovers its lights
+func setupHueClient(b config.HueConfig) *bridge {
+	hueLog.Info("Testing connection to Hue bridge", "bridge", b.Name, "ip", b.BridgeIP)
+	home, lights, err := connectHue(context.Background(), b)
 	if err != nil {
-		log.Printf("Failed to load config: %v", err)
-		log.Println("Using example configuration...")
-		cfg = &config.Config{
-			OSC: config.OSCConfig{
-				Host: "0.0.0.0",
-				Port: 8080,
-			},
-			Hue: config.HueConfig{
-				BridgeIP: "", // Empty, will be discovered
-				APIKey:   "", // Empty, will be authenticated
-			},
+		hueLog.Warn("Failed to connect to Hue bridge, reconnecting in the background, its lights are added once it answers",
+			"bridge", b.Name, "error", err)
+		return newBridge(b.Name, b.BridgeIP, home, nil, false)
+	}
+
+	hueLog.Info("Connected to Hue bridge", "bridge", b.Name, "lights", len(lights))
+	for id, light := range lights {
+		hueLog.Info("Light", "bridge", b.Name, "number", id+1, "id", *light.Id, "name", lightName(light))
+	}
+	return newBridge(b.Name, b.BridgeIP, home, lights, true)
+}
+
+// connectHue creates the Hue client for a bridge and fetches the lights. The
+// client is returned even if fetching the lights fails.
+func connectHue(ctx context.Context, b config.HueConfig) (*hue.Client, []openhue.LightGet, error) {
+	home, err := hue.NewClient(b.BridgeIP, b.APIKey, hue.TLSConfig(b.BridgeID, b.CertFingerprint))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create Hue client: %v", err)
+	}
+	lights, err := fetchLights(ctx, home)
+	if err != nil {
+		return home, nil, err
+	}
+	return home, lights, nil
+}
+
+// fetchLights returns the lights of a bridge in alias order
+func fetchLights(ctx context.Context, home *hue.Client) ([]openhue.LightGet, error) {
+	lightsMap, err := home.GetLights(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lights := make([]openhue.LightGet, 0, len(lightsMap))
+	for _, light := range lightsMap {
+		lights = append(lights, light)
+	}
+	sortLights(lights)
+	return lights, nil
+}
+
+// loadOrCreateConfig loads configuration from file, or the defaults if there is none, and applies environment overrides
+func loadOrCreateConfig(configPath string) (*config.Config, error) {
+	cfg, migrated, err := config.Load(configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		configLog.Info("No config file, using defaults", "path", configPath)
+		cfg = config.Default()
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Validate once, on the file merged with the environment overrides
+	if err := config.ApplyEnv(cfg); err != nil {
+		return nil, fmt.Errorf("invalid environment override: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v (after applying %s* environment overrides)", configPath, err, config.EnvPrefix)
+	}
+
+	// Save migrated configs so the file matches what is in use
+	if len(migrated) > 0 {
+		for _, change := range migrated {
+			configLog.Info("Config migration", "change", change)
+		}
+		if err := config.UpdateConfig(configPath, func(*config.Config) {}); err != nil {
+			configLog.Warn("Failed to save migrated config", "error", err)
+		} else {
+			configLog.Info("Migrated config", "path", configPath, "version", config.CurrentVersion)
 		}
 	}
-	return cfg
+	return cfg, nil
 }
 
-// setupBridgeConnection handles bridge discovery and authentication
-func setupBridgeConnection(cfg *config.Config, configPath string) {
+// setupBridgeConnection handles bridge discovery and identification for one of
+// the configured bridges. It returns an error if the bridge at the configured
+// IP cannot be trusted and the bridge was not found.
+func setupBridgeConnection(cfg *config.Config, b *config.HueConfig, configPath string) error {
 	// Discover bridge if IP is not set or seems invalid
-	if cfg.Hue.BridgeIP == "" {
-		discoverAndSaveBridge(cfg, configPath)
+	if b.BridgeIP == "" {
+		discoverAndSaveBridge(cfg, b, configPath)
 	}
 
-	// Authenticate with bridge if needed
-	if !hue.IsValidAPIKey(cfg.Hue.APIKey) {
-		authenticateAndSaveAPIKey(cfg, configPath)
-	} else {
-		log.Printf("Using existing API key: %s", cfg.Hue.APIKey)
+	// Make sure the bridge is the one we paired with, following it if its IP changed
+	if b.BridgeIP != "" {
+		if err := checkBridge(b, configPath); errors.Is(err, errUntrustedBridge) {
+			return err
+		} else if err != nil {
+			hueLog.Warn("Failed to check bridge", "bridge", b.Name, "error", err)
+		}
 	}
+
+	// Authentication waits for the link button, so it is done in the background once serving
+	if hue.IsValidAPIKey(b.APIKey) {
+		hueLog.Info("Using existing API key", "bridge", b.Name)
+	}
+	return nil
 }
 
-// discoverAndSaveBridge discovers the Hue bridge and saves the IP to config
-func discoverAndSaveBridge(cfg *config.Config, configPath string) {
-	log.Println("Discovering Hue bridges...")
-	bridge, err := hue.DiscoverBridge(5 * time.Second)
-	if err != nil {
-		log.Printf("Bridge discovery failed: %v", err)
-		log.Println("Please manually set the bridge_ip in config.json")
-		return
+// discoverAndSaveBridge discovers the bridge with the recorded ID, or else a
+// Hue bridge not used by the other configured bridges, and saves its IP to config
+func discoverAndSaveBridge(cfg *config.Config, b *config.HueConfig, configPath string) {
+	var bridgeIP string
+	if b.BridgeID != "" {
+		hueLog.Info("Discovering Hue bridge", "bridge", b.Name, "id", b.BridgeID)
+		identity, err := hue.Rediscover(b.BridgeID, 5*time.Second)
+		if err != nil {
+			hueLog.Error("Bridge discovery failed, please set its bridge_ip manually", "bridge", b.Name, "config", configPath, "error", err)
+			return
+		}
+		bridgeIP = identity.IPAddress
+	} else {
+		hueLog.Info("Discovering Hue bridge", "bridge", b.Name)
+		bridge, err := discoverUnusedBridge(cfg)
+		if err != nil {
+			hueLog.Error("Bridge discovery failed, please set its bridge_ip manually", "bridge", b.Name, "config", configPath, "error", err)
+			return
+		}
+		bridgeIP = bridge.IPAddress
 	}
 
-	log.Printf("Found Hue bridge at %s", bridge.IPAddress)
+	hueLog.Info("Found Hue bridge", "bridge", b.Name, "ip", bridgeIP)
 
 	// Update config if the bridge IP has changed or was empty
-	if cfg.Hue.BridgeIP != bridge.IPAddress {
-		cfg.Hue.BridgeIP = bridge.IPAddress
-		log.Printf("Updated bridge IP to %s", bridge.IPAddress)
+	if b.BridgeIP != bridgeIP {
+		b.BridgeIP = bridgeIP
+		hueLog.Info("Updated bridge IP", "bridge", b.Name, "ip", bridgeIP)
 
 		// Save the updated configuration
-		if err := config.SaveConfig(cfg, configPath); err != nil {
-			log.Printf("Warning: Failed to save updated config: %v", err)
+		name := b.Name
+		err := config.UpdateConfig(configPath, func(c *config.Config) {
+			if saved := c.Bridge(name); saved != nil {
+				saved.BridgeIP = bridgeIP
+			}
+		})
+		if err != nil {
+			configLog.Warn("Failed to save updated config", "error", err)
 		} else {
-			log.Println("Configuration saved with discovered bridge IP")
+			configLog.Info("Configuration saved with discovered bridge IP", "path", configPath)
 		}
 	}
 }
 
-// authenticateAndSaveAPIKey authenticates with the bridge and saves the API key
-func authenticateAndSaveAPIKey(cfg *config.Config, configPath string) {
-	log.Printf("Setting up authentication with Hue bridge at %s", cfg.Hue.BridgeIP)
-	log.Println("🔗 Press the link button on your Hue bridge now...")
+// discoverUnusedBridge finds a bridge on the network whose IP is not configured
+// for another bridge. With several bridges configured, the choice must be unambiguous.
+func discoverUnusedBridge(cfg *config.Config) (*hue.Bridge, error) {
+	if len(cfg.Hue) == 1 {
+		return hue.DiscoverBridge(5 * time.Second)
+	}
 
-	apiKey, err := hue.AuthenticateWithBridge(cfg.Hue.BridgeIP)
+	found, err := hue.DiscoverBridges(5 * time.Second)
 	if err != nil {
-		log.Printf("Authentication failed: %v", err)
-		log.Println("You can manually set the api_key in config.json or run again to retry authentication")
-		return
+		return nil, err
 	}
-
-	log.Printf("\n✅ Authentication successful!")
-	// Safe string truncation
-	keyPreview := apiKey
-	if len(apiKey) > 10 {
-		keyPreview = apiKey[:10] + "..."
+	var unused []hue.Bridge
+	for _, candidate := range found {
+		used := false
+		for _, b := range cfg.Hue {
+			used = used || b.BridgeIP == candidate.IPAddress
+		}
+		if !used {
+			unused = append(unused, candidate)
+		}
 	}
-	log.Printf("API key obtained: %s", keyPreview)
-
-	// Update config with the new API key
-	cfg.Hue.APIKey = apiKey
-
-	// Save the updated configuration
-	if err := config.SaveConfig(cfg, configPath); err != nil {
-		log.Printf("Warning: Failed to save updated config: %v", err)
-	} else {
-		log.Println("Configuration saved with new API key")
+	switch len(unused) {
+	case 0:
+		return nil, fmt.Errorf("every bridge found is already configured")
+	case 1:
+		return &unused[0], nil
 	}
+	return nil, fmt.Errorf("found %d unconfigured bridges, cannot tell which one to use (see osc2hue discover)", len(unused))
 }
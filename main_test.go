@@ -1,8 +1,34 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"osc2hue/internal/api"
+	"osc2hue/internal/color"
+	"osc2hue/internal/command"
 	"osc2hue/internal/config"
+	"osc2hue/internal/dmx"
+	"osc2hue/internal/hue"
+	"osc2hue/internal/osc"
+	"osc2hue/internal/policy"
+	"osc2hue/internal/state"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+	"github.com/openhue/openhue-go"
 )
 
 func TestConfigStructure(t *testing.T) {
@@ -12,10 +38,11 @@ func TestConfigStructure(t *testing.T) {
 			Host: "127.0.0.1",
 			Port: 9000,
 		},
-		Hue: config.HueConfig{
+		Hue: []config.HueConfig{{
+			Name:     "main",
 			BridgeIP: "192.168.1.100",
 			APIKey:   "test-api-key",
-		},
+		}},
 	}
 
 	if cfg.OSC.Host != "127.0.0.1" {
@@ -26,11 +53,995 @@ func TestConfigStructure(t *testing.T) {
 		t.Errorf("Expected OSC port to be 9000, got %d", cfg.OSC.Port)
 	}
 
-	if cfg.Hue.BridgeIP != "192.168.1.100" {
-		t.Errorf("Expected Hue bridge IP to be 192.168.1.100, got %s", cfg.Hue.BridgeIP)
+	if cfg.Hue[0].BridgeIP != "192.168.1.100" {
+		t.Errorf("Expected Hue bridge IP to be 192.168.1.100, got %s", cfg.Hue[0].BridgeIP)
+	}
+
+	if cfg.Hue[0].APIKey != "test-api-key" {
+		t.Errorf("Expected Hue API key to be test-api-key, got %s", cfg.Hue[0].APIKey)
+	}
+}
+
+func TestControllerUpdateLightRecordsState(t *testing.T) {
+	id := "light-1"
+	ctrl := newController([]*bridge{{name: "main", lights: []openhue.LightGet{{Id: &id}}}})
+
+	on := true
+	brightness := float32(50)
+	x, y := float32(0.4), float32(0.5)
+	put := openhue.LightPut{
+		On:      &openhue.On{On: &on},
+		Dimming: &openhue.Dimming{Brightness: &brightness},
+		Color:   &openhue.Color{Xy: &openhue.GamutPosition{X: &x, Y: &y}},
+	}
+
+	// Without a bridge the update fails but the commanded state is still cached
+	if err := ctrl.updateLight(id, put); err == nil {
+		t.Error("Expected error when bridge is not connected")
+	}
+
+	st, ok := ctrl.state.Get(id)
+	if !ok {
+		t.Fatal("Expected light state to be cached")
+	}
+	if !st.On || st.Brightness != 0.5 || st.X != float64(x) || st.Y != float64(y) {
+		t.Errorf("Unexpected cached state: %+v", st)
+	}
+}
+
+func TestControllerResolveLight(t *testing.T) {
+	a, b := "uuid-a", "uuid-b"
+	ctrl := newController([]*bridge{{name: "main", lights: []openhue.LightGet{{Id: &a}, {Id: &b}}}})
+
+	tests := []struct {
+		ref      string
+		expected string
+		ok       bool
+	}{
+		{"1", "uuid-a", true},
+		{"2", "uuid-b", true},
+		{"3", "", false},
+		{"uuid-b", "uuid-b", true},
+		{"uuid-c", "", false},
+	}
+
+	for _, tt := range tests {
+		id, ok := ctrl.resolveLight(tt.ref)
+		if id != tt.expected || ok != tt.ok {
+			t.Errorf("resolveLight(%q) = (%q, %v), expected (%q, %v)", tt.ref, id, ok, tt.expected, tt.ok)
+		}
+	}
+}
+
+func TestControllerKeepsLightNumbers(t *testing.T) {
+	a, b, c, d, e := "uuid-a", "uuid-b", "uuid-c", "uuid-d", "uuid-e"
+	old := newController([]*bridge{
+		{name: "main", lights: []openhue.LightGet{{Id: &a}, {Id: &b}, {Id: &c}}},
+		{name: "annex", lights: []openhue.LightGet{{Id: &d}}},
+	})
+
+	// b was removed and e added on main
+	ctrl := newController([]*bridge{
+		{name: "main", lights: []openhue.LightGet{{Id: &a}, {Id: &c}, {Id: &e}}},
+		old.bridges[1],
+	})
+	ctrl.keepNumbers(old)
+
+	tests := []struct {
+		ref      string
+		expected string
+		ok       bool
+	}{
+		{"1", "uuid-a", true},
+		{"2", "", false},
+		{"3", "uuid-c", true},
+		{"4", "uuid-d", true},
+		{"5", "uuid-e", true},
+		{"main/2", "", false},
+		{"main/3", "uuid-c", true},
+		{"main/4", "uuid-e", true},
+		{"annex/1", "uuid-d", true},
+		{"uuid-b", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := ctrl.resolveLight(tt.ref)
+		if id != tt.expected || ok != tt.ok {
+			t.Errorf("resolveLight(%q) = (%q, %v), expected (%q, %v)", tt.ref, id, ok, tt.expected, tt.ok)
+		}
+	}
+	if sameLights(old, ctrl) {
+		t.Error("Expected the lights to differ")
+	}
+}
+
+func TestControllerMultipleBridges(t *testing.T) {
+	a, b, c := "uuid-a", "uuid-b", "uuid-c"
+	ctrl := newController([]*bridge{
+		{name: "main", lights: []openhue.LightGet{{Id: &a}, {Id: &b}}},
+		{name: "annex", lights: []openhue.LightGet{{Id: &c}}},
+	})
+
+	tests := []struct {
+		ref      string
+		expected string
+		ok       bool
+	}{
+		{"3", "uuid-c", true},
+		{"annex/1", "uuid-c", true},
+		{"main/2", "uuid-b", true},
+		{"annex/2", "", false},
+		{"annex/uuid-a", "", false},
+		{"garage/1", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := ctrl.resolveLight(tt.ref)
+		if id != tt.expected || ok != tt.ok {
+			t.Errorf("resolveLight(%q) = (%q, %v), expected (%q, %v)", tt.ref, id, ok, tt.expected, tt.ok)
+		}
+	}
+
+	ctrl.addConfigGroups([]config.GroupConfig{{Name: "stage", Lights: []string{"main/1", "annex/1"}}})
+	group, ok := ctrl.resolveGroup("stage")
+	if !ok {
+		t.Fatal("Expected the config group to resolve by name")
+	}
+	if len(group.LightIDs) != 2 || group.LightIDs[0] != a || group.LightIDs[1] != c {
+		t.Errorf("Expected the group to span both bridges, got %v", group.LightIDs)
+	}
+
+	if err := ctrl.updateLight("uuid-unknown", openhue.LightPut{}); err == nil {
+		t.Error("Expected error updating a light on no bridge")
+	}
+}
+
+func TestControllerReportsUnreachableBridge(t *testing.T) {
+	// Nothing listens on the port, so requests fail before reaching a bridge
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	home, err := hue.NewClient(addr, "key", hue.TLSConfig("", ""))
+	if err != nil {
+		t.Fatalf("Failed to create Hue client: %v", err)
+	}
+	id := "light-1"
+	ctrl := newController([]*bridge{{name: "main", home: home, lights: []openhue.LightGet{{Id: &id}}}})
+	var unreachable []string
+	ctrl.onUnreachable = func(name string) { unreachable = append(unreachable, name) }
+
+	if err := ctrl.updateLight(id, openhue.LightPut{}); err == nil {
+		t.Fatal("Expected error without a bridge")
+	}
+	if len(unreachable) != 1 || unreachable[0] != "main" {
+		t.Errorf("Expected bridge main to be reported unreachable, got %v", unreachable)
+	}
+
+	if isNetworkError(errors.New("bridge returned 403")) {
+		t.Error("Expected an error from the bridge not to be a network error")
+	}
+}
+
+// newTestBridge starts a fake bridge answering with handler, closed when the
+// test ends, and returns it with a client trusting its certificate
+func newTestBridge(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *hue.Client) {
+	t.Helper()
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+	home, err := hue.NewClient(strings.TrimPrefix(server.URL, "https://"), "key",
+		hue.TLSConfig("", hue.Fingerprint(server.Certificate())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, home
+}
+
+func TestControllerFlashLimiter(t *testing.T) {
+	var mu sync.Mutex
+	var puts []string
+	_, home := newTestBridge(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		puts = append(puts, string(body))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"errors":[],"data":[]}`))
+	})
+
+	id := "light-1"
+	ctrl := newController([]*bridge{{name: "main", home: home, lights: []openhue.LightGet{{Id: &id}}}})
+	ctrl.state.Update(id, func(st *state.LightState) { st.Brightness = 1 })
+	cfg := config.Default()
+	cfg.Safety = &config.SafetyConfig{MaxFlashes: 1}
+	setupSafety(cfg, ctrl, nil)
+	defer ctrl.safety.Stop()
+
+	// A strobe ending on: two changes pass, the last one is sent once allowed
+	for i := 0; i < 7; i++ {
+		on := i%2 == 0
+		if err := ctrl.updateLight(id, openhue.LightPut{On: &openhue.On{On: &on}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	if len(puts) != 2 {
+		t.Errorf("Expected 2 updates to pass, got %v", puts)
+	}
+	mu.Unlock()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(puts)
+		mu.Unlock()
+		if n > 2 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(puts) != 3 || !strings.Contains(puts[2], `"on":{"on":true}`) {
+		t.Errorf("Expected the held change to turn the light on, got %v", puts)
+	}
+}
+
+func TestControllerLimitsSceneRecalls(t *testing.T) {
+	var recalls atomic.Int32
+	_, home := newTestBridge(t, func(w http.ResponseWriter, r *http.Request) {
+		recalls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"errors":[],"data":[]}`))
+	})
+
+	id, on, off, brightness := "light-1", true, false, float32(100)
+	b := &bridge{name: "main", home: home, lights: []openhue.LightGet{{Id: &id}}}
+	ctrl := newController([]*bridge{b})
+	ctrl.scenes = []scene{
+		{ID: "bright", bridge: b, actions: map[string]openhue.LightPut{id: {On: &openhue.On{On: &on}, Dimming: &openhue.Dimming{Brightness: &brightness}}}},
+		{ID: "dark", bridge: b, actions: map[string]openhue.LightPut{id: {On: &openhue.On{On: &off}}}},
+	}
+	cfg := config.Default()
+	cfg.Safety = &config.SafetyConfig{MaxFlashes: 1}
+	setupSafety(cfg, ctrl, nil)
+	defer ctrl.safety.Stop()
+
+	// Alternating scenes strobes the light, the third recall in a second is refused
+	for _, sceneID := range []string{"bright", "dark"} {
+		if err := ctrl.recallScene(sceneID, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ctrl.recallScene("bright", 0); !errors.Is(err, errFlashLimited) {
+		t.Errorf("Expected the third recall to be refused, got %v", err)
+	}
+	if n := recalls.Load(); n != 2 {
+		t.Errorf("Expected 2 recalls to reach the bridge, got %d", n)
+	}
+}
+
+func TestSceneActions(t *testing.T) {
+	var sc openhue.SceneGet
+	if err := json.Unmarshal([]byte(`{"actions": [
+		{"target": {"rid": "light-1", "rtype": "light"}, "action": {"on": {"on": true}, "color_temperature": {"mirek": 250}}},
+		{"target": {"rid": "device-1", "rtype": "device"}, "action": {"on": {"on": true}}}
+	]}`), &sc); err != nil {
+		t.Fatal(err)
+	}
+
+	actions := sceneActions(sc)
+	put, ok := actions["light-1"]
+	if len(actions) != 1 || !ok {
+		t.Fatalf("Expected only the action on the light, got %v", actions)
+	}
+	x, y := color.KelvinToXY(4000)
+	if put.Color == nil || math.Abs(float64(*put.Color.Xy.X)-x) > 1e-3 || math.Abs(float64(*put.Color.Xy.Y)-y) > 1e-3 {
+		t.Errorf("Expected 250 mirek to become the XY of 4000K, got %+v", put.Color)
+	}
+}
+
+func TestControllerPolicies(t *testing.T) {
+	a, b := "light-a", "light-b"
+	ctrl := newController([]*bridge{{name: "main", lights: []openhue.LightGet{{Id: &a}, {Id: &b}}}})
+	ctrl.groups = []lightGroup{{ID: "room-1", Name: "Bedroom", LightIDs: []string{b}}}
+	cfg := config.Default()
+	cfg.Policies = []config.PolicyConfig{
+		{Lights: []string{"1"}, KeepOn: true, MaxBrightness: 0.8},
+		{Groups: []string{"Bedroom"}, MaxBrightness: 0.5, MaxKelvin: 3000},
+		{Lights: []string{"main/2"}, MaxBrightness: 0.7, QuietHours: []config.QuietHoursConfig{{Start: "22:00", End: "07:00", MaxBrightness: 0.1}}},
+	}
+	setupPolicies(cfg, ctrl)
+	if len(ctrl.policies) != 2 || ctrl.policies[b].MaxBrightness != 0.5 || len(ctrl.policies[b].QuietHours) != 1 {
+		t.Fatalf("Unexpected policies: %+v", ctrl.policies)
+	}
+
+	off := false
+	put := ctrl.limitLight(a, ctrl.policies[a], openhue.LightPut{On: &openhue.On{On: &off}}, time.Now())
+	if put.On == nil || !*put.On.On {
+		t.Error("Expected light 1 to stay on")
+	}
+
+	on, brightness := true, float32(100)
+	night := time.Date(2024, 1, 1, 23, 0, 0, 0, time.Local)
+	put = ctrl.limitLight(b, ctrl.policies[b], openhue.LightPut{On: &openhue.On{On: &on}, Dimming: &openhue.Dimming{Brightness: &brightness}}, night)
+	if put.Dimming == nil || math.Abs(float64(*put.Dimming.Brightness)-10) > 0.01 {
+		t.Errorf("Expected the bedroom light to be capped at 10%% at night, got %+v", put.Dimming)
+	}
+	if put.Color == nil || color.XYToKelvin(float64(*put.Color.Xy.X), float64(*put.Color.Xy.Y)) > 3050 {
+		t.Errorf("Expected the bedroom light to be warmed to 3000K, got %+v", put.Color)
+	}
+}
+
+func TestControllerMasterAndBlackout(t *testing.T) {
+	var mu sync.Mutex
+	var puts []map[string]interface{}
+	_, home := newTestBridge(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		puts = append(puts, body)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"errors":[],"data":[]}`))
+	})
+	id := "light-1"
+	ctrl := newController([]*bridge{{name: "main", home: home, lights: []openhue.LightGet{{Id: &id}}}})
+	setupMaster(config.Default(), ctrl, nil)
+
+	// waitFor returns the last update once n were sent
+	waitFor := func(n int) map[string]interface{} {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			mu.Lock()
+			got := len(puts)
+			var last map[string]interface{}
+			if got > 0 {
+				last = puts[got-1]
+			}
+			mu.Unlock()
+			if got >= n {
+				if got > n {
+					t.Fatalf("Expected %d updates, got %d", n, got)
+				}
+				return last
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d updates, got %d", n, got)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	brightnessOf := func(body map[string]interface{}) float64 {
+		dimming, _ := body["dimming"].(map[string]interface{})
+		b, _ := dimming["brightness"].(float64)
+		return b
+	}
+
+	on, brightness := true, float32(80)
+	ctrl.master.setLevel(0.5)
+	if err := ctrl.updateLight(id, openhue.LightPut{On: &openhue.On{On: &on}, Dimming: &openhue.Dimming{Brightness: &brightness}}); err != nil {
+		t.Fatal(err)
+	}
+	if b := brightnessOf(waitFor(1)); b != 40 {
+		t.Errorf("Expected brightness 40 at master 50%%, got %v", b)
+	}
+
+	// During blackout the light is turned off and changes are only recorded
+	ctrl.master.setBlackout(true)
+	ctrl.refreshLights(0)
+	if body := waitFor(2); body["on"].(map[string]interface{})["on"] != false {
+		t.Errorf("Expected the light to be turned off, got %v", body)
+	}
+	brightness = 100
+	if err := ctrl.updateLight(id, openhue.LightPut{Dimming: &openhue.Dimming{Brightness: &brightness}}); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := ctrl.state.Get(id); st.Brightness != 1 {
+		t.Errorf("Expected the change to be recorded, got %+v", st)
+	}
+
+	// Releasing it restores the recorded state through the master
+	ctrl.master.setBlackout(false)
+	ctrl.refreshLights(0)
+	if b := brightnessOf(waitFor(3)); b != 50 {
+		t.Errorf("Expected brightness 50 after the blackout, got %v", b)
+	}
+
+	// Panic resets the master and sets the safe look
+	ctrl.master.setBlackout(true)
+	ctrl.applyPanic(0)
+	if b := brightnessOf(waitFor(4)); b != 100 {
+		t.Errorf("Expected full brightness after panic, got %v", b)
+	}
+	if level, blackout := ctrl.master.get(); level != 1 || blackout {
+		t.Errorf("Expected panic to reset the master, got %v %v", level, blackout)
+	}
+}
+
+func TestDMXOutputFollowsMaster(t *testing.T) {
+	dimmed, emergency := "light-1", "light-2"
+	ctrl := newController([]*bridge{{name: "main", lights: []openhue.LightGet{{Id: &dimmed}, {Id: &emergency}}}})
+	ctrl.policies = map[string]policy.Policy{emergency: {KeepOn: true}}
+	setupMaster(config.Default(), ctrl, nil)
+	for _, id := range []string{dimmed, emergency} {
+		ctrl.state.Set(id, state.LightState{On: true, Brightness: 1})
+	}
+	output := dmx.NewOutput(nil, []dmx.Fixture{
+		{LightID: dimmed, Address: 1, Channels: dmx.BuiltinProfiles["dimmer"]},
+		{LightID: emergency, Address: 2, Channels: dmx.BuiltinProfiles["dimmer"]},
+	}, dmxSource{ctrl}, 30)
+
+	ctrl.master.setLevel(0.5)
+	if frame := output.Frames()[0]; frame[0] != 128 || frame[1] != 255 {
+		t.Errorf("Expected the master to dim only light 1 to half, got %v", frame[:2])
+	}
+	ctrl.master.setBlackout(true)
+	if frame := output.Frames()[0]; frame[0] != 0 || frame[1] != 255 {
+		t.Errorf("Expected the blackout to zero only light 1, got %v", frame[:2])
+	}
+	ctrl.applyPanic(0)
+	if frame := output.Frames()[0]; frame[0] == 0 {
+		t.Errorf("Expected panic to bring light 1 back, got %v", frame[:2])
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	_, home := newTestBridge(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	id := "metrics-light"
+	ctrl := newController([]*bridge{newBridge("main", "", home, []openhue.LightGet{{Id: &id}}, true)})
+	svc := newService("", config.Default(), ctrl, osc.NewServer("127.0.0.1", 0))
+
+	rejected := hueRequests.Value("light", "error", "429")
+	if err := ctrl.updateLight(id, openhue.LightPut{}); err == nil {
+		t.Fatal("Expected the bridge to reject the update")
+	}
+	if n := hueRequests.Value("light", "error", "429"); n != rejected+1 {
+		t.Errorf("Expected a rejected request to be counted, got %g", n-rejected)
+	}
+	if depth := lightQueueDepth.Value(id); depth != 0 {
+		t.Errorf("Expected no changes waiting after the request, got %g", depth)
+	}
+
+	one, two, unmatched := oscMessages.Value("/hue/1/on"), oscMessages.Value("/hue/2/on"), oscMessages.Value("unmatched")
+	observer := metricsObserver{}
+	observer.MessageDispatched(gosc.NewMessage("/hue/1/on"), []string{"/hue/1/on"})
+	observer.MessageDispatched(gosc.NewMessage("/hue/[1-2]/on"), []string{"/hue/1/on", "/hue/2/on"})
+	observer.MessageDispatched(gosc.NewMessage("/nowhere"), nil)
+	observer.PacketError(nil, osc.ErrNotOSC)
+	if oscMessages.Value("/hue/1/on") != one+2 || oscMessages.Value("/hue/2/on") != two+1 || oscMessages.Value("unmatched") != unmatched+1 {
+		t.Error("Expected messages to be counted once for every handler they matched")
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler(svc).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{
+		`osc2hue_osc_messages_total{handler="/hue/1/on"}`,
+		`osc2hue_osc_messages_total{handler="unmatched"}`,
+		`osc2hue_osc_parse_errors_total{reason="not_osc"}`,
+		`osc2hue_hue_request_duration_seconds_count{resource="light"}`,
+		`osc2hue_bridge_connected{bridge="main"} 1`,
+		`osc2hue_lights{bridge="main"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Errorf("Expected %s in:\n%s", line, rec.Body.String())
+		}
 	}
+}
 
-	if cfg.Hue.APIKey != "test-api-key" {
-		t.Errorf("Expected Hue API key to be test-api-key, got %s", cfg.Hue.APIKey)
+func TestAPIBackendReportsErrors(t *testing.T) {
+	_, home := newTestBridge(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	failing, offline := "failing-light", "offline-light"
+	ctrl := newController([]*bridge{
+		newBridge("main", "", home, []openhue.LightGet{{Id: &failing}}, true),
+		newBridge("attic", "", nil, []openhue.LightGet{{Id: &offline}}, false),
+	})
+	backend := &apiBackend{svc: newService("", config.Default(), ctrl, osc.NewServer("127.0.0.1", 0))}
+	on := true
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"Unknown light", backend.SetLight("99", command.Light{On: &on}), api.ErrNotFound},
+		{"Unknown group", backend.SetGroup("99", command.Light{On: &on}), api.ErrNotFound},
+		{"Unknown scene", backend.RecallScene("99", -1), api.ErrNotFound},
+		{"Bridge failure", backend.SetLight(failing, command.Light{On: &on}), api.ErrBridge},
+		{"Disconnected bridge", backend.SetLight(offline, command.Light{On: &on}), api.ErrUnavailable},
+		{"Blackout", withStatus(errBlackout), api.ErrConflict},
+		{"Flash limiter", withStatus(errFlashLimited), api.ErrConflict},
+	}
+	for _, tt := range tests {
+		if !errors.Is(tt.err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, tt.err)
+		}
+	}
+
+	x := 0.5
+	if err := backend.SetLight(failing, command.Light{X: &x}); err == nil || errors.Is(err, api.ErrBridge) {
+		t.Errorf("Expected an invalid command to be rejected before the bridge, got %v", err)
+	}
+}
+
+func TestMQTTCommandTargets(t *testing.T) {
+	var requests atomic.Int32
+	_, home := newTestBridge(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"errors":[],"data":[]}`))
+	})
+	a, b := "light-a", "light-b"
+	ctrl := newController([]*bridge{newBridge("main", "", home, []openhue.LightGet{{Id: &a}, {Id: &b}}, true)})
+	mqttCommand := mqttCommandHandler(newService("", config.Default(), ctrl, osc.NewServer("127.0.0.1", 0)))
+
+	// Topics name a light, they are not OSC address patterns
+	on := true
+	for _, light := range []string{"*", "{1,2}", "[12]", "unknown"} {
+		mqttCommand(light, command.Light{On: &on})
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("Expected patterns in MQTT topics to reach no light, got %d requests", n)
+	}
+	mqttCommand("all", command.Light{On: &on})
+	mqttCommand("light-b", command.Light{On: &on})
+	if n := requests.Load(); n != 3 {
+		t.Errorf("Expected all to reach both lights once and a UUID its light, got %d requests", n)
+	}
+}
+
+func TestCommandsShareConversion(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	_, home := newTestBridge(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"errors":[],"data":[]}`))
+	})
+	requests := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		sent := bodies
+		bodies = nil
+		return sent
+	}
+
+	a, b := "light-a", "light-b"
+	ctrl := newController([]*bridge{newBridge("main", "", home, []openhue.LightGet{{Id: &a}, {Id: &b}}, true)})
+	svc := newService("", config.Default(), ctrl, osc.NewServer("127.0.0.1", 0))
+	backend := &apiBackend{svc: svc}
+	mqttCommand := mqttCommandHandler(svc)
+
+	// The same command is one identical request over the API, MQTT and OSC
+	tests := []struct {
+		name    string
+		payload string
+		osc     *gosc.Message
+	}{
+		{"On with brightness", `{"on": true, "brightness": 0.5}`, nil},
+		{"Negative brightness", `{"brightness": -0.2}`, gosc.NewMessage("/hue/1/set", int32(-1), int32(-1), float32(-0.2))},
+		{"Color with duration", `{"x": 0.25, "y": 0.5, "duration_ms": 400}`, gosc.NewMessage("/hue/1/set", float32(0.25), float32(0.5), int32(-1), int32(400))},
+	}
+	for _, tt := range tests {
+		var cmd command.Light
+		if err := json.Unmarshal([]byte(tt.payload), &cmd); err != nil {
+			t.Fatal(err)
+		}
+		if err := backend.SetLight("1", cmd); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		viaAPI := requests()
+		mqttCommand("1", cmd)
+		viaMQTT := requests()
+		if len(viaAPI) != 1 || !slices.Equal(viaAPI, viaMQTT) {
+			t.Errorf("%s: expected one identical request, got %v over the API and %v over MQTT", tt.name, viaAPI, viaMQTT)
+		}
+		if tt.osc != nil {
+			svc.oscServer.Dispatch(tt.osc)
+			if viaOSC := requests(); !slices.Equal(viaAPI, viaOSC) {
+				t.Errorf("%s: expected %v over OSC, got %v", tt.name, viaAPI, viaOSC)
+			}
+		}
+	}
+}
+
+func TestBridgeHealth(t *testing.T) {
+	id := "light-1"
+	now := time.Now()
+	home := &hue.Client{}
+
+	unpaired := newBridge("attic", "", nil, nil, false)
+	if h := bridgeHealth(unpaired, nil, now); h.Authenticated.OK || h.Reachable.OK || h.Ready() {
+		t.Errorf("Expected an unpaired bridge not to be ready, got %+v", h)
+	}
+
+	rejected := newBridge("main", "192.168.1.2", home, nil, false)
+	h := bridgeHealth(rejected, &hue.StatusError{StatusCode: http.StatusForbidden, Status: "403 Forbidden"}, now)
+	if h.Authenticated.OK || !strings.Contains(h.Authenticated.Detail, "rejected") {
+		t.Errorf("Expected a rejected API key to fail authentication, got %+v", h.Authenticated)
+	}
+
+	up := newBridge("main", "192.168.1.2", home, []openhue.LightGet{{Id: &id}}, true)
+	if h := bridgeHealth(up, nil, now); !h.Ready() {
+		t.Errorf("Expected a connected bridge with lights to be ready, got %+v", h)
+	}
+	if h := bridgeHealth(up, nil, now.Add(pollStaleAfter+time.Second)); h.Polling.OK || h.Ready() {
+		t.Errorf("Expected a bridge not polled for long not to be ready, got %+v", h.Polling)
+	}
+}
+
+func TestSortLights(t *testing.T) {
+	var lights []openhue.LightGet
+	err := json.Unmarshal([]byte(`[
+		{"id":"uuid-a","metadata":{"name":"Kitchen"}},
+		{"id":"uuid-c"},
+		{"id":"uuid-b","metadata":{"name":"Desk"}}
+	]`), &lights)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal lights: %v", err)
+	}
+
+	sortLights(lights)
+
+	expected := []string{"uuid-c", "uuid-b", "uuid-a"}
+	for i, light := range lights {
+		if *light.Id != expected[i] {
+			t.Errorf("lights[%d] = %s, expected %s", i, *light.Id, expected[i])
+		}
+	}
+}
+
+func TestLightCapabilities(t *testing.T) {
+	light := openhue.LightGet{}
+	if got := strings.Join(lightCapabilities(light), ","); got != "on" {
+		t.Errorf("Expected on-only light, got %s", got)
+	}
+	if got := lightGamut(light); got != "-" {
+		t.Errorf("Expected no gamut, got %s", got)
+	}
+
+	if err := json.Unmarshal([]byte(`{"dimming":{"brightness":50},"color":{"gamut_type":"C"},"color_temperature":{}}`), &light); err != nil {
+		t.Fatalf("Failed to unmarshal light: %v", err)
+	}
+	if got := strings.Join(lightCapabilities(light), ","); got != "on,dim,color,ct" {
+		t.Errorf("Expected full color light, got %s", got)
+	}
+	if got := lightGamut(light); got != "C" {
+		t.Errorf("Expected gamut C, got %s", got)
+	}
+}
+
+func TestLoadOrCreateConfigValidatesOverrides(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(configPath, []byte(`{"version": 2, "osc": {"host": "127.0.0.1", "port": 70000}, "hue": [{"name": "main"}]}`), 0600)
+
+	// An override fixes the file, only the merged config is validated
+	t.Setenv("OSC2HUE_OSC_PORT", "9000")
+	cfg, err := loadOrCreateConfig(configPath)
+	if err != nil {
+		t.Fatalf("Expected the override to make the config valid, got %v", err)
+	}
+	if cfg.OSC.Port != 9000 {
+		t.Errorf("Expected port 9000 from the environment, got %d", cfg.OSC.Port)
+	}
+
+	// An invalid override is rejected
+	t.Setenv("OSC2HUE_OSC_PORT", "0")
+	if _, err := loadOrCreateConfig(configPath); err == nil || !strings.Contains(err.Error(), "osc.port: 0 is out of range") {
+		t.Errorf("Expected the overridden port to be rejected, got %v", err)
+	}
+}
+
+func TestServiceReload(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(port int, bridgeIP string) {
+		cfg := config.Default()
+		cfg.OSC.Host = "127.0.0.1"
+		cfg.OSC.Port = port
+		cfg.Hue[0].BridgeIP = bridgeIP
+		if err := config.SaveConfig(cfg, configPath); err != nil {
+			t.Fatalf("Failed to save config: %v", err)
+		}
+	}
+	writeConfig(9000, "")
+	cfg, err := loadOrCreateConfig(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	id := "light-1"
+	ctrl := newController([]*bridge{{name: "main", lights: []openhue.LightGet{{Id: &id}}}})
+	svc := newService(configPath, cfg, ctrl, osc.NewServer(cfg.OSC.Host, cfg.OSC.Port))
+
+	// An invalid config is rejected and the current one kept
+	os.WriteFile(configPath, []byte(`{"version": 2, "osc": {"host": "127.0.0.1", "port": 70000}, "hue": [{"name": "main"}]}`), 0600)
+	svc.reload(false)
+	if current, currentCtrl := svc.current(); current != cfg || currentCtrl != ctrl {
+		t.Error("Expected the current config to be kept after an invalid reload")
+	}
+
+	// A valid change replaces the config and controller, keeping the state cache
+	writeConfig(9001, "")
+	svc.reload(false)
+	current, currentCtrl := svc.current()
+	if current.OSC.Port != 9001 {
+		t.Errorf("Expected port 9001 after reload, got %d", current.OSC.Port)
+	}
+	if currentCtrl == ctrl || currentCtrl.state != ctrl.state {
+		t.Error("Expected a new controller sharing the state cache")
+	}
+	if _, ok := currentCtrl.resolveLight("1"); !ok {
+		t.Error("Expected the known lights to be kept without a bridge")
+	}
+
+	// A bridge without an API key is kept disconnected until paired
+	writeConfig(9001, "192.168.1.100")
+	svc.reload(false)
+	after, afterCtrl := svc.current()
+	if after == current || after.Hue[0].BridgeIP != "192.168.1.100" {
+		t.Error("Expected the bridge change to be applied without an API key")
+	}
+	if afterCtrl.connected() {
+		t.Error("Expected the unpaired bridge to stay disconnected")
+	}
+}
+
+func TestServiceFailedReloadKeepsFlashLimiter(t *testing.T) {
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	// The reload disables the limiter but cannot move the OSC server to a busy port
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	next := config.Default()
+	next.OSC.Host = "127.0.0.1"
+	next.OSC.Port = busy.LocalAddr().(*net.UDPAddr).Port
+	if err := config.SaveConfig(next, configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.OSC.Host, cfg.OSC.Port = "127.0.0.1", 0
+	cfg.Safety = &config.SafetyConfig{MaxFlashes: 1}
+	id := "light-1"
+	ctrl := newController([]*bridge{{name: "main", lights: []openhue.LightGet{{Id: &id}}}})
+	setupSafety(cfg, ctrl, nil)
+	defer ctrl.safety.Stop()
+	oscServer := osc.NewServer(cfg.OSC.Host, cfg.OSC.Port)
+	svc := newService(configPath, cfg, ctrl, oscServer)
+	go oscServer.Start()
+	defer oscServer.Stop()
+	for oscServer.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	svc.reload(false)
+	if _, current := svc.current(); current != ctrl {
+		t.Fatal("Expected the failed reload to keep the controller")
+	}
+	held := false
+	for i := 0; i < 7 && !held; i++ {
+		held = !ctrl.safety.Submit(id, lightLevel(state.LightState{On: i%2 == 0, Brightness: 1}), func() {})
+	}
+	if !held {
+		t.Error("Expected the flash limiter to keep holding back a strobe after the failed reload")
+	}
+}
+
+func TestServiceReconnectsBridge(t *testing.T) {
+	var mu sync.Mutex
+	var updates []string
+	bridgeServer, _ := newTestBridge(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPut:
+			mu.Lock()
+			updates = append(updates, r.URL.Path)
+			mu.Unlock()
+			w.Write([]byte(`{"errors":[],"data":[]}`))
+		case r.URL.Path == "/clip/v2/resource/light":
+			w.Write([]byte(`{"errors":[],"data":[{"id":"light-1","type":"light","metadata":{"name":"Desk"}}]}`))
+		default:
+			w.Write([]byte(`{"errors":[],"data":[]}`))
+		}
+	})
+	addr := strings.TrimPrefix(bridgeServer.URL, "https://")
+
+	feedback, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer feedback.Close()
+
+	cfg := config.Default()
+	cfg.OSC.Feedback = feedback.LocalAddr().String()
+	cfg.Hue[0].BridgeIP = addr
+	cfg.Hue[0].APIKey = "key"
+	cfg.Hue[0].CertFingerprint = hue.Fingerprint(bridgeServer.Certificate())
+	ctrl := newController([]*bridge{newBridge("main", addr, nil, nil, false)})
+	svc := newService(filepath.Join(t.TempDir(), "config.json"), cfg, ctrl, osc.NewServer("127.0.0.1", 0))
+
+	// A bridge that is down is retried with backoff
+	bridgeServer.Close()
+	retries := make(map[string]*connectionRetry)
+	svc.checkConnections(retries)
+	if retries["main"] == nil || retries["main"].delay != reconnectMinDelay {
+		t.Fatalf("Expected a retry after %v, got %+v", reconnectMinDelay, retries["main"])
+	}
+	svc.checkConnections(retries)
+	if retries["main"].delay != reconnectMinDelay {
+		t.Error("Expected no attempt before the retry delay passed")
+	}
+	retries["main"].next = time.Time{}
+	svc.checkConnections(retries)
+	if retries["main"].delay != 2*reconnectMinDelay {
+		t.Errorf("Expected the delay to double, got %v", retries["main"].delay)
+	}
+
+	// Once it answers, its lights and handlers are swapped in
+	bridgeServer = httptest.NewUnstartedServer(bridgeServer.Config.Handler)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("Cannot listen on %s again: %v", addr, err)
+	}
+	bridgeServer.Listener = listener
+	bridgeServer.StartTLS()
+	defer bridgeServer.Close()
+	cfg.Hue[0].CertFingerprint = hue.Fingerprint(bridgeServer.Certificate())
+
+	retries["main"].next = time.Time{}
+	svc.checkConnections(retries)
+	_, current := svc.current()
+	if current == ctrl || !current.bridge("main").up.Load() {
+		t.Fatal("Expected a new controller with the bridge up")
+	}
+	if _, ok := current.resolveLight("1"); !ok {
+		t.Fatal("Expected the lights of the bridge to be known")
+	}
+	svc.oscServer.Dispatch(gosc.NewMessage("/hue/1/on", int32(1)))
+	mu.Lock()
+	if len(updates) != 1 || updates[0] != "/clip/v2/resource/light/light-1" {
+		t.Errorf("Expected the light handler to reach the bridge, got %v", updates)
+	}
+	mu.Unlock()
+
+	// The state changes were reported over OSC
+	buf := make([]byte, 1024)
+	for _, expected := range []int32{0, 1} {
+		feedback.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := feedback.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Expected feedback message: %v", err)
+		}
+		packet, err := gosc.ParsePacket(string(buf[:n]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := packet.(*gosc.Message)
+		if msg.Address != "/hue/main/connected" || msg.Arguments[0] != expected {
+			t.Errorf("Expected /hue/main/connected %d, got %s %v", expected, msg.Address, msg.Arguments)
+		}
+	}
+}
+
+func TestServicePicksUpNewLights(t *testing.T) {
+	var mu sync.Mutex
+	lights := `[{"id":"light-a","type":"light","metadata":{"name":"A"}},{"id":"light-b","type":"light","metadata":{"name":"B"}}]`
+	var updates []string
+	bridgeServer, _ := newTestBridge(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPut:
+			updates = append(updates, r.URL.Path)
+			w.Write([]byte(`{"errors":[],"data":[]}`))
+		case r.URL.Path == "/clip/v2/resource/light":
+			w.Write([]byte(`{"errors":[],"data":` + lights + `}`))
+		default:
+			w.Write([]byte(`{"errors":[],"data":[]}`))
+		}
+	})
+	addr := strings.TrimPrefix(bridgeServer.URL, "https://")
+
+	cfg := config.Default()
+	cfg.Hue[0].BridgeIP = addr
+	cfg.Hue[0].APIKey = "key"
+	cfg.Hue[0].CertFingerprint = hue.Fingerprint(bridgeServer.Certificate())
+	home, found, err := connectHue(context.Background(), cfg.Hue[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl := newController([]*bridge{newBridge("main", addr, home, found, true)})
+	svc := newService(filepath.Join(t.TempDir(), "config.json"), cfg, ctrl, osc.NewServer("127.0.0.1", 0))
+
+	// light-a is removed and light-c added
+	mu.Lock()
+	lights = `[{"id":"light-b","type":"light","metadata":{"name":"B"}},{"id":"light-c","type":"light","metadata":{"name":"C"}}]`
+	mu.Unlock()
+	svc.pollLights(map[string]time.Time{"main": time.Now().Add(-lightPollInterval)})
+
+	_, current := svc.current()
+	if current == ctrl {
+		t.Fatal("Expected a new controller")
+	}
+	for _, address := range []string{"/hue/1/on", "/hue/2/on", "/hue/3/on", "/hue/main/3/on"} {
+		svc.oscServer.Dispatch(gosc.NewMessage(address, int32(1)))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"/clip/v2/resource/light/light-b", "/clip/v2/resource/light/light-c", "/clip/v2/resource/light/light-c"}
+	if !slices.Equal(updates, expected) {
+		t.Errorf("Expected updates %v, got %v", expected, updates)
+	}
+}
+
+func TestServiceShutdown(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var updated []string
+	_, home := newTestBridge(t, func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		mu.Lock()
+		updated = append(updated, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"errors":[],"data":[]}`))
+	})
+	newTestService := func() (*service, *bridge) {
+		a, b := "light-a", "light-b"
+		br := newBridge("main", "", home, []openhue.LightGet{{Id: &a}, {Id: &b}}, true)
+		return newService("", config.Default(), newController([]*bridge{br}), osc.NewServer("127.0.0.1", 0)), br
+	}
+
+	// Shutdown waits for the updates of a message being handled
+	svc, _ := newTestService()
+	go svc.oscServer.Dispatch(gosc.NewMessage("/hue/all/on", int32(1)))
+	<-started
+	<-started
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	svc.shutdown(5 * time.Second)
+	mu.Lock()
+	if len(updated) != 2 {
+		t.Errorf("Expected both lights to be updated before shutdown returned, got %v", updated)
+	}
+	mu.Unlock()
+	if n := svc.pending(); n != 0 {
+		t.Errorf("Expected nothing pending after shutdown, got %d", n)
+	}
+
+	// Requests still running when the timeout passes are cancelled, without
+	// taking the bridge for unreachable
+	release = make(chan struct{})
+	defer close(release)
+	svc, br := newTestService()
+	go svc.oscServer.Dispatch(gosc.NewMessage("/hue/1/on", int32(1)))
+	<-started
+	start := time.Now()
+	svc.shutdown(50 * time.Millisecond)
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("Expected shutdown to give up after its timeout, took %v", took)
+	}
+	if !br.up.Load() {
+		t.Error("Expected a cancelled request not to mark the bridge down")
 	}
 }
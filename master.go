@@ -0,0 +1,251 @@
+package main
+
+import (
+	"sync"
+
+	"osc2hue/internal/color"
+	"osc2hue/internal/config"
+	"osc2hue/internal/osc"
+	"osc2hue/internal/state"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+	"github.com/openhue/openhue-go"
+)
+
+// Panic look used when the config has no panic section
+const (
+	defaultPanicBrightness = 1.0
+	defaultPanicKelvin     = 4000
+)
+
+// masterState holds the master fader and blackout, which apply between the
+// light state asked for and what is sent to the bridges. It is shared by the
+// controllers that replace each other on reload.
+type masterState struct {
+	mu       sync.Mutex
+	level    float64 // 0.0-1.0, scales all outgoing brightness
+	blackout bool    // all lights off, incoming changes are only recorded
+}
+
+// newMasterState creates a master at full level without blackout
+func newMasterState() *masterState {
+	return &masterState{level: 1}
+}
+
+// get returns the master level and whether the blackout is on
+func (m *masterState) get() (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.level, m.blackout
+}
+
+// setLevel changes the master level
+func (m *masterState) setLevel(level float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.level = level
+}
+
+// setBlackout turns the blackout on or off
+func (m *masterState) setBlackout(blackout bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blackout = blackout
+}
+
+// reset sets the master to full and releases the blackout
+func (m *masterState) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.level, m.blackout = 1, false
+}
+
+// noMaster applies to lights that must stay on, it is never changed
+var noMaster = newMasterState()
+
+// masterOf returns the master that applies to a light: none for lights whose
+// policy keeps them on, a blackout must not turn off safety lights
+func (c *controller) masterOf(lightID string) *masterState {
+	if c.policies[lightID].KeepOn {
+		return noMaster
+	}
+	return c.master
+}
+
+// output returns what a light in state st emits with the master applied
+func (m *masterState) output(st state.LightState) state.LightState {
+	level, blackout := m.get()
+	if blackout || level <= 0 {
+		st.On = false
+	}
+	st.Brightness *= level
+	return st
+}
+
+// scale returns a light update for a light in state st as sent to the
+// bridge: off during blackout, with its brightness scaled by the master
+// otherwise. A light turned on without a brightness gets the scaled one of st.
+func (m *masterState) scale(put openhue.LightPut, st state.LightState) openhue.LightPut {
+	level, blackout := m.get()
+	if blackout || level <= 0 {
+		off := false
+		return openhue.LightPut{On: &openhue.On{On: &off}, Dynamics: put.Dynamics}
+	}
+	if level >= 1 {
+		return put
+	}
+	if put.Dimming != nil && put.Dimming.Brightness != nil {
+		brightness := *put.Dimming.Brightness * float32(level)
+		put.Dimming = &openhue.Dimming{Brightness: &brightness}
+	} else if put.On != nil && put.On.On != nil && *put.On.On {
+		brightness := float32(st.Brightness * 100 * level)
+		put.Dimming = &openhue.Dimming{Brightness: &brightness}
+	}
+	return put
+}
+
+// statePut returns a light update that sets a light to st, with an optional transition
+func statePut(st state.LightState, durationMs int) openhue.LightPut {
+	put := openhue.LightPut{On: &openhue.On{On: &st.On}}
+	if st.On {
+		brightness := float32(st.Brightness * 100)
+		x, y := float32(st.X), float32(st.Y)
+		put.Dimming = &openhue.Dimming{Brightness: &brightness}
+		put.Color = &openhue.Color{Xy: &openhue.GamutPosition{X: &x, Y: &y}}
+	}
+	if durationMs > 0 {
+		put.Dynamics = &openhue.LightDynamics{Duration: &durationMs}
+	}
+	return put
+}
+
+// setupMaster gives a controller the master of the controller it replaces,
+// or a new one, and the panic look from the config
+func setupMaster(cfg *config.Config, ctrl *controller, previous *masterState) {
+	if previous == nil {
+		previous = newMasterState()
+	}
+	ctrl.master = previous
+
+	ctrl.panicLook = state.LightState{On: true, Brightness: defaultPanicBrightness}
+	kelvin := float64(defaultPanicKelvin)
+	if cfg.Panic != nil {
+		if cfg.Panic.Brightness > 0 {
+			ctrl.panicLook.Brightness = cfg.Panic.Brightness
+		}
+		if cfg.Panic.Kelvin > 0 {
+			kelvin = float64(cfg.Panic.Kelvin)
+		}
+	}
+	ctrl.panicLook.X, ctrl.panicLook.Y = color.KelvinToXY(kelvin)
+}
+
+// refreshLights sends every light its state as seen through the master, after the master changed
+func (c *controller) refreshLights(durationMs int) {
+	var wg sync.WaitGroup
+	for _, light := range c.lights {
+		wg.Add(1)
+		go func(lightID string) {
+			defer wg.Done()
+			c.refreshLight(lightID, durationMs)
+		}(*light.Id)
+	}
+	wg.Wait()
+}
+
+// refreshLight sends the cached state of a light through the master and the flash limiter
+func (c *controller) refreshLight(lightID string, durationMs int) {
+	b := c.lightBridge[lightID]
+	if b == nil || b.home == nil {
+		return
+	}
+	st, _ := c.state.Get(lightID)
+	master := c.masterOf(lightID)
+	if c.safety != nil && !c.safety.Submit(lightID, lightLevel(master.output(st)), func() { c.sendState(b, lightID) }) {
+		return
+	}
+	if err := c.sendLight(b, lightID, master.scale(statePut(st, durationMs), st)); err != nil {
+		hueLog.Error("Failed to update light", "light", lightID, "error", err)
+	}
+}
+
+// applyPanic releases the blackout, sets the master to full and every light to the panic look
+func (c *controller) applyPanic(durationMs int) {
+	c.master.reset()
+	var wg sync.WaitGroup
+	for _, light := range c.lights {
+		wg.Add(1)
+		go func(lightID string) {
+			defer wg.Done()
+			if err := c.updateLight(lightID, statePut(c.panicLook, durationMs)); err != nil {
+				hueLog.Error("Failed to update light", "light", lightID, "error", err)
+			}
+		}(*light.Id)
+	}
+	wg.Wait()
+}
+
+// addMasterHandlers adds /hue/master, /hue/blackout and /hue/panic
+func addMasterHandlers(oscServer osc.HandlerAdder, ctrl *controller) {
+	oscServer.AddHandler("/hue/master", func(msg *gosc.Message) {
+		level, ok := floatArg(msg, 0)
+		if !ok {
+			oscLog.Warn("Invalid or missing level for /hue/master, expected 0-1")
+			return
+		}
+		level = min(max(level, 0), 1)
+		ctrl.master.setLevel(level)
+		ctrl.refreshLights(durationArg(msg, 1))
+		oscLog.Info("Master", "level", level)
+	})
+
+	oscServer.AddHandler("/hue/blackout", func(msg *gosc.Message) {
+		value, ok := floatArg(msg, 0)
+		if !ok {
+			oscLog.Warn("Invalid or missing value for /hue/blackout, expected 0 or 1")
+			return
+		}
+		ctrl.master.setBlackout(value > 0)
+		ctrl.refreshLights(durationArg(msg, 1))
+		if value > 0 {
+			oscLog.Info("Blackout")
+		} else {
+			oscLog.Info("Blackout released")
+		}
+	})
+
+	oscServer.AddHandler("/hue/panic", func(msg *gosc.Message) {
+		ctrl.applyPanic(durationArg(msg, 0))
+		oscLog.Warn("Panic: all lights set to the safe look")
+	})
+}
+
+// floatArg returns argument i of a message as a number
+func floatArg(msg *gosc.Message, i int) (float64, bool) {
+	if len(msg.Arguments) <= i {
+		return 0, false
+	}
+	switch v := msg.Arguments[i].(type) {
+	case int32:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// durationArg returns the optional transition duration in milliseconds at argument i, or 0
+func durationArg(msg *gosc.Message, i int) int {
+	d, ok := floatArg(msg, i)
+	if !ok || d < 0 {
+		return 0
+	}
+	return int(d)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"osc2hue/internal/hue"
+	"osc2hue/internal/metrics"
+	"osc2hue/internal/osc"
+	"osc2hue/internal/safety"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+)
+
+// registry holds the metrics served at /metrics
+var registry = metrics.NewRegistry()
+
+var (
+	oscMessages = registry.Counter("osc2hue_osc_messages_total",
+		"OSC messages received, by the address of the handler they matched. A message matching several handlers counts for each, messages no handler matched count as unmatched.", "handler")
+	oscParseErrors = registry.Counter("osc2hue_osc_parse_errors_total",
+		"OSC packets that could not be parsed, by reason.", "reason")
+	hueRequests = registry.Counter("osc2hue_hue_requests_total",
+		"Requests sent to the Hue bridges, by resource, outcome (ok, error or network_error) and HTTP status.", "resource", "outcome", "status")
+	hueRequestDuration = registry.Histogram("osc2hue_hue_request_duration_seconds",
+		"Time taken by requests to the Hue bridges.", metrics.DefaultBuckets, "resource")
+	flashLimiterChanges = registry.Counter("osc2hue_flash_limiter_changes_total",
+		"Light changes the flash limiter held back, coalesced into a later change, released or dropped.", "event")
+	lightQueueDepth = registry.Gauge("osc2hue_light_queue_depth",
+		"Changes of a light waiting to reach its bridge: requests in flight and changes held back by the flash limiter.", "light")
+	bridgeConnected = registry.Gauge("osc2hue_bridge_connected",
+		"Whether a bridge is connected (1) or not (0).", "bridge")
+	lightsDiscovered = registry.Gauge("osc2hue_lights",
+		"Lights discovered on a bridge.", "bridge")
+)
+
+// metricsObserver counts the OSC traffic of a server
+type metricsObserver struct{}
+
+// PacketReceived is counted per message in MessageDispatched
+func (metricsObserver) PacketReceived(net.Addr, gosc.Packet) {}
+
+// PacketError counts a packet that could not be parsed
+func (metricsObserver) PacketError(_ net.Addr, err error) {
+	oscParseErrors.Inc(osc.ErrorReason(err))
+}
+
+// MessageDispatched counts a message by the handlers it matched. The address
+// sent is never a label: it can be any pattern, so the labels would grow
+// without bound.
+func (metricsObserver) MessageDispatched(_ *gosc.Message, matched []string) {
+	if len(matched) == 0 {
+		oscMessages.Inc("unmatched")
+		return
+	}
+	for _, handler := range matched {
+		oscMessages.Inc(handler)
+	}
+}
+
+// observeRequest records the outcome and duration of a request to a bridge
+func observeRequest(resource string, took time.Duration, err error) {
+	outcome, status := "ok", "200"
+	var statusErr *hue.StatusError
+	switch {
+	case errors.As(err, &statusErr):
+		outcome, status = "error", strconv.Itoa(statusErr.StatusCode)
+	case err != nil && isNetworkError(err):
+		outcome, status = "network_error", ""
+	case err != nil:
+		outcome, status = "error", ""
+	}
+	hueRequests.Inc(resource, outcome, status)
+	hueRequestDuration.Observe(took.Seconds(), resource)
+}
+
+// observeLimiterEvent records what the flash limiter did with a light change
+func observeLimiterEvent(lightID string, e safety.Event) {
+	flashLimiterChanges.Inc(e.String())
+	switch e {
+	case safety.Held:
+		lightQueueDepth.Add(1, lightID)
+	case safety.Released, safety.Dropped:
+		lightQueueDepth.Add(-1, lightID)
+	}
+}
+
+// metricsHandler serves the metrics, with the connection state of the bridges of the service's current controller
+func metricsHandler(svc *service) http.Handler {
+	return registry.Handler(func() {
+		_, ctrl := svc.current()
+		bridgeConnected.Reset()
+		lightsDiscovered.Reset()
+		for _, b := range ctrl.bridges {
+			up := 0.0
+			if b.up.Load() {
+				up = 1
+			}
+			bridgeConnected.Set(up, b.name)
+			lightsDiscovered.Set(float64(len(b.lights)), b.name)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"osc2hue/internal/command"
+	"osc2hue/internal/config"
+	"osc2hue/internal/mqtt"
+)
+
+// startMQTT connects to the MQTT broker if configured, returns nil otherwise.
+// Commands are applied to the service's current controller.
+func startMQTT(cfg *config.Config, ctrl *controller, svc *service) *mqtt.Client {
+	if cfg.MQTT == nil {
+		return nil
+	}
+
+	var lights []mqtt.Light
+	for _, light := range ctrl.lights {
+		name := *light.Id
+		if light.Metadata != nil && light.Metadata.Name != nil {
+			name = *light.Metadata.Name
+		}
+		lights = append(lights, mqtt.Light{ID: *light.Id, Name: name})
+	}
+
+	opts := mqtt.Options{
+		Broker:          cfg.MQTT.Broker,
+		ClientID:        cfg.MQTT.ClientID,
+		Username:        cfg.MQTT.Username,
+		Password:        cfg.MQTT.Password,
+		TopicPrefix:     cfg.MQTT.TopicPrefix,
+		HomeAssistant:   cfg.MQTT.HomeAssistant,
+		DiscoveryPrefix: cfg.MQTT.DiscoveryPrefix,
+	}
+
+	client, err := mqtt.Connect(opts, lights, ctrl.state, mqttCommandHandler(svc))
+	if err != nil {
+		mqttLog.Error("MQTT disabled", "error", err)
+		return nil
+	}
+	return client
+}
+
+// mqttCommandHandler applies the commands published on {prefix}/light/{id}/set.
+// The topic's light segment must name a light or "all", it is never matched
+// as an OSC address pattern.
+func mqttCommandHandler(svc *service) func(light string, cmd command.Light) {
+	return func(light string, cmd command.Light) {
+		_, ctrl := svc.current()
+		if err := applyCommand(ctrl, light, cmd); err != nil {
+			mqttLog.Warn("Failed to apply MQTT command", "light", light, "error", err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"osc2hue/internal/config"
+	"osc2hue/internal/hue"
+	"osc2hue/internal/osc"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+)
+
+// pairTimeout is how long background pairing waits for the link button
+const pairTimeout = 2 * time.Minute
+
+// pairProgressInterval is how often background pairing logs the time left
+const pairProgressInterval = 15 * time.Second
+
+// addServiceHandlers adds the OSC handlers that act on the service rather than on lights
+func (s *service) addServiceHandlers(oscServer osc.HandlerAdder) {
+	s.addPairHandler(oscServer)
+	s.addStatusHandler(oscServer)
+}
+
+// addPairHandler adds /hue/pair [bridge], which pairs the named bridge, or
+// every bridge without an API key, in the background
+func (s *service) addPairHandler(oscServer osc.HandlerAdder) {
+	oscServer.AddHandler("/hue/pair", func(msg *gosc.Message) {
+		if len(msg.Arguments) == 0 {
+			if s.pairUnpaired() == 0 {
+				hueLog.Info("Every bridge is paired, send /hue/pair with a bridge name to pair one again")
+			}
+			return
+		}
+		name, ok := msg.Arguments[0].(string)
+		if !ok {
+			oscLog.Warn("Invalid bridge name for /hue/pair", "name", msg.Arguments[0])
+			return
+		}
+		cfg, _ := s.current()
+		if cfg.Bridge(name) == nil {
+			oscLog.Warn("Unknown bridge for /hue/pair", "bridge", name)
+			return
+		}
+		s.pair(name)
+	})
+}
+
+// pairUnpaired starts pairing every bridge without an API key and returns how many
+func (s *service) pairUnpaired() int {
+	cfg, _ := s.current()
+	n := 0
+	for _, b := range cfg.Hue {
+		if !hue.IsValidAPIKey(b.APIKey) {
+			s.pair(b.Name)
+			n++
+		}
+	}
+	return n
+}
+
+// pair waits in the background for the link button of a bridge, saves the API
+// key once obtained and reloads the configuration to connect the bridge. A
+// bridge already being paired is left alone.
+func (s *service) pair(name string) {
+	s.mu.Lock()
+	if _, ok := s.pairing[name]; ok {
+		s.mu.Unlock()
+		hueLog.Info("Already pairing bridge", "bridge", name)
+		return
+	}
+	ctx, cancel := context.WithTimeout(s.pairCtx, pairTimeout)
+	s.pairing[name] = cancel
+	cfg := s.cfg
+	s.mu.Unlock()
+
+	b := *cfg.Bridge(name)
+	go func() {
+		defer func() {
+			cancel()
+			s.mu.Lock()
+			delete(s.pairing, name)
+			s.mu.Unlock()
+		}()
+		if err := s.pairBridge(ctx, cfg, &b); err != nil {
+			if s.pairCtx.Err() != nil {
+				return // shutting down
+			}
+			hueLog.Error("Pairing failed, send /hue/pair with the bridge name to try again", "bridge", name, "error", err)
+			return
+		}
+		s.reload(true)
+	}()
+}
+
+// pairBridge discovers and identifies a bridge if needed, then authenticates
+// with it and saves the API key
+func (s *service) pairBridge(ctx context.Context, cfg *config.Config, b *config.HueConfig) error {
+	if b.BridgeIP == "" {
+		discoverAndSaveBridge(cfg, b, s.configPath)
+		if b.BridgeIP == "" {
+			return fmt.Errorf("no bridge found, set its bridge_ip in %s", s.configPath)
+		}
+	}
+	if err := checkBridge(b, s.configPath); err != nil {
+		return err
+	}
+
+	deadline, _ := ctx.Deadline()
+	hueLog.Info("🔗 Press the link button on the Hue bridge, or send /hue/pair with its name later",
+		"bridge", b.Name, "ip", b.BridgeIP, "within", time.Until(deadline).Round(time.Second))
+	lastLog := time.Now()
+	apiKey, err := hue.AuthenticateWithBridge(ctx, b.BridgeIP, hue.TLSConfig(b.BridgeID, b.CertFingerprint), func(time.Duration) {
+		if time.Since(lastLog) >= pairProgressInterval {
+			lastLog = time.Now()
+			hueLog.Info("Waiting for the link button", "bridge", b.Name, "remaining", time.Until(deadline).Round(time.Second))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	hueLog.Info("✅ Paired with bridge", "bridge", b.Name)
+
+	b.APIKey = apiKey
+	return config.UpdateConfig(s.configPath, func(c *config.Config) {
+		if saved := c.Bridge(b.Name); saved != nil {
+			saved.APIKey = apiKey
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"time"
+
+	"osc2hue/internal/config"
+	"osc2hue/internal/policy"
+	"osc2hue/internal/state"
+
+	"github.com/openhue/openhue-go"
+)
+
+// policyCheckInterval is how often lights are brought within their policies,
+// so quiet hours apply to lights left on when they start
+const policyCheckInterval = time.Minute
+
+// setupPolicies resolves the lights of the configured policies, merging the
+// policies of lights named by more than one
+func setupPolicies(cfg *config.Config, ctrl *controller) {
+	ctrl.policies = make(map[string]policy.Policy)
+	for i, pc := range cfg.Policies {
+		p := policyFromConfig(pc)
+		for _, lightID := range policyLights(ctrl, i, pc) {
+			ctrl.policies[lightID] = ctrl.policies[lightID].Merge(p)
+		}
+	}
+	if len(cfg.Policies) > 0 {
+		safetyLog.Info("Policies apply", "lights", len(ctrl.policies))
+	}
+}
+
+// policyLights returns the UUIDs of the lights and groups of a policy,
+// skipping those that are not known
+func policyLights(ctrl *controller, index int, pc config.PolicyConfig) []string {
+	var lightIDs []string
+	for _, ref := range pc.Lights {
+		lightID, ok := ctrl.resolveLight(ref)
+		if !ok {
+			configLog.Warn("Skipping unknown light of policy", "policy", index+1, "light", ref)
+			continue
+		}
+		lightIDs = append(lightIDs, lightID)
+	}
+	for _, ref := range pc.Groups {
+		group, ok := ctrl.resolveGroup(ref)
+		if !ok {
+			group, ok = ctrl.groupByName(ref)
+		}
+		if !ok {
+			configLog.Warn("Skipping unknown group of policy", "policy", index+1, "group", ref)
+			continue
+		}
+		lightIDs = append(lightIDs, group.LightIDs...)
+	}
+	return lightIDs
+}
+
+// policyFromConfig converts a validated policy from the config
+func policyFromConfig(pc config.PolicyConfig) policy.Policy {
+	p := policy.Policy{
+		MinBrightness: pc.MinBrightness,
+		MaxBrightness: pc.MaxBrightness,
+		MinKelvin:     float64(pc.MinKelvin),
+		MaxKelvin:     float64(pc.MaxKelvin),
+		KeepOn:        pc.KeepOn,
+	}
+	for _, q := range pc.QuietHours {
+		start, _ := policy.ParseClock(q.Start)
+		end, _ := policy.ParseClock(q.End)
+		p.QuietHours = append(p.QuietHours, policy.QuietHours{Start: start, End: end, MaxBrightness: q.MaxBrightness})
+	}
+	return p
+}
+
+// limitLight returns a light update changed so the resulting state is within
+// the policy of the light at time t
+func (c *controller) limitLight(lightID string, p policy.Policy, put openhue.LightPut, t time.Time) openhue.LightPut {
+	st, ok := c.state.Get(lightID)
+	if !ok {
+		st = state.DefaultLightState()
+	}
+	applyLightPut(&st, put)
+	limited := p.Limit(st, t)
+
+	if limited.On != st.On {
+		put.On = &openhue.On{On: &limited.On}
+	}
+	if limited.Brightness != st.Brightness {
+		brightness := float32(limited.Brightness * 100)
+		put.Dimming = &openhue.Dimming{Brightness: &brightness}
+	}
+	if limited.X != st.X || limited.Y != st.Y {
+		x, y := float32(limited.X), float32(limited.Y)
+		put.Color = &openhue.Color{Xy: &openhue.GamutPosition{X: &x, Y: &y}}
+	}
+	return put
+}
+
+// enforcePolicies updates the lights whose state is outside their policy at
+// time t, such as lights left bright when quiet hours start
+func (c *controller) enforcePolicies(t time.Time) {
+	for lightID, p := range c.policies {
+		if b := c.lightBridge[lightID]; b == nil || !b.up.Load() {
+			continue
+		}
+		put := c.limitLight(lightID, p, openhue.LightPut{}, t)
+		if put.On == nil && put.Dimming == nil && put.Color == nil {
+			continue
+		}
+		if err := c.updateLight(lightID, put); err != nil {
+			safetyLog.Error("Failed to apply the policy of light", "light", lightID, "error", err)
+		} else {
+			safetyLog.Info("Light brought within its policy", "light", lightID)
+		}
+	}
+}
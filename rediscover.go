@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"osc2hue/internal/config"
+	"osc2hue/internal/hue"
+)
+
+// identifyTimeout bounds asking a bridge for its ID
+const identifyTimeout = 3 * time.Second
+
+// rediscoverInterval is the minimum time between searches for a bridge that stopped answering
+const rediscoverInterval = time.Minute
+
+// errUntrustedBridge means another bridge, or a bridge with another
+// certificate, answers at the configured IP
+var errUntrustedBridge = errors.New("untrusted bridge")
+
+// checkBridge makes sure the bridge answering at b.BridgeIP is the configured
+// one, recording the ID and certificate fingerprint of a bridge seen for the
+// first time. If the bridge does not answer, or another bridge does, it is
+// searched for by its ID and the new IP is saved. An error wrapping
+// errUntrustedBridge means the bridge must not be used.
+func checkBridge(b *config.HueConfig, configPath string) error {
+	identity, err := hue.Identify(b.BridgeIP, identifyTimeout)
+	if err == nil && b.BridgeID != "" && identity.ID != b.BridgeID {
+		err = fmt.Errorf("%w: bridge %s answers at %s, expected %s", errUntrustedBridge, identity.ID, b.BridgeIP, b.BridgeID)
+	}
+	if err != nil {
+		if b.BridgeID == "" {
+			// Without a recorded ID the bridge cannot be told apart from others
+			return fmt.Errorf("bridge %s at %s: %v", b.Name, b.BridgeIP, err)
+		}
+
+		hueLog.Warn("Bridge not found, searching for its ID", "bridge", b.Name, "ip", b.BridgeIP, "id", b.BridgeID, "error", err)
+		found, searchErr := hue.Rediscover(b.BridgeID, 5*time.Second)
+		if searchErr != nil {
+			if errors.Is(err, errUntrustedBridge) {
+				return fmt.Errorf("bridge %s: %v, and %v", b.Name, err, searchErr)
+			}
+			return fmt.Errorf("bridge %s: %v", b.Name, searchErr)
+		}
+		identity = found
+	}
+	return trustBridge(b, identity, configPath)
+}
+
+// trustBridge checks the certificate of an identified bridge against the
+// pinned fingerprint, then records the IP, ID and fingerprint of the bridge.
+// Certificates signed by the Signify root CA may change, they are renewed by
+// firmware updates.
+func trustBridge(b *config.HueConfig, identity *hue.Identity, configPath string) error {
+	if !identity.Signed && b.CertFingerprint != "" && identity.Fingerprint != b.CertFingerprint {
+		return fmt.Errorf("%w: the certificate of bridge %s at %s changed, its fingerprint is %s instead of %s. "+
+			"If the bridge was reset or replaced, run osc2hue pair -bridge %s to trust it again",
+			errUntrustedBridge, b.Name, identity.IPAddress, identity.Fingerprint, b.CertFingerprint, b.Name)
+	}
+	if identity.IPAddress == b.BridgeIP && identity.ID == b.BridgeID && identity.Fingerprint == b.CertFingerprint {
+		return nil
+	}
+
+	switch {
+	case b.BridgeID == "":
+		hueLog.Info("Bridge identified", "bridge", b.Name, "ip", identity.IPAddress, "id", identity.ID)
+	case identity.IPAddress != b.BridgeIP:
+		hueLog.Info("Bridge moved", "bridge", b.Name, "ip", identity.IPAddress, "was", b.BridgeIP)
+	}
+	if b.CertFingerprint == "" {
+		hueLog.Info("Pinning bridge certificate", "bridge", b.Name, "fingerprint", identity.Fingerprint)
+	} else if identity.Fingerprint != b.CertFingerprint {
+		hueLog.Info("Bridge has a renewed certificate signed by the Hue root CA", "bridge", b.Name, "fingerprint", identity.Fingerprint)
+	}
+	b.BridgeIP = identity.IPAddress
+	b.BridgeID = identity.ID
+	b.CertFingerprint = identity.Fingerprint
+	saveBridge(*b, configPath)
+	return nil
+}
+
+// saveBridge saves the IP, ID and certificate fingerprint of a bridge to the config file
+func saveBridge(b config.HueConfig, configPath string) {
+	err := config.UpdateConfig(configPath, func(c *config.Config) {
+		if saved := c.Bridge(b.Name); saved != nil {
+			saved.BridgeIP = b.BridgeIP
+			saved.BridgeID = b.BridgeID
+			saved.CertFingerprint = b.CertFingerprint
+		}
+	})
+	if err != nil {
+		configLog.Warn("Failed to save bridge to config", "bridge", b.Name, "error", err)
+	} else {
+		configLog.Info("Configuration saved with bridge address", "path", configPath, "bridge", b.Name, "ip", b.BridgeIP)
+	}
+}
+
+// isNetworkError reports whether a bridge request failed to reach the bridge,
+// as opposed to the bridge rejecting it
+func isNetworkError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false // cancelled on shutdown, the bridge did not fail
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// bridgeUnreachable checks a bridge whose requests fail, at most once per
+// rediscoverInterval, and reloads the configuration if it moved or renewed its certificate
+func (s *service) bridgeUnreachable(name string) {
+	s.mu.Lock()
+	if time.Since(s.lastRediscovery[name]) < rediscoverInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastRediscovery[name] = time.Now()
+	cfg := s.cfg
+	s.mu.Unlock()
+
+	b := cfg.Bridge(name)
+	if b == nil || b.BridgeID == "" {
+		return
+	}
+	go func() {
+		checked := *b
+		if err := checkBridge(&checked, s.configPath); errors.Is(err, errUntrustedBridge) {
+			hueLog.Error("Bridge not trusted", "bridge", name, "error", err)
+			return
+		} else if err != nil {
+			hueLog.Warn("Failed to check bridge", "bridge", name, "error", err)
+			return
+		}
+		if checked != *b {
+			s.reload(true)
+		}
+	}()
+}
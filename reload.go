@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"osc2hue/internal/api"
+	"osc2hue/internal/config"
+	"osc2hue/internal/dmx"
+	"osc2hue/internal/hue"
+	"osc2hue/internal/mqtt"
+	"osc2hue/internal/osc"
+
+	gosc "github.com/hypebeast/go-osc/osc"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = time.Second
+
+// service holds the running components of osc2hue serve, which reload
+// replaces when the configuration changes
+type service struct {
+	configPath string
+	oscServer  *osc.Server
+
+	// reloadMu serializes starting, stopping and reloading components
+	reloadMu       sync.Mutex
+	dmxOutput      *dmx.Output
+	dmxInput       *dmx.Receiver
+	mqttClient     *mqtt.Client
+	stopConnecting chan struct{} // stops the connection manager
+
+	// mu guards the fields read while handling requests, it is never held during I/O
+	mu              sync.Mutex
+	cfg             *config.Config
+	ctrl            *controller
+	httpAPI         *api.Server
+	lastRediscovery map[string]time.Time          // bridge name -> last search after a failed request
+	pairing         map[string]context.CancelFunc // bridge name -> cancels pairing in progress
+	reported        map[string]bool               // bridge name -> connection state last reported
+	connErrors      map[string]error              // bridge name -> why the last connection attempt failed
+
+	// pairCtx is cancelled by stop to abort pairing in progress
+	pairCtx       context.Context
+	cancelPairing context.CancelFunc
+
+	// requests counts the requests to the bridges of every controller, its
+	// context is cancelled by shutdown once it stops waiting for them
+	requests       *requests
+	cancelRequests context.CancelFunc
+}
+
+// newService creates a service for a connected controller and registers its handlers
+func newService(configPath string, cfg *config.Config, ctrl *controller, oscServer *osc.Server) *service {
+	s := &service{
+		configPath:      configPath,
+		oscServer:       oscServer,
+		cfg:             cfg,
+		ctrl:            ctrl,
+		lastRediscovery: make(map[string]time.Time),
+		pairing:         make(map[string]context.CancelFunc),
+		reported:        make(map[string]bool),
+		connErrors:      make(map[string]error),
+	}
+	s.pairCtx, s.cancelPairing = context.WithCancel(context.Background())
+	s.requests = &requests{}
+	s.requests.ctx, s.cancelRequests = context.WithCancel(context.Background())
+	ctrl.requests = s.requests
+	ctrl.onUnreachable = s.bridgeUnreachable
+	addAllHandlers(oscServer, ctrl)
+	s.addServiceHandlers(oscServer)
+
+	// Feed every OSC message to the control panel message log, whichever HTTP server is running
+	oscServer.AddHandler("*", func(msg *gosc.Message) {
+		s.mu.Lock()
+		httpAPI := s.httpAPI
+		s.mu.Unlock()
+		if httpAPI != nil {
+			httpAPI.PublishMessage(msg.Address, msg.Arguments)
+		}
+	})
+	return s
+}
+
+// current returns the configuration and controller in use
+func (s *service) current() (*config.Config, *controller) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg, s.ctrl
+}
+
+// start starts the DMX, MQTT and HTTP components enabled in the configuration,
+// and the connection manager
+func (s *service) start() {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.stopConnecting = make(chan struct{})
+	go s.manageConnections(s.stopConnecting)
+
+	cfg, ctrl := s.current()
+	s.dmxOutput = startDMXOutput(cfg, ctrl)
+	s.dmxInput = startDMXInput(cfg, ctrl, s.oscServer)
+	s.mqttClient = startMQTT(cfg, ctrl, s)
+	s.setHTTPAPI(startHTTPAPI(cfg, s))
+}
+
+// setHTTPAPI replaces the running HTTP server reference
+func (s *service) setHTTPAPI(server *api.Server) {
+	s.mu.Lock()
+	s.httpAPI = server
+	s.mu.Unlock()
+}
+
+// stop stops every running component except the OSC server, and cancels pairing
+func (s *service) stop() {
+	s.stopInputs()
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if s.dmxOutput != nil {
+		s.dmxOutput.Stop()
+		s.dmxOutput = nil
+	}
+}
+
+// stopInputs cancels pairing and stops the components that take commands or
+// change lights on their own: the connection manager, the HTTP API, MQTT and
+// DMX input
+func (s *service) stopInputs() {
+	s.cancelPairing()
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if s.stopConnecting != nil {
+		close(s.stopConnecting)
+		s.stopConnecting = nil
+	}
+	s.mu.Lock()
+	httpAPI := s.httpAPI
+	s.httpAPI = nil
+	s.mu.Unlock()
+	if httpAPI != nil {
+		httpAPI.Stop()
+	}
+	if s.mqttClient != nil {
+		s.mqttClient.Close()
+		s.mqttClient = nil
+	}
+	if s.dmxInput != nil {
+		s.dmxInput.Close()
+		s.dmxInput = nil
+	}
+}
+
+// watch reloads the configuration when the config file or one of its includes
+// changes, and on SIGHUP. The returned function stops watching.
+func (s *service) watch(watchFile bool) func() {
+	stop := make(chan struct{})
+	if watchFile {
+		go config.Watch(s.configPath, configPollInterval, stop, func() {
+			configLog.Info("Config file changed", "path", s.configPath)
+			s.reload(false)
+		})
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				configLog.Info("Received SIGHUP")
+				s.reload(true)
+			case <-stop:
+				signal.Stop(hup)
+				return
+			}
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+// reload loads the configuration again and applies it without restarting.
+// The new configuration is validated and the bridge connected before anything
+// is replaced, so on error the old configuration stays in use. Unless force
+// is set, nothing happens if the configuration did not change.
+func (s *service) reload(force bool) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	old, oldCtrl := s.current()
+	cfg, err := s.loadConfig()
+	if err != nil {
+		configLog.Error("Config reload failed, keeping the current config", "error", err)
+		return
+	}
+	if !force && reflect.DeepEqual(cfg, old) {
+		configLog.Info("Config unchanged")
+		return
+	}
+
+	ctrl, err := reconnect(cfg, old, oldCtrl)
+	if err != nil {
+		configLog.Error("Config reload failed, keeping the current config", "error", err)
+		return
+	}
+
+	if cfg.OSC.Host != old.OSC.Host || cfg.OSC.Port != old.OSC.Port {
+		if err := s.oscServer.Rebind(cfg.OSC.Host, cfg.OSC.Port); err != nil {
+			configLog.Error("Config reload failed, keeping the current config", "error", fmt.Errorf("osc: %v", err))
+			return
+		}
+	}
+
+	s.install(old, cfg, ctrl, oldCtrl)
+	configLog.Info("Config reloaded", "path", s.configPath)
+}
+
+// install swaps in a new configuration and controller, with handlers for the
+// new lights, rooms and scenes, and restarts the components that need it.
+// The flash limiter is only reconfigured here, once nothing can fail anymore,
+// so a failed reload leaves the running limiter as it was.
+func (s *service) install(old, cfg *config.Config, ctrl, oldCtrl *controller) {
+	setupSafety(cfg, ctrl, oldCtrl.safety)
+	table := osc.NewHandlerTable()
+	addAllHandlers(table, ctrl)
+	s.addServiceHandlers(table)
+	s.oscServer.ReplaceHandlers(table)
+
+	s.mu.Lock()
+	s.cfg, s.ctrl = cfg, ctrl
+	s.mu.Unlock()
+	s.restartComponents(old, cfg, ctrl, !sameLights(oldCtrl, ctrl))
+}
+
+// loadConfig loads, validates and applies environment overrides to the config
+// file. Unlike at startup, a missing file is an error rather than the defaults.
+func (s *service) loadConfig() (*config.Config, error) {
+	if _, err := os.Stat(s.configPath); err != nil {
+		return nil, err
+	}
+	return loadOrCreateConfig(s.configPath)
+}
+
+// reconnect creates a controller for cfg replacing the controller for old,
+// connecting again to the bridges that were added or whose address or API key
+// changed. Bridges without an API key are left disconnected until paired. The
+// state cache is shared with the old controller.
+func reconnect(cfg, old *config.Config, oldCtrl *controller) (*controller, error) {
+	var bridges []*bridge
+	for _, b := range cfg.Hue {
+		oldBridge, oldCfg := oldCtrl.bridge(b.Name), old.Bridge(b.Name)
+		if oldBridge != nil && oldCfg != nil && *oldCfg == b {
+			lights, up := oldBridge.lights, oldBridge.up.Load()
+			if oldBridge.home != nil {
+				if fetched, err := fetchLights(oldCtrl.requests.ctx, oldBridge.home); err == nil {
+					lights, up = fetched, true
+				} else {
+					hueLog.Warn("Failed to refresh lights, keeping the known lights", "bridge", b.Name, "error", err)
+				}
+			}
+			bridges = append(bridges, newBridge(b.Name, b.BridgeIP, oldBridge.home, lights, up))
+			continue
+		}
+
+		// Pairing needs someone at the bridge, so it waits for /hue/pair
+		if b.BridgeIP == "" || !hue.IsValidAPIKey(b.APIKey) {
+			hueLog.Warn("Bridge is not paired yet, send /hue/pair with its name to pair it", "bridge", b.Name)
+			bridges = append(bridges, newBridge(b.Name, b.BridgeIP, nil, nil, false))
+			continue
+		}
+		hueLog.Info("Connecting to Hue bridge", "bridge", b.Name, "ip", b.BridgeIP)
+		home, lights, err := connectHue(oldCtrl.requests.ctx, b)
+		if err != nil {
+			return nil, fmt.Errorf("hue %s: %v", b.Name, err)
+		}
+		hueLog.Info("Connected to Hue bridge", "bridge", b.Name, "lights", len(lights))
+		bridges = append(bridges, newBridge(b.Name, b.BridgeIP, home, lights, true))
+	}
+	return replaceController(cfg, bridges, oldCtrl), nil
+}
+
+// replaceController creates a controller for bridges that takes over the
+// state cache, request tracking, callbacks and numeric light aliases of
+// oldCtrl, and discovers rooms and scenes. The flash limiter is taken over by
+// install.
+func replaceController(cfg *config.Config, bridges []*bridge, oldCtrl *controller) *controller {
+	ctrl := newControllerWithStore(bridges, oldCtrl.state)
+	ctrl.requests = oldCtrl.requests
+	ctrl.keepNumbers(oldCtrl)
+	ctrl.onRequest = oldCtrl.onRequest
+	ctrl.onUnreachable = oldCtrl.onUnreachable
+	ctrl.discoverGroupsAndScenes()
+	ctrl.addConfigGroups(cfg.Groups)
+	setupPolicies(cfg, ctrl)
+	setupMaster(cfg, ctrl, oldCtrl.master)
+	return ctrl
+}
+
+// restartComponents restarts the components whose configuration changed, and
+// those that resolve lights if the set of lights changed. DMX output also
+// follows the policies, which decide the lights the master applies to.
+func (s *service) restartComponents(old, cfg *config.Config, ctrl *controller, lightsChanged bool) {
+	if lightsChanged || !reflect.DeepEqual(old.DMXOutput, cfg.DMXOutput) || !reflect.DeepEqual(old.Policies, cfg.Policies) {
+		if s.dmxOutput != nil {
+			s.dmxOutput.Stop()
+		}
+		s.dmxOutput = startDMXOutput(cfg, ctrl)
+	}
+	if lightsChanged || !reflect.DeepEqual(old.DMXInput, cfg.DMXInput) {
+		if s.dmxInput != nil {
+			s.dmxInput.Close()
+		}
+		s.dmxInput = startDMXInput(cfg, ctrl, s.oscServer)
+	}
+	if lightsChanged || !reflect.DeepEqual(old.MQTT, cfg.MQTT) {
+		if s.mqttClient != nil {
+			s.mqttClient.Close()
+		}
+		s.mqttClient = startMQTT(cfg, ctrl, s)
+	}
+	if !reflect.DeepEqual(old.HTTP, cfg.HTTP) {
+		s.mu.Lock()
+		httpAPI := s.httpAPI
+		s.mu.Unlock()
+		if httpAPI != nil {
+			httpAPI.Stop()
+		}
+		s.setHTTPAPI(startHTTPAPI(cfg, s))
+	}
+}
+
+// sameLights reports whether two controllers have the same lights under the
+// same numeric aliases
+func sameLights(a, b *controller) bool {
+	if !slices.Equal(a.numbers, b.numbers) || len(a.bridges) != len(b.bridges) {
+		return false
+	}
+	for i := range a.bridges {
+		if a.bridges[i].name != b.bridges[i].name || !slices.Equal(a.bridges[i].numbers, b.bridges[i].numbers) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"osc2hue/internal/config"
+	"osc2hue/internal/logging"
+	"osc2hue/internal/osc"
+	"osc2hue/internal/recording"
+)
+
+// startRecording creates a recording file and records every packet the server receives into it
+func startRecording(path string, oscServer *osc.Server) (*os.File, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %v", err)
+	}
+
+	recorder, err := recording.NewRecorder(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	oscServer.AddObserver(recorder)
+	oscLog.Info("Recording OSC packets", "path", path)
+	return f, nil
+}
+
+// runReplay plays a recording back into the handlers or to another OSC host
+func runReplay(args []string) error {
+	fs := newFlagSet("replay")
+	speed := fs.Float64("speed", 1, "playback speed factor, 2 plays twice as fast")
+	loop := fs.Bool("loop", false, "restart from the seek position after the last packet")
+	seek := fs.Duration("seek", 0, "skip packets recorded before this offset, e.g. 1m30s")
+	to := fs.String("to", "", "send packets to host:port instead of controlling the lights directly")
+	configFile := configFlag(fs)
+	logOpts := logFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if err := logging.Setup(*logOpts); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: osc2hue replay [-speed 1] [-loop] [-seek 0s] [-to host:port] file")
+		return errUsage
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	entries, err := recording.Load(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %v", fs.Arg(0), err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("%s contains no packets", fs.Arg(0))
+	}
+
+	send, err := replayTarget(*to, config.Path(*configFile))
+	if err != nil {
+		return err
+	}
+
+	player := recording.NewPlayer(entries, recording.PlayOptions{Speed: *speed, Seek: *seek, Loop: *loop})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		oscLog.Info("Stopping replay")
+		player.Stop()
+	}()
+
+	length := entries[len(entries)-1].Offset
+	oscLog.Info("Replaying", "path", fs.Arg(0), "packets", len(entries), "length", length.Round(time.Millisecond), "speed", *speed)
+	if err := player.Play(send); err != nil {
+		return err
+	}
+	oscLog.Info("Replay finished")
+	return nil
+}
+
+// replayTarget returns a function sending replayed packets to host:port, or into the handlers if to is empty
+func replayTarget(to, configPath string) (func(recording.Entry) error, error) {
+	if to != "" {
+		host, portStr, err := net.SplitHostPort(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -to address %q: %v", to, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -to port %q", portStr)
+		}
+		return func(e recording.Entry) error {
+			return osc.SendPacket(host, port, e.Packet)
+		}, nil
+	}
+
+	cfg, err := loadOrCreateConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	ctrl := setupController(cfg, configPath)
+	oscServer := osc.NewServer(cfg.OSC.Host, cfg.OSC.Port)
+	addAllHandlers(oscServer, ctrl)
+
+	return func(e recording.Entry) error {
+		// Bundle timetags are in the past by now, so deliver their messages right away
+		for _, msg := range e.Messages() {
+			oscServer.Dispatch(msg)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"osc2hue/internal/config"
+	"osc2hue/internal/safety"
+	"osc2hue/internal/state"
+)
+
+// setupSafety enables the flash limiter of a controller if configured, taking
+// over the flash history of the limiter of the controller it replaces
+func setupSafety(cfg *config.Config, ctrl *controller, previous *safety.Limiter) {
+	if cfg.Safety == nil {
+		if previous != nil {
+			previous.Stop()
+			safetyLog.Info("Flash limiter disabled")
+		}
+		return
+	}
+
+	limits := safety.Limits{MaxFlashes: cfg.Safety.MaxFlashes, Threshold: cfg.Safety.Threshold}
+	limiter := previous
+	if limiter == nil {
+		limiter = safety.New(limits)
+		limiter.OnEvent(observeLimiterEvent)
+		maxFlashes := cfg.Safety.MaxFlashes
+		if maxFlashes == 0 {
+			maxFlashes = safety.DefaultMaxFlashes
+		}
+		safetyLog.Info("Flash limiter enabled", "max_flashes_per_second", maxFlashes)
+	} else {
+		limiter.SetLimits(limits)
+	}
+
+	// Rooms and config groups flash together
+	rooms := make(map[string][]string)
+	for _, g := range ctrl.groups {
+		name := g.Name
+		if _, ok := rooms[name]; ok {
+			name += " " + g.ID
+		}
+		rooms[name] = g.LightIDs
+	}
+	limiter.SetRooms(rooms)
+	for _, light := range ctrl.lights {
+		st, _ := ctrl.state.Get(*light.Id)
+		limiter.Seed(*light.Id, lightLevel(st))
+	}
+	ctrl.safety = limiter
+}
+
+// lightLevel returns what the flash limiter sees of a light state
+func lightLevel(st state.LightState) safety.Level {
+	return safety.LevelOf(st.On, st.Brightness, st.X, st.Y)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// drainInterval is how often shutdown checks whether light updates are still pending
+const drainInterval = 10 * time.Millisecond
+
+// shutdown stops taking input, then waits up to timeout for the OSC messages
+// being handled, the changes held back by the flash limiter and the requests
+// to the bridges to finish. What is still pending then is dropped or
+// cancelled before the remaining components stop.
+func (s *service) shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	s.stopInputs()
+	if err := s.oscServer.Shutdown(ctx); err != nil {
+		oscLog.Warn("OSC messages still being handled", "error", err)
+	}
+	if pending := s.drain(ctx); pending > 0 {
+		hueLog.Warn("Shutdown timed out, dropping pending light updates", "pending", pending, "timeout", timeout)
+	}
+
+	_, ctrl := s.current()
+	if ctrl.safety != nil {
+		ctrl.safety.Stop()
+	}
+	s.cancelRequests()
+	s.stop()
+}
+
+// drain waits until no change is held back by the flash limiter and no
+// request to a bridge is in flight, or ctx is done, and returns the number of
+// those still pending
+func (s *service) drain(ctx context.Context) int {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		n := s.pending()
+		if n == 0 || ctx.Err() != nil {
+			return n
+		}
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+}
+
+// pending returns the number of light changes held back by the flash limiter
+// or being sent to a bridge
+func (s *service) pending() int {
+	_, ctrl := s.current()
+	n := int(s.requests.inflight.Load())
+	if ctrl.safety != nil {
+		n += ctrl.safety.Pending()
+	}
+	return n
+}